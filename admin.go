@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// AdminQueue summarizes a queue for the admin API
+type AdminQueue struct {
+	Name string `json:"name"`
+
+	// RUNNING, PAUSED or DISABLED
+	State string `json:"state"`
+
+	// The tasks in the queue, scheduled or being dispatched
+	PendingTasks int64 `json:"pendingTasks"`
+
+	InFlightDispatches int64 `json:"inFlightDispatches"`
+
+	// The tasks that succeeded or ran out of attempts since the queue was created
+	CompletedTasks int64 `json:"completedTasks"`
+
+	// The earliest schedule time of the pending tasks, left out if none
+	OldestScheduleTime *time.Time `json:"oldestScheduleTime,omitempty"`
+}
+
+// AdminTask describes a pending task for the admin API
+type AdminTask struct {
+	Name string `json:"name"`
+
+	ScheduleTime time.Time `json:"scheduleTime"`
+
+	CreateTime time.Time `json:"createTime"`
+
+	// The attempts so far, including the one in flight if any
+	DispatchCount int32 `json:"dispatchCount"`
+
+	ResponseCount int32 `json:"responseCount"`
+
+	// Set while an attempt awaits its response
+	Dispatching bool `json:"dispatching"`
+
+	// The HTTP status code of the last attempt, -1 if it got no response, left
+	// out before the first one
+	LastStatusCode int `json:"lastStatusCode,omitempty"`
+}
+
+// AdminQueues summarizes all queues, by name
+func (s *Server) AdminQueues() []AdminQueue {
+	s.qsMux.Lock()
+	queues := make([]*Queue, 0, len(s.qs))
+	for _, queue := range s.qs {
+		if queue != nil {
+			queues = append(queues, queue)
+		}
+	}
+	s.qsMux.Unlock()
+
+	summaries := make([]AdminQueue, 0, len(queues))
+	for _, queue := range queues {
+		stats := queue.Stats()
+		vars := queue.Vars()
+		summary := AdminQueue{
+			Name:               queue.name,
+			State:              queue.frozenState().GetState().String(),
+			PendingTasks:       stats.TasksCount,
+			InFlightDispatches: vars.InFlightDispatches,
+			CompletedTasks:     vars.CompletedTasks,
+		}
+		if !stats.OldestEstimatedArrivalTime.IsZero() {
+			oldest := stats.OldestEstimatedArrivalTime.UTC()
+			summary.OldestScheduleTime = &oldest
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+
+	return summaries
+}
+
+// AdminTasks describes the pending tasks of the queue, in schedule time order
+func (s *Server) AdminTasks(queueName string) ([]AdminTask, error) {
+	queue, err := s.lookupQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.tsMux.Lock()
+	ts := queue.ts.list()
+	queue.tsMux.Unlock()
+
+	descriptions := make([]AdminTask, 0, len(ts))
+	for _, task := range ts {
+		descriptions = append(descriptions, task.adminTask())
+	}
+	sort.Slice(descriptions, func(i, j int) bool {
+		if !descriptions[i].ScheduleTime.Equal(descriptions[j].ScheduleTime) {
+			return descriptions[i].ScheduleTime.Before(descriptions[j].ScheduleTime)
+		}
+		return descriptions[i].Name < descriptions[j].Name
+	})
+
+	return descriptions, nil
+}
+
+func (task *Task) adminTask() AdminTask {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	scheduleTime, _ := ptypes.Timestamp(task.state.GetScheduleTime())
+	createTime, _ := ptypes.Timestamp(task.state.GetCreateTime())
+
+	return AdminTask{
+		Name:           task.state.GetName(),
+		ScheduleTime:   scheduleTime.UTC(),
+		CreateTime:     createTime.UTC(),
+		DispatchCount:  task.attempts.dispatches,
+		ResponseCount:  task.attempts.responses,
+		Dispatching:    task.attempts.inFlight,
+		LastStatusCode: task.attempts.lastStatusCode,
+	}
+}
+
+// Export captures the queues and their pending tasks, sorted by name, in the
+// form Import loads, e.g. to replay the state of a CI run locally
+func (s *Server) Export() *Snapshot {
+	snapshot := s.snapshot()
+	sort.Slice(snapshot.Queues, func(i, j int) bool { return snapshot.Queues[i].GetName() < snapshot.Queues[j].GetName() })
+	sort.Slice(snapshot.Tasks, func(i, j int) bool { return snapshot.Tasks[i].GetName() < snapshot.Tasks[j].GetName() })
+	sort.Strings(snapshot.PullQueues)
+
+	return snapshot
+}
+
+// Import replaces the queues and tasks of the emulator with those of the
+// snapshot. A snapshot that fails to restore, e.g. with tasks of queues it
+// doesn't hold, is rejected before anything is replaced.
+func (s *Server) Import(snapshot *Snapshot) error {
+	queueNames := make(map[string]bool)
+	for _, queueState := range snapshot.Queues {
+		queueNames[queueState.GetName()] = true
+	}
+	for _, taskState := range snapshot.Tasks {
+		if !queueNames[taskQueueName(taskState.GetName())] {
+			return invalidArgument("tasks", "Task %v is not in any of the queues.", taskState.GetName())
+		}
+	}
+
+	// Restored into a frozen server of its own first, to then restore it for
+	// good only if it succeeds. The tasks keep the states they are created
+	// from, and the queues notify nothing.
+	staging := newServer(s.clock)
+	staging.silent = true
+	staging.Freeze()
+	err := staging.restore(proto.Clone(snapshot).(*Snapshot))
+	staging.Reset()
+	if err != nil {
+		return err
+	}
+
+	// Replaced at once, so that queues and tasks created meanwhile don't get
+	// in the way
+	s.importMux.Lock()
+	defer s.importMux.Unlock()
+	s.reset()
+
+	return s.restore(snapshot)
+}
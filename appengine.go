@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+var appEngineRoutingPartRegexp = regexp.MustCompile("^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$")
+
+// appEngineRoutingHost resolves the host App Engine tasks are sent to, the local
+// URL the version or else the service is mapped to if any (see
+// appEngineServiceHosts)
+func appEngineRoutingHost(project string, routing *tasks.AppEngineRouting) string {
+	service := routing.GetService()
+	if service == "" {
+		service = "default"
+	}
+	serviceHosts := appEngineServiceHosts()
+	if routing.GetVersion() != "" {
+		if host, ok := serviceHosts[routing.GetVersion()+"."+service]; ok {
+			return host
+		}
+	}
+	if host, ok := serviceHosts[service]; ok {
+		return host
+	}
+
+	var host, domainSeparator string
+
+	emulatorHost := os.Getenv("APP_ENGINE_EMULATOR_HOST")
+
+	if emulatorHost == "" {
+		// TODO: the new route format for appengine is <PROJECT_ID>.<REGION_ID>.r.appspot.com
+		// TODO: support custom domains
+		// https://cloud.google.com/appengine/docs/standard/python/how-requests-are-routed
+		host = "https://" + project + ".appspot.com"
+		domainSeparator = "-dot-"
+	} else {
+		host = emulatorHost
+		domainSeparator = "."
+	}
+
+	hostURL, err := url.Parse(host)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if routing.GetService() != "" {
+		hostURL.Host = routing.GetService() + domainSeparator + hostURL.Host
+	}
+	if routing.GetVersion() != "" {
+		hostURL.Host = routing.GetVersion() + domainSeparator + hostURL.Host
+	}
+	if routing.GetInstance() != "" {
+		hostURL.Host = routing.GetInstance() + domainSeparator + hostURL.Host
+	}
+
+	return hostURL.String()
+}
+
+// The mappings given with the -app-engine-service flags, see main, which add to
+// those of the env
+var appEngineServiceFlags []string
+
+// appEngineServiceHosts returns the local URLs of the App Engine services, set
+// with APP_ENGINE_SERVICE_HOSTS as comma separated [<VERSION>.]<SERVICE>=<URL>
+// mappings, e.g. default=http://localhost:8080,v2.worker=http://localhost:8082,
+// and with the flags. Invalid mappings are ignored, they are rejected on startup.
+func appEngineServiceHosts() map[string]string {
+	hosts := make(map[string]string)
+	mappings := append(strings.Split(os.Getenv("APP_ENGINE_SERVICE_HOSTS"), ","), appEngineServiceFlags...)
+	for _, mapping := range mappings {
+		if service, host, err := parseAppEngineServiceHost(mapping); err == nil {
+			hosts[service] = host
+		}
+	}
+
+	return hosts
+}
+
+// parseAppEngineServiceHost parses a [<VERSION>.]<SERVICE>=<URL> mapping,
+// returning the version and service as they are looked up
+func parseAppEngineServiceHost(mapping string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(mapping), "=", 2)
+	if len(parts) != 2 || !isAppEngineServiceKey(parts[0]) {
+		return "", "", fmt.Errorf("App Engine service mapping %q must be formatted [<VERSION>.]<SERVICE>=<URL>", mapping)
+	}
+	hostURL, err := url.ParseRequestURI(parts[1])
+	if err != nil || hostURL.Host == "" {
+		return "", "", fmt.Errorf("App Engine service mapping %q must map to a URL, e.g. http://localhost:8081", mapping)
+	}
+
+	return parts[0], strings.TrimSuffix(parts[1], "/"), nil
+}
+
+// isAppEngineServiceKey checks a <SERVICE> or <VERSION>.<SERVICE> mapping key
+func isAppEngineServiceKey(key string) bool {
+	labels := strings.Split(key, ".")
+	if len(labels) > 2 {
+		return false
+	}
+	for _, label := range labels {
+		if !appEngineRoutingPartRegexp.MatchString(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateAppEngineRoutingOverride checks that the service, version and
+// instance of the override can be used as host name labels
+func validateAppEngineRoutingOverride(routing *tasks.AppEngineRouting) error {
+	for field, value := range map[string]string{
+		"service":  routing.GetService(),
+		"version":  routing.GetVersion(),
+		"instance": routing.GetInstance(),
+	} {
+		if value != "" && !appEngineRoutingPartRegexp.MatchString(value) {
+			return status.Errorf(codes.InvalidArgument, "AppEngineRoutingOverride.%v must consist of lowercase letters, digits and hyphens, of at most 63 characters.", field)
+		}
+	}
+
+	return nil
+}
+
+// setAppEngineRoutingOverrideHost fills in the output only host of the queue routing override
+func setAppEngineRoutingOverrideHost(queueState *tasks.Queue) {
+	if routing := queueState.GetAppEngineRoutingOverride(); routing != nil {
+		routing.Host = appEngineRoutingHost(queueProject(queueState.GetName()), routing)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+// attemptHistory counts the attempts of a task. As in Cloud Tasks, the retry
+// count is the number of attempts before the current one whatever their
+// outcome, while the execution count is the number of responses from the
+// handler other than 5XX.
+type attemptHistory struct {
+	// The attempts so far, the dispatch count of the task
+	dispatches int32
+
+	// The attempts that got a response, the response count of the task
+	responses int32
+
+	// The responses other than 5XX
+	executions int32
+
+	// The HTTP status code of the last attempt, -1 if it got no response, 0
+	// before the first one
+	lastStatusCode int
+
+	// Set while an attempt awaits its response
+	inFlight bool
+}
+
+// newAttemptHistory picks up the counts of the task, as restored from a
+// snapshot. Which of its responses were 5XX isn't kept, so they all count as
+// executions.
+func newAttemptHistory(dispatchCount, responseCount int32) attemptHistory {
+	return attemptHistory{
+		dispatches: dispatchCount,
+		responses:  responseCount,
+		executions: responseCount,
+	}
+}
+
+// dispatched records the start of an attempt
+func (h *attemptHistory) dispatched() {
+	h.dispatches++
+	h.inFlight = true
+}
+
+// responded records the outcome of the attempt, which got no response if the
+// dispatch failed with an error
+func (h *attemptHistory) responded(statusCode int, dispatchErr error) {
+	h.inFlight = false
+	if dispatchErr != nil {
+		h.lastStatusCode = -1
+		return
+	}
+
+	h.lastStatusCode = statusCode
+
+	h.responses++
+	if statusCode < 500 || statusCode > 599 {
+		h.executions++
+	}
+}
+
+// retryCount returns the number of attempts before the current one
+func (h attemptHistory) retryCount() int32 {
+	if h.dispatches == 0 {
+		return 0
+	}
+
+	return h.dispatches - 1
+}
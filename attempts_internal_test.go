@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttemptHistory(t *testing.T) {
+	var history attemptHistory
+	assert.EqualValues(t, 0, history.retryCount())
+
+	for _, outcome := range []struct {
+		statusCode int
+		err        error
+	}{
+		{http.StatusServiceUnavailable, nil},
+		{-1, errDispatchDeadlineExceeded},
+		{-1, errors.New("connection refused")},
+		{http.StatusNotFound, nil},
+	} {
+		history.dispatched()
+		history.responded(outcome.statusCode, outcome.err)
+	}
+
+	// Retried after every attempt, but only two responses, one of them a 5XX
+	history.dispatched()
+	assert.EqualValues(t, 5, history.dispatches)
+	assert.EqualValues(t, 4, history.retryCount())
+	assert.EqualValues(t, 2, history.responses)
+	assert.EqualValues(t, 1, history.executions)
+
+	history.responded(http.StatusOK, nil)
+	assert.EqualValues(t, 3, history.responses)
+	assert.EqualValues(t, 2, history.executions)
+}
+
+func TestNewAttemptHistoryPicksUpRestoredCounts(t *testing.T) {
+	history := newAttemptHistory(3, 2)
+	assert.EqualValues(t, 2, history.retryCount())
+	assert.EqualValues(t, 2, history.responses)
+	assert.EqualValues(t, 2, history.executions)
+
+	history.dispatched()
+	assert.EqualValues(t, 3, history.retryCount())
+}
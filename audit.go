@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The longest request summary in the audit log, the rest being cut off
+const maxAuditRequestSize = 1024
+
+// AuditEntry records a gRPC call received by the emulator
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+
+	Method string `json:"method"`
+
+	// The queue or task the call is about, or their parent
+	Resource string `json:"resource,omitempty"`
+
+	// The request in the protobuf text format, cut off at 1KB
+	Request string `json:"request"`
+
+	// The address and user agent of the client
+	Caller string `json:"caller"`
+
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// The gRPC status code of the response, e.g. OK or NOT_FOUND
+	Code string `json:"code"`
+
+	Error string `json:"error,omitempty"`
+
+	// In nanoseconds in JSON
+	Duration time.Duration `json:"duration"`
+}
+
+// auditLog appends every gRPC call to the file set with AUDIT_LOG_FILE, as JSON lines
+type auditLog struct {
+	mux sync.Mutex
+
+	file *os.File
+}
+
+// newAuditLog opens the audit log at the path, nil if none is given or the file
+// can't be opened
+func newAuditLog(path string) *auditLog {
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logWarn("Not writing the audit log", field("path", path), field("error", err))
+		return nil
+	}
+
+	return &auditLog{file: file}
+}
+
+func (l *auditLog) record(entry AuditEntry) {
+	line, _ := json.Marshal(entry)
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	// Closed on shutdown
+	if l.file == nil {
+		return
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		logError("Failed to write audit log entry", field("error", err))
+	}
+}
+
+func (l *auditLog) close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// intercept records the call once handled
+func (l *auditLog) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	l.recordCall(ctx, info.FullMethod, req, start, err)
+
+	return resp, err
+}
+
+// interceptStream records the streaming call once it ends, e.g. WatchTasks, or
+// the v2beta3 BufferTask served as an unknown method, with its first request
+func (l *auditLog) interceptStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	stream := &auditedStream{ServerStream: ss}
+	err := handler(srv, stream)
+	l.recordCall(ss.Context(), info.FullMethod, stream.req, start, err)
+
+	return err
+}
+
+// auditedStream keeps the first message received on the stream
+type auditedStream struct {
+	grpc.ServerStream
+
+	req interface{}
+}
+
+func (stream *auditedStream) RecvMsg(m interface{}) error {
+	err := stream.ServerStream.RecvMsg(m)
+	if err == nil && stream.req == nil {
+		stream.req = m
+	}
+
+	return err
+}
+
+// recordCall records the call to the method, started at start
+func (l *auditLog) recordCall(ctx context.Context, method string, req interface{}, start time.Time, err error) {
+	entry := AuditEntry{
+		Time:     start,
+		Method:   method,
+		Resource: auditResource(req),
+		Request:  auditRequest(req),
+		Code:     toCodeName(int32(status.Code(err))),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		entry.Error = status.Convert(err).Message()
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		entry.Caller = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if userAgents := md.Get("user-agent"); len(userAgents) > 0 {
+			entry.UserAgent = userAgents[0]
+		}
+	}
+	l.record(entry)
+}
+
+// auditResource returns the name of the resource of the request, or its parent
+func auditResource(req interface{}) string {
+	if named, ok := req.(interface{ GetName() string }); ok && named.GetName() != "" {
+		return named.GetName()
+	}
+	if withParent, ok := req.(interface{ GetParent() string }); ok {
+		return withParent.GetParent()
+	}
+	if withResource, ok := req.(interface{ GetResource() string }); ok {
+		return withResource.GetResource()
+	}
+	if withQueue, ok := req.(interface{ GetQueue() string }); ok {
+		return withQueue.GetQueue()
+	}
+
+	return ""
+}
+
+// auditRequest summarizes the request on a line, cut off at maxAuditRequestSize.
+// The credential headers of the tasks are masked, as for the logged dispatches
+// (see dispatchlog.go).
+func auditRequest(req interface{}) string {
+	message, ok := req.(proto.Message)
+	if !ok {
+		return ""
+	}
+	message = proto.Clone(message)
+	redactHeaders(reflect.ValueOf(message), redactedHeaders())
+
+	summary := proto.CompactTextString(message)
+	if len(summary) > maxAuditRequestSize {
+		summary = summary[:maxAuditRequestSize] + "..."
+	}
+
+	return summary
+}
+
+// redactHeaders masks the redacted headers of the HTTP requests in the message,
+// of any of the API versions
+func redactHeaders(value reflect.Value, redacted map[string]bool) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			redactHeaders(value.Elem(), redacted)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			structField := value.Type().Field(i)
+			if structField.PkgPath != "" {
+				continue
+			}
+			if headers, ok := value.Field(i).Interface().(map[string]string); ok && structField.Name == "Headers" {
+				for name := range headers {
+					if redacted[http.CanonicalHeaderKey(name)] {
+						headers[name] = "[REDACTED]"
+					}
+				}
+				continue
+			}
+			redactHeaders(value.Field(i), redacted)
+		}
+	case reflect.Slice:
+		if kind := value.Type().Elem().Kind(); kind == reflect.Ptr || kind == reflect.Interface || kind == reflect.Struct {
+			for i := 0; i < value.Len(); i++ {
+				redactHeaders(value.Index(i), redacted)
+			}
+		}
+	}
+}
+
+// chainUnaryInterceptors runs the interceptors in order around the handler
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+
+		return chained(ctx, req)
+	}
+}
+
+// newGRPCServer creates the gRPC server of the emulator, tracing the calls and
+// recording them in the audit log if enabled, apart from the health checks.
+// Unknown methods, e.g. those of the v2beta3 API missing from the generated
+// code, go to the v2beta3 server.
+func newGRPCServer(v2beta3Server *V2beta3Server) *grpc.Server {
+	interceptors := []grpc.UnaryServerInterceptor{traceUnaryRPC}
+	auditLog := newAuditLog(v2beta3Server.s.currentSettings().auditLogFile)
+	if auditLog != nil {
+		interceptors = append(interceptors, auditLog.intercept)
+		// Closed with the server
+		v2beta3Server.s.auditLog = auditLog
+	}
+
+	chained := chainUnaryInterceptors(interceptors...)
+
+	options := []grpc.ServerOption{
+		grpc.UnknownServiceHandler(v2beta3Server.HandleUnknownMethod),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if isHealthCheck(info.FullMethod) {
+				return handler(ctx, req)
+			}
+			return chained(ctx, req, info, handler)
+		}),
+	}
+	if auditLog != nil {
+		options = append(options, grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if isHealthCheck(info.FullMethod) {
+				return handler(srv, ss)
+			}
+			return auditLog.interceptStream(srv, ss, info, handler)
+		}))
+	}
+
+	return grpc.NewServer(options...)
+}
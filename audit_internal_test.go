@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuditLog(t *testing.T) {
+	file, err := ioutil.TempFile("", "audit")
+	require.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	defer os.Unsetenv("AUDIT_LOG_FILE")
+	os.Setenv("AUDIT_LOG_FILE", file.Name())
+
+	ctx := context.Background()
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/audited"
+	_, err = emulator.Client.CreateQueue(ctx, &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+	_, err = emulator.Client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: queueName + "-missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Served as an unknown method, through a stream
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	err = conn.Invoke(ctx, v2beta3BufferTaskMethod, &BufferTaskRequest{Queue: queueName}, &BufferTaskResponse{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	f, err := os.Open(file.Name())
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, "/google.cloud.tasks.v2.CloudTasks/CreateQueue", entries[0].Method)
+	assert.Equal(t, "projects/bluebook/locations/us-east1", entries[0].Resource)
+	assert.Contains(t, entries[0].Request, `name:"`+queueName+`"`)
+	assert.Equal(t, "OK", entries[0].Code)
+	assert.Empty(t, entries[0].Error)
+	assert.NotEmpty(t, entries[0].Caller)
+	assert.False(t, entries[0].Time.IsZero())
+
+	assert.Equal(t, "/google.cloud.tasks.v2.CloudTasks/GetQueue", entries[1].Method)
+	assert.Equal(t, queueName+"-missing", entries[1].Resource)
+	assert.Equal(t, "NOT_FOUND", entries[1].Code)
+	assert.NotEmpty(t, entries[1].Error)
+
+	assert.Equal(t, v2beta3BufferTaskMethod, entries[2].Method)
+	assert.Equal(t, queueName, entries[2].Resource)
+	assert.Contains(t, entries[2].Request, `queue:"`+queueName+`"`)
+	assert.Equal(t, "FAILED_PRECONDITION", entries[2].Code)
+}
+
+func TestAuditRequestCutOff(t *testing.T) {
+	summary := auditRequest(&taskspb.CreateTaskRequest{
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Body: []byte(strings.Repeat("x", 2*maxAuditRequestSize))},
+			},
+		},
+	})
+
+	assert.Len(t, summary, maxAuditRequestSize+len("..."))
+}
+
+func TestChainUnaryInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name+" before")
+			resp, err := handler(ctx, req)
+			calls = append(calls, name+" after")
+			return resp, err
+		}
+	}
+
+	chained := chainUnaryInterceptors(interceptor("outer"), interceptor("inner"))
+	resp, err := chained(context.Background(), "req", &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return "resp", nil
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, "resp", resp)
+	assert.Equal(t, []string{"outer before", "inner before", "handler", "inner after", "outer after"}, calls)
+}
+
+func TestAuditRequestRedactsCredentials(t *testing.T) {
+	summary := auditRequest(&taskspb.CreateTaskRequest{
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Headers: map[string]string{"authorization": "Bearer secret", "X-Trace": "kept"},
+				},
+			},
+		},
+	})
+
+	assert.NotContains(t, summary, "secret")
+	assert.Contains(t, summary, "[REDACTED]")
+	assert.Contains(t, summary, "kept")
+}
+
+func TestAuditLogClosedWithServer(t *testing.T) {
+	file, err := ioutil.TempFile("", "audit")
+	require.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	defer os.Unsetenv("AUDIT_LOG_FILE")
+	os.Setenv("AUDIT_LOG_FILE", file.Name())
+
+	server := NewServer()
+	newGRPCServer(NewV2beta3Server(server))
+	require.NotNil(t, server.auditLog)
+
+	require.NoError(t, server.Close())
+	assert.Nil(t, server.auditLog.file)
+	// Calls still in flight aren't recorded
+	server.auditLog.record(AuditEntry{Method: "late"})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+// bodyTemplateHeader opts a task in to having its body expanded as a template
+// on dispatch. It isn't sent on to the target.
+const bodyTemplateHeader = "X-Emulator-Body-Template"
+
+// BodyTemplateData holds the values available to task body templates, e.g.
+// {"task": "{{.TaskName}}", "retry": {{.RetryCount}}}
+type BodyTemplateData struct {
+	TaskName string
+
+	QueueName string
+
+	RetryCount int32
+
+	ExecutionCount int32
+}
+
+// usesBodyTemplate tells whether the body is a template, either for all tasks
+// with BODY_TEMPLATES=true or per task with the template header
+func usesBodyTemplate(headers map[string]string) bool {
+	if enabled, _ := strconv.ParseBool(os.Getenv("BODY_TEMPLATES")); enabled {
+		return true
+	}
+
+	for k, v := range headers {
+		if http.CanonicalHeaderKey(k) == bodyTemplateHeader {
+			enabled, _ := strconv.ParseBool(v)
+			return enabled
+		}
+	}
+
+	return false
+}
+
+// dispatchBody returns the body to send for the attempt
+func dispatchBody(body []byte, headers map[string]string, taskState *tasks.Task, attempts attemptHistory) []byte {
+	if len(body) == 0 || !usesBodyTemplate(headers) {
+		return body
+	}
+
+	return expandBodyTemplate(body, taskState, attempts)
+}
+
+// expandBodyTemplate expands the body for the attempt. A body that isn't a
+// valid template is sent as is.
+func expandBodyTemplate(body []byte, taskState *tasks.Task, attempts attemptHistory) []byte {
+	tmpl, err := template.New("body").Parse(string(body))
+	if err != nil {
+		logWarn("Sending the body as is, it isn't a valid template", field("task", taskState.GetName()), field("error", err))
+		return body
+	}
+
+	nameParts := parseTaskName(taskState)
+	data := BodyTemplateData{
+		TaskName:       taskState.GetName(),
+		QueueName:      nameParts.queueId,
+		RetryCount:     attempts.retryCount(),
+		ExecutionCount: attempts.executions,
+	}
+
+	var expanded bytes.Buffer
+	if err := tmpl.Execute(&expanded, data); err != nil {
+		logWarn("Sending the body as is, expanding the template failed", field("task", taskState.GetName()), field("error", err))
+		return body
+	}
+
+	return expanded.Bytes()
+}
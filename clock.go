@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	ptimestamp "github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// Clock is the source of time for scheduling tasks and generating tokens, so
+// that time can be controlled in tests
+type Clock interface {
+	Now() time.Time
+
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer mirrors time.Timer, as created by a Clock
+type Timer interface {
+	C() <-chan time.Time
+
+	Stop() bool
+
+	Reset(d time.Duration) bool
+}
+
+// timestampNow returns the time of the clock as a timestamp
+func timestampNow(clock Clock) *ptimestamp.Timestamp {
+	ts, _ := ptypes.TimestampProto(clock.Now())
+	return ts
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{timer: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t *realTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+// fakeClock only moves forward when advanced
+type fakeClock struct {
+	mux sync.Mutex
+
+	now time.Time
+
+	// The timers that haven't fired or been stopped yet
+	timers map[*fakeTimer]bool
+
+	seq uint64
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{
+		now:    now,
+		timers: make(map[*fakeTimer]bool),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+
+	return t
+}
+
+// Advance moves the clock forward, firing the timers that become due in order
+// of their deadline, each at its own deadline. A timer set for a time already
+// passed, e.g. by a goroutine acting on a timer that fired, fires straight away,
+// so that what is due by the new time is never missed whenever the goroutine
+// gets to run.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	target := c.now.Add(d)
+	for next := c.nextTimer(target); next != nil; next = c.nextTimer(target) {
+		if next.deadline.After(c.now) {
+			c.now = next.deadline
+		}
+		c.fire(next)
+	}
+	c.now = target
+}
+
+// nextTimer finds the earliest timer due by the target, expects mux to be held
+func (c *fakeClock) nextTimer(target time.Time) *fakeTimer {
+	var next *fakeTimer
+	for t := range c.timers {
+		if t.deadline.After(target) {
+			continue
+		}
+		if next == nil || t.deadline.Before(next.deadline) || (t.deadline.Equal(next.deadline) && t.seq < next.seq) {
+			next = t
+		}
+	}
+
+	return next
+}
+
+// fire delivers the current time on the timer channel, expects mux to be held
+func (c *fakeClock) fire(t *fakeTimer) {
+	delete(c.timers, t)
+
+	// Dropped if the previous time wasn't received, as with time.Timer
+	select {
+	case t.c <- c.now:
+	default:
+	}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+
+	c chan time.Time
+
+	deadline time.Time
+
+	// Orders timers with the same deadline
+	seq uint64
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+
+	active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+
+	active := t.clock.timers[t]
+
+	t.clock.seq++
+	t.seq = t.clock.seq
+	t.deadline = t.clock.now.Add(d)
+
+	if d <= 0 {
+		t.clock.fire(t)
+	} else {
+		t.clock.timers[t] = true
+	}
+
+	return active
+}
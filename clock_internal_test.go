@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestFakeClockFiresTimersInOrder(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := newFakeClock(start)
+
+	late := fake.NewTimer(3 * time.Second)
+	early := fake.NewTimer(1 * time.Second)
+	notDue := fake.NewTimer(10 * time.Second)
+	stopped := fake.NewTimer(2 * time.Second)
+	assert.True(t, stopped.Stop())
+
+	fake.Advance(5 * time.Second)
+
+	assert.Equal(t, start.Add(5*time.Second), fake.Now())
+	assert.Equal(t, start.Add(1*time.Second), <-early.C())
+	assert.Equal(t, start.Add(3*time.Second), <-late.C())
+	assert.Len(t, notDue.C(), 0)
+	assert.Len(t, stopped.C(), 0)
+}
+
+func TestAdvanceDispatchesDueTasksInOrder(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	var mux sync.Mutex
+	var dispatched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		dispatched = append(dispatched, req.Header.Get("X-CloudTasks-TaskName"))
+	}))
+	defer srv.Close()
+	dispatchedTasks := func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]string(nil), dispatched...)
+	}
+
+	server := newServer(fake)
+	defer server.Reset()
+	handler := NewRestHandler(server)
+
+	// One dispatch at a time, so that the tasks due at once arrive in order
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue: &taskspb.Queue{
+			Name:       queueName,
+			RateLimits: &taskspb.RateLimits{MaxConcurrentDispatches: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, delay := range []time.Duration{30 * time.Second, 10 * time.Second, 20 * time.Second} {
+		scheduleTime, _ := ptypes.TimestampProto(fake.Now().Add(delay))
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				Name:         queueName + "/tasks/after-" + delay.String(),
+				ScheduleTime: scheduleTime,
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, dispatchedTasks(), "Nothing is due before the clock advances")
+
+	advance(t, handler, "15s")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{"after-10s"}, dispatchedTasks())
+
+	advance(t, handler, "20s")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{"after-10s", "after-20s", "after-30s"}, dispatchedTasks())
+}
+
+func TestAdvanceReleasesElapsedTokens(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	var mux sync.Mutex
+	dispatchCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		dispatchCount++
+	}))
+	defer srv.Close()
+	dispatched := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return dispatchCount
+	}
+
+	server := newServer(fake)
+	defer server.Reset()
+	handler := NewRestHandler(server)
+
+	// A single token in the bucket, with a new one every second
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue: &taskspb.Queue{
+			Name: queueName,
+			RateLimits: &taskspb.RateLimits{
+				MaxDispatchesPerSecond: 1,
+				MaxBurstSize:           1,
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, dispatched(), "Uses the initial token")
+
+	advance(t, handler, "1s")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, dispatched())
+
+	advance(t, handler, "2s")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 4, dispatched())
+}
+
+func TestEmptyInitialTokenBucketPacesFirstDispatches(t *testing.T) {
+	fake := newFakeClock(time.Now())
+	os.Setenv("INITIAL_TOKEN_FILL", "0")
+	defer os.Unsetenv("INITIAL_TOKEN_FILL")
+
+	var mux sync.Mutex
+	dispatchCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		dispatchCount++
+	}))
+	defer srv.Close()
+	dispatched := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return dispatchCount
+	}
+
+	server := newServer(fake)
+	defer server.Reset()
+	handler := NewRestHandler(server)
+
+	// Room for a burst of 10, but a new token only every second
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue: &taskspb.Queue{
+			Name: queueName,
+			RateLimits: &taskspb.RateLimits{
+				MaxDispatchesPerSecond: 1,
+				MaxBurstSize:           10,
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, dispatched(), "No burst from a full bucket")
+
+	for i := 1; i <= 3; i++ {
+		advance(t, handler, "1s")
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, i, dispatched())
+	}
+}
+
+func TestInitialTokens(t *testing.T) {
+	defer os.Unsetenv("INITIAL_TOKEN_FILL")
+
+	for fill, expected := range map[string]int{
+		"":     10,
+		"1":    10,
+		"0.5":  5,
+		"0":    0,
+		"1.5":  10,
+		"-1":   10,
+		"half": 10,
+	} {
+		os.Setenv("INITIAL_TOKEN_FILL", fill)
+		assert.Equal(t, expected, initialTokens(10), "INITIAL_TOKEN_FILL=%v", fill)
+	}
+}
+
+func TestAdvanceRequiresFakeClock(t *testing.T) {
+	handler := NewRestHandler(NewServer())
+
+	req := httptest.NewRequest(http.MethodPost, "/advance?duration=30s", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "FAILED_PRECONDITION")
+}
+
+func advance(t *testing.T, handler http.Handler, duration string) {
+	req := httptest.NewRequest(http.MethodPost, "/advance?duration="+duration, nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// seedConfig declares the queues, and optionally their first tasks, to create
+// on startup. It is read from YAML, or JSON as a subset of it, with projects
+// holding locations holding queues, see the readme.
+type seedConfig struct {
+	Projects []seedProject `json:"projects"`
+}
+
+type seedProject struct {
+	ID string `json:"id"`
+
+	Locations []seedLocation `json:"locations"`
+}
+
+type seedLocation struct {
+	ID string `json:"id"`
+
+	Queues []seedQueue `json:"queues"`
+}
+
+// seedQueue is a queue in the JSON mapping of the Cloud Tasks protos, as taken
+// by the REST API, named by its ID, with the tasks to create in it
+type seedQueue struct {
+	ID string
+
+	Queue *tasks.Queue
+
+	Tasks []seedTask
+}
+
+// seedTask is a task in the JSON mapping of the Cloud Tasks protos, with an
+// optional ID to name it by
+type seedTask struct {
+	ID string
+
+	Task *tasks.Task
+}
+
+func (q *seedQueue) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if err := unmarshalSeedField(fields, "id", &q.ID); err != nil {
+		return err
+	}
+	if err := unmarshalSeedField(fields, "tasks", &q.Tasks); err != nil {
+		return err
+	}
+
+	q.Queue = &tasks.Queue{}
+	if err := unmarshalSeedProto(fields, q.Queue); err != nil {
+		return fmt.Errorf("Invalid queue %v: %v", q.ID, err)
+	}
+
+	return nil
+}
+
+func (t *seedTask) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if err := unmarshalSeedField(fields, "id", &t.ID); err != nil {
+		return err
+	}
+
+	t.Task = &tasks.Task{}
+	if err := unmarshalSeedProto(fields, t.Task); err != nil {
+		return fmt.Errorf("Invalid task %v: %v", t.ID, err)
+	}
+
+	return nil
+}
+
+// unmarshalSeedField unmarshals the field, if set, and removes it from the
+// fields left for the proto
+func unmarshalSeedField(fields map[string]json.RawMessage, key string, v interface{}) error {
+	data, ok := fields[key]
+	if !ok {
+		return nil
+	}
+	delete(fields, key)
+
+	return json.Unmarshal(data, v)
+}
+
+// unmarshalSeedProto unmarshals the remaining fields, rejecting unknown ones so
+// that a misspelled setting isn't silently ignored
+func unmarshalSeedProto(fields map[string]json.RawMessage, pb proto.Message) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	return jsonpb.Unmarshal(bytes.NewReader(data), pb)
+}
+
+// loadSeedConfig reads the config file, in YAML or JSON
+func loadSeedConfig(path string) (*seedConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Invalid config %v: %v", path, err)
+	}
+	data, err = json.Marshal(yamlToJSON(doc))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config %v: %v", path, err)
+	}
+
+	// The queues and tasks reject their unknown fields as jsonpb does
+	config := &seedConfig{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, fmt.Errorf("Invalid config %v: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// yamlToJSON converts the maps decoded from YAML, keyed by any value, to maps
+// keyed by strings that encoding/json can marshal
+func yamlToJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			converted[fmt.Sprint(k)] = yamlToJSON(v)
+		}
+		return converted
+	case []interface{}:
+		for i, v := range value {
+			value[i] = yamlToJSON(v)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// seedFromConfig creates the queues and tasks of the config file. The queues
+// that already exist, e.g. restored from the data dir, are left as they are,
+// without creating their tasks again.
+func seedFromConfig(s *Server, path string) error {
+	config, err := loadSeedConfig(path)
+	if err != nil {
+		return err
+	}
+
+	for _, project := range config.Projects {
+		for _, location := range project.Locations {
+			parent := fmt.Sprintf("projects/%v/locations/%v", project.ID, location.ID)
+			for _, queue := range location.Queues {
+				if err := seedQueueFromConfig(s, parent, queue); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func seedQueueFromConfig(s *Server, parent string, queue seedQueue) error {
+	queueName := parent + "/queues/" + queue.ID
+	queue.Queue.Name = queueName
+
+	logInfo("Creating queue from config", field("queue", queueName), field("tasks", len(queue.Tasks)))
+
+	_, err := s.CreateQueue(context.Background(), &tasks.CreateQueueRequest{
+		Parent: parent,
+		Queue:  queue.Queue,
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to create queue %v: %v", queueName, err)
+	}
+	// Output only in the API, but a queue can be declared paused, holding its
+	// tasks until resumed
+	if queue.Queue.GetState() == tasks.Queue_PAUSED {
+		if _, err := s.PauseQueue(context.Background(), &tasks.PauseQueueRequest{Name: queueName}); err != nil {
+			return fmt.Errorf("Failed to pause queue %v: %v", queueName, err)
+		}
+	}
+
+	for _, task := range queue.Tasks {
+		if task.ID != "" {
+			task.Task.Name = queueName + "/tasks/" + task.ID
+		}
+		_, err := s.CreateTask(context.Background(), &tasks.CreateTaskRequest{
+			Parent: queueName,
+			Task:   task.Task,
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to create task in queue %v: %v", queueName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	require.NoError(t, err)
+
+	return file.Name()
+}
+
+func TestSeedFromYAMLConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+projects:
+- id: bluebook
+  locations:
+  - id: us-east1
+    queues:
+    - id: seeded
+      state: PAUSED
+      rateLimits:
+        maxDispatchesPerSecond: 2.5
+        maxConcurrentDispatches: 3
+      retryConfig:
+        maxAttempts: 4
+        minBackoff: 2s
+      tasks:
+      - id: first
+        httpRequest:
+          url: http://localhost:8080/first
+          httpMethod: PUT
+      - httpRequest:
+          url: http://localhost:8080/second
+    - id: empty
+`)
+	defer os.Remove(path)
+
+	server := NewServer()
+	defer server.Reset()
+	require.NoError(t, seedFromConfig(server, path))
+
+	queueName := "projects/bluebook/locations/us-east1/queues/seeded"
+	queue, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, queue.GetState())
+	assert.Equal(t, 2.5, queue.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.Equal(t, int32(3), queue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.Equal(t, int32(4), queue.GetRetryConfig().GetMaxAttempts())
+	minBackoff, _ := ptypes.Duration(queue.GetRetryConfig().GetMinBackoff())
+	assert.Equal(t, "2s", minBackoff.String())
+
+	listed, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queueName})
+	require.NoError(t, err)
+	require.Len(t, listed.GetTasks(), 2)
+	task, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: queueName + "/tasks/first"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/first", task.GetHttpRequest().GetUrl())
+	assert.Equal(t, taskspb.HttpMethod_PUT, task.GetHttpRequest().GetHttpMethod())
+
+	_, err = server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: "projects/bluebook/locations/us-east1/queues/empty"})
+	assert.NoError(t, err)
+
+	// Seeding again leaves the existing queues, without duplicating their tasks
+	require.NoError(t, seedFromConfig(server, path))
+	listed, err = server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queueName})
+	require.NoError(t, err)
+	assert.Len(t, listed.GetTasks(), 2)
+}
+
+func TestSeedFromJSONConfig(t *testing.T) {
+	path := writeConfigFile(t, `{"projects": [{"id": "bluebook", "locations": [{"id": "us-east1", "queues": [{"id": "seeded", "rateLimits": {"maxBurstSize": 10}}]}]}]}`)
+	defer os.Remove(path)
+
+	server := NewServer()
+	defer server.Reset()
+	require.NoError(t, seedFromConfig(server, path))
+
+	_, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: "projects/bluebook/locations/us-east1/queues/seeded"})
+	assert.NoError(t, err)
+}
+
+func TestSeedFromInvalidConfig(t *testing.T) {
+	server := NewServer()
+	defer server.Reset()
+
+	assert.Error(t, seedFromConfig(server, "/nonexistent/config.yaml"))
+
+	// A misspelled setting isn't ignored
+	path := writeConfigFile(t, `
+projects:
+- id: bluebook
+  locations:
+  - id: us-east1
+    queues:
+    - id: seeded
+      rateLimit:
+        maxDispatchesPerSecond: 1
+`)
+	defer os.Remove(path)
+	err := seedFromConfig(server, path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rateLimit")
+
+	// Nor at the project or location level
+	for misspelled, config := range map[string]string{
+		"locationz": `{"projects": [{"id": "bluebook", "locationz": [{"id": "us-east1"}]}]}`,
+		"queuez":    `{"projects": [{"id": "bluebook", "locations": [{"id": "us-east1", "queuez": [{"id": "seeded"}]}]}]}`,
+	} {
+		misspelledPath := writeConfigFile(t, config)
+		defer os.Remove(misspelledPath)
+		err := seedFromConfig(server, misspelledPath)
+		require.Error(t, err, misspelled)
+		assert.Contains(t, err.Error(), misspelled)
+	}
+
+	// Nor is a project ID the API rejects
+	invalidPath := writeConfigFile(t, `{"projects": [{"id": "blue_book", "locations": [{"id": "us-east1", "queues": [{"id": "seeded"}]}]}]}`)
+	defer os.Remove(invalidPath)
+	assert.Error(t, seedFromConfig(server, invalidPath))
+}
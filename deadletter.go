@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+// DeadLetter describes a task that ran out of attempts without succeeding
+type DeadLetter struct {
+	TaskName string `json:"taskName"`
+
+	QueueName string `json:"queueName"`
+
+	// The status code of the last attempt, -1 if no response was received
+	StatusCode int `json:"statusCode"`
+
+	DispatchCount int32 `json:"dispatchCount"`
+}
+
+// deadLetterURL returns the endpoint permanently failed tasks are posted to, set
+// per queue with DEAD_LETTER_URL_<QUEUE_ID> or for all queues with DEAD_LETTER_URL
+func deadLetterURL(queueName string) string {
+	return queueSetting("DEAD_LETTER_URL", queueName)
+}
+
+// deadLetterQueueName returns the queue the permanently failed tasks of the
+// queue are added to, set per queue with DEAD_LETTER_QUEUE_<QUEUE_ID> or for all
+// queues with DEAD_LETTER_QUEUE. A queue ID refers to a queue in the same
+// location. Empty if unset, or if it is the queue itself.
+func deadLetterQueueName(queueName string) string {
+	deadLetterQueue := queueSetting("DEAD_LETTER_QUEUE", queueName)
+	if deadLetterQueue != "" && !strings.Contains(deadLetterQueue, "/") {
+		deadLetterQueue = queueParent(queueName) + "/queues/" + deadLetterQueue
+	}
+	if deadLetterQueue == queueName {
+		return ""
+	}
+
+	return deadLetterQueue
+}
+
+// enqueueDeadLetter adds a new task with the payload of the failed task to the
+// dead letter queue, so that it can be inspected, or retried once the target is
+// fixed. The new task is named by the emulator and due straight away.
+func (s *Server) enqueueDeadLetter(deadLetterQueue string, task *Task) {
+	task.stateMutex.Lock()
+	taskState := proto.Clone(task.state).(*tasks.Task)
+	task.stateMutex.Unlock()
+
+	// Not taking importMux, as Reset waits for the dispatch of the failed task
+	_, err := s.createTask(context.Background(), &tasks.CreateTaskRequest{
+		Parent: deadLetterQueue,
+		Task: &tasks.Task{
+			MessageType:      taskState.GetMessageType(),
+			DispatchDeadline: taskState.GetDispatchDeadline(),
+		},
+	})
+	if err != nil {
+		logError("Failed to add the task to the dead letter queue", field("task", taskState.GetName()), field("deadLetterQueue", deadLetterQueue), field("error", err))
+	}
+}
+
+// sendDeadLetter posts the dead letter as JSON to the endpoint
+func sendDeadLetter(url string, deadLetter DeadLetter) {
+	body, err := json.Marshal(deadLetter)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		logError("Failed to send dead letter", field("task", deadLetter.TaskName), field("error", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := outboundClient.Do(req.WithContext(ctx))
+	if err != nil {
+		logError("Failed to send dead letter", field("task", deadLetter.TaskName), field("error", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logError("Failed to send dead letter", field("task", deadLetter.TaskName), field("statusCode", resp.StatusCode))
+	}
+}
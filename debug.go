@@ -0,0 +1,34 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// newDebugHandler serves the runtime profiles of net/http/pprof under
+// /debug/pprof/, and the expvars on /debug/vars
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// serveDebug serves the profiles and expvars on the address, e.g. localhost:6060, apart
+// from the APIs so that they aren't exposed unless asked for
+func serveDebug(address string) *http.Server {
+	server := &http.Server{Addr: address, Handler: newDebugHandler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logError("Failed to serve the debug endpoints", field("address", address), field("error", err))
+		}
+	}()
+
+	return server
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultDispatchEventLogSize = 1000
+
+// DispatchEvent records the outcome of a dispatch
+type DispatchEvent struct {
+	Time time.Time `json:"time"`
+
+	QueueName string `json:"queueName"`
+
+	TaskName string `json:"taskName"`
+
+	// Starts at 1 for the first dispatch
+	Attempt int32 `json:"attempt"`
+
+	URL string `json:"url"`
+
+	// -1 if no response was received
+	StatusCode int `json:"statusCode"`
+
+	// In nanoseconds in JSON
+	Duration time.Duration `json:"duration"`
+}
+
+// dispatchEventLog keeps the latest dispatch events in a ring buffer, the size
+// of which is set with DISPATCH_EVENT_LOG_SIZE (0 to disable). With
+// DISPATCH_EVENT_LOG_FILE, all events are also appended to the file as JSON lines.
+type dispatchEventLog struct {
+	mux sync.Mutex
+
+	events []DispatchEvent
+
+	// Where the next event goes in the ring buffer
+	next int
+
+	full bool
+
+	file *os.File
+}
+
+func newDispatchEventLog() *dispatchEventLog {
+	size := defaultDispatchEventLogSize
+	if value, err := strconv.ParseInt(os.Getenv("DISPATCH_EVENT_LOG_SIZE"), 10, 32); err == nil && value >= 0 {
+		size = int(value)
+	}
+
+	eventLog := &dispatchEventLog{events: make([]DispatchEvent, size)}
+
+	if path := os.Getenv("DISPATCH_EVENT_LOG_FILE"); path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logWarn("Not writing dispatch events", field("path", path), field("error", err))
+		} else {
+			eventLog.file = file
+		}
+	}
+
+	return eventLog
+}
+
+func (l *dispatchEventLog) record(event DispatchEvent) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if len(l.events) > 0 {
+		l.events[l.next] = event
+		l.next = (l.next + 1) % len(l.events)
+		if l.next == 0 {
+			l.full = true
+		}
+	}
+
+	if l.file != nil {
+		line, _ := json.Marshal(event)
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			logError("Failed to write dispatch event", field("error", err))
+		}
+	}
+}
+
+// query returns the recorded events of the queue, or of all queues if the name
+// is empty, from since up to but excluding until, unbounded if zero, oldest first
+func (l *dispatchEventLog) query(queueName string, since time.Time, until time.Time) []DispatchEvent {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	ordered := l.events[:l.next]
+	if l.full {
+		ordered = append(append([]DispatchEvent(nil), l.events[l.next:]...), l.events[:l.next]...)
+	}
+
+	events := []DispatchEvent{}
+	for _, event := range ordered {
+		if queueName != "" && event.QueueName != queueName {
+			continue
+		}
+		if !since.IsZero() && event.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !event.Time.Before(until) {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	return events
+}
+
+// close closes the file the events are appended to, if any. Events recorded
+// afterwards are only kept in memory.
+func (l *dispatchEventLog) close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// clear drops the events kept in memory
+func (l *dispatchEventLog) clear() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.events = make([]DispatchEvent, len(l.events))
+	l.next = 0
+	l.full = false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatchEventLogKeepsLatestEvents(t *testing.T) {
+	defer os.Unsetenv("DISPATCH_EVENT_LOG_SIZE")
+	os.Setenv("DISPATCH_EVENT_LOG_SIZE", "3")
+
+	eventLog := newDispatchEventLog()
+	assert.Empty(t, eventLog.query("", time.Time{}, time.Time{}))
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, queueName := range []string{"first", "second", "first", "second", "first"} {
+		eventLog.record(DispatchEvent{
+			Time:      start.Add(time.Duration(i) * time.Second),
+			QueueName: queueName,
+			Attempt:   int32(i),
+		})
+	}
+
+	attempts := func(events []DispatchEvent) []int32 {
+		var attempts []int32
+		for _, event := range events {
+			attempts = append(attempts, event.Attempt)
+		}
+		return attempts
+	}
+
+	// The oldest two were dropped
+	assert.Equal(t, []int32{2, 3, 4}, attempts(eventLog.query("", time.Time{}, time.Time{})))
+	assert.Equal(t, []int32{2, 4}, attempts(eventLog.query("first", time.Time{}, time.Time{})))
+	assert.Equal(t, []int32{3}, attempts(eventLog.query("", start.Add(3*time.Second), start.Add(4*time.Second))))
+
+	eventLog.clear()
+	assert.Empty(t, eventLog.query("", time.Time{}, time.Time{}))
+}
+
+func TestDispatchEventLogDisabled(t *testing.T) {
+	defer os.Unsetenv("DISPATCH_EVENT_LOG_SIZE")
+	os.Setenv("DISPATCH_EVENT_LOG_SIZE", "0")
+
+	eventLog := newDispatchEventLog()
+	eventLog.record(DispatchEvent{QueueName: "first"})
+
+	assert.Empty(t, eventLog.query("", time.Time{}, time.Time{}))
+}
+
+func TestDispatchEventLogFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "dispatches")
+	require.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+	defer os.Unsetenv("DISPATCH_EVENT_LOG_FILE")
+	os.Setenv("DISPATCH_EVENT_LOG_FILE", file.Name())
+
+	eventLog := newDispatchEventLog()
+	eventLog.record(DispatchEvent{QueueName: "first"})
+	require.NoError(t, eventLog.close())
+
+	// Only kept in memory once closed
+	eventLog.record(DispatchEvent{QueueName: "second"})
+	assert.Len(t, eventLog.query("", time.Time{}, time.Time{}), 2)
+
+	lines, err := ioutil.ReadFile(file.Name())
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(lines), "\n"))
+	assert.Contains(t, string(lines), `"queueName":"first"`)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dispatched requests and their responses are logged for debugging with
+// LOG_DISPATCHES=true. So that the logs can be shared, the values of sensitive
+// headers are masked, and bodies are cut off after LOG_MAX_BODY_SIZE bytes.
+
+const defaultLogMaxBodySize = 1024
+
+// defaultRedactedHeaders are masked unless LOG_REDACTED_HEADERS says otherwise
+var defaultRedactedHeaders = []string{"Authorization", "Cookie"}
+
+func dispatchLoggingEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("LOG_DISPATCHES"))
+	return enabled
+}
+
+// redactedHeaders returns the canonical names of the headers to mask, set as a
+// comma separated list with LOG_REDACTED_HEADERS
+func redactedHeaders() map[string]bool {
+	names := defaultRedactedHeaders
+	if value, ok := os.LookupEnv("LOG_REDACTED_HEADERS"); ok {
+		names = strings.Split(value, ",")
+	}
+
+	redacted := make(map[string]bool)
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			redacted[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+
+	return redacted
+}
+
+func logMaxBodySize() int {
+	maxSize, err := strconv.ParseInt(os.Getenv("LOG_MAX_BODY_SIZE"), 10, 32)
+	if err != nil || maxSize < 0 {
+		return defaultLogMaxBodySize
+	}
+
+	return int(maxSize)
+}
+
+func logDispatchRequest(taskName string, req *http.Request) {
+	var body []byte
+	if req.GetBody != nil {
+		if reader, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(reader)
+		}
+	}
+
+	logInfo(fmt.Sprintf("Dispatching %v %v\n%v\n%v", req.Method, req.URL, formatLoggedHeaders(req.Header), formatLoggedBody(body)), field("task", taskName))
+}
+
+func logDispatchResponse(taskName string, resp *http.Response, body []byte) {
+	logInfo(fmt.Sprintf("Response %v\n%v\n%v", resp.Status, formatLoggedHeaders(resp.Header), formatLoggedBody(body)), field("task", taskName), field("statusCode", resp.StatusCode))
+}
+
+// formatLoggedHeaders formats the headers one per line, masking the redacted ones
+func formatLoggedHeaders(header http.Header) string {
+	redacted := redactedHeaders()
+
+	var lines []string
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		if redacted[http.CanonicalHeaderKey(name)] {
+			value = "[REDACTED]"
+		}
+		lines = append(lines, name+": "+value)
+	}
+	sort.Strings(lines)
+
+	return strings.Join(lines, "\n")
+}
+
+// formatLoggedBody cuts the body off at the maximum logged size
+func formatLoggedBody(body []byte) string {
+	if maxSize := logMaxBodySize(); len(body) > maxSize {
+		return fmt.Sprintf("%s... (truncated at %d bytes)", body[:maxSize], maxSize)
+	}
+
+	return string(body)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	pduration "github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/assert"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestDispatchLogging(t *testing.T) {
+	defer os.Unsetenv("LOG_DISPATCHES")
+	os.Setenv("LOG_DISPATCHES", "true")
+	defer os.Unsetenv("LOG_MAX_BODY_SIZE")
+	os.Setenv("LOG_MAX_BODY_SIZE", "10")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("response-body-that-is-long"))
+	}))
+	defer srv.Close()
+
+	dispatchLogged := func() string {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+
+		dispatch(context.Background(), realClock{}, false, &taskspb.Task{
+			Name:             "projects/bluebook/locations/us-east1/queues/agentq/tasks/my-task",
+			DispatchDeadline: &pduration.Duration{Seconds: 10},
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:        srv.URL,
+					HttpMethod: taskspb.HttpMethod_POST,
+					Body:       []byte("request-body-that-is-long"),
+					Headers: map[string]string{
+						"Authorization": "Bearer secret-token",
+						"X-Api-Key":     "secret-key",
+					},
+				},
+			},
+		}, attemptHistory{}, nil, nil)
+
+		// Done with the logger before reading the buffer
+		log.SetOutput(os.Stderr)
+		return buf.String()
+	}
+
+	logged := dispatchLogged()
+	assert.Contains(t, logged, "Authorization: [REDACTED]")
+	assert.NotContains(t, logged, "secret-token")
+	assert.Contains(t, logged, "X-Api-Key: secret-key")
+	assert.Contains(t, logged, "request-bo... (truncated at 10 bytes)")
+	assert.Contains(t, logged, "response-b... (truncated at 10 bytes)")
+	assert.NotContains(t, logged, "that-is-long")
+
+	defer os.Unsetenv("LOG_REDACTED_HEADERS")
+	os.Setenv("LOG_REDACTED_HEADERS", "x-api-key")
+
+	logged = dispatchLogged()
+	assert.Contains(t, logged, "Authorization: Bearer secret-token")
+	assert.Contains(t, logged, "X-Api-Key: [REDACTED]")
+	assert.NotContains(t, logged, "secret-key")
+}
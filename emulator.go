@@ -4,37 +4,112 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net"
+	"io"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	beta2 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta2"
+	beta3 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
 	v1 "google.golang.org/genproto/googleapis/iam/v1"
 
 	codes "google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
 	status "google.golang.org/grpc/status"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/empty"
 	"google.golang.org/grpc"
 )
 
 // NewServer creates a new emulator server with its own task and queue bookkeeping
 func NewServer() *Server {
+	return newServer(realClock{})
+}
+
+// newServer creates a new emulator server keeping time with the clock, e.g. a
+// fake one
+func newServer(clock Clock) *Server {
 	return &Server{
-		qs: make(map[string]*Queue),
-		ts: make(map[string]*Task),
+		clock:          clock,
+		qs:             make(map[string]*Queue),
+		ts:             newMemoryTaskStore(),
+		tombstones:     newTaskTombstones(),
+		dispatchSlots:  newDispatchSlots(),
+		newTaskStore:   func(queueName string) taskStore { return newMemoryTaskStore() },
+		dispatchEvents: newDispatchEventLog(),
+		metrics:        newMetricsRegistry(),
+		taskEvents:     newTaskEventStream(),
+		ready:          true,
 	}
 }
 
 // Server represents the emulator server
 type Server struct {
+	// The source of time of the server and its queues, see clock.go
+	clock Clock
+
+	// Given with the command line flags, nil to read the env, see settings.go
+	settings *settings
+
 	qs map[string]*Queue
-	ts map[string]*Task
+	ts taskStore
+
+	// Creates the task stores of the queues, see taskstore.go
+	newTaskStore func(queueName string) taskStore
+
+	// Saves the queues as they change, nil unless they're kept in Redis or SQLite
+	queueStore queueStore
+
+	// The tasks that completed or got deleted, so that their names aren't
+	// reused within the dedup window. Guarded by tsMux.
+	tombstones *taskTombstones
 
 	qsMux sync.Mutex
 	tsMux sync.Mutex
+
+	// Held by Reset and Import while they replace the queues and tasks, and
+	// for reading while queues and tasks are created, so that those aren't
+	// caught halfway
+	importMux sync.RWMutex
+
+	// Bounds the concurrent dispatches across all queues, nil for no bound
+	dispatchSlots chan bool
+
+	dispatchEvents *dispatchEventLog
+
+	// Records the gRPC calls if enabled, see audit.go
+	auditLog *auditLog
+
+	metrics *metricsRegistry
+
+	taskEvents *taskEventStream
+
+	// Set by Freeze, so that new queues start frozen. Guarded by qsMux.
+	frozen bool
+
+	// Unset while the emulator starts up, see Ready. Guarded by qsMux.
+	ready bool
+
+	// Set on the server Import checks a snapshot with, whose queues neither
+	// post events nor report failed tasks
+	silent bool
+}
+
+// newDispatchSlots creates the slots for the concurrent dispatches across all
+// queues, limited with GLOBAL_MAX_CONCURRENT_DISPATCHES and unlimited by default
+func newDispatchSlots() chan bool {
+	maxDispatches, err := strconv.ParseInt(os.Getenv("GLOBAL_MAX_CONCURRENT_DISPATCHES"), 10, 32)
+	if err != nil || maxDispatches <= 0 {
+		return nil
+	}
+
+	return make(chan bool, maxDispatches)
 }
 
 func (s *Server) setQueue(queueName string, queue *Queue) {
@@ -43,6 +118,26 @@ func (s *Server) setQueue(queueName string, queue *Queue) {
 	s.qs[queueName] = queue
 }
 
+// addQueue adds the queue, unless a queue with the same name exists or existed recently
+func (s *Server) addQueue(queueName string, queue *Queue) error {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	if existing, ok := s.qs[queueName]; ok {
+		if existing != nil {
+			return status.Errorf(codes.AlreadyExists, "Queue already exists")
+		}
+
+		return status.Errorf(codes.FailedPrecondition, "The queue cannot be created because a queue with this name existed too recently.")
+	}
+	s.qs[queueName] = queue
+	if s.frozen {
+		queue.Freeze()
+	}
+
+	return nil
+}
+
 func (s *Server) fetchQueue(queueName string) (*Queue, bool) {
 	s.qsMux.Lock()
 	defer s.qsMux.Unlock()
@@ -50,39 +145,272 @@ func (s *Server) fetchQueue(queueName string) (*Queue, bool) {
 	return queue, ok
 }
 
+// lookupQueue fetches the queue, treating a recently deleted queue as not found
+func (s *Server) lookupQueue(queueName string) (*Queue, error) {
+	queue, ok := s.fetchQueue(queueName)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Queue does not exist.")
+	}
+	if queue == nil {
+		return nil, status.Errorf(codes.NotFound, "The queue no longer exists, though a queue with this name existed recently.")
+	}
+
+	return queue, nil
+}
+
 func (s *Server) removeQueue(queueName string) {
 	s.setQueue(queueName, nil)
 }
 
+// saveQueue saves the changed queue to the queue store, if any
+func (s *Server) saveQueue(queue *Queue) {
+	if s.queueStore != nil {
+		s.queueStore.saveQueue(queue.frozenState(), queue.pull)
+	}
+}
+
 func (s *Server) setTask(taskName string, task *Task) {
 	s.tsMux.Lock()
 	defer s.tsMux.Unlock()
-	s.ts[taskName] = task
+	s.ts.put(taskName, task)
+}
+
+// reserveTaskName claims the name for a task being created, unless a task with
+// that name exists, or existed within the dedup window. The name is then taken
+// with takeTaskName once the task is created, or given up with releaseTaskName.
+func (s *Server) reserveTaskName(taskName string) error {
+	s.tsMux.Lock()
+	defer s.tsMux.Unlock()
+
+	if _, ok := s.ts.get(taskName); ok {
+		return status.Errorf(codes.AlreadyExists, "Requested entity already exists")
+	}
+	if s.isRecentlyRemoved(taskName) {
+		return status.Errorf(codes.AlreadyExists, "The task cannot be created because a task with this name existed too recently.")
+	}
+	// Reserved, but not found until created
+	s.ts.put(taskName, nil)
+
+	return nil
+}
+
+// takeTaskName stores the created task under its reserved name, unless the task
+// is already done and removed
+func (s *Server) takeTaskName(taskName string, task *Task) {
+	s.tsMux.Lock()
+	defer s.tsMux.Unlock()
+
+	if existing, ok := s.ts.get(taskName); ok && existing == nil {
+		s.ts.put(taskName, task)
+	}
+}
+
+// releaseTaskName gives up the name reserved for a task that wasn't created
+func (s *Server) releaseTaskName(taskName string) {
+	s.tsMux.Lock()
+	defer s.tsMux.Unlock()
+
+	if existing, _ := s.ts.get(taskName); existing == nil {
+		s.ts.remove(taskName)
+	}
+}
+
+// isRecentlyRemoved tells whether the task got removed within the dedup window,
+// expects tsMux to be held
+func (s *Server) isRecentlyRemoved(taskName string) bool {
+	return s.tombstones.isRecent(taskName, s.clock.Now())
 }
 
-func (s *Server) fetchTask(taskName string) (*Task, bool) {
+// lookupTask fetches the task, treating a recently completed or deleted task as not found
+func (s *Server) lookupTask(taskName string) (*Task, error) {
 	s.tsMux.Lock()
 	defer s.tsMux.Unlock()
-	task, ok := s.ts[taskName]
-	return task, ok
+
+	if task, _ := s.ts.get(taskName); task != nil {
+		return task, nil
+	}
+	if s.isRecentlyRemoved(taskName) {
+		return nil, status.Errorf(codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+	}
+
+	return nil, status.Errorf(codes.NotFound, "Task does not exist.")
 }
 
+// generateTaskName picks a task name that isn't in use, nor was recently
+func (s *Server) generateTaskName(queueName string) string {
+	s.tsMux.Lock()
+	defer s.tsMux.Unlock()
+
+	for {
+		taskName := queueName + "/tasks/" + newTaskID()
+		_, inUse := s.ts.get(taskName)
+		if !inUse && !s.tombstones.has(taskName) {
+			return taskName
+		}
+	}
+}
+
+// removeTask forgets the task, leaving a tombstone for the dedup window
 func (s *Server) removeTask(taskName string) {
-	s.setTask(taskName, nil)
+	s.tsMux.Lock()
+	defer s.tsMux.Unlock()
+
+	s.ts.remove(taskName)
+	s.tombstones.add(taskName, s.clock.Now())
 }
 
-// ListQueues lists the existing queues
+// taskDedupWindow returns how long the name of a completed or deleted task
+// can't be reused, an hour as in Cloud Tasks unless set with the
+// TASK_DEDUP_WINDOW env variable (e.g. 5m, or 0 to allow reuse right away)
+func taskDedupWindow() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("TASK_DEDUP_WINDOW"))
+	if err != nil || window < 0 {
+		return time.Hour
+	}
+
+	return window
+}
+
+// Reset deletes all queues and their tasks, returning once the queues have
+// stopped, and unfreezes the emulator. Meant for clearing the emulator between
+// tests.
+func (s *Server) Reset() {
+	s.importMux.Lock()
+	defer s.importMux.Unlock()
+
+	s.reset()
+}
+
+// reset deletes all queues and their tasks, expects importMux to be held
+func (s *Server) reset() {
+	s.qsMux.Lock()
+	qs := s.qs
+	s.qs = make(map[string]*Queue)
+	s.frozen = false
+	s.qsMux.Unlock()
+
+	for name, queue := range qs {
+		if queue != nil {
+			queue.Delete()
+			queue.Wait()
+			if s.queueStore != nil {
+				s.queueStore.removeQueue(name)
+			}
+		}
+	}
+
+	// Cleared last, as deleting the queues removes their tasks
+	s.tsMux.Lock()
+	s.ts = newMemoryTaskStore()
+	s.tombstones = newTaskTombstones()
+	s.tsMux.Unlock()
+
+	s.dispatchEvents.clear()
+	s.metrics.clear()
+
+	// Tests creating the same tasks after a reset get the same generated names
+	resetTaskIDs()
+}
+
+// Close closes the files the server writes to, the dispatch event log and the
+// audit log, on shutdown
+func (s *Server) Close() error {
+	err := s.dispatchEvents.close()
+	if s.auditLog != nil {
+		if auditErr := s.auditLog.close(); err == nil {
+			err = auditErr
+		}
+	}
+
+	return err
+}
+
+// DispatchEvents returns the recorded outcomes of the dispatches of the queue, or
+// of all queues if the name is empty, from since up to until (unbounded if zero)
+func (s *Server) DispatchEvents(queueName string, since time.Time, until time.Time) []DispatchEvent {
+	return s.dispatchEvents.query(queueName, since, until)
+}
+
+// Ready tells whether the emulator finished starting up, with its initial
+// queues created and its snapshot restored
+func (s *Server) Ready() bool {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	return s.ready
+}
+
+func (s *Server) setReady(ready bool) {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	s.ready = ready
+}
+
+// QueueRoutineCounts returns the numbers of running goroutines of each queue
+func (s *Server) QueueRoutineCounts() map[string]RoutineCounts {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	counts := make(map[string]RoutineCounts)
+	for name, queue := range s.qs {
+		if queue != nil {
+			counts[name] = queue.RoutineCounts()
+		}
+	}
+
+	return counts
+}
+
+// WriteMetrics outputs the metrics of the queues in the Prometheus text format
+func (s *Server) WriteMetrics(w io.Writer) {
+	s.qsMux.Lock()
+	stats := make(map[string]QueueStats)
+	for name, queue := range s.qs {
+		if queue != nil {
+			stats[name] = queue.Stats()
+		}
+	}
+	s.qsMux.Unlock()
+
+	s.metrics.write(w, stats)
+}
+
+// QueueTokenBuckets returns the state of the token bucket of each queue
+func (s *Server) QueueTokenBuckets() map[string]TokenBucketStats {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	buckets := make(map[string]TokenBucketStats)
+	for name, queue := range s.qs {
+		if queue != nil {
+			buckets[name] = queue.TokenBucketStats()
+		}
+	}
+
+	return buckets
+}
+
+// ListQueues lists the existing queues, those matching the filter if given
+// (see queueFilter)
 func (s *Server) ListQueues(ctx context.Context, in *tasks.ListQueuesRequest) (*tasks.ListQueuesResponse, error) {
 	// TODO: Implement pageing
 
+	filter, err := queueFilter(in.GetFilter())
+	if err != nil {
+		return nil, err
+	}
+
 	var queueStates []*tasks.Queue
 
 	s.qsMux.Lock()
 	defer s.qsMux.Unlock()
 
-	for _, queue := range s.qs {
-		if queue != nil {
-			queueStates = append(queueStates, queue.state)
+	for name, queue := range s.qs {
+		if queue != nil && queueParent(name) == in.GetParent() {
+			if queueState := queue.frozenState(); filter(queueState) {
+				queueStates = append(queueStates, queueState)
+			}
 		}
 	}
 
@@ -100,11 +428,43 @@ func (s *Server) GetQueue(ctx context.Context, in *tasks.GetQueueRequest) (*task
 		return nil, status.Errorf(codes.NotFound, "Queue does not exist. If you just created the queue, wait at least a minute for the queue to initialize.")
 	}
 
-	return queue.state, nil
+	// Returned as response headers, for want of Queue.stats (see queuelogging.go)
+	grpc.SetHeader(ctx, queueStatsMetadata(queue.Stats()))
+
+	return queue.frozenState(), nil
+}
+
+func queueStatsMetadata(stats QueueStats) metadata.MD {
+	md := metadata.Pairs(
+		"x-cloudtasks-stats-tasks-count", strconv.FormatInt(stats.TasksCount, 10),
+		"x-cloudtasks-stats-executed-last-minute-count", strconv.FormatInt(stats.ExecutedLastMinuteCount, 10),
+		"x-cloudtasks-stats-concurrent-dispatches-count", strconv.FormatInt(stats.ConcurrentDispatchesCount, 10),
+		"x-cloudtasks-stats-effective-execution-rate", strconv.FormatFloat(stats.EffectiveExecutionRate, 'f', -1, 64),
+	)
+	if !stats.OldestEstimatedArrivalTime.IsZero() {
+		md.Set("x-cloudtasks-stats-oldest-estimated-arrival-time", stats.OldestEstimatedArrivalTime.UTC().Format(time.RFC3339Nano))
+	}
+
+	return md
 }
 
 // CreateQueue creates a new queue
 func (s *Server) CreateQueue(ctx context.Context, in *tasks.CreateQueueRequest) (*tasks.Queue, error) {
+	return s.createQueue(in, false)
+}
+
+// createQueue creates a new queue, a pull queue if pull is set or the queue is
+// configured as such (see pull.go)
+func (s *Server) createQueue(in *tasks.CreateQueueRequest, pull bool) (*tasks.Queue, error) {
+	s.importMux.RLock()
+	defer s.importMux.RUnlock()
+
+	return s.startQueue(in, pull)
+}
+
+// startQueue creates and starts a new queue, expects importMux to be held, for
+// reading at least
+func (s *Server) startQueue(in *tasks.CreateQueueRequest, pull bool) (*tasks.Queue, error) {
 	queueState := in.GetQueue()
 
 	name := queueState.GetName()
@@ -117,32 +477,153 @@ func (s *Server) CreateQueue(ctx context.Context, in *tasks.CreateQueueRequest)
 	if !parentMatched {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource field value in the request.")
 	}
-	queue, ok := s.fetchQueue(name)
-	if ok {
-		if queue != nil {
-			return nil, status.Errorf(codes.AlreadyExists, "Queue already exists")
-		}
-
-		return nil, status.Errorf(codes.FailedPrecondition, "The queue cannot be created because a queue with this name existed too recently.")
+	if err := validateStackdriverLoggingConfig(queueState); err != nil {
+		return nil, err
+	}
+	if err := validateAppEngineRoutingOverride(queueState.GetAppEngineRoutingOverride()); err != nil {
+		return nil, err
 	}
-
 	// Make a deep copy so that the original is frozen for the http response
-	queue, queueState = NewQueue(
+	queue, _ := newQueue(
 		name,
 		proto.Clone(queueState).(*tasks.Queue),
+		s.clock,
 		func(task *Task) {
 			s.removeTask(task.state.GetName())
 		},
+		s.currentSettings(),
 	)
-	s.setQueue(name, queue)
+	queue.pull = queue.pull || pull
+	queue.ts = s.newTaskStore(name)
+	queue.dispatchSlots = s.dispatchSlots
+	queue.dispatchEvents = s.dispatchEvents
+	queue.metrics = s.metrics
+	queue.taskEvents = s.taskEvents
+	queue.enqueueDeadLetter = s.enqueueDeadLetter
+	if s.silent {
+		queue.onTaskFailed = func(task *Task, statusCode int) {}
+		queue.onEvent = func(event QueueEvent) {}
+	}
+	// The new queue isn't running yet, so it can just be dropped if the name is taken
+	if err := s.addQueue(name, queue); err != nil {
+		return nil, err
+	}
+	s.saveQueue(queue)
+	if leaser, ok := s.queueStore.(queueLeaser); ok {
+		queue.setLeased(leaser.leaseQueue(name))
+	}
 	queue.Run()
 
-	return queueState, nil
+	return queue.frozenState(), nil
 }
 
-// UpdateQueue updates an existing queue (not implemented yet)
+// UpdateQueue updates an existing queue, which requires an update mask. The
+// stackdriver_logging_config, app_engine_routing_override, rate_limits and
+// retry_config fields can be updated, the new rate limits and retry config
+// taking effect straight away (see Queue.reconfigure). Unset rate limits and
+// retry config fields revert to their defaults.
 func (s *Server) UpdateQueue(ctx context.Context, in *tasks.UpdateQueueRequest) (*tasks.Queue, error) {
-	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
+	queue, ok := s.fetchQueue(in.GetQueue().GetName())
+	if !ok || queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+	}
+
+	paths := in.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		return nil, status.Errorf(codes.Unimplemented, "Updating a queue without an update mask is not yet supported")
+	}
+
+	// The rate limits and retry config are updated on a copy, to then be applied at once
+	current := queue.frozenState()
+	updated := &tasks.Queue{
+		Name:        current.GetName(),
+		RateLimits:  current.GetRateLimits(),
+		RetryConfig: current.GetRetryConfig(),
+	}
+	var updateLoggingConfig, updateRoutingOverride, reconfigure bool
+	for _, path := range paths {
+		switch field := strings.SplitN(path, ".", 2)[0]; field {
+		case "stackdriver_logging_config":
+			updateLoggingConfig = true
+		case "app_engine_routing_override":
+			updateRoutingOverride = true
+		case "rate_limits", "retry_config":
+			if err := updateQueueField(updated, in.GetQueue(), path); err != nil {
+				return nil, err
+			}
+			reconfigure = true
+		default:
+			return nil, status.Errorf(codes.Unimplemented, "Updating %v is not yet supported", path)
+		}
+	}
+
+	if err := validateStackdriverLoggingConfig(in.GetQueue()); err != nil {
+		return nil, err
+	}
+	if err := validateAppEngineRoutingOverride(in.GetQueue().GetAppEngineRoutingOverride()); err != nil {
+		return nil, err
+	}
+
+	if updateLoggingConfig {
+		config, _ := getStackdriverLoggingConfig(in.GetQueue())
+		queue.setLoggingConfig(config)
+	}
+	if updateRoutingOverride {
+		queue.setRoutingOverride(in.GetQueue().GetAppEngineRoutingOverride())
+	}
+	if reconfigure {
+		setRateLimitsDefaults(updated)
+		setRetryConfigDefaults(updated)
+		queue.reconfigure(updated.GetRateLimits(), updated.GetRetryConfig())
+	}
+	s.saveQueue(queue)
+
+	return queue.frozenState(), nil
+}
+
+// updateQueueField copies the rate limits or retry config field at the path of
+// the update mask from the request queue onto the updated one. The burst size
+// is output only, so it is kept as is.
+func updateQueueField(updated *tasks.Queue, from *tasks.Queue, path string) error {
+	rateLimits := proto.Clone(updated.GetRateLimits()).(*tasks.RateLimits)
+	retryConfig := proto.Clone(updated.GetRetryConfig()).(*tasks.RetryConfig)
+
+	switch path {
+	case "rate_limits":
+		rateLimits.MaxDispatchesPerSecond = from.GetRateLimits().GetMaxDispatchesPerSecond()
+		rateLimits.MaxConcurrentDispatches = from.GetRateLimits().GetMaxConcurrentDispatches()
+	case "rate_limits.max_dispatches_per_second":
+		rateLimits.MaxDispatchesPerSecond = from.GetRateLimits().GetMaxDispatchesPerSecond()
+	case "rate_limits.max_concurrent_dispatches":
+		rateLimits.MaxConcurrentDispatches = from.GetRateLimits().GetMaxConcurrentDispatches()
+	case "rate_limits.max_burst_size":
+		return invalidArgument("update_mask", "RateLimits.max_burst_size is output only.")
+	case "retry_config":
+		retryConfig = &tasks.RetryConfig{}
+		if from.GetRetryConfig() != nil {
+			retryConfig = proto.Clone(from.GetRetryConfig()).(*tasks.RetryConfig)
+		}
+	case "retry_config.max_attempts":
+		retryConfig.MaxAttempts = from.GetRetryConfig().GetMaxAttempts()
+	case "retry_config.max_retry_duration":
+		retryConfig.MaxRetryDuration = from.GetRetryConfig().GetMaxRetryDuration()
+	case "retry_config.min_backoff":
+		retryConfig.MinBackoff = from.GetRetryConfig().GetMinBackoff()
+	case "retry_config.max_backoff":
+		retryConfig.MaxBackoff = from.GetRetryConfig().GetMaxBackoff()
+	case "retry_config.max_doublings":
+		retryConfig.MaxDoublings = from.GetRetryConfig().GetMaxDoublings()
+	default:
+		return invalidArgument("update_mask", "Unknown field %v.", path)
+	}
+	if rateLimits.GetMaxDispatchesPerSecond() < 0 || rateLimits.GetMaxConcurrentDispatches() < 0 {
+		return invalidArgument("queue.rate_limits", "RateLimits must not be negative.")
+	}
+
+	updated.RateLimits = rateLimits
+	updated.RetryConfig = retryConfig
+
+	return nil
 }
 
 // DeleteQueue removes an existing queue.
@@ -157,35 +638,65 @@ func (s *Server) DeleteQueue(ctx context.Context, in *tasks.DeleteQueueRequest)
 	queue.Delete()
 
 	s.removeQueue(in.GetName())
+	if s.queueStore != nil {
+		s.queueStore.removeQueue(in.GetName())
+	}
 
 	return &empty.Empty{}, nil
 }
 
 // PurgeQueue purges the specified queue
 func (s *Server) PurgeQueue(ctx context.Context, in *tasks.PurgeQueueRequest) (*tasks.Queue, error) {
-	queue, _ := s.fetchQueue(in.GetName())
+	queue, err := s.lookupQueue(in.GetName())
+	if err != nil {
+		return nil, err
+	}
 
 	queue.Purge()
+	s.saveQueue(queue)
 
-	return queue.state, nil
+	return queue.frozenState(), nil
 }
 
 // PauseQueue pauses queue execution
 func (s *Server) PauseQueue(ctx context.Context, in *tasks.PauseQueueRequest) (*tasks.Queue, error) {
-	queue, _ := s.fetchQueue(in.GetName())
+	queue, err := s.lookupQueue(in.GetName())
+	if err != nil {
+		return nil, err
+	}
 
 	queue.Pause()
+	s.saveQueue(queue)
 
-	return queue.state, nil
+	return queue.frozenState(), nil
 }
 
 // ResumeQueue resumes a paused queue
 func (s *Server) ResumeQueue(ctx context.Context, in *tasks.ResumeQueueRequest) (*tasks.Queue, error) {
-	queue, _ := s.fetchQueue(in.GetName())
+	queue, err := s.lookupQueue(in.GetName())
+	if err != nil {
+		return nil, err
+	}
 
 	queue.Resume()
+	s.saveQueue(queue)
 
-	return queue.state, nil
+	return queue.frozenState(), nil
+}
+
+// DrainQueue stops the queue from accepting new tasks, and disables it once the
+// tasks it holds are done. The v2 API doesn't define draining, so it isn't
+// registered as a gRPC method.
+func (s *Server) DrainQueue(ctx context.Context, queueName string) (*tasks.Queue, error) {
+	queue, err := s.lookupQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.Drain()
+	s.saveQueue(queue)
+
+	return queue.frozenState(), nil
 }
 
 // GetIamPolicy doesn't do anything
@@ -203,71 +714,220 @@ func (s *Server) TestIamPermissions(ctx context.Context, in *v1.TestIamPermissio
 	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
 }
 
-// ListTasks lists the tasks in the specified queue
+// ListTasks lists the tasks in the specified queue by schedule time, a page of
+// at most page_size at a time. The BASIC view, which is the default, leaves out
+// the body and headers of the targets.
 func (s *Server) ListTasks(ctx context.Context, in *tasks.ListTasksRequest) (*tasks.ListTasksResponse, error) {
-	// TODO: Implement pageing of some sort
-	queue, _ := s.fetchQueue(in.GetParent())
+	queue, err := s.lookupQueue(in.GetParent())
+	if err != nil {
+		return nil, err
+	}
+	size, err := pageSize(in.GetPageSize())
+	if err != nil {
+		return nil, err
+	}
+	token, err := decodeTaskPageToken(in.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
 
-	var taskStates []*tasks.Task
+	var taskStates taskListing
 
 	queue.tsMux.Lock()
-	defer queue.tsMux.Unlock()
-
-	for _, task := range queue.ts {
-		if task != nil {
-			taskStates = append(taskStates, task.state)
+	for _, task := range queue.ts.list() {
+		if in.GetResponseView() == tasks.Task_FULL {
+			taskStates = append(taskStates, taskView(task.frozenState(), tasks.Task_FULL))
+		} else {
+			taskStates = append(taskStates, task.basicState())
 		}
 	}
+	queue.tsMux.Unlock()
+
+	page, nextPageToken := taskStates.page(token, size)
 
 	return &tasks.ListTasksResponse{
-		Tasks: taskStates,
+		Tasks:         page,
+		NextPageToken: nextPageToken,
 	}, nil
 }
 
-// GetTask returns the specified task
+// GetTask returns the specified task in the requested view
 func (s *Server) GetTask(ctx context.Context, in *tasks.GetTaskRequest) (*tasks.Task, error) {
-	task, ok := s.fetchTask(in.GetName())
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+	task, err := s.lookupTask(in.GetName())
+	if err != nil {
+		return nil, err
 	}
-	if task == nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "The task no longer exists,  though a task with this name existed recently. The task either successfully completed or was deleted.")
+
+	return taskView(task.frozenState(), in.GetResponseView()), nil
+}
+
+// validateTask checks the task as per the constraints of Cloud Tasks
+func validateTask(queueName string, taskState *tasks.Task, now time.Time) error {
+	if taskState == nil {
+		return invalidArgument("task", "Task is required.")
 	}
 
-	return task.state, nil
+	if name := taskState.GetName(); name != "" {
+		if !isValidTaskName(name) {
+			return invalidArgument("task.name", `Task name must be formatted: "projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>"`)
+		}
+		if !strings.HasPrefix(name, queueName+"/tasks/") {
+			return invalidArgument("task.name", "Task name must be in the parent queue %q.", queueName)
+		}
+	}
+
+	// The target is a oneof, so it can't be ambiguous once decoded
+	switch {
+	case taskState.GetHttpRequest() != nil:
+		if taskState.GetHttpRequest().GetUrl() == "" {
+			return invalidArgument("task.http_request.url", "HttpRequest.url is required.")
+		}
+	case taskState.GetAppEngineHttpRequest() == nil && getPullMessage(taskState) == nil:
+		return invalidArgument("task", "Task must have either an http_request or an app_engine_http_request target.")
+	}
+
+	if taskState.GetScheduleTime() != nil {
+		scheduleTime, err := ptypes.Timestamp(taskState.GetScheduleTime())
+		if err != nil {
+			return invalidArgument("task.schedule_time", "Invalid schedule time: %v", err)
+		}
+		if scheduleTime.After(now.Add(maxScheduleAhead)) {
+			return invalidArgument("task.schedule_time", "Task schedule time must not be more than 30 days in the future.")
+		}
+	}
+
+	if taskState.GetDispatchDeadline() != nil {
+		if err := validateDispatchDeadline(taskState); err != nil {
+			return err
+		}
+	}
+
+	if bodySize, maxSize := len(getBody(taskState)), maxTaskBodySize(); bodySize > maxSize {
+		return invalidArgument(bodyField(taskState), "Task body size too large: %d bytes, the maximum is %d bytes.", bodySize, maxSize)
+	}
+	if taskSize, maxSize := proto.Size(taskState), maxTaskSize(); taskSize > maxSize {
+		return invalidArgument("task", "Task size too large: %d bytes, the maximum is %d bytes.", taskSize, maxSize)
+	}
+
+	return nil
+}
+
+// validateDispatchDeadline checks the dispatch deadline is within the range of
+// the task target
+func validateDispatchDeadline(taskState *tasks.Task) error {
+	deadline, err := ptypes.Duration(taskState.GetDispatchDeadline())
+	if err != nil {
+		return invalidArgument("task.dispatch_deadline", "Invalid dispatch deadline: %v", err)
+	}
+
+	maxDeadline := maxDispatchDeadline
+	if taskState.GetAppEngineHttpRequest() != nil {
+		maxDeadline = maxAppEngineDispatchDeadline
+	}
+	if deadline < minDispatchDeadline || deadline > maxDeadline {
+		return invalidArgument("task.dispatch_deadline", "Task dispatch deadline must be between %v and %v.", minDispatchDeadline, maxDeadline)
+	}
+
+	return nil
 }
 
-// CreateTask creates a new task
+// bodyField returns the path of the body field of the task target
+func bodyField(taskState *tasks.Task) string {
+	if taskState.GetAppEngineHttpRequest() != nil {
+		return "task.app_engine_http_request.body"
+	}
+
+	return "task.http_request.body"
+}
+
+// CreateTask creates a new task, returned in the requested view
 func (s *Server) CreateTask(ctx context.Context, in *tasks.CreateTaskRequest) (*tasks.Task, error) {
+	s.importMux.RLock()
+	defer s.importMux.RUnlock()
+
+	return s.createTask(ctx, in)
+}
 
+// createTask creates a new task, expects importMux to be held, for reading at
+// least
+func (s *Server) createTask(ctx context.Context, in *tasks.CreateTaskRequest) (*tasks.Task, error) {
 	queueName := in.GetParent()
-	queue, ok := s.fetchQueue(queueName)
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Queue does not exist.")
+	queue, err := s.lookupQueue(queueName)
+	if status.Code(err) == codes.NotFound {
+		if s.currentSettings().autoCreateQueues {
+			queue, err = s.autoCreateQueue(queueName)
+		}
 	}
-	if queue == nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "The queue no longer exists, though a queue with this name existed recently.")
+	if err != nil {
+		return nil, err
 	}
 
-	if (in.Task.Name != "") && !isValidTaskName(in.Task.Name) {
-		return nil, status.Errorf(codes.InvalidArgument, `Task name must be formatted: "projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>"`)
+	if err := validateTask(queueName, in.GetTask(), s.clock.Now()); err != nil {
+		return nil, err
+	}
+	if getPullMessage(in.GetTask()) != nil && !queue.pull {
+		return nil, invalidArgument("task.pull_message", "Tasks with a pull message can only be added to pull queues.")
 	}
 
-	task, taskState := queue.NewTask(in.GetTask())
+	if in.GetTask().GetName() == "" {
+		in.GetTask().Name = s.generateTaskName(queueName)
+	}
+	// Output only
+	in.GetTask().CreateTime = nil
 
-	s.setTask(taskState.GetName(), task)
+	if err := s.reserveTaskName(in.GetTask().GetName()); err != nil {
+		return nil, err
+	}
+	task, taskState, err := queue.newTracedTask(in.GetTask(), spanContextFrom(ctx))
+	if err != nil {
+		s.releaseTaskName(in.GetTask().GetName())
+		return nil, err
+	}
+
+	s.takeTaskName(taskState.GetName(), task)
+
+	return taskView(taskState, in.GetResponseView()), nil
+}
+
+// autoCreateQueue creates a missing queue with the default settings so that
+// tasks can be created in it straight away
+func (s *Server) autoCreateQueue(queueName string) (*Queue, error) {
+	logInfo("Creating missing queue", field("queue", queueName))
+
+	_, err := s.startQueue(&tasks.CreateQueueRequest{
+		Parent: queueParent(queueName),
+		Queue:  &tasks.Queue{Name: queueName},
+	}, false)
+	// Another request may have created it in the meantime
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return nil, err
+	}
+
+	return s.lookupQueue(queueName)
+}
+
+// BufferTask creates a task from just a body, dispatched to the queue's default HTTP target.
+// The v2 API in use doesn't define BufferTask, it is served through REST and the v2beta3 API.
+func (s *Server) BufferTask(ctx context.Context, queueName string, taskID string, body []byte, contentType string) (*tasks.Task, error) {
+	queue, err := s.lookupQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+	if queue.httpTarget == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "The queue does not have an HTTP target configured.")
+	}
 
-	return taskState, nil
+	return s.CreateTask(ctx, &tasks.CreateTaskRequest{
+		Parent: queueName,
+		Task:   queue.bufferedTaskState(taskID, body, contentType),
+	})
 }
 
 // DeleteTask removes an existing task
 func (s *Server) DeleteTask(ctx context.Context, in *tasks.DeleteTaskRequest) (*empty.Empty, error) {
-	task, ok := s.fetchTask(in.GetName())
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
-	}
-	if task == nil {
-		return nil, status.Errorf(codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+	task, err := s.lookupTask(in.GetName())
+	if err != nil {
+		return nil, err
 	}
 
 	// The removal of the task from the server struct is handled in the queue callback
@@ -276,20 +936,19 @@ func (s *Server) DeleteTask(ctx context.Context, in *tasks.DeleteTaskRequest) (*
 	return &empty.Empty{}, nil
 }
 
-// RunTask executes an existing task immediately
+// RunTask executes an existing task immediately, returned in the requested view
 func (s *Server) RunTask(ctx context.Context, in *tasks.RunTaskRequest) (*tasks.Task, error) {
-	task, ok := s.fetchTask(in.GetName())
-
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+	task, err := s.lookupTask(in.GetName())
+	if err != nil {
+		return nil, err
 	}
-	if task == nil {
-		return nil, status.Errorf(codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+	if task.queue.pull {
+		return nil, status.Errorf(codes.FailedPrecondition, "Tasks of pull queues are leased, they can't be run.")
 	}
 
 	taskState := task.Run()
 
-	return taskState, nil
+	return taskView(taskState, in.GetResponseView()), nil
 }
 
 // arrayFlags used for parsing list of potentially repeated flags e.g. -queue $Q1 -queue $Q2
@@ -306,7 +965,7 @@ func (i *arrayFlags) Set(value string) error {
 
 // Creates an initial queue on the emulator
 func createInitialQueue(emulatorServer *Server, name string) {
-	print(fmt.Sprintf("Creating initial queue %s\n", name))
+	logInfo("Creating initial queue", field("queue", name))
 
 	r := regexp.MustCompile("/queues/[A-Za-z0-9-]+$")
 	parentName := r.ReplaceAllString(name, "")
@@ -318,6 +977,10 @@ func createInitialQueue(emulatorServer *Server, name string) {
 	}
 
 	_, err := emulatorServer.CreateQueue(context.TODO(), req)
+	// Already restored from the data dir
+	if status.Code(err) == codes.AlreadyExists {
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -325,15 +988,73 @@ func createInitialQueue(emulatorServer *Server, name string) {
 
 func main() {
 	var initialQueues arrayFlags
+	var appEngineServices arrayFlags
 
-	host := flag.String("host", "localhost", "The host name")
-	port := flag.String("port", "8123", "The port")
+	host := flag.String("host", envOrDefault("HOST", "localhost"), "The host name (or HOST env)")
+	port := flag.String("port", envOrDefault("PORT", "8123"), "The port (or PORT env)")
+	socket := flag.String("socket", os.Getenv("SOCKET"), "Unix domain socket path to listen on instead of TCP (or SOCKET env)")
 	openidIssuer := flag.String("openid-issuer", "", "URL to serve the OpenID configuration on, if required")
+	restPort := flag.String("rest-port", "", "The port to serve the REST API on, if required")
+	debugAddr := flag.String("debug-addr", os.Getenv("DEBUG_ADDR"), "Address to serve the pprof profiles and expvars on, e.g. localhost:6060, if required (or DEBUG_ADDR env)")
+	auditLogFile := flag.String("audit-log", os.Getenv("AUDIT_LOG_FILE"), "File to append every gRPC call to as JSON lines, if required (or AUDIT_LOG_FILE env)")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON file declaring the queues, and their tasks, to create on startup, if required (or CONFIG_FILE env)")
+	queueYAMLFile := flag.String("queue-yaml", os.Getenv("QUEUE_YAML"), "App Engine queue.yaml file of the queues to create on startup, if required (or QUEUE_YAML env)")
+	queueYAMLLocation := flag.String("queue-yaml-location", os.Getenv("QUEUE_YAML_LOCATION"), "The location to create the queues of the queue.yaml in, e.g. projects/my-project/locations/my-location (or QUEUE_YAML_LOCATION env)")
+	dataDir := flag.String("data-dir", os.Getenv("DATA_DIR"), "Directory to save the queues and tasks to, and restore them from on startup, if required (or DATA_DIR env)")
+	redisAddr := flag.String("redis-addr", os.Getenv("REDIS_ADDR"), "Redis server to share the queues and tasks with other instances through, e.g. localhost:6379, if required (or REDIS_ADDR env)")
+	fakeClockEnabled := flag.Bool("fake-clock", os.Getenv("FAKE_CLOCK") == "true", "Use a fake clock that only moves forward when advanced through the REST API (or FAKE_CLOCK env)")
+	scheduler := flag.String("scheduler", envOrDefault("SCHEDULER", "heap"), "How tasks wait for their schedule time, in a heap, or a timing wheel for millions of tasks: heap or wheel (or SCHEDULER env)")
+	maxTasksPerQueue := flag.Int("max-tasks-per-queue", maxTasksFromEnv(), "The maximum number of tasks a queue holds, creating more fails with RESOURCE_EXHAUSTED, 0 for unlimited (or MAX_TASKS_PER_QUEUE env)")
+	autoCreateQueues := flag.Bool("auto-create-queues", os.Getenv("AUTO_CREATE_QUEUES") == "true", "Create the missing queue with the default config when creating a task rather than failing with NOT_FOUND (or AUTO_CREATE_QUEUES env)")
+	systemThrottling := flag.Bool("system-throttling", os.Getenv("SYSTEM_THROTTLING") == "true", "Slow a queue down when its target returns 429 or 503, recovering gradually, like Cloud Tasks (or SYSTEM_THROTTLING env)")
+	logLevel := flag.String("log-level", envOrDefault("LOG_LEVEL", "info"), "The least level of the logged messages: debug, info, warn or error (or LOG_LEVEL env)")
+	logFormat := flag.String("log-format", envOrDefault("LOG_FORMAT", "console"), "How messages are logged, console or json for JSON lines (or LOG_FORMAT env)")
+	serial := flag.Bool("serial-dispatch", os.Getenv("SERIAL_DISPATCH") == "true", "Dispatch the tasks of each queue one at a time in schedule order, without retry jitter, for reproducible runs (or SERIAL_DISPATCH env)")
+	jitter := flag.Float64("retry-jitter", retryJitter(), "Randomly spread each retry backoff by up to this fraction, e.g. 0.2 for +/-20% (or RETRY_JITTER env)")
 
 	flag.Var(&initialQueues, "queue", "A queue to create on startup (repeat as required)")
+	flag.Var(&appEngineServices, "app-engine-service", "The local URL of an App Engine service or version, e.g. worker=http://localhost:8081 or v2.worker=http://localhost:8082 (repeat as required, or APP_ENGINE_SERVICE_HOSTS env)")
 
 	flag.Parse()
 
+	if _, ok := logLevels[*logLevel]; !ok {
+		panic(fmt.Errorf("Unknown log level %v, use debug, info, warn or error", *logLevel))
+	}
+	if !logFormats[*logFormat] {
+		panic(fmt.Errorf("Unknown log format %v, use console or json", *logFormat))
+	}
+	logLevelSetting, logFormatSetting = *logLevel, *logFormat
+
+	if _, ok := taskSchedules[*scheduler]; !ok {
+		panic(fmt.Errorf("Unknown scheduler %v, use heap or wheel", *scheduler))
+	}
+	if *maxTasksPerQueue < 0 {
+		panic(fmt.Errorf("Invalid maximum of %v tasks per queue, use 0 for unlimited", *maxTasksPerQueue))
+	}
+	if *jitter < 0 || *jitter > 1 {
+		panic(fmt.Errorf("Invalid retry jitter of %v, use a fraction from 0 to 1", *jitter))
+	}
+	serverSettings := &settings{
+		scheduler:        *scheduler,
+		maxTasksPerQueue: *maxTasksPerQueue,
+		systemThrottling: *systemThrottling,
+		serialDispatch:   *serial,
+		autoCreateQueues: *autoCreateQueues,
+		retryJitter:      *jitter,
+		auditLogFile:     *auditLogFile,
+	}
+
+	// The flags add to the mappings of the env
+	for _, mapping := range append(strings.Split(os.Getenv("APP_ENGINE_SERVICE_HOSTS"), ","), appEngineServices...) {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+		if _, _, err := parseAppEngineServiceHost(mapping); err != nil {
+			panic(err)
+		}
+	}
+	appEngineServiceFlags = appEngineServices
+
 	if *openidIssuer != "" {
 		srv, err := configureOpenIdIssuer(*openidIssuer)
 		if err != nil {
@@ -342,20 +1063,107 @@ func main() {
 		defer srv.Shutdown(context.Background())
 	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("%v:%v", *host, *port))
+	tcpConfigured := os.Getenv("HOST") != "" || os.Getenv("PORT") != ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "host" || f.Name == "port" {
+			tcpConfigured = true
+		}
+	})
+
+	network, address, err := listenAddress(*host, *port, *socket, tcpConfigured)
 	if err != nil {
 		panic(err)
 	}
 
-	print(fmt.Sprintf("Starting cloud tasks emulator, listening on %v:%v\n", *host, *port))
+	lis, err := listen(network, address)
+	if err != nil {
+		panic(err)
+	}
+
+	logInfo("Starting cloud tasks emulator", field("network", network), field("address", lis.Addr()))
 
-	grpcServer := grpc.NewServer()
 	emulatorServer := NewServer()
+	if *fakeClockEnabled {
+		emulatorServer = newServer(newFakeClock(time.Now()))
+	}
+	emulatorServer.settings = serverSettings
+	emulatorServer.setReady(false)
+	v2beta3Server := NewV2beta3Server(emulatorServer)
+	grpcServer := newGRPCServer(v2beta3Server)
 	tasks.RegisterCloudTasksServer(grpcServer, emulatorServer)
+	beta2.RegisterCloudTasksServer(grpcServer, NewV2beta2Server(emulatorServer))
+	beta3.RegisterCloudTasksServer(grpcServer, v2beta3Server)
+	registerEmulatorService(grpcServer, emulatorServer)
+	healthServer := registerHealthServer(grpcServer)
+
+	if *restPort != "" {
+		logInfo("Serving REST API", field("address", *host+":"+*restPort))
+		srv := serveRest(emulatorServer, *host, *restPort)
+		defer srv.Shutdown(context.Background())
+	}
+
+	if *debugAddr != "" {
+		logInfo("Serving debug endpoints", field("address", *debugAddr))
+		publishQueueVars(emulatorServer)
+		srv := serveDebug(*debugAddr)
+		defer srv.Shutdown(context.Background())
+	}
+
+	if *redisAddr != "" {
+		if *dataDir != "" {
+			panic(fmt.Errorf("The queues and tasks are saved either to Redis with -redis-addr or to a data dir with -data-dir, not both"))
+		}
+		redis, err := newRedisStore(*redisAddr, redisSyncInterval())
+		if err != nil {
+			panic(err)
+		}
+		emulatorServer.newTaskStore = redis.newTaskStore
+		emulatorServer.queueStore = redis
+		if err := emulatorServer.syncRedis(redis); err != nil {
+			panic(err)
+		}
+		go syncRedis(emulatorServer, redis)
+	}
+
+	var store snapshotStore
+	if *dataDir != "" {
+		store, err = newSnapshotStore(*dataDir)
+		if err != nil {
+			panic(err)
+		}
+		if factory, ok := store.(taskStoreFactory); ok {
+			emulatorServer.newTaskStore = factory.newTaskStore
+		}
+		if queues, ok := store.(queueStore); ok {
+			emulatorServer.queueStore = queues
+		}
+		if err := restoreSnapshot(emulatorServer, store); err != nil {
+			panic(err)
+		}
+		go persistSnapshots(emulatorServer, store, snapshotInterval())
+	}
+	go shutdownOnSignal(emulatorServer, store)
+
+	if *configFile != "" {
+		if err := seedFromConfig(emulatorServer, *configFile); err != nil {
+			panic(err)
+		}
+	}
+
+	if *queueYAMLFile != "" {
+		if *queueYAMLLocation == "" {
+			panic(fmt.Errorf("The location to create the queues of %v in must be set with -queue-yaml-location", *queueYAMLFile))
+		}
+		if err := importQueueYAML(emulatorServer, *queueYAMLFile, *queueYAMLLocation); err != nil {
+			panic(err)
+		}
+	}
 
 	for i := 0; i < len(initialQueues); i++ {
 		createInitialQueue(emulatorServer, initialQueues[i])
 	}
+	setServing(healthServer)
+	emulatorServer.setReady(true)
 
 	grpcServer.Serve(lis)
 }
@@ -2,15 +2,21 @@ package main_test
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,13 +24,25 @@ import (
 
 	. "cloud.google.com/go/cloudtasks/apiv2"
 	. "github.com/aertje/cloud-tasks-emulator"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	gax "github.com/googleapis/gax-go/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/api/httpbody"
 	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	taskspbbeta2 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta2"
+	taskspbbeta "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/genproto/protobuf/field_mask"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	grpcStatus "google.golang.org/grpc/status"
 )
@@ -64,6 +82,30 @@ func tearDown(t *testing.T, serv *grpc.Server) {
 	serv.Stop()
 }
 
+// setUpServer starts a gRPC server as setUp does, also returning its emulator
+// server for tearDownServer to stop the queues the test updated
+func setUpServer(t *testing.T) (*grpc.Server, *Client, *Server) {
+	serv := grpc.NewServer()
+	emulatorServer := NewServer()
+	taskspb.RegisterCloudTasksServer(serv, emulatorServer)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go serv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	return serv, client, emulatorServer
+}
+
+func tearDownServer(t *testing.T, serv *grpc.Server, emulatorServer *Server) {
+	tearDown(t, serv)
+	emulatorServer.Reset()
+}
+
 func TestCloudTasksCreateQueue(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
@@ -79,6 +121,106 @@ func TestCloudTasksCreateQueue(t *testing.T) {
 	assert.Equal(t, taskspb.Queue_RUNNING, resp.State)
 }
 
+func TestCreateExistingQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	createdQueue := createTestQueue(t, client)
+
+	scheduleTime, _ := ptypes.TimestampProto(time.Now().Add(200 * time.Millisecond))
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: scheduleTime,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/success",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// The existing queue and its task are left alone
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 1, receivedRequests.count())
+}
+
+func TestCreateQueueConcurrently(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	var wg sync.WaitGroup
+	codesReturned := make(chan codes.Code, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+				Parent: formattedParent,
+				Queue:  newQueue(formattedParent, "contested"),
+			})
+			codesReturned <- status.Code(err)
+		}()
+	}
+	wg.Wait()
+	close(codesReturned)
+
+	counts := make(map[codes.Code]int)
+	for code := range codesReturned {
+		counts[code]++
+	}
+	assert.Equal(t, map[codes.Code]int{codes.OK: 1, codes.AlreadyExists: 9}, counts)
+}
+
+func TestQueueEffectiveConfig(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	os.Setenv("MAX_DISPATCHES_PER_SECOND", "25")
+	defer os.Unsetenv("MAX_DISPATCHES_PER_SECOND")
+
+	queue := newQueue(formattedParent, "effective")
+	queue.RateLimits = &taskspb.RateLimits{
+		MaxDispatchesPerSecond: 5,
+		MaxBurstSize:           10,
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	gotQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+
+	for _, q := range []*taskspb.Queue{createdQueue, gotQueue} {
+		// The env overrides the requested value
+		assert.Equal(t, 25.0, q.GetRateLimits().GetMaxDispatchesPerSecond())
+		assert.Equal(t, int32(10), q.GetRateLimits().GetMaxBurstSize())
+		// Defaults fill in the values that weren't requested
+		assert.Equal(t, int32(1000), q.GetRateLimits().GetMaxConcurrentDispatches())
+		assert.Equal(t, int32(100), q.GetRetryConfig().GetMaxAttempts())
+		assert.Equal(t, int64(3600), q.GetRetryConfig().GetMaxBackoff().GetSeconds())
+	}
+}
+
 func TestCreateTask(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
@@ -134,6 +276,188 @@ func TestCreateTaskRejectsInvalidName(t *testing.T) {
 	}
 }
 
+func TestCreateTaskGeneratesName(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+
+	names := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		createdTask, err := client.CreateTask(context.Background(), proto.Clone(&createTaskRequest).(*taskspb.CreateTaskRequest))
+		require.NoError(t, err)
+		assert.Regexp(t, "^"+createdQueue.GetName()+"/tasks/[0-9]+$", createdTask.GetName())
+		names[createdTask.GetName()] = true
+
+		gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+		require.NoError(t, err)
+		assert.Equal(t, createdTask.GetName(), gettedTask.GetName())
+	}
+	assert.Len(t, names, 10, "Names are unique")
+
+	for name := range names {
+		err := client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: name})
+		require.NoError(t, err)
+	}
+}
+
+func TestCreateTaskValidation(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue := createTestQueue(t, client)
+	httpRequest := &taskspb.Task_HttpRequest{
+		HttpRequest: &taskspb.HttpRequest{
+			Url: "http://www.google.com",
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		task            *taskspb.Task
+		expectedMessage string
+	}{
+		{
+			name: "bad name format",
+			task: &taskspb.Task{
+				Name:        createdQueue.GetName() + "/tasks/not.valid",
+				MessageType: httpRequest,
+			},
+			expectedMessage: "^Task name must be formatted",
+		},
+		{
+			name: "task ID too long",
+			task: &taskspb.Task{
+				Name:        createdQueue.GetName() + "/tasks/" + strings.Repeat("a", 501),
+				MessageType: httpRequest,
+			},
+			expectedMessage: "^Task name must be formatted",
+		},
+		{
+			name: "mismatched queue parent",
+			task: &taskspb.Task{
+				Name:        formatQueueName(formattedParent, "other") + "/tasks/my-task",
+				MessageType: httpRequest,
+			},
+			expectedMessage: "^Task name must be in the parent queue",
+		},
+		{
+			name: "schedule too far out",
+			task: &taskspb.Task{
+				ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(31 * 24 * time.Hour).Unix()},
+				MessageType:  httpRequest,
+			},
+			expectedMessage: "^Task schedule time must not be more than 30 days in the future",
+		},
+		{
+			name:            "missing target",
+			task:            &taskspb.Task{},
+			expectedMessage: "^Task must have either an http_request or an app_engine_http_request target",
+		},
+		{
+			name: "missing url",
+			task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{},
+				},
+			},
+			expectedMessage: "^HttpRequest.url is required",
+		},
+		{
+			name: "dispatch deadline too short",
+			task: &taskspb.Task{
+				DispatchDeadline: &duration.Duration{Seconds: 5},
+				MessageType:      httpRequest,
+			},
+			expectedMessage: "^Task dispatch deadline must be between 15s and 30m0s",
+		},
+		{
+			name: "dispatch deadline too long for http",
+			task: &taskspb.Task{
+				DispatchDeadline: &duration.Duration{Seconds: 3600},
+				MessageType:      httpRequest,
+			},
+			expectedMessage: "^Task dispatch deadline must be between 15s and 30m0s",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+				Parent: createdQueue.GetName(),
+				Task:   tc.task,
+			})
+
+			assert.Nil(t, createdTask)
+			rsp, ok := grpcStatus.FromError(err)
+			require.True(t, ok, "Should be grpc error")
+			assert.Regexp(t, tc.expectedMessage, rsp.Message())
+			assert.Equal(t, grpcCodes.InvalidArgument, rsp.Code())
+		})
+	}
+
+	// App Engine handlers can take longer
+	_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime:     &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+			DispatchDeadline: &duration.Duration{Seconds: 3600},
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{RelativeUri: "/"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+}
+
+func TestCreateTaskRejectsOversizeBody(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:  "http://www.google.com",
+					Body: make([]byte, 100*1024+1),
+				},
+			},
+		},
+	}
+
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+
+	assert.Nil(t, createdTask)
+	if assert.Error(t, err, "Should return error") {
+		rsp, ok := grpcStatus.FromError(err)
+		assert.True(t, ok, "Should be grpc error")
+		assert.Regexp(t, "^Task body size too large", rsp.Message())
+		assert.Equal(t, grpcCodes.InvalidArgument, rsp.Code())
+	}
+
+	defer os.Unsetenv("MAX_TASK_BODY_SIZE")
+	os.Setenv("MAX_TASK_BODY_SIZE", "200000")
+
+	createdTask, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+	assert.NotNil(t, createdTask)
+}
+
 func TestGetQueueExists(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
@@ -150,6 +474,42 @@ func TestGetQueueExists(t *testing.T) {
 	assert.Equal(t, createdQueue.GetName(), gettedQueue.GetName())
 }
 
+func TestGetQueueStats(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue := createTestQueue(t, client)
+
+	scheduleTime := time.Now().Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: &timestamp.Timestamp{Seconds: scheduleTime.Unix() + int64(i)},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://www.google.com",
+					},
+				},
+			},
+		}
+		_, err := client.CreateTask(context.Background(), &createTaskRequest)
+		require.NoError(t, err)
+	}
+
+	getQueueRequest := taskspb.GetQueueRequest{
+		Name: createdQueue.GetName(),
+	}
+
+	var md metadata.MD
+	_, err := client.GetQueue(context.Background(), &getQueueRequest, gax.WithGRPCOptions(grpc.Header(&md)))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"2"}, md.Get("x-cloudtasks-stats-tasks-count"))
+	assert.Equal(t, []string{"0"}, md.Get("x-cloudtasks-stats-executed-last-minute-count"))
+	assert.Equal(t, []string{time.Unix(scheduleTime.Unix(), 0).UTC().Format(time.RFC3339Nano)}, md.Get("x-cloudtasks-stats-oldest-estimated-arrival-time"))
+}
+
 func TestGetQueueNeverExisted(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
@@ -190,124 +550,359 @@ func TestGetQueuePreviouslyExisted(t *testing.T) {
 	assert.Equal(t, codes.NotFound, st.Code())
 }
 
-func TestSuccessTaskExecution(t *testing.T) {
+func TestOperationsOnMissingResources(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
 
-	var receivedRequest *http.Request
-	srv := startTestServer(
-		func(req *http.Request) { receivedRequest = req },
-		func(req *http.Request) {},
-	)
+	ctx := context.Background()
 
-	createdQueue := createTestQueue(t, client)
+	deletedQueue, err := client.CreateQueue(ctx, &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "deleted"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.DeleteQueue(ctx, &taskspb.DeleteQueueRequest{Name: deletedQueue.GetName()}))
 
-	createTaskRequest := taskspb.CreateTaskRequest{
+	createdQueue := createTestQueue(t, client)
+	deletedTask, err := client.CreateTask(ctx, &taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
-			Name: createdQueue.GetName() + "/tasks/my-test-task",
+			ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
-					Url: "http://localhost:5000/success",
+					Url: "http://www.google.com",
 				},
 			},
 		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: deletedTask.GetName()}))
+	// Deleting happens asynchronously
+	time.Sleep(10 * time.Millisecond)
+
+	queueOperations := map[string]func(name string) error{
+		"GetQueue": func(name string) error {
+			_, err := client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: name})
+			return err
+		},
+		"UpdateQueue": func(name string) error {
+			_, err := client.UpdateQueue(ctx, &taskspb.UpdateQueueRequest{
+				Queue:      &taskspb.Queue{Name: name},
+				UpdateMask: &field_mask.FieldMask{Paths: []string{"stackdriver_logging_config"}},
+			})
+			return err
+		},
+		"DeleteQueue": func(name string) error {
+			return client.DeleteQueue(ctx, &taskspb.DeleteQueueRequest{Name: name})
+		},
+		"PurgeQueue": func(name string) error {
+			_, err := client.PurgeQueue(ctx, &taskspb.PurgeQueueRequest{Name: name})
+			return err
+		},
+		"PauseQueue": func(name string) error {
+			_, err := client.PauseQueue(ctx, &taskspb.PauseQueueRequest{Name: name})
+			return err
+		},
+		"ResumeQueue": func(name string) error {
+			_, err := client.ResumeQueue(ctx, &taskspb.ResumeQueueRequest{Name: name})
+			return err
+		},
+		"ListTasks": func(name string) error {
+			_, err := client.ListTasks(ctx, &taskspb.ListTasksRequest{Parent: name}).Next()
+			return err
+		},
+		"CreateTask": func(name string) error {
+			_, err := client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+				Parent: name,
+				Task: &taskspb.Task{
+					MessageType: &taskspb.Task_HttpRequest{
+						HttpRequest: &taskspb.HttpRequest{
+							Url: "http://www.google.com",
+						},
+					},
+				},
+			})
+			return err
+		},
 	}
-	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
 
-	getTaskRequest := taskspb.GetTaskRequest{
-		Name: createdTask.GetName(),
+	taskOperations := map[string]func(name string) error{
+		"GetTask": func(name string) error {
+			_, err := client.GetTask(ctx, &taskspb.GetTaskRequest{Name: name})
+			return err
+		},
+		"DeleteTask": func(name string) error {
+			return client.DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: name})
+		},
+		"RunTask": func(name string) error {
+			_, err := client.RunTask(ctx, &taskspb.RunTaskRequest{Name: name})
+			return err
+		},
 	}
 
-	// Need to give it a chance to make the actual call
-	time.Sleep(100 * time.Millisecond)
-	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
-	assert.Error(t, err)
-	assert.Nil(t, gettedTask)
-
-	// Validate that the call was actually made properly
-	assert.NotNil(t, receivedRequest, "Request was received")
-
-	// Simple predictable headers
-	expectHeaders := map[string]string{
-		"X-CloudTasks-TaskExecutionCount": "0",
-		"X-CloudTasks-TaskRetryCount":     "0",
-		"X-CloudTasks-TaskName":           "my-test-task",
-		"X-CloudTasks-QueueName":          "test",
+	queueNames := map[string]string{
+		"never existed": formatQueueName(formattedParent, "missing"),
+		"deleted":       deletedQueue.GetName(),
 	}
-	actualHeaders := make(map[string]string)
-	for hdr := range expectHeaders {
-		actualHeaders[hdr] = receivedRequest.Header.Get(hdr)
+	for operation, call := range queueOperations {
+		for description, name := range queueNames {
+			t.Run(operation+" "+description, func(t *testing.T) {
+				rsp, ok := grpcStatus.FromError(call(name))
+				require.True(t, ok, "Should be grpc error")
+				assert.Equal(t, grpcCodes.NotFound, rsp.Code())
+			})
+		}
 	}
 
-	assert.Equal(t, expectHeaders, actualHeaders)
-	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-CloudTasks-TaskETA"))
-
-	srv.Shutdown(context.Background())
+	taskNames := map[string]string{
+		"never existed": createdQueue.GetName() + "/tasks/missing",
+		"deleted":       deletedTask.GetName(),
+	}
+	for operation, call := range taskOperations {
+		for description, name := range taskNames {
+			t.Run(operation+" "+description, func(t *testing.T) {
+				rsp, ok := grpcStatus.FromError(call(name))
+				require.True(t, ok, "Should be grpc error")
+				assert.Equal(t, grpcCodes.NotFound, rsp.Code())
+			})
+		}
+	}
 }
 
-func TestSuccessAppEngineTaskExecution(t *testing.T) {
+func TestPurgeQueueSetsPurgeTime(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
 
-	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
-	os.Setenv("APP_ENGINE_EMULATOR_HOST", "http://localhost:5000")
-
-	var receivedRequest *http.Request
-
+	receivedRequests := &requestRecorder{}
 	srv := startTestServer(
-		func(req *http.Request) { receivedRequest = req },
+		receivedRequests.record,
 		func(req *http.Request) {},
 	)
-
 	defer srv.Shutdown(context.Background())
 
 	createdQueue := createTestQueue(t, client)
+	assert.Nil(t, createdQueue.GetPurgeTime())
 
-	createTaskRequest := taskspb.CreateTaskRequest{
+	beforePurge := time.Now().Unix()
+	purgedQueue, err := client.PurgeQueue(context.Background(), &taskspb.PurgeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.True(t, purgedQueue.GetPurgeTime().GetSeconds() >= beforePurge)
+
+	gotQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, purgedQueue.GetPurgeTime(), gotQueue.GetPurgeTime())
+
+	// Tasks created after the purge are dispatched as usual
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
-			Name: createdQueue.GetName() + "/tasks/my-test-task",
-			MessageType: &taskspb.Task_AppEngineHttpRequest{
-				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
-					RelativeUri: "/success",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/success",
 				},
 			},
 		},
-	}
-
-	createdTask, _ := client.CreateTask(context.Background(), &createTaskRequest)
+	})
+	require.NoError(t, err)
 
-	// Need to give it a chance to make the actual call
 	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, receivedRequests.count())
+}
 
-	assert.NotNil(t, createdTask)
+func TestCreateTaskAutoCreatesQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
 
-	expectHeaders := map[string]string{
-		"X-AppEngine-TaskExecutionCount": "0",
-		"X-AppEngine-TaskRetryCount":     "0",
-		"X-AppEngine-TaskName":           "my-test-task",
-		"X-AppEngine-QueueName":          "test",
+	newTaskRequest := func(queueName string) *taskspb.CreateTaskRequest {
+		return &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://www.google.com",
+					},
+				},
+			},
+		}
 	}
-	actualHeaders := make(map[string]string)
 
-	for hdr := range expectHeaders {
-		actualHeaders[hdr] = receivedRequest.Header.Get(hdr)
+	strictQueueName := formatQueueName(formattedParent, "strict")
+	_, err := client.CreateTask(context.Background(), newTaskRequest(strictQueueName))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: strictQueueName})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	os.Setenv("AUTO_CREATE_QUEUES", "true")
+	defer os.Unsetenv("AUTO_CREATE_QUEUES")
+
+	autoQueueName := formatQueueName(formattedParent, "auto")
+	createdTask, err := client.CreateTask(context.Background(), newTaskRequest(autoQueueName))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(createdTask.GetName(), autoQueueName+"/tasks/"))
+
+	autoQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: autoQueueName})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1000), autoQueue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.Equal(t, int32(100), autoQueue.GetRetryConfig().GetMaxAttempts())
+
+	// The second task goes into the queue created for the first
+	_, err = client.CreateTask(context.Background(), newTaskRequest(autoQueueName))
+	require.NoError(t, err)
+	it := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: autoQueueName})
+	taskCount := 0
+	for _, err := it.Next(); err == nil; _, err = it.Next() {
+		taskCount++
 	}
+	assert.Equal(t, 2, taskCount)
+}
 
-	assert.Equal(t, expectHeaders, actualHeaders)
+func TestListTasksViews(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
 
-	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-AppEngine-TaskETA"))
+	createdQueue := createTestQueue(t, client)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:  "http://www.google.com",
+					Body: []byte("payload"),
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	basicTask, err := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+		Parent: createdQueue.GetName(),
+	}).Next()
+	require.NoError(t, err)
+	assert.Equal(t, createdTask.GetName(), basicTask.GetName())
+	assert.Equal(t, createdTask.GetScheduleTime().GetSeconds(), basicTask.GetScheduleTime().GetSeconds())
+	assert.Equal(t, taskspb.Task_BASIC, basicTask.GetView())
+	assert.Equal(t, "http://www.google.com", basicTask.GetHttpRequest().GetUrl())
+	assert.Empty(t, basicTask.GetHttpRequest().GetBody())
+	assert.Empty(t, basicTask.GetHttpRequest().GetHeaders())
+
+	fullTask, err := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+		Parent:       createdQueue.GetName(),
+		ResponseView: taskspb.Task_FULL,
+	}).Next()
+	require.NoError(t, err)
+	assert.Equal(t, createdTask.GetName(), fullTask.GetName())
+	assert.Equal(t, taskspb.Task_FULL, fullTask.GetView())
+	assert.Equal(t, []byte("payload"), fullTask.GetHttpRequest().GetBody())
 }
 
-func TestErrorTaskExecution(t *testing.T) {
+func TestGetAndCreateTaskViews(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue := createTestQueue(t, client)
+	newTask := func(taskID string) *taskspb.Task {
+		return &taskspb.Task{
+			Name:         createdQueue.GetName() + "/tasks/" + taskID,
+			ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					RelativeUri: "/handler",
+					Headers:     map[string]string{"X-Secret": "secret"},
+					Body:        []byte("payload"),
+				},
+			},
+		}
+	}
+
+	basicTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task:   newTask("basic"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Task_BASIC, basicTask.GetView())
+	assert.Equal(t, "/handler", basicTask.GetAppEngineHttpRequest().GetRelativeUri())
+	assert.Empty(t, basicTask.GetAppEngineHttpRequest().GetBody())
+	assert.Empty(t, basicTask.GetAppEngineHttpRequest().GetHeaders())
+
+	fullTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent:       createdQueue.GetName(),
+		Task:         newTask("full"),
+		ResponseView: taskspb.Task_FULL,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Task_FULL, fullTask.GetView())
+	assert.Equal(t, []byte("payload"), fullTask.GetAppEngineHttpRequest().GetBody())
+	assert.Equal(t, "secret", fullTask.GetAppEngineHttpRequest().GetHeaders()["X-Secret"])
+
+	// The stored task keeps its payload whichever view it was created with
+	gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: basicTask.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Task_BASIC, gettedTask.GetView())
+	assert.Empty(t, gettedTask.GetAppEngineHttpRequest().GetBody())
+
+	gettedTask, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{
+		Name:         basicTask.GetName(),
+		ResponseView: taskspb.Task_FULL,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Task_FULL, gettedTask.GetView())
+	assert.Equal(t, []byte("payload"), gettedTask.GetAppEngineHttpRequest().GetBody())
+	assert.Equal(t, "secret", gettedTask.GetAppEngineHttpRequest().GetHeaders()["X-Secret"])
+}
+
+func BenchmarkListTasks(b *testing.B) {
+	server := NewServer()
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "bench"),
+	})
+	require.NoError(b, err)
+	defer server.Reset()
+
+	scheduleTime := &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()}
+	for i := 0; i < 10000; i++ {
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: scheduleTime,
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url:     "http://www.google.com",
+						Body:    make([]byte, 1024),
+						Headers: map[string]string{"X-Bench": "header"},
+					},
+				},
+			},
+		})
+		require.NoError(b, err)
+	}
+
+	for _, view := range []taskspb.Task_View{taskspb.Task_BASIC, taskspb.Task_FULL} {
+		b.Run(view.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+					Parent:       queue.GetName(),
+					ResponseView: view,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSuccessTaskExecution(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
 
-	called := 0
+	receivedRequests := &requestRecorder{}
 	srv := startTestServer(
+		receivedRequests.record,
 		func(req *http.Request) {},
-		func(req *http.Request) { called++ },
 	)
 
 	createdQueue := createTestQueue(t, client)
@@ -315,9 +910,10 @@ func TestErrorTaskExecution(t *testing.T) {
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/my-test-task",
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
-					Url: "http://localhost:5000/not_found",
+					Url: "http://localhost:5000/success",
 				},
 			},
 		},
@@ -328,127 +924,2415 @@ func TestErrorTaskExecution(t *testing.T) {
 		Name: createdTask.GetName(),
 	}
 
-	time.Sleep(time.Second)
+	// Need to give it a chance to make the actual call
+	time.Sleep(100 * time.Millisecond)
 	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
-	require.NoError(t, err)
+	assert.Error(t, err)
+	assert.Nil(t, gettedTask)
 
-	// at t=0, 0.1, 0.3 (+0.2), 0.7 (+0.4) seconds (plus some buffer) ==> 4 calls
-	assert.EqualValues(t, 4, gettedTask.GetDispatchCount())
-	assert.Equal(t, 4, called)
+	// Validate that the call was actually made properly
+	receivedRequest := receivedRequests.last()
+	require.NotNil(t, receivedRequest, "Request was received")
+
+	// Simple predictable headers
+	expectHeaders := map[string]string{
+		"X-CloudTasks-TaskExecutionCount": "0",
+		"X-CloudTasks-TaskRetryCount":     "0",
+		"X-CloudTasks-TaskName":           "my-test-task",
+		"X-CloudTasks-QueueName":          "test",
+	}
+	actualHeaders := make(map[string]string)
+	for hdr := range expectHeaders {
+		actualHeaders[hdr] = receivedRequest.Header.Get(hdr)
+	}
+
+	assert.Equal(t, expectHeaders, actualHeaders)
+	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-CloudTasks-TaskETA"))
 
 	srv.Shutdown(context.Background())
 }
 
-func TestOIDCAuthenticatedTaskExecution(t *testing.T) {
+func TestSuccessAppEngineTaskExecution(t *testing.T) {
 	serv, client := setUp(t)
 	defer tearDown(t, serv)
 
-	OpenIDConfig.IssuerURL = "http://localhost:8980"
+	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
+	os.Setenv("APP_ENGINE_EMULATOR_HOST", "http://localhost:5000")
+
+	receivedRequests := &requestRecorder{}
 
-	var receivedRequest *http.Request
 	srv := startTestServer(
-		func(req *http.Request) { receivedRequest = req },
+		receivedRequests.record,
 		func(req *http.Request) {},
 	)
 
+	defer srv.Shutdown(context.Background())
+
 	createdQueue := createTestQueue(t, client)
 
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
-			MessageType: &taskspb.Task_HttpRequest{
-				HttpRequest: &taskspb.HttpRequest{
-					Url: "http://localhost:5000/success?foo=bar",
-					AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
-						OidcToken: &taskspb.OidcToken{
-							ServiceAccountEmail: "emulator@service.test",
-						},
-					},
+			Name: createdQueue.GetName() + "/tasks/my-test-task",
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					RelativeUri: "/success",
 				},
 			},
 		},
 	}
-	_, err := client.CreateTask(context.Background(), &createTaskRequest)
-	require.NoError(t, err)
+
+	createdTask, _ := client.CreateTask(context.Background(), &createTaskRequest)
 
 	// Need to give it a chance to make the actual call
 	time.Sleep(100 * time.Millisecond)
 
-	// Validate that the call was actually made properly
-	assert.NotNil(t, receivedRequest, "Request was received")
-	authHeader := receivedRequest.Header.Get("Authorization")
-	assert.NotNil(t, authHeader, "Has Authorization header")
-	assert.Regexp(t, "^Bearer [a-zA-Z0-9_-]+\\.[a-zA-Z0-9_-]+\\.[a-zA-Z0-9_-]+$", authHeader)
-	tokenStr := strings.Replace(authHeader, "Bearer ", "", 1)
+	assert.NotNil(t, createdTask)
 
-	// Full token validation is done in the docker smoketests and the oidc internal tests
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenStr, &OpenIDConnectClaims{})
-	require.NoError(t, err)
+	receivedRequest := receivedRequests.last()
+	require.NotNil(t, receivedRequest, "Request was received")
 
-	claims := token.Claims.(*OpenIDConnectClaims)
-	assert.Equal(t, "http://localhost:5000/success?foo=bar", claims.Audience, "Specifies audience")
-	assert.Equal(t, "emulator@service.test", claims.Email, "Specifies email")
-	assert.Equal(t, "http://localhost:8980", claims.Issuer, "Specifies issuer")
+	expectHeaders := map[string]string{
+		"X-AppEngine-TaskExecutionCount": "0",
+		"X-AppEngine-TaskRetryCount":     "0",
+		"X-AppEngine-TaskName":           "my-test-task",
+		"X-AppEngine-QueueName":          "test",
+	}
+	actualHeaders := make(map[string]string)
 
-	srv.Shutdown(context.Background())
-}
+	for hdr := range expectHeaders {
+		actualHeaders[hdr] = receivedRequest.Header.Get(hdr)
+	}
 
-func newQueue(formattedParent, name string) *taskspb.Queue {
-	return &taskspb.Queue{Name: formatQueueName(formattedParent, name)}
-}
+	assert.Equal(t, expectHeaders, actualHeaders)
 
-func formatQueueName(formattedParent, name string) string {
-	return fmt.Sprintf("%s/queues/%s", formattedParent, name)
+	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-AppEngine-TaskETA"))
 }
 
-func formatParent(project, location string) string {
-	return fmt.Sprintf("projects/%s/locations/%s", project, location)
-}
+func TestErrorTaskExecution(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
 
-func assertIsRecentTimestamp(t *testing.T, etaString string) {
-	assert.Regexp(t, "^[0-9]+\\.[0-9]+$", etaString)
-	float, err := strconv.ParseFloat(etaString, 64)
+	calls := &requestRecorder{}
+	srv := startTestServer(
+		func(req *http.Request) {},
+		calls.record,
+	)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+
+	getTaskRequest := taskspb.GetTaskRequest{
+		Name: createdTask.GetName(),
+	}
+
+	time.Sleep(time.Second)
+	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
 	require.NoError(t, err)
-	seconds, fraction := math.Modf(float)
-	etaTime := time.Unix(int64(seconds), int64(fraction*1e9))
 
-	assert.WithinDuration(
-		t,
-		time.Now(),
-		etaTime,
-		2*time.Second,
-		"task eta should be within last few seconds",
-	)
+	// at t=0, 0.1, 0.3 (+0.2), 0.7 (+0.4) seconds (plus some buffer) ==> 4 calls
+	assert.EqualValues(t, 4, gettedTask.GetDispatchCount())
+	assert.Equal(t, 4, calls.count())
+
+	srv.Shutdown(context.Background())
 }
 
-func createTestQueue(t *testing.T, client *Client) *taskspb.Queue {
-	queue := newQueue(formattedParent, "test")
+func TestDispatchHeadersCountRetriesAndExecutions(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
 
-	createQueueRequest := taskspb.CreateQueueRequest{
+	// Two 5XX failures, one other failure, then success
+	responses := []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusNotFound, http.StatusOK}
+	var mux sync.Mutex
+	var received []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		w.WriteHeader(responses[len(received)])
+		received = append(received, req.Header)
+	}))
+	defer srv.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: &duration.Duration{Nanos: 10000000},
+		MaxBackoff: &duration.Duration{Nanos: 10000000},
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
 		Parent: formattedParent,
 		Queue:  queue,
-	}
+	})
+	require.NoError(t, err)
 
-	createdQueue, err := client.CreateQueue(context.Background(), &createQueueRequest)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/my-test-task",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: srv.URL,
+					Headers: map[string]string{
+						"x-cloudtasks-taskname": "overridden",
+						"X-Custom":              "kept",
+					},
+				},
+			},
+		},
+	})
 	require.NoError(t, err)
 
-	return createdQueue
+	time.Sleep(500 * time.Millisecond)
+
+	mux.Lock()
+	defer mux.Unlock()
+	require.Len(t, received, 4)
+	for i, expected := range []struct {
+		retryCount     string
+		executionCount string
+	}{
+		{"0", "0"},
+		{"1", "0"},
+		{"2", "0"},
+		{"3", "1"},
+	} {
+		assert.Equal(t, expected.retryCount, received[i].Get("X-CloudTasks-TaskRetryCount"), "Attempt %d", i)
+		assert.Equal(t, expected.executionCount, received[i].Get("X-CloudTasks-TaskExecutionCount"), "Attempt %d", i)
+		assert.Equal(t, []string{"my-test-task"}, received[i].Values("X-CloudTasks-TaskName"), "Attempt %d", i)
+		assert.Equal(t, "test", received[i].Get("X-CloudTasks-QueueName"), "Attempt %d", i)
+		assert.Equal(t, "kept", received[i].Get("X-Custom"), "Attempt %d", i)
+	}
+
+	scheduled, _ := ptypes.Timestamp(createdTask.GetScheduleTime())
+	assert.Equal(t, fmt.Sprintf("%f", float64(scheduled.UnixNano())/1e9), received[0].Get("X-CloudTasks-TaskETA"))
 }
 
-func startTestServer(successCallback serverRequestCallback, notFoundCallback serverRequestCallback) *http.Server {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/success", func(w http.ResponseWriter, r *http.Request) {
-		successCallback(r)
-		w.WriteHeader(200)
-	})
-	mux.HandleFunc("/not_found", func(w http.ResponseWriter, r *http.Request) {
-		notFoundCallback(r)
-		w.WriteHeader(404)
+func TestAppEngineDispatchHeadersCountRetriesAndExecutions(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	// A 5XX failure, another failure, then success
+	responses := []int{http.StatusServiceUnavailable, http.StatusConflict, http.StatusOK}
+	var mux sync.Mutex
+	var received []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		w.WriteHeader(responses[len(received)])
+		received = append(received, req.Header)
+	}))
+	defer srv.Close()
+
+	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
+	os.Setenv("APP_ENGINE_EMULATOR_HOST", srv.URL)
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: &duration.Duration{Nanos: 10000000},
+		MaxBackoff: &duration.Duration{Nanos: 10000000},
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
 	})
+	require.NoError(t, err)
 
-	srv := &http.Server{Addr: "localhost:5000", Handler: mux}
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/my-test-task",
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					RelativeUri: "/work",
+					Headers: map[string]string{
+						"X-AppEngine-QueueName": "spoofed",
+						"X-Google-Something":    "spoofed",
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
 
-	go srv.ListenAndServe()
+	time.Sleep(500 * time.Millisecond)
+
+	mux.Lock()
+	defer mux.Unlock()
+	require.Len(t, received, 3)
+	for i, expected := range []struct {
+		retryCount     string
+		executionCount string
+	}{
+		{"0", "0"},
+		{"1", "0"},
+		{"2", "1"},
+	} {
+		assert.Equal(t, expected.retryCount, received[i].Get("X-AppEngine-TaskRetryCount"), "Attempt %d", i)
+		assert.Equal(t, expected.executionCount, received[i].Get("X-AppEngine-TaskExecutionCount"), "Attempt %d", i)
+		assert.Equal(t, "my-test-task", received[i].Get("X-AppEngine-TaskName"), "Attempt %d", i)
+		assert.Equal(t, []string{"test"}, received[i].Values("X-AppEngine-QueueName"), "Attempt %d", i)
+		assert.Empty(t, received[i].Get("X-Google-Something"), "Attempt %d", i)
+		assertIsRecentTimestamp(t, received[i].Get("X-AppEngine-TaskETA"))
+	}
+}
+
+func TestTaskStopsRetryingAtMaxAttempts(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	failedRequests := &requestRecorder{}
+	srv := startTestServer(
+		func(req *http.Request) {},
+		failedRequests.record,
+	)
+	defer srv.Shutdown(context.Background())
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 3,
+		MinBackoff:  &duration.Duration{Nanos: 10000000},
+		MaxBackoff:  &duration.Duration{Nanos: 10000000},
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// Plenty of time for more retries, were they to happen
+	time.Sleep(300 * time.Millisecond)
+
+	assert.Equal(t, 3, failedRequests.count())
+
+	// The task is done once it runs out of attempts
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	rsp, ok := grpcStatus.FromError(err)
+	require.True(t, ok, "Should be grpc error")
+	assert.Equal(t, grpcCodes.NotFound, rsp.Code())
+}
+
+func TestMaxTasksPerQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	defer os.Unsetenv("MAX_TASKS_PER_QUEUE")
+	os.Setenv("MAX_TASKS_PER_QUEUE", "2")
+
+	createdQueue := createTestQueue(t, client)
+
+	// Not due straight away, so the tasks are still in the queue for the last one
+	scheduleTime, _ := ptypes.TimestampProto(time.Now().Add(200 * time.Millisecond))
+	createTask := func() error {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: scheduleTime,
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://localhost:5000/success",
+					},
+				},
+			},
+		})
+		return err
+	}
+
+	require.NoError(t, createTask())
+	require.NoError(t, createTask())
+	assert.Equal(t, codes.ResourceExhausted, status.Code(createTask()))
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 2, receivedRequests.count())
+
+	// There is room again once the tasks are done
+	require.NoError(t, createTask())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 3, receivedRequests.count())
+}
+
+func TestCreateTaskErrorDetails(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	defer os.Unsetenv("MAX_TASK_BODY_SIZE")
+	os.Setenv("MAX_TASK_BODY_SIZE", "10")
+	defer os.Unsetenv("MAX_TASKS_PER_QUEUE")
+	os.Setenv("MAX_TASKS_PER_QUEUE", "1")
+
+	createdQueue := createTestQueue(t, client)
+	createTask := func(httpRequest *taskspb.HttpRequest) error {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: httpRequest,
+				},
+			},
+		})
+		return err
+	}
+
+	for field, httpRequest := range map[string]*taskspb.HttpRequest{
+		"task.http_request.url":  {},
+		"task.http_request.body": {Url: "http://www.google.com", Body: []byte("more than ten bytes")},
+	} {
+		st := status.Convert(createTask(httpRequest))
+		assert.Equal(t, codes.InvalidArgument, st.Code())
+		require.Len(t, st.Details(), 1)
+		badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+		require.True(t, ok, "Should be a BadRequest detail")
+		require.Len(t, badRequest.GetFieldViolations(), 1)
+		assert.Equal(t, field, badRequest.GetFieldViolations()[0].GetField())
+		assert.Equal(t, st.Message(), badRequest.GetFieldViolations()[0].GetDescription())
+	}
+
+	require.NoError(t, createTask(&taskspb.HttpRequest{Url: "http://www.google.com"}))
+	st := status.Convert(createTask(&taskspb.HttpRequest{Url: "http://www.google.com"}))
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	quotaFailure, ok := st.Details()[0].(*errdetails.QuotaFailure)
+	require.True(t, ok, "Should be a QuotaFailure detail")
+	require.Len(t, quotaFailure.GetViolations(), 1)
+	assert.Equal(t, createdQueue.GetName(), quotaFailure.GetViolations()[0].GetSubject())
+}
+
+func TestGlobalMaxConcurrentDispatches(t *testing.T) {
+	defer os.Unsetenv("GLOBAL_MAX_CONCURRENT_DISPATCHES")
+	os.Setenv("GLOBAL_MAX_CONCURRENT_DISPATCHES", "5")
+
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	var mux sync.Mutex
+	inFlight, maxInFlight, dispatched := 0, 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mux.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mux.Lock()
+		inFlight--
+		dispatched++
+		mux.Unlock()
+	}))
+	defer srv.Close()
+
+	for _, queueID := range []string{"first", "second"} {
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, queueID),
+		})
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+				Parent: createdQueue.GetName(),
+				Task: &taskspb.Task{
+					MessageType: &taskspb.Task_HttpRequest{
+						HttpRequest: &taskspb.HttpRequest{
+							Url: srv.URL,
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	// At least 4 rounds of 5 dispatches
+	time.Sleep(500 * time.Millisecond)
+
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, 20, dispatched)
+	assert.True(t, maxInFlight <= 5, "At most 5 dispatches in flight, got %d", maxInFlight)
+}
+
+func TestTaskBodyTemplate(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	// Ignores the retries of tasks left behind by other tests
+	failedRequests := &requestRecorder{}
+	srv := startTestServer(
+		func(req *http.Request) {},
+		func(req *http.Request) {
+			if strings.HasPrefix(req.Header.Get("X-CloudTasks-TaskName"), "templated") {
+				failedRequests.record(req)
+			}
+		},
+	)
+	defer srv.Shutdown(context.Background())
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 3,
+		MinBackoff:  &duration.Duration{Nanos: 10000000},
+		MaxBackoff:  &duration.Duration{Nanos: 10000000},
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	taskName := createdQueue.GetName() + "/tasks/templated"
+	body := `{"task": "{{.TaskName}}", "retry": {{.RetryCount}}}`
+	for _, templated := range []bool{false, true} {
+		headers := map[string]string{}
+		if templated {
+			headers["X-Emulator-Body-Template"] = "true"
+		}
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name: taskName + fmt.Sprint(templated),
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url:     "http://localhost:5000/not_found",
+						Body:    []byte(body),
+						Headers: headers,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	bodies := failedRequests.allBodies()
+	require.Len(t, bodies, 6)
+	// Passes through untouched unless opted in
+	assert.Equal(t, []string{body, body, body}, bodies[:3])
+	assert.Equal(t, []string{
+		`{"task": "` + taskName + `true", "retry": 0}`,
+		`{"task": "` + taskName + `true", "retry": 1}`,
+		`{"task": "` + taskName + `true", "retry": 2}`,
+	}, bodies[3:])
+	for _, req := range failedRequests.all() {
+		assert.Empty(t, req.Header.Get("X-Emulator-Body-Template"))
+	}
+}
+
+func TestTaskRetriedOnRedirect(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	successRequests := &requestRecorder{}
+	srv := startTestServer(
+		successRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	redirectRequests := &requestRecorder{}
+	redirectSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		redirectRequests.record(req)
+		http.Redirect(w, req, "http://localhost:5000/success", http.StatusFound)
+	}))
+	defer redirectSrv.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 2,
+		MinBackoff:  &duration.Duration{Nanos: 10000000},
+		MaxBackoff:  &duration.Duration{Nanos: 10000000},
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: redirectSrv.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+
+	// The redirect counts as a failed attempt, and isn't followed
+	assert.Equal(t, 2, redirectRequests.count())
+	assert.Equal(t, 0, successRequests.count())
+}
+
+func TestTaskRetriesUnlimitedAttempts(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	failedRequests := &requestRecorder{}
+	srv := startTestServer(
+		func(req *http.Request) {},
+		failedRequests.record,
+	)
+	defer srv.Shutdown(context.Background())
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: -1,
+		MinBackoff:  &duration.Duration{Nanos: 10000000},
+		MaxBackoff:  &duration.Duration{Nanos: 10000000},
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+
+	assert.True(t, failedRequests.count() > 3, "Keeps retrying")
+
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+}
+
+func TestTaskCreateTime(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	failingSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingSrv.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: -1,
+		MinBackoff:  &duration.Duration{Nanos: 10000000},
+		MaxBackoff:  &duration.Duration{Nanos: 10000000},
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	// The create time is truncated to seconds, like Cloud Tasks does
+	before := time.Now().Truncate(time.Second)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: failingSrv.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	after := time.Now()
+
+	createTime, err := ptypes.Timestamp(createdTask.GetCreateTime())
+	require.NoError(t, err)
+	assert.False(t, createTime.Before(before), "Created at %v, not before %v", createTime, before)
+	assert.False(t, createTime.After(after), "Created at %v, not after %v", createTime, after)
+
+	// Scheduled straight away when the schedule time is omitted
+	scheduleTime, err := ptypes.Timestamp(createdTask.GetScheduleTime())
+	require.NoError(t, err)
+	assert.False(t, scheduleTime.Before(createTime))
+	assert.False(t, scheduleTime.After(after))
+
+	// Preserved across retries
+	time.Sleep(100 * time.Millisecond)
+
+	gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.True(t, gettedTask.GetDispatchCount() > 1, "Was retried")
+	assert.Equal(t, createdTask.GetCreateTime(), gettedTask.GetCreateTime())
+
+	listedTask, err := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: createdQueue.GetName()}).Next()
+	require.NoError(t, err)
+	assert.Equal(t, createdTask.GetCreateTime(), listedTask.GetCreateTime())
+
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+}
+
+func TestDeleteTaskAbortsInFlightRequest(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	started := make(chan bool, 1)
+	aborted := make(chan bool, 1)
+	slowSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		select {
+		case <-req.Context().Done():
+			aborted <- true
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slowSrv.Close()
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: slowSrv.URL,
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		require.Fail(t, "Request was not received")
+	}
+
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		require.Fail(t, "Request was not aborted")
+	}
+
+	// Not retried, as the task no longer exists
+	select {
+	case <-started:
+		assert.Fail(t, "Task was retried")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDeadLetterOnRetriesExhausted(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	srv := startTestServer(
+		func(req *http.Request) {},
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	deadLetters := make(chan DeadLetter, 1)
+	deadLetterSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var deadLetter DeadLetter
+		json.NewDecoder(req.Body).Decode(&deadLetter)
+		deadLetters <- deadLetter
+	}))
+	defer deadLetterSrv.Close()
+
+	defer os.Unsetenv("DEAD_LETTER_URL_DEAD_LETTERED")
+	os.Setenv("DEAD_LETTER_URL_DEAD_LETTERED", deadLetterSrv.URL)
+
+	queue := newQueue(formattedParent, "dead-lettered")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 2}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	select {
+	case deadLetter := <-deadLetters:
+		assert.Equal(t, createdTask.GetName(), deadLetter.TaskName)
+		assert.Equal(t, createdQueue.GetName(), deadLetter.QueueName)
+		assert.Equal(t, 404, deadLetter.StatusCode)
+		assert.EqualValues(t, 2, deadLetter.DispatchCount)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Dead letter was not received")
+	}
+}
+
+func TestDeadLetterQueueOnRetriesExhausted(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	defer os.Unsetenv("DEAD_LETTER_QUEUE_FAILING")
+	os.Setenv("DEAD_LETTER_QUEUE_FAILING", "dead-letters")
+
+	// Paused so that the dead letters stay in it
+	deadLetterQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "dead-letters"),
+	})
+	require.NoError(t, err)
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: deadLetterQueue.GetName()})
+	require.NoError(t, err)
+
+	queue := newQueue(formattedParent, "failing")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 2}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:  "http://localhost:5000/not_found",
+					Body: []byte("payload"),
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	var deadLetter *taskspb.Task
+	assert.Eventually(t, func() bool {
+		deadLetter, err = client.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+			Parent:       deadLetterQueue.GetName(),
+			ResponseView: taskspb.Task_FULL,
+		}).Next()
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "http://localhost:5000/not_found", deadLetter.GetHttpRequest().GetUrl())
+	assert.Equal(t, []byte("payload"), deadLetter.GetHttpRequest().GetBody())
+	assert.EqualValues(t, 0, deadLetter.GetDispatchCount())
+}
+
+func TestFailedTaskPublishedToPubSub(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	srv := startTestServer(
+		func(req *http.Request) {},
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	type publishRequest struct {
+		Messages []struct {
+			Data       []byte            `json:"data"`
+			Attributes map[string]string `json:"attributes"`
+		} `json:"messages"`
+	}
+	published := make(chan publishRequest, 1)
+	paths := make(chan string, 1)
+	pubsubSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var publish publishRequest
+		json.NewDecoder(req.Body).Decode(&publish)
+		paths <- req.URL.Path
+		published <- publish
+	}))
+	defer pubsubSrv.Close()
+
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(pubsubSrv.URL, "http://"))
+	defer os.Unsetenv("FAILED_TASK_TOPIC_ARCHIVED")
+	os.Setenv("FAILED_TASK_TOPIC_ARCHIVED", "failed-tasks")
+
+	queue := newQueue(formattedParent, "archived")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:     "http://localhost:5000/not_found",
+					Headers: map[string]string{"X-Job": "archive-me"},
+					Body:    []byte("payload"),
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	select {
+	case publish := <-published:
+		assert.Equal(t, "/v1/projects/TestProject/topics/failed-tasks:publish", <-paths)
+		require.Len(t, publish.Messages, 1)
+		assert.Equal(t, createdTask.GetName(), publish.Messages[0].Attributes["taskName"])
+
+		var failedTask FailedTask
+		require.NoError(t, json.Unmarshal(publish.Messages[0].Data, &failedTask))
+		assert.Equal(t, createdTask.GetName(), failedTask.TaskName)
+		assert.Equal(t, createdQueue.GetName(), failedTask.QueueName)
+		assert.Equal(t, "http://localhost:5000/not_found", failedTask.URL)
+		assert.Equal(t, "archive-me", failedTask.Headers["X-Job"])
+		assert.Equal(t, []byte("payload"), failedTask.Body)
+		assert.Equal(t, 404, failedTask.StatusCode)
+		assert.EqualValues(t, 1, failedTask.DispatchCount)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Failed task was not published")
+	}
+}
+
+func TestQueueEvents(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	events := make(chan QueueEvent, 1)
+	eventsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event QueueEvent
+		json.NewDecoder(req.Body).Decode(&event)
+		events <- event
+	}))
+	defer eventsSrv.Close()
+
+	defer os.Unsetenv("QUEUE_EVENTS_URL_EVENTFUL")
+	os.Setenv("QUEUE_EVENTS_URL_EVENTFUL", eventsSrv.URL)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "eventful"),
+	})
+	require.NoError(t, err)
+	name := createdQueue.GetName()
+
+	expectEvent := func(event string, state string) {
+		select {
+		case received := <-events:
+			assert.Equal(t, name, received.QueueName)
+			assert.Equal(t, event, received.Event)
+			assert.Equal(t, state, received.State)
+			assert.WithinDuration(t, time.Now(), received.Time, time.Second)
+		case <-time.After(time.Second):
+			assert.Fail(t, "Queue event was not received", event)
+		}
+	}
+
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: name})
+	require.NoError(t, err)
+	expectEvent(QueuePausedEvent, "PAUSED")
+
+	// Already paused, so nothing changes
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: name})
+	require.NoError(t, err)
+
+	_, err = client.PurgeQueue(context.Background(), &taskspb.PurgeQueueRequest{Name: name})
+	require.NoError(t, err)
+	expectEvent(QueuePurgedEvent, "PAUSED")
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: name})
+	require.NoError(t, err)
+	expectEvent(QueueResumedEvent, "RUNNING")
+
+	require.NoError(t, client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: name}))
+	expectEvent(QueueDeletedEvent, "DELETED")
+}
+
+func TestQueueDefaultHeaders(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	defer os.Unsetenv("DEFAULT_HEADERS_TEST")
+	os.Setenv("DEFAULT_HEADERS_TEST", `{"X-Environment": "local", "X-Team": "queue"}`)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:     "http://localhost:5000/success",
+					Headers: map[string]string{"x-team": "task"},
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// Need to give it a chance to make the actual call
+	time.Sleep(100 * time.Millisecond)
+
+	receivedRequest := receivedRequests.last()
+	require.NotNil(t, receivedRequest, "Request was received")
+	assert.Equal(t, "local", receivedRequest.Header.Get("X-Environment"), "Inherits queue default")
+	assert.Equal(t, []string{"task"}, receivedRequest.Header["X-Team"], "Task header takes precedence")
+}
+
+func TestQueueStackdriverLoggingConfig(t *testing.T) {
+	serv, client, emulatorServer := setUpServer(t)
+	defer tearDownServer(t, serv, emulatorServer)
+
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  withSamplingRatio(newQueue(formattedParent, "test"), 1.5),
+	})
+	rsp, ok := grpcStatus.FromError(err)
+	require.True(t, ok, "Should be grpc error")
+	assert.Equal(t, grpcCodes.InvalidArgument, rsp.Code())
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  withSamplingRatio(newQueue(formattedParent, "test"), 0.25),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, samplingRatio(t, createdQueue))
+
+	gettedQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, samplingRatio(t, gettedQueue))
+
+	updatedQueue, err := client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue:      withSamplingRatio(newQueue(formattedParent, "test"), 0.5),
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"stackdriver_logging_config.sampling_ratio"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, samplingRatio(t, updatedQueue))
+
+	_, err = client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue:      withSamplingRatio(newQueue(formattedParent, "test"), -0.1),
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"stackdriver_logging_config"}},
+	})
+	rsp, ok = grpcStatus.FromError(err)
+	require.True(t, ok, "Should be grpc error")
+	assert.Equal(t, grpcCodes.InvalidArgument, rsp.Code())
+
+	gettedQueue, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, samplingRatio(t, gettedQueue))
+}
+
+func TestQueueAppEngineRoutingOverride(t *testing.T) {
+	serv, client, emulatorServer := setUpServer(t)
+	defer tearDownServer(t, serv, emulatorServer)
+
+	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
+	os.Setenv("APP_ENGINE_EMULATOR_HOST", "http://appengine")
+
+	// The routed hosts don't resolve, so capture the requests with a proxy
+	proxiedRequests := &requestRecorder{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxiedRequests.record(req)
+	}))
+	defer proxy.Close()
+
+	defer os.Unsetenv("OUTBOUND_PROXY_URL")
+	os.Setenv("OUTBOUND_PROXY_URL", proxy.URL)
+
+	queue := newQueue(formattedParent, "test")
+	queue.AppEngineRoutingOverride = &taskspb.AppEngineRouting{Service: "Not_Valid"}
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	rsp, ok := grpcStatus.FromError(err)
+	require.True(t, ok, "Should be grpc error")
+	assert.Equal(t, grpcCodes.InvalidArgument, rsp.Code())
+
+	queue.AppEngineRoutingOverride = &taskspb.AppEngineRouting{Service: "worker", Version: "v1"}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://v1.worker.appengine", createdQueue.GetAppEngineRoutingOverride().GetHost())
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					RelativeUri:      "/work",
+					AppEngineRouting: &taskspb.AppEngineRouting{Service: "other"},
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// Need to give it a chance to make the actual call
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Contains(t, proxiedRequests.urls(), "http://v1.worker.appengine/work", "Queue override takes precedence")
+
+	updatedQueue, err := client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name:                     createdQueue.GetName(),
+			AppEngineRoutingOverride: &taskspb.AppEngineRouting{Service: "updated"},
+		},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"app_engine_routing_override"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://updated.appengine", updatedQueue.GetAppEngineRoutingOverride().GetHost())
+
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Contains(t, proxiedRequests.urls(), "http://updated.appengine/work", "Updated override applies")
+}
+
+func TestTaskBodyByHTTPMethod(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	createdQueue := createTestQueue(t, client)
+
+	testCases := []struct {
+		name                string
+		method              taskspb.HttpMethod
+		body                string
+		headers             map[string]string
+		expectedBody        string
+		expectedContentType string
+	}{
+		{
+			name:                "POST without content type",
+			method:              taskspb.HttpMethod_POST,
+			body:                "post body",
+			expectedBody:        "post body",
+			expectedContentType: "application/octet-stream",
+		},
+		{
+			name:                "PUT",
+			method:              taskspb.HttpMethod_PUT,
+			body:                "put body",
+			expectedBody:        "put body",
+			expectedContentType: "application/octet-stream",
+		},
+		{
+			name:                "PATCH with content type",
+			method:              taskspb.HttpMethod_PATCH,
+			body:                `{"patch": true}`,
+			headers:             map[string]string{"content-type": "application/json"},
+			expectedBody:        `{"patch": true}`,
+			expectedContentType: "application/json",
+		},
+		{
+			name:   "DELETE with body",
+			method: taskspb.HttpMethod_DELETE,
+			body:   "ignored",
+		},
+		{
+			name:   "GET without body",
+			method: taskspb.HttpMethod_GET,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			createTaskRequest := taskspb.CreateTaskRequest{
+				Parent: createdQueue.GetName(),
+				Task: &taskspb.Task{
+					MessageType: &taskspb.Task_HttpRequest{
+						HttpRequest: &taskspb.HttpRequest{
+							Url:        "http://localhost:5000/success",
+							HttpMethod: tc.method,
+							Body:       []byte(tc.body),
+							Headers:    tc.headers,
+						},
+					},
+				},
+			}
+			_, err := client.CreateTask(context.Background(), &createTaskRequest)
+			require.NoError(t, err)
+
+			// Need to give it a chance to make the actual call
+			time.Sleep(100 * time.Millisecond)
+
+			receivedRequest := receivedRequests.last()
+			require.NotNil(t, receivedRequest, "Request was received")
+			assert.Equal(t, tc.method.String(), receivedRequest.Method)
+			assert.Equal(t, tc.expectedBody, string(receivedRequests.lastBody()))
+			assert.Equal(t, tc.expectedContentType, receivedRequest.Header.Get("Content-Type"))
+			assert.Equal(t, int64(len(tc.expectedBody)), receivedRequest.ContentLength)
+			assert.Empty(t, receivedRequest.TransferEncoding)
+		})
+	}
+}
+
+func TestTaskBodyChunked(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	defer os.Unsetenv("OUTBOUND_CHUNKED")
+	os.Setenv("OUTBOUND_CHUNKED", "true")
+
+	createdQueue := createTestQueue(t, client)
+	_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:  "http://localhost:5000/success",
+					Body: []byte("chunked body"),
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	receivedRequest := receivedRequests.last()
+	require.NotNil(t, receivedRequest, "Request was received")
+	assert.Equal(t, []string{"chunked"}, receivedRequest.TransferEncoding)
+	assert.Equal(t, int64(-1), receivedRequest.ContentLength)
+	assert.Equal(t, "chunked body", string(receivedRequests.lastBody()))
+}
+
+func TestOIDCAuthenticatedTaskExecution(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	OpenIDConfig.IssuerURL = "http://localhost:8980"
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/success?foo=bar",
+					AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
+						OidcToken: &taskspb.OidcToken{
+							ServiceAccountEmail: "emulator@service.test",
+						},
+					},
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// Need to give it a chance to make the actual call
+	time.Sleep(100 * time.Millisecond)
+
+	// Validate that the call was actually made properly
+	receivedRequest := receivedRequests.last()
+	require.NotNil(t, receivedRequest, "Request was received")
+	authHeader := receivedRequest.Header.Get("Authorization")
+	assert.NotNil(t, authHeader, "Has Authorization header")
+	assert.Regexp(t, "^Bearer [a-zA-Z0-9_-]+\\.[a-zA-Z0-9_-]+\\.[a-zA-Z0-9_-]+$", authHeader)
+	tokenStr := strings.Replace(authHeader, "Bearer ", "", 1)
+
+	// Full token validation is done in the docker smoketests and the oidc internal tests
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenStr, &OpenIDConnectClaims{})
+	require.NoError(t, err)
+
+	claims := token.Claims.(*OpenIDConnectClaims)
+	assert.Equal(t, "http://localhost:5000/success?foo=bar", claims.Audience, "Specifies audience")
+	assert.Equal(t, "emulator@service.test", claims.Email, "Specifies email")
+	assert.Equal(t, "http://localhost:8980", claims.Issuer, "Specifies issuer")
+
+	srv.Shutdown(context.Background())
+}
+
+func TestTasksDispatchedInETAOrder(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	queue := newQueue(formattedParent, "test")
+	queue.RateLimits = &taskspb.RateLimits{MaxConcurrentDispatches: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	// Hold off dispatching until all tasks are due
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	now := time.Now()
+	for _, secondsAgo := range []int64{20, 40, 10, 30} {
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name:         fmt.Sprintf("%s/tasks/task-%d", createdQueue.GetName(), secondsAgo),
+				ScheduleTime: &timestamp.Timestamp{Seconds: now.Unix() - secondsAgo},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://localhost:5000/success",
+					},
+				},
+			},
+		}
+		_, err := client.CreateTask(context.Background(), &createTaskRequest)
+		require.NoError(t, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	// Need to give it a chance to make the actual calls
+	time.Sleep(200 * time.Millisecond)
+
+	var taskNames []string
+	for _, req := range receivedRequests.all() {
+		taskNames = append(taskNames, req.Header.Get("X-CloudTasks-TaskName"))
+	}
+	assert.Equal(t, []string{"task-40", "task-30", "task-20", "task-10"}, taskNames)
+}
+
+func TestBufferTask(t *testing.T) {
+	defer os.Unsetenv("HTTP_TARGET_URI_TEST")
+	os.Setenv("HTTP_TARGET_URI_TEST", "http://localhost:5000/success")
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	server := NewServer()
+	createdQueue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	bufferedTask, err := server.BufferTask(context.Background(), createdQueue.GetName(), "my-buffered-task", []byte("hello"), "text/plain")
+	require.NoError(t, err)
+	assert.Equal(t, createdQueue.GetName()+"/tasks/my-buffered-task", bufferedTask.GetName())
+	assert.Equal(t, "http://localhost:5000/success", bufferedTask.GetHttpRequest().GetUrl())
+	assert.Equal(t, taskspb.HttpMethod_POST, bufferedTask.GetHttpRequest().GetHttpMethod())
+
+	// Need to give it a chance to make the actual call
+	time.Sleep(100 * time.Millisecond)
+
+	receivedRequest := receivedRequests.last()
+	require.NotNil(t, receivedRequest, "Request was received")
+	assert.Equal(t, "text/plain", receivedRequest.Header.Get("Content-Type"))
+	assert.Equal(t, "my-buffered-task", receivedRequest.Header.Get("X-CloudTasks-TaskName"))
+}
+
+func TestBufferTaskWithoutHttpTarget(t *testing.T) {
+	server := NewServer()
+	createdQueue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	_, err = server.BufferTask(context.Background(), createdQueue.GetName(), "", []byte("hello"), "")
+
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+}
+
+func TestProxiedTaskExecution(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	receivedRequests := &requestRecorder{}
+	srv := startTestServer(
+		receivedRequests.record,
+		func(req *http.Request) {},
+	)
+	defer srv.Shutdown(context.Background())
+
+	proxiedRequests := &requestRecorder{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxiedRequests.record(req)
+
+		// Forward on to the actual target
+		req.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+	}))
+	defer proxy.Close()
+
+	defer os.Unsetenv("OUTBOUND_PROXY_URL")
+	os.Setenv("OUTBOUND_PROXY_URL", proxy.URL)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/success",
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// Need to give it a chance to make the actual call
+	time.Sleep(100 * time.Millisecond)
+
+	// Retries of tasks left over from other tests will also go through the proxy
+	assert.Contains(t, proxiedRequests.urls(), "http://localhost:5000/success", "Request went through the proxy")
+	assert.Equal(t, 1, receivedRequests.count(), "Request was forwarded to the target")
+}
+
+func newQueue(formattedParent, name string) *taskspb.Queue {
+	return &taskspb.Queue{Name: formatQueueName(formattedParent, name)}
+}
+
+func formatQueueName(formattedParent, name string) string {
+	return fmt.Sprintf("%s/queues/%s", formattedParent, name)
+}
+
+func formatParent(project, location string) string {
+	return fmt.Sprintf("projects/%s/locations/%s", project, location)
+}
+
+func assertIsRecentTimestamp(t *testing.T, etaString string) {
+	assert.Regexp(t, "^[0-9]+\\.[0-9]+$", etaString)
+	float, err := strconv.ParseFloat(etaString, 64)
+	require.NoError(t, err)
+	seconds, fraction := math.Modf(float)
+	etaTime := time.Unix(int64(seconds), int64(fraction*1e9))
+
+	assert.WithinDuration(
+		t,
+		time.Now(),
+		etaTime,
+		2*time.Second,
+		"task eta should be within last few seconds",
+	)
+}
+
+// withSamplingRatio sets Queue.stackdriver_logging_config (field 9) as unknown
+// bytes, the way a client on newer protos would send it
+func withSamplingRatio(queue *taskspb.Queue, ratio float64) *taskspb.Queue {
+	config, _ := proto.Marshal(&taskspbbeta.StackdriverLoggingConfig{SamplingRatio: ratio})
+
+	buf := proto.NewBuffer(nil)
+	buf.EncodeVarint(9<<3 | proto.WireBytes)
+	buf.EncodeRawBytes(config)
+	queue.XXX_unrecognized = buf.Bytes()
+
+	return queue
+}
+
+func samplingRatio(t *testing.T, queue *taskspb.Queue) float64 {
+	buf := proto.NewBuffer(queue.XXX_unrecognized)
+	key, err := buf.DecodeVarint()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9<<3|proto.WireBytes), key)
+	rawConfig, err := buf.DecodeRawBytes(false)
+	require.NoError(t, err)
+
+	config := &taskspbbeta.StackdriverLoggingConfig{}
+	require.NoError(t, proto.Unmarshal(rawConfig, config))
+
+	return config.GetSamplingRatio()
+}
+
+func createTestQueue(t *testing.T, client *Client) *taskspb.Queue {
+	queue := newQueue(formattedParent, "test")
+
+	createQueueRequest := taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	}
+
+	createdQueue, err := client.CreateQueue(context.Background(), &createQueueRequest)
+	require.NoError(t, err)
+
+	return createdQueue
+}
+
+// requestRecorder captures the requests received by a test server, so that
+// they can be safely inspected from the test
+type requestRecorder struct {
+	mux      sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (recorder *requestRecorder) record(req *http.Request) {
+	// The body can only be read while the request is being handled
+	body, _ := ioutil.ReadAll(req.Body)
+
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	recorder.requests = append(recorder.requests, req)
+	recorder.bodies = append(recorder.bodies, body)
+}
+
+func (recorder *requestRecorder) count() int {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	return len(recorder.requests)
+}
+
+func (recorder *requestRecorder) all() []*http.Request {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	return append([]*http.Request(nil), recorder.requests...)
+}
+
+func (recorder *requestRecorder) urls() []string {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	var urls []string
+	for _, req := range recorder.requests {
+		urls = append(urls, req.URL.String())
+	}
+	return urls
+}
+
+func (recorder *requestRecorder) last() *http.Request {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	if len(recorder.requests) == 0 {
+		return nil
+	}
+	return recorder.requests[len(recorder.requests)-1]
+}
+
+func (recorder *requestRecorder) allBodies() []string {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	var bodies []string
+	for _, body := range recorder.bodies {
+		bodies = append(bodies, string(body))
+	}
+	return bodies
+}
+
+func (recorder *requestRecorder) lastBody() []byte {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	if len(recorder.bodies) == 0 {
+		return nil
+	}
+	return recorder.bodies[len(recorder.bodies)-1]
+}
+
+func startTestServer(successCallback serverRequestCallback, notFoundCallback serverRequestCallback) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/success", func(w http.ResponseWriter, r *http.Request) {
+		successCallback(r)
+		w.WriteHeader(200)
+	})
+	mux.HandleFunc("/not_found", func(w http.ResponseWriter, r *http.Request) {
+		notFoundCallback(r)
+		w.WriteHeader(404)
+	})
+
+	srv := &http.Server{Addr: "localhost:5000", Handler: mux}
+	// Avoid the emulator reusing connections to servers from previous tests
+	srv.SetKeepAlivesEnabled(false)
+
+	// Listen right away, so that tasks dispatched before the server goroutine runs are received
+	lis, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		panic(err)
+	}
+	go srv.Serve(lis)
 
 	return srv
 }
+
+func TestV2beta3API(t *testing.T) {
+	ctx := context.Background()
+
+	received := make(chan string, 1)
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("X-CloudTasks-TaskName")
+	}))
+	defer handler.Close()
+
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	betaClient := taskspbbeta.NewCloudTasksClient(conn)
+
+	queueName := formatQueueName(formattedParent, "beta")
+	createdQueue, err := betaClient.CreateQueue(ctx, &taskspbbeta.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspbbeta.Queue{
+			Name: queueName,
+			QueueType: &taskspbbeta.Queue_AppEngineHttpQueue{
+				AppEngineHttpQueue: &taskspbbeta.AppEngineHttpQueue{
+					AppEngineRoutingOverride: &taskspbbeta.AppEngineRouting{Service: "worker"},
+				},
+			},
+			RateLimits:               &taskspbbeta.RateLimits{MaxConcurrentDispatches: 5},
+			StackdriverLoggingConfig: &taskspbbeta.StackdriverLoggingConfig{SamplingRatio: 0.5},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, queueName, createdQueue.GetName())
+	assert.Equal(t, taskspbbeta.Queue_RUNNING, createdQueue.GetState())
+	assert.Equal(t, int32(5), createdQueue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.Equal(t, "worker", createdQueue.GetAppEngineHttpQueue().GetAppEngineRoutingOverride().GetService())
+	assert.Equal(t, 0.5, createdQueue.GetStackdriverLoggingConfig().GetSamplingRatio())
+
+	// Shares the queues of the v2 API
+	v2Queue, err := emulator.Client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, "worker", v2Queue.GetAppEngineRoutingOverride().GetService())
+
+	createdTask, err := betaClient.CreateTask(ctx, &taskspbbeta.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspbbeta.Task{
+			Name: queueName + "/tasks/beta-task",
+			PayloadType: &taskspbbeta.Task_HttpRequest{
+				HttpRequest: &taskspbbeta.HttpRequest{
+					Url:     handler.URL,
+					Headers: map[string]string{"X-Version": "v2beta3"},
+					Body:    []byte("body"),
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, queueName+"/tasks/beta-task", createdTask.GetName())
+	assert.NotNil(t, createdTask.GetCreateTime())
+
+	select {
+	case taskID := <-received:
+		assert.Equal(t, "beta-task", taskID)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Task was not dispatched")
+	}
+
+	listedQueues, err := betaClient.ListQueues(ctx, &taskspbbeta.ListQueuesRequest{Parent: formattedParent})
+	require.NoError(t, err)
+	require.Len(t, listedQueues.GetQueues(), 1)
+	assert.Equal(t, queueName, listedQueues.GetQueues()[0].GetName())
+
+	_, err = betaClient.GetQueue(ctx, &taskspbbeta.GetQueueRequest{Name: formatQueueName(formattedParent, "missing")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestV2beta2PullQueue(t *testing.T) {
+	ctx := context.Background()
+
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	betaClient := taskspbbeta2.NewCloudTasksClient(conn)
+
+	queueName := formatQueueName(formattedParent, "pull")
+	createdQueue, err := betaClient.CreateQueue(ctx, &taskspbbeta2.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspbbeta2.Queue{
+			Name:       queueName,
+			TargetType: &taskspbbeta2.Queue_PullTarget{PullTarget: &taskspbbeta2.PullTarget{}},
+		},
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, createdQueue.GetPullTarget())
+
+	gotQueue, err := betaClient.GetQueue(ctx, &taskspbbeta2.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.NotNil(t, gotQueue.GetPullTarget())
+
+	for _, task := range []struct{ id, tag string }{{"a1", "a"}, {"a2", "a"}, {"b1", "b"}} {
+		_, err := betaClient.CreateTask(ctx, &taskspbbeta2.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspbbeta2.Task{
+				Name: queueName + "/tasks/" + task.id,
+				PayloadType: &taskspbbeta2.Task_PullMessage{
+					PullMessage: &taskspbbeta2.PullMessage{Payload: []byte(task.id), Tag: task.tag},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	lease := func(filter string, leaseDuration time.Duration) []*taskspbbeta2.Task {
+		resp, err := betaClient.LeaseTasks(ctx, &taskspbbeta2.LeaseTasksRequest{
+			Parent:        queueName,
+			MaxTasks:      10,
+			LeaseDuration: ptypes.DurationProto(leaseDuration),
+			Filter:        filter,
+		})
+		require.NoError(t, err)
+		return resp.GetTasks()
+	}
+
+	leased := lease(`tag="a"`, time.Minute)
+	require.Len(t, leased, 2)
+	assert.Equal(t, []byte("a1"), leased[0].GetPullMessage().GetPayload())
+	assert.Equal(t, "a", leased[0].GetPullMessage().GetTag())
+	assert.Equal(t, int32(1), leased[0].GetStatus().GetAttemptDispatchCount())
+	assert.Len(t, lease(`tag="a"`, time.Minute), 0, "Not available again while leased")
+
+	// Acknowledging requires the schedule time of the current lease
+	otherScheduleTime := proto.Clone(leased[0].GetScheduleTime()).(*timestamp.Timestamp)
+	otherScheduleTime.Seconds++
+	_, err = betaClient.AcknowledgeTask(ctx, &taskspbbeta2.AcknowledgeTaskRequest{
+		Name:         leased[0].GetName(),
+		ScheduleTime: otherScheduleTime,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = betaClient.AcknowledgeTask(ctx, &taskspbbeta2.AcknowledgeTaskRequest{
+		Name:         leased[0].GetName(),
+		ScheduleTime: leased[0].GetScheduleTime(),
+	})
+	require.NoError(t, err)
+	_, err = betaClient.GetTask(ctx, &taskspbbeta2.GetTaskRequest{Name: leased[0].GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	renewed, err := betaClient.RenewLease(ctx, &taskspbbeta2.RenewLeaseRequest{
+		Name:          leased[1].GetName(),
+		ScheduleTime:  leased[1].GetScheduleTime(),
+		LeaseDuration: ptypes.DurationProto(2 * time.Minute),
+	})
+	require.NoError(t, err)
+	assert.True(t, renewed.GetScheduleTime().GetSeconds() > leased[1].GetScheduleTime().GetSeconds())
+
+	// The previous lease no longer holds
+	_, err = betaClient.CancelLease(ctx, &taskspbbeta2.CancelLeaseRequest{
+		Name:         leased[1].GetName(),
+		ScheduleTime: leased[1].GetScheduleTime(),
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = betaClient.CancelLease(ctx, &taskspbbeta2.CancelLeaseRequest{
+		Name:         renewed.GetName(),
+		ScheduleTime: renewed.GetScheduleTime(),
+	})
+	require.NoError(t, err)
+
+	leased = lease(`tag="a"`, time.Minute)
+	require.Len(t, leased, 1)
+	assert.Equal(t, queueName+"/tasks/a2", leased[0].GetName())
+	assert.Equal(t, int32(2), leased[0].GetStatus().GetAttemptDispatchCount())
+
+	// Tasks are leased again once their lease expires
+	leased = lease("", 200*time.Millisecond)
+	require.Len(t, leased, 1)
+	assert.Equal(t, queueName+"/tasks/b1", leased[0].GetName())
+	time.Sleep(300 * time.Millisecond)
+	leased = lease(`tag="b"`, time.Minute)
+	require.Len(t, leased, 1)
+	assert.Equal(t, int32(2), leased[0].GetStatus().GetAttemptDispatchCount())
+
+	_, err = betaClient.LeaseTasks(ctx, &taskspbbeta2.LeaseTasksRequest{
+		Parent:        queueName,
+		MaxTasks:      10,
+		LeaseDuration: ptypes.DurationProto(time.Minute),
+		Filter:        "tag_function=oldest_tag",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Pull messages can't be added to push queues
+	pushQueueName := formatQueueName(formattedParent, "push")
+	_, err = betaClient.CreateQueue(ctx, &taskspbbeta2.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  &taskspbbeta2.Queue{Name: pushQueueName},
+	})
+	require.NoError(t, err)
+	_, err = betaClient.CreateTask(ctx, &taskspbbeta2.CreateTaskRequest{
+		Parent: pushQueueName,
+		Task: &taskspbbeta2.Task{
+			PayloadType: &taskspbbeta2.Task_PullMessage{PullMessage: &taskspbbeta2.PullMessage{Payload: []byte("payload")}},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestV2beta3BufferTask(t *testing.T) {
+	ctx := context.Background()
+
+	received := make(chan *http.Request, 1)
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req
+	}))
+	defer handler.Close()
+
+	defer os.Unsetenv("HTTP_TARGET_URI_BUFFERED")
+	os.Setenv("HTTP_TARGET_URI_BUFFERED", handler.URL+"/buffered")
+
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	queue, err := emulator.CreateQueue(ctx, formatQueueName(formattedParent, "buffered"))
+	require.NoError(t, err)
+
+	resp := &BufferTaskResponse{}
+	err = conn.Invoke(ctx, "/google.cloud.tasks.v2beta3.CloudTasks/BufferTask", &BufferTaskRequest{
+		Queue:  queue.GetName(),
+		TaskId: "buffered-task",
+		Body:   &httpbody.HttpBody{ContentType: "text/plain", Data: []byte("hello")},
+	}, resp)
+	require.NoError(t, err)
+	assert.Equal(t, queue.GetName()+"/tasks/buffered-task", resp.Task.GetName())
+	assert.Equal(t, handler.URL+"/buffered", resp.Task.GetHttpRequest().GetUrl())
+
+	select {
+	case req := <-received:
+		assert.Equal(t, "/buffered", req.URL.Path)
+		assert.Equal(t, "text/plain", req.Header.Get("Content-Type"))
+	case <-time.After(time.Second):
+		assert.Fail(t, "Task was not dispatched")
+	}
+
+	// Without an HTTP target
+	otherQueue, err := emulator.CreateQueue(ctx, formatQueueName(formattedParent, "unbuffered"))
+	require.NoError(t, err)
+	err = conn.Invoke(ctx, "/google.cloud.tasks.v2beta3.CloudTasks/BufferTask", &BufferTaskRequest{Queue: otherQueue.GetName()}, resp)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Other unknown methods are still unimplemented
+	err = conn.Invoke(ctx, "/google.cloud.tasks.v2beta3.CloudTasks/UnknownMethod", &BufferTaskRequest{}, resp)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestUpdateQueueReconfiguresRunningQueue(t *testing.T) {
+	ctx := context.Background()
+
+	var mux sync.Mutex
+	attempts := make(map[string]int)
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		attempts[req.URL.Path]++
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer handler.Close()
+	attemptCount := func(path string) int {
+		mux.Lock()
+		defer mux.Unlock()
+		return attempts[path]
+	}
+
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	queue := newQueue(formattedParent, "reconfigured")
+	queue.RateLimits = &taskspb.RateLimits{MaxDispatchesPerSecond: 0.5, MaxBurstSize: 1, MaxConcurrentDispatches: 5}
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: -1,
+		MinBackoff:  ptypes.DurationProto(50 * time.Millisecond),
+		MaxBackoff:  ptypes.DurationProto(50 * time.Millisecond),
+	}
+	createdQueue, err := emulator.Client.CreateQueue(ctx, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), emulator.Server.QueueRoutineCounts()[createdQueue.GetName()].Workers)
+
+	for i := 0; i < 3; i++ {
+		_, err := emulator.Client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: handler.URL + "/success"},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, attemptCount("/success"), "Only the initial token at first")
+
+	// A higher rate retunes the token generator, rather than waiting out the 2s period
+	updatedQueue, err := emulator.Client.UpdateQueue(ctx, &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name:       createdQueue.GetName(),
+			RateLimits: &taskspb.RateLimits{MaxDispatchesPerSecond: 100, MaxConcurrentDispatches: 2},
+		},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"rate_limits"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, float64(100), updatedQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.Equal(t, int32(2), updatedQueue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.Equal(t, int32(1), updatedQueue.GetRateLimits().GetMaxBurstSize(), "Output only")
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 3, attemptCount("/success"), "Pending tasks are kept")
+	assert.Equal(t, int64(2), emulator.Server.QueueRoutineCounts()[createdQueue.GetName()].Workers)
+
+	_, err = emulator.Client.UpdateQueue(ctx, &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name:       createdQueue.GetName(),
+			RateLimits: &taskspb.RateLimits{MaxConcurrentDispatches: 8},
+		},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"rate_limits.max_concurrent_dispatches"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), emulator.Server.QueueRoutineCounts()[createdQueue.GetName()].Workers)
+
+	// A task retried without limit until the max attempts are lowered
+	failingTask, err := emulator.Client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: handler.URL + "/fail"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, attemptCount("/fail") > 1)
+
+	updatedQueue, err = emulator.Client.UpdateQueue(ctx, &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name:        createdQueue.GetName(),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 1},
+		},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"retry_config.max_attempts"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), updatedQueue.GetRetryConfig().GetMaxAttempts())
+	assert.Equal(t, 50*time.Millisecond, durationValue(updatedQueue.GetRetryConfig().GetMinBackoff()), "Other fields are kept")
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = emulator.Client.GetTask(ctx, &taskspb.GetTaskRequest{Name: failingTask.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Gives up on the next attempt")
+	finalAttempts := attemptCount("/fail")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, finalAttempts, attemptCount("/fail"))
+
+	_, err = emulator.Client.UpdateQueue(ctx, &taskspb.UpdateQueueRequest{
+		Queue:      &taskspb.Queue{Name: createdQueue.GetName(), RateLimits: &taskspb.RateLimits{MaxBurstSize: 5}},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"rate_limits.max_burst_size"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func durationValue(d *duration.Duration) time.Duration {
+	value, _ := ptypes.Duration(d)
+	return value
+}
+
+func TestListTasksPagination(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue := createTestQueue(t, client)
+
+	// Created out of schedule order
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, i := range rand.Perm(25) {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name:         fmt.Sprintf("%v/tasks/task-%02d", createdQueue.GetName(), i),
+				ScheduleTime: &timestamp.Timestamp{Seconds: start.Add(time.Duration(i) * time.Minute).Unix()},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com"},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	listPage := func(pageToken string) ([]string, string) {
+		var names []string
+		pager := iterator.NewPager(client.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+			Parent: createdQueue.GetName(),
+		}), 10, pageToken)
+		var page []*taskspb.Task
+		nextPageToken, err := pager.NextPage(&page)
+		require.NoError(t, err)
+		for _, task := range page {
+			names = append(names, task.GetName()[len(createdQueue.GetName())+len("/tasks/"):])
+		}
+		return names, nextPageToken
+	}
+
+	firstPage, pageToken := listPage("")
+	assert.Equal(t, []string{"task-00", "task-01", "task-02", "task-03", "task-04", "task-05", "task-06", "task-07", "task-08", "task-09"}, firstPage)
+	require.NotEmpty(t, pageToken)
+
+	// Removing a task of the first page doesn't shift the next one
+	err := client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdQueue.GetName() + "/tasks/task-03"})
+	require.NoError(t, err)
+
+	secondPage, pageToken := listPage(pageToken)
+	assert.Equal(t, []string{"task-10", "task-11", "task-12", "task-13", "task-14", "task-15", "task-16", "task-17", "task-18", "task-19"}, secondPage)
+	require.NotEmpty(t, pageToken)
+
+	lastPage, pageToken := listPage(pageToken)
+	assert.Equal(t, []string{"task-20", "task-21", "task-22", "task-23", "task-24"}, lastPage)
+	assert.Empty(t, pageToken)
+
+	// All at once by default
+	taskCount := 0
+	it := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: createdQueue.GetName()})
+	for _, err := it.Next(); err == nil; _, err = it.Next() {
+		taskCount++
+	}
+	assert.Equal(t, 24, taskCount)
+
+	_, err = client.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+		Parent:    createdQueue.GetName(),
+		PageToken: "not-a-token",
+	}).Next()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+		Parent:   createdQueue.GetName(),
+		PageSize: -1,
+	}).Next()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestListQueuesFilter(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	for _, queueID := range []string{"test-running", "test-paused", "other-paused"} {
+		_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, queueID),
+		})
+		require.NoError(t, err)
+		if strings.HasSuffix(queueID, "-paused") {
+			_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: formatQueueName(formattedParent, queueID)})
+			require.NoError(t, err)
+		}
+	}
+
+	listQueueIDs := func(filter string) []string {
+		var queueIDs []string
+		it := client.ListQueues(context.Background(), &taskspb.ListQueuesRequest{
+			Parent: formattedParent,
+			Filter: filter,
+		})
+		for queue, err := it.Next(); err == nil; queue, err = it.Next() {
+			queueIDs = append(queueIDs, queue.GetName()[len(formattedParent)+len("/queues/"):])
+		}
+		sort.Strings(queueIDs)
+		return queueIDs
+	}
+
+	assert.Equal(t, []string{"other-paused", "test-paused", "test-running"}, listQueueIDs(""))
+	assert.Equal(t, []string{"other-paused", "test-paused"}, listQueueIDs("state: PAUSED"))
+	assert.Equal(t, []string{"test-running"}, listQueueIDs("state != PAUSED"))
+	assert.Equal(t, []string{"test-paused", "test-running"}, listQueueIDs("name:test-*"))
+	assert.Equal(t, []string{"test-paused"}, listQueueIDs(`name = "`+formatQueueName(formattedParent, "test-*")+`" AND state = PAUSED`))
+	assert.Empty(t, listQueueIDs("name = test"))
+
+	for _, filter := range []string{"state: SLEEPING", "rate_limits: 1", "paused"} {
+		_, err := client.ListQueues(context.Background(), &taskspb.ListQueuesRequest{
+			Parent: formattedParent,
+			Filter: filter,
+		}).Next()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), filter)
+	}
+}
+
+func TestRunTaskForcesImmediateDispatch(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	succeeded := &requestRecorder{}
+	failed := &requestRecorder{}
+	srv := startTestServer(succeeded.record, failed.record)
+	defer srv.Shutdown(context.Background())
+
+	createdQueue := createTestQueue(t, client)
+	_, err := client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	farFuture := &timestamp.Timestamp{Seconds: time.Now().Add(24 * time.Hour).Unix()}
+	createTask := func(taskID string, url string) *taskspb.Task {
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name:         createdQueue.GetName() + "/tasks/" + taskID,
+				ScheduleTime: farFuture,
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: url},
+				},
+			},
+		})
+		require.NoError(t, err)
+		return createdTask
+	}
+
+	// Runs despite the schedule time and the paused queue, and only once
+	succeedingTask := createTask("succeeding", "http://localhost:5000/success")
+	ranTask, err := client.RunTask(context.Background(), &taskspb.RunTaskRequest{Name: succeedingTask.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), ranTask.GetDispatchCount())
+	assert.WithinDuration(t, time.Now(), time.Unix(ranTask.GetScheduleTime().GetSeconds(), 0), 2*time.Second)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, succeeded.count())
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: succeedingTask.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Backs off from now rather than from the original schedule time
+	failingTask := createTask("failing", "http://localhost:5000/not_found")
+	_, err = client.RunTask(context.Background(), &taskspb.RunTaskRequest{Name: failingTask.GetName()})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, failed.count())
+	retriedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: failingTask.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), retriedTask.GetResponseCount())
+	assert.True(t, retriedTask.GetScheduleTime().GetSeconds() < time.Now().Add(time.Minute).Unix(),
+		"Scheduled for a retry soon, not at %v", retriedTask.GetScheduleTime())
+}
+
+func TestCreateTaskDeduplication(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	os.Setenv("TASK_DEDUP_WINDOW", "500ms")
+	defer os.Unsetenv("TASK_DEDUP_WINDOW")
+
+	createdQueue := createTestQueue(t, client)
+	createTask := func() (*taskspb.Task, error) {
+		return client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name:         createdQueue.GetName() + "/tasks/idempotent",
+				ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com"},
+				},
+			},
+		})
+	}
+
+	createdTask, err := createTask()
+	require.NoError(t, err)
+
+	_, err = createTask()
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "Exists")
+
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+
+	_, err = createTask()
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "Existed too recently")
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "existed recently")
+
+	// Free again once the window has passed
+	time.Sleep(600 * time.Millisecond)
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	assert.Equal(t, "Task does not exist.", status.Convert(err).Message())
+	_, err = createTask()
+	assert.NoError(t, err)
+}
+
+func TestWatchTasks(t *testing.T) {
+	ctx := context.Background()
+
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer handler.Close()
+
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	queue := newQueue(formattedParent, "watched")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+	createdQueue, err := emulator.Client.CreateQueue(ctx, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	watchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	watch, err := NewEmulatorClient(conn).WatchTasks(watchCtx, &WatchTasksRequest{
+		Queue: createdQueue.GetName(),
+		Types: []string{TaskCompletedEvent, TaskFailedEvent},
+	})
+	require.NoError(t, err)
+
+	createTask := func(path string) string {
+		task, err := emulator.Client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: handler.URL + path},
+				},
+			},
+		})
+		require.NoError(t, err)
+		return task.GetName()
+	}
+
+	// Awaited without sleeping, the watch being subscribed before the task exists
+	completed, err := watch.Await(createTask("/success"), TaskCompletedEvent)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), completed.Attempt)
+	assert.Equal(t, int32(200), completed.StatusCode)
+
+	failed, err := watch.Await(createTask("/fail"), TaskFailedEvent)
+	require.NoError(t, err)
+	assert.Equal(t, int32(500), failed.StatusCode)
+
+	_, err = NewEmulatorClient(conn).WatchTasks(watchCtx, &WatchTasksRequest{Types: []string{"DONE"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestFreezeAndFlush(t *testing.T) {
+	ctx := context.Background()
+
+	var mux sync.Mutex
+	dispatched := 0
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		dispatched++
+	}))
+	defer handler.Close()
+	dispatchCount := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return dispatched
+	}
+
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	control := NewEmulatorClient(conn)
+
+	// Queues created while frozen start frozen
+	require.NoError(t, control.Freeze(ctx))
+	queue := newQueue(formattedParent, "frozen")
+	queue.RateLimits = &taskspb.RateLimits{MaxDispatchesPerSecond: 1, MaxBurstSize: 1}
+	createdQueue, err := emulator.Client.CreateQueue(ctx, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, createdQueue.GetState())
+
+	createTask := func(scheduleTime time.Time) {
+		_, err := emulator.Client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: &timestamp.Timestamp{Seconds: scheduleTime.Unix()},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: handler.URL},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	createTask(time.Now())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, dispatchCount(), "Frozen")
+
+	// Unfrozen, the due task runs
+	require.NoError(t, control.Unfreeze(ctx))
+	assert.Eventually(t, func() bool { return dispatchCount() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Flushed, the tasks run whatever their schedule time and the rate limit,
+	// even while frozen
+	require.NoError(t, control.Freeze(ctx))
+	for i := 0; i < 3; i++ {
+		createTask(time.Now().Add(time.Hour))
+	}
+	flushed, err := control.Flush(ctx, createdQueue.GetName())
+	require.NoError(t, err)
+	assert.Equal(t, 3, flushed)
+	assert.Eventually(t, func() bool { return dispatchCount() == 4 }, time.Second, 10*time.Millisecond)
+
+	_, err = control.Flush(ctx, formatQueueName(formattedParent, "missing"))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Resetting is only enabled on request
+	assert.Equal(t, codes.FailedPrecondition, status.Code(control.Reset(ctx)))
+	os.Setenv("ENABLE_RESET", "true")
+	defer os.Unsetenv("ENABLE_RESET")
+	require.NoError(t, control.Reset(ctx))
+	_, err = emulator.Client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAdvanceTime(t *testing.T) {
+	ctx := context.Background()
+
+	dispatched := make(chan bool, 3)
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dispatched <- true
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer handler.Close()
+
+	os.Setenv("FAKE_CLOCK", "true")
+	emulator, err := StartInProcess(ctx)
+	os.Unsetenv("FAKE_CLOCK")
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	control := NewEmulatorClient(conn)
+
+	queue := newQueue(formattedParent, "delayed")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 2,
+		MinBackoff:  ptypes.DurationProto(10 * time.Minute),
+		MaxBackoff:  ptypes.DurationProto(10 * time.Minute),
+	}
+	createdQueue, err := emulator.Client.CreateQueue(ctx, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	start, err := control.AdvanceTime(ctx, 0)
+	require.NoError(t, err)
+	scheduleTime, _ := ptypes.TimestampProto(start.Add(time.Hour))
+	_, err = emulator.Client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: scheduleTime,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: handler.URL},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	now, err := control.AdvanceTime(ctx, 59*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(59*time.Minute), now)
+	assert.Len(t, dispatched, 0)
+
+	// Due, then retried after the backoff, without waiting for either
+	_, err = control.AdvanceTime(ctx, time.Minute)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(dispatched) == 1 }, time.Second, time.Millisecond)
+	_, err = control.AdvanceTime(ctx, 10*time.Minute)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(dispatched) == 2 }, time.Second, time.Millisecond)
+
+	_, err = control.AdvanceTime(ctx, -time.Second)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
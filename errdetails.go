@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// invalidArgument returns an INVALID_ARGUMENT error with a BadRequest detail
+// describing the violation of the field, as Cloud Tasks does
+func invalidArgument(field string, format string, a ...interface{}) error {
+	description := fmt.Sprintf(format, a...)
+
+	return withDetails(codes.InvalidArgument, description, &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: field, Description: description},
+		},
+	})
+}
+
+// resourceExhausted returns a RESOURCE_EXHAUSTED error with a QuotaFailure
+// detail describing the quota of the subject that ran out
+func resourceExhausted(subject string, format string, a ...interface{}) error {
+	description := fmt.Sprintf(format, a...)
+
+	return withDetails(codes.ResourceExhausted, description, &errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{
+			{Subject: subject, Description: description},
+		},
+	})
+}
+
+func withDetails(code codes.Code, description string, details proto.Message) error {
+	st, err := status.New(code, description).WithDetails(details)
+	if err != nil {
+		// Not expected as the details are well-formed, but the error itself still applies
+		return status.Error(code, description)
+	}
+
+	return st.Err()
+}
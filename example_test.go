@@ -0,0 +1,51 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/aertje/cloud-tasks-emulator"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func ExampleStartInProcess() {
+	ctx := context.Background()
+
+	received := make(chan string, 1)
+	handler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("X-CloudTasks-TaskName")
+	}))
+	defer handler.Close()
+
+	emulator, err := StartInProcess(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer emulator.Close()
+
+	queue, err := emulator.CreateQueue(ctx, "projects/my-project/locations/my-location/queues/my-queue")
+	if err != nil {
+		panic(err)
+	}
+
+	task, err := emulator.Client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			Name: queue.GetName() + "/tasks/my-task",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: handler.URL},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(task.GetName())
+	fmt.Println(<-received)
+	// Output:
+	// projects/my-project/locations/my-location/queues/my-queue/tasks/my-task
+	// my-task
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// QueueVars are the live counters of a queue published with expvar
+type QueueVars struct {
+	// The tasks in the queue, scheduled or being dispatched
+	PendingTasks int64 `json:"pendingTasks"`
+
+	InFlightDispatches int64 `json:"inFlightDispatches"`
+
+	// The tokens of the rate limit available for dispatches
+	TokensAvailable int `json:"tokensAvailable"`
+
+	// The tasks that succeeded or ran out of attempts since the queue was created
+	CompletedTasks int64 `json:"completedTasks"`
+}
+
+// Vars returns the live counters of the queue
+func (queue *Queue) Vars() QueueVars {
+	queue.tsMux.Lock()
+	pending := int64(queue.ts.len())
+	queue.tsMux.Unlock()
+
+	queue.statsMux.Lock()
+	defer queue.statsMux.Unlock()
+
+	return QueueVars{
+		PendingTasks:       pending,
+		InFlightDispatches: queue.concurrentDispatches,
+		TokensAvailable:    len(queue.tokenBucket),
+		CompletedTasks:     queue.completedTasks,
+	}
+}
+
+// QueueVars returns the live counters of each queue
+func (s *Server) QueueVars() map[string]QueueVars {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	vars := make(map[string]QueueVars)
+	for name, queue := range s.qs {
+		if queue != nil {
+			vars[name] = queue.Vars()
+		}
+	}
+
+	return vars
+}
+
+var (
+	publishQueueVarsOnce sync.Once
+
+	// The server of the "queues" expvar, the last one published
+	queueVarsServer *Server
+
+	queueVarsMux sync.Mutex
+)
+
+// publishQueueVars publishes the counters of the queues of the server as the
+// "queues" expvar, served on /debug/vars. Expvar names being global to the
+// process, the expvar is published once, and then reports on the server last
+// passed.
+func publishQueueVars(s *Server) {
+	queueVarsMux.Lock()
+	queueVarsServer = s
+	queueVarsMux.Unlock()
+
+	publishQueueVarsOnce.Do(func() {
+		expvar.Publish("queues", expvar.Func(func() interface{} {
+			queueVarsMux.Lock()
+			defer queueVarsMux.Unlock()
+			return queueVarsServer.QueueVars()
+		}))
+	})
+}
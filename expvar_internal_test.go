@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueVars(t *testing.T) {
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+
+	done := make(chan bool, 1)
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{Name: queueName}, realClock{}, func(task *Task) {
+		done <- true
+	})
+	queue.Run()
+	defer queue.Delete()
+
+	_, _, err := queue.NewTask(&taskspb.Task{
+		MessageType: &taskspb.Task_HttpRequest{
+			HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return queue.Vars().InFlightDispatches == 1
+	}, time.Second, 10*time.Millisecond)
+	vars := queue.Vars()
+	assert.Equal(t, int64(1), vars.PendingTasks)
+	assert.Equal(t, int64(0), vars.CompletedTasks)
+
+	close(release)
+	<-done
+
+	vars = queue.Vars()
+	assert.Equal(t, int64(0), vars.PendingTasks)
+	assert.Equal(t, int64(0), vars.InFlightDispatches)
+	assert.Equal(t, int64(1), vars.CompletedTasks)
+}
+
+func TestDebugHandlerServesQueueVars(t *testing.T) {
+	server := NewServer()
+	publishQueueVars(server)
+
+	srv := httptest.NewServer(newDebugHandler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/debug/vars")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&vars))
+	assert.Equal(t, "{}", string(vars["queues"]))
+	assert.Contains(t, vars, "memstats")
+}
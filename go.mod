@@ -6,10 +6,14 @@ require (
 	cloud.google.com/go v0.49.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/golang/protobuf v1.3.2
+	github.com/googleapis/gax-go/v2 v2.0.5
 	github.com/lestrrat-go/jwx v1.0.5
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.5.1
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
 	google.golang.org/api v0.14.0
 	google.golang.org/genproto v0.0.0-20191115221424-83cc0476cb11
 	google.golang.org/grpc v1.25.1
+	gopkg.in/yaml.v2 v2.2.2
 )
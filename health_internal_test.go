@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthServer(t *testing.T) {
+	healthServer := registerHealthServer(grpc.NewServer())
+
+	for _, service := range healthServices {
+		resp, err := healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus(), service)
+	}
+
+	setServing(healthServer)
+	for _, service := range healthServices {
+		resp, err := healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus(), service)
+	}
+
+	assert.True(t, isHealthCheck("/grpc.health.v1.Health/Check"))
+	assert.False(t, isHealthCheck("/google.cloud.tasks.v2.CloudTasks/GetQueue"))
+}
+
+func TestInProcessHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	conn, err := emulator.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "google.cloud.tasks.v2.CloudTasks"})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+}
+
+// Once ready, see TestRestHealthEndpoints
+func TestReadyzWhileStartingUp(t *testing.T) {
+	server := NewServer()
+	server.setReady(false)
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/readyz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// Live all along
+	resp, err = srv.Client().Get(srv.URL + "/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
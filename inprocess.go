@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	"google.golang.org/api/option"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	beta2 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta2"
+	beta3 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const inProcessBufferSize = 1024 * 1024
+
+// InProcessEmulator runs the emulator in the test process, on an in-memory
+// listener rather than a port, with a client connected to it
+type InProcessEmulator struct {
+	Server *Server
+
+	Client *cloudtasks.Client
+
+	grpcServer *grpc.Server
+
+	listener *bufconn.Listener
+}
+
+// StartInProcess starts the emulator on an in-memory listener and connects a
+// client to it. Close it once done to stop the queues and the server. With
+// FAKE_CLOCK=true, the emulator uses a fake clock of its own.
+func StartInProcess(ctx context.Context) (*InProcessEmulator, error) {
+	server := NewServer()
+	if os.Getenv("FAKE_CLOCK") == "true" {
+		server = newServer(newFakeClock(time.Now()))
+	}
+	v2beta3Server := NewV2beta3Server(server)
+	emulator := &InProcessEmulator{
+		Server:     server,
+		grpcServer: newGRPCServer(v2beta3Server),
+		listener:   bufconn.Listen(inProcessBufferSize),
+	}
+	tasks.RegisterCloudTasksServer(emulator.grpcServer, emulator.Server)
+	beta2.RegisterCloudTasksServer(emulator.grpcServer, NewV2beta2Server(emulator.Server))
+	beta3.RegisterCloudTasksServer(emulator.grpcServer, v2beta3Server)
+	registerEmulatorService(emulator.grpcServer, emulator.Server)
+	setServing(registerHealthServer(emulator.grpcServer))
+	go emulator.grpcServer.Serve(emulator.listener)
+
+	conn, err := emulator.Dial(ctx)
+	if err != nil {
+		emulator.stop()
+		return nil, err
+	}
+
+	emulator.Client, err = cloudtasks.NewClient(ctx, option.WithGRPCConn(conn))
+	if err != nil {
+		conn.Close()
+		emulator.stop()
+		return nil, err
+	}
+
+	return emulator, nil
+}
+
+// Dial opens another connection to the emulator, e.g. for a client other than
+// the Cloud Tasks one. The caller closes it.
+func (emulator *InProcessEmulator) Dial(ctx context.Context) (*grpc.ClientConn, error) {
+	return grpc.DialContext(ctx, "bufconn",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return emulator.listener.Dial()
+		}),
+	)
+}
+
+// CreateQueue creates a queue with the default config, e.g.
+// projects/my-project/locations/my-location/queues/my-queue
+func (emulator *InProcessEmulator) CreateQueue(ctx context.Context, queueName string) (*tasks.Queue, error) {
+	return emulator.Server.CreateQueue(ctx, &tasks.CreateQueueRequest{
+		Parent: queueParent(queueName),
+		Queue:  &tasks.Queue{Name: queueName},
+	})
+}
+
+// Close closes the client, deletes the queues, returning once their goroutines
+// have stopped, and stops the server
+func (emulator *InProcessEmulator) Close() error {
+	err := emulator.Client.Close()
+	emulator.stop()
+
+	return err
+}
+
+func (emulator *InProcessEmulator) stop() {
+	emulator.Server.Reset()
+	emulator.Server.Close()
+	emulator.grpcServer.Stop()
+	emulator.listener.Close()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// listenAddress resolves the network and address for the gRPC listener.
+// A socket path takes the place of the TCP host and port, so configuring both
+// is rejected.
+func listenAddress(host string, port string, socket string, tcpConfigured bool) (string, string, error) {
+	if socket != "" {
+		if tcpConfigured {
+			return "", "", errors.New("Configure either a host and port or a socket, not both")
+		}
+		return "unix", socket, nil
+	}
+
+	if host == "" || port == "" {
+		return "", "", errors.New("A host and port or a socket is required")
+	}
+
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+func listen(network string, address string) (net.Listener, error) {
+	if network == "unix" {
+		// Clean up a socket left behind by a previous run
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, fmt.Errorf("Removing stale socket %v: %v", address, err)
+			}
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+func envOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return defaultValue
+}
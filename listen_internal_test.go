@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenAddressTCP(t *testing.T) {
+	network, address, err := listenAddress("localhost", "8123", "", false)
+
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "localhost:8123", address)
+}
+
+func TestListenAddressSocket(t *testing.T) {
+	network, address, err := listenAddress("localhost", "8123", "/tmp/tasks.sock", false)
+
+	require.NoError(t, err)
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/tmp/tasks.sock", address)
+}
+
+func TestListenAddressRejectsSocketAndTCP(t *testing.T) {
+	_, _, err := listenAddress("localhost", "8000", "/tmp/tasks.sock", true)
+
+	assert.Error(t, err)
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emulator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "tasks.sock")
+
+	lis, err := listen("unix", socket)
+	require.NoError(t, err)
+	// Leave the socket file behind, as a killed process would
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+	lis.Close()
+
+	lis, err = listen("unix", socket)
+	require.NoError(t, err)
+	lis.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+	errorLevel
+)
+
+// logLevels are the levels by their name in LOG_LEVEL
+var logLevels = map[string]logLevel{
+	"debug": debugLevel,
+	"info":  infoLevel,
+	"warn":  warnLevel,
+	"error": errorLevel,
+}
+
+var logLevelNames = map[logLevel]string{
+	debugLevel: "debug",
+	infoLevel:  "info",
+	warnLevel:  "warn",
+	errorLevel: "error",
+}
+
+// logFormats are the formats of LOG_FORMAT
+var logFormats = map[string]bool{"console": true, "json": true}
+
+// logField is a key value pair added to a log entry, e.g. the queue or task name
+type logField struct {
+	key string
+
+	value interface{}
+}
+
+func field(key string, value interface{}) logField {
+	return logField{key, value}
+}
+
+// Serializes the entries, which may span several writes
+var logMux sync.Mutex
+
+// The level and format given with the command line flags, see main. The env is
+// read on every entry unless set.
+var logLevelSetting, logFormatSetting string
+
+// currentLogLevel returns the least level logged, set with LOG_LEVEL, info by default
+func currentLogLevel() logLevel {
+	name := logLevelSetting
+	if name == "" {
+		name = os.Getenv("LOG_LEVEL")
+	}
+	if level, ok := logLevels[strings.ToLower(name)]; ok {
+		return level
+	}
+
+	return infoLevel
+}
+
+func logDebug(message string, fields ...logField) { logEntry(debugLevel, message, fields) }
+func logInfo(message string, fields ...logField)  { logEntry(infoLevel, message, fields) }
+func logWarn(message string, fields ...logField)  { logEntry(warnLevel, message, fields) }
+func logError(message string, fields ...logField) { logEntry(errorLevel, message, fields) }
+
+// logFatal logs the error and exits
+func logFatal(message string, fields ...logField) {
+	logEntry(errorLevel, message, fields)
+	os.Exit(1)
+}
+
+// logEntry writes the entry to the output of the standard logger, as a line of
+// JSON with LOG_FORMAT=json, or as the message followed by the fields otherwise
+func logEntry(level logLevel, message string, fields []logField) {
+	if level < currentLogLevel() {
+		return
+	}
+
+	now := time.Now()
+	var line string
+	format := logFormatSetting
+	if format == "" {
+		format = os.Getenv("LOG_FORMAT")
+	}
+	if format == "json" {
+		entry := map[string]interface{}{
+			"time":    now.UTC().Format(time.RFC3339Nano),
+			"level":   logLevelNames[level],
+			"message": message,
+		}
+		for _, f := range fields {
+			if err, ok := f.value.(error); ok {
+				entry[f.key] = err.Error()
+			} else {
+				entry[f.key] = f.value
+			}
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			data, _ = json.Marshal(map[string]interface{}{"level": "error", "message": "Failed to log entry: " + err.Error()})
+		}
+		line = string(data)
+	} else {
+		var b strings.Builder
+		b.WriteString(now.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(logLevelNames[level]) + " " + message)
+		sort.SliceStable(fields, func(i, j int) bool { return fieldOrder(fields[i].key) < fieldOrder(fields[j].key) })
+		for _, f := range fields {
+			b.WriteString(" " + f.key + "=" + formatLogValue(f.value))
+		}
+		line = b.String()
+	}
+
+	logMux.Lock()
+	defer logMux.Unlock()
+	fmt.Fprintln(log.Writer(), line)
+}
+
+// fieldOrder puts the queue and task first in the console format, the other
+// fields keeping their order
+func fieldOrder(key string) int {
+	switch key {
+	case "queue":
+		return 0
+	case "task":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// formatLogValue quotes the values that would be ambiguous otherwise
+func formatLogValue(value interface{}) string {
+	formatted := fmt.Sprint(value)
+	if formatted == "" || strings.ContainsAny(formatted, " \t\n\"=") {
+		return fmt.Sprintf("%q", formatted)
+	}
+
+	return formatted
+}
+
+// logFields returns the queue, task and attempt fields of the task
+func (task *Task) logFields(fields ...logField) []logField {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	return append([]logField{
+		field("queue", task.queue.name),
+		field("task", task.state.GetName()),
+		field("attempt", task.state.GetDispatchCount()),
+	}, fields...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLog returns what the function logged
+func captureLog(f func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	f()
+	log.SetOutput(os.Stderr)
+
+	return buf.String()
+}
+
+func TestLogLevels(t *testing.T) {
+	defer os.Unsetenv("LOG_LEVEL")
+
+	logged := captureLog(func() {
+		logDebug("Debugging")
+		logInfo("Informing")
+	})
+	assert.NotContains(t, logged, "Debugging")
+	assert.Contains(t, logged, "INFO Informing")
+
+	os.Setenv("LOG_LEVEL", "warn")
+	logged = captureLog(func() {
+		logInfo("Informing")
+		logWarn("Warning")
+		logError("Failing")
+	})
+	assert.NotContains(t, logged, "Informing")
+	assert.Contains(t, logged, "WARN Warning")
+	assert.Contains(t, logged, "ERROR Failing")
+
+	os.Setenv("LOG_LEVEL", "debug")
+	assert.Contains(t, captureLog(func() { logDebug("Debugging") }), "DEBUG Debugging")
+}
+
+func TestConsoleLogFields(t *testing.T) {
+	logged := captureLog(func() {
+		logWarn("Task exec error", field("statusCode", 503), field("task", "my-task"), field("queue", "my-queue"), field("error", errors.New("no luck")))
+	})
+
+	assert.True(t, strings.HasSuffix(logged, ` WARN Task exec error queue=my-queue task=my-task statusCode=503 error="no luck"`+"\n"), logged)
+}
+
+func TestJSONLogFields(t *testing.T) {
+	defer os.Unsetenv("LOG_FORMAT")
+	os.Setenv("LOG_FORMAT", "json")
+
+	logged := captureLog(func() {
+		logError("Ran out of attempts", field("queue", "my-queue"), field("task", "my-task"), field("attempt", int32(3)), field("error", errors.New("no luck")))
+	})
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(logged), &entry))
+	assert.NotEmpty(t, entry["time"])
+	delete(entry, "time")
+	assert.Equal(t, map[string]interface{}{
+		"level":   "error",
+		"message": "Ran out of attempts",
+		"queue":   "my-queue",
+		"task":    "my-task",
+		"attempt": 3.0,
+		"error":   "no luck",
+	}, entry)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The bounds of the dispatch duration histogram in seconds, those of the
+// Prometheus client libraries, extended up to the maximum dispatch deadline
+var dispatchDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 1800}
+
+// metric describes a metric in the Prometheus text format
+type metric struct {
+	name string
+
+	help string
+
+	kind string
+}
+
+var (
+	tasksCreatedMetric       = metric{"cloud_tasks_emulator_tasks_created_total", "The tasks created.", "counter"}
+	dispatchesMetric         = metric{"cloud_tasks_emulator_dispatches_total", "The dispatch attempts, including retries.", "counter"}
+	retriesMetric            = metric{"cloud_tasks_emulator_retries_total", "The dispatch attempts that were retries.", "counter"}
+	tasksSucceededMetric     = metric{"cloud_tasks_emulator_tasks_succeeded_total", "The tasks that succeeded.", "counter"}
+	dispatchFailuresMetric   = metric{"cloud_tasks_emulator_dispatch_failures_total", "The failed dispatch attempts by status code, -1 if no response was received.", "counter"}
+	tasksFailedMetric        = metric{"cloud_tasks_emulator_tasks_failed_total", "The tasks that ran out of attempts.", "counter"}
+	tokenStarvationMetric    = metric{"cloud_tasks_emulator_token_starvation_seconds_total", "The time due tasks waited for a token of the rate limit.", "counter"}
+	dispatchDurationMetric   = metric{"cloud_tasks_emulator_dispatch_duration_seconds", "The time from sending a task to its target to the response.", "histogram"}
+	queueDepthMetric         = metric{"cloud_tasks_emulator_queue_depth", "The tasks in the queue.", "gauge"}
+	concurrentDispatchMetric = metric{"cloud_tasks_emulator_concurrent_dispatches", "The dispatches in flight.", "gauge"}
+)
+
+// metricSeries identifies a time series of a metric by its labels, formatted
+type metricSeries struct {
+	metric metric
+
+	labels string
+}
+
+// metricsRegistry keeps the counters and histograms of all queues, served in
+// the Prometheus text format on /metrics of the REST API. The gauges are taken
+// from the queues as they are scraped.
+type metricsRegistry struct {
+	mux sync.Mutex
+
+	counters map[metricSeries]float64
+
+	histograms map[metricSeries]*histogram
+}
+
+type histogram struct {
+	// Cumulative, as per the Prometheus format
+	counts []uint64
+
+	count uint64
+
+	sum float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters:   make(map[metricSeries]float64),
+		histograms: make(map[metricSeries]*histogram),
+	}
+}
+
+// labels formats the label pairs, e.g. `{queue="q",status_code="500"}`
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(pairs[i] + "=" + strconv.Quote(pairs[i+1]))
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+func (r *metricsRegistry) add(m metric, labels string, value float64) {
+	if r == nil {
+		return
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.counters[metricSeries{m, labels}] += value
+}
+
+func (r *metricsRegistry) observe(m metric, labels string, value float64) {
+	if r == nil {
+		return
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	series := metricSeries{m, labels}
+	h, ok := r.histograms[series]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(dispatchDurationBuckets))}
+		r.histograms[series] = h
+	}
+	for i, bound := range dispatchDurationBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (r *metricsRegistry) taskCreated(queueName string) {
+	r.add(tasksCreatedMetric, labels("queue", queueName), 1)
+}
+
+// dispatched records the outcome of a dispatch attempt, the first one being 1
+func (r *metricsRegistry) dispatched(queueName string, attempt int32, statusCode int, duration time.Duration) {
+	queueLabels := labels("queue", queueName)
+	r.add(dispatchesMetric, queueLabels, 1)
+	if attempt > 1 {
+		r.add(retriesMetric, queueLabels, 1)
+	}
+	if statusCode >= 200 && statusCode <= 299 {
+		r.add(tasksSucceededMetric, queueLabels, 1)
+	} else {
+		r.add(dispatchFailuresMetric, labels("queue", queueName, "status_code", strconv.Itoa(statusCode)), 1)
+	}
+	r.observe(dispatchDurationMetric, queueLabels, duration.Seconds())
+}
+
+func (r *metricsRegistry) taskFailed(queueName string) {
+	r.add(tasksFailedMetric, labels("queue", queueName), 1)
+}
+
+func (r *metricsRegistry) tokenStarved(queueName string, waited time.Duration) {
+	r.add(tokenStarvationMetric, labels("queue", queueName), waited.Seconds())
+}
+
+func (r *metricsRegistry) clear() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.counters = make(map[metricSeries]float64)
+	r.histograms = make(map[metricSeries]*histogram)
+}
+
+// write outputs the metrics in the Prometheus text format, along with the
+// gauges of the queues
+func (r *metricsRegistry) write(w io.Writer, queues map[string]QueueStats) {
+	samples := make(map[metric][]string)
+
+	r.mux.Lock()
+	for series, value := range r.counters {
+		samples[series.metric] = append(samples[series.metric], series.metric.name+series.labels+" "+formatSample(value))
+	}
+	for series, h := range r.histograms {
+		name := series.metric.name
+		// The le label goes after the others
+		prefix := strings.TrimSuffix(series.labels, "}") + ","
+		for i, bound := range dispatchDurationBuckets {
+			samples[series.metric] = append(samples[series.metric], fmt.Sprintf("%s_bucket%sle=%q} %d", name, prefix, formatSample(bound), h.counts[i]))
+		}
+		samples[series.metric] = append(samples[series.metric],
+			fmt.Sprintf("%s_bucket%sle=\"+Inf\"} %d", name, prefix, h.count),
+			name+"_sum"+series.labels+" "+formatSample(h.sum),
+			name+"_count"+series.labels+" "+strconv.FormatUint(h.count, 10),
+		)
+	}
+	r.mux.Unlock()
+
+	for queueName, stats := range queues {
+		queueLabels := labels("queue", queueName)
+		samples[queueDepthMetric] = append(samples[queueDepthMetric], queueDepthMetric.name+queueLabels+" "+strconv.FormatInt(stats.TasksCount, 10))
+		samples[concurrentDispatchMetric] = append(samples[concurrentDispatchMetric], concurrentDispatchMetric.name+queueLabels+" "+strconv.FormatInt(stats.ConcurrentDispatchesCount, 10))
+	}
+
+	metrics := make([]metric, 0, len(samples))
+	for m := range samples {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		// Histogram samples keep their order, the buckets being cumulative
+		if m.kind != "histogram" {
+			sort.Strings(samples[m])
+		}
+		for _, sample := range samples[m] {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+func formatSample(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
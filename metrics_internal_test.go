@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsRegistryWrite(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.dispatched("q", 1, http.StatusOK, 30*time.Millisecond)
+	registry.dispatched("q", 2, -1, 2*time.Second)
+	registry.tokenStarved("q", 1500*time.Millisecond)
+
+	var buf bytes.Buffer
+	registry.write(&buf, map[string]QueueStats{"q": {TasksCount: 3}})
+	lines := strings.Split(buf.String(), "\n")
+
+	assert.Contains(t, lines, `cloud_tasks_emulator_dispatch_failures_total{queue="q",status_code="-1"} 1`)
+	assert.Contains(t, lines, `cloud_tasks_emulator_token_starvation_seconds_total{queue="q"} 1.5`)
+	assert.Contains(t, lines, `cloud_tasks_emulator_queue_depth{queue="q"} 3`)
+
+	// The buckets are cumulative
+	assert.Contains(t, lines, `cloud_tasks_emulator_dispatch_duration_seconds_bucket{queue="q",le="0.025"} 0`)
+	assert.Contains(t, lines, `cloud_tasks_emulator_dispatch_duration_seconds_bucket{queue="q",le="0.05"} 1`)
+	assert.Contains(t, lines, `cloud_tasks_emulator_dispatch_duration_seconds_bucket{queue="q",le="2.5"} 2`)
+	assert.Contains(t, lines, `cloud_tasks_emulator_dispatch_duration_seconds_sum{queue="q"} 2.03`)
+
+	// Each metric is described once, before its samples
+	help := strings.Index(buf.String(), "# HELP cloud_tasks_emulator_dispatches_total")
+	sample := strings.Index(buf.String(), `cloud_tasks_emulator_dispatches_total{queue="q"} 2`)
+	assert.True(t, help >= 0 && help < sample)
+	assert.Equal(t, 1, strings.Count(buf.String(), "# TYPE cloud_tasks_emulator_dispatches_total counter"))
+
+	registry.clear()
+	buf.Reset()
+	registry.write(&buf, nil)
+	assert.Empty(t, buf.String())
+}
+
+func TestNilMetricsRegistry(t *testing.T) {
+	var registry *metricsRegistry
+	registry.taskCreated("q")
+	registry.dispatched("q", 1, http.StatusOK, time.Second)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+// defaultOAuthScope is the scope Cloud Tasks requests when the task sets none
+const defaultOAuthScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// defaultOAuthToken is sent when neither OAUTH_TOKEN nor OAUTH_TOKEN_URL is set
+const defaultOAuthToken = "cloud-tasks-emulator-oauth-token"
+
+// oauthTokenResponse is the response of the token endpoint, as the one of the
+// GCE metadata server
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type cachedOAuthToken struct {
+	accessToken string
+
+	expires time.Time
+}
+
+// oauthTokens caches the tokens fetched from OAUTH_TOKEN_URL by service account
+// email and scope, until they expire
+var oauthTokens = struct {
+	sync.Mutex
+
+	cache map[string]cachedOAuthToken
+}{cache: make(map[string]cachedOAuthToken)}
+
+// oauthAccessToken returns the access token for the task's oauth_token. It is
+// the OAUTH_TOKEN env variable if set, else fetched from the OAUTH_TOKEN_URL
+// endpoint if set, else a fixed fake token.
+func oauthAccessToken(ctx context.Context, oauthToken *tasks.OAuthToken) (string, error) {
+	if token := os.Getenv("OAUTH_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	tokenURL := os.Getenv("OAUTH_TOKEN_URL")
+	if tokenURL == "" {
+		return defaultOAuthToken, nil
+	}
+
+	scope := oauthToken.GetScope()
+	if scope == "" {
+		scope = defaultOAuthScope
+	}
+	key := oauthToken.GetServiceAccountEmail() + " " + scope
+
+	oauthTokens.Lock()
+	cached, ok := oauthTokens.cache[key]
+	oauthTokens.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.accessToken, nil
+	}
+
+	token, err := fetchOAuthToken(ctx, tokenURL, oauthToken.GetServiceAccountEmail(), scope)
+	if err != nil {
+		return "", err
+	}
+
+	oauthTokens.Lock()
+	// Refreshed a little before it actually expires
+	oauthTokens.cache[key] = cachedOAuthToken{
+		accessToken: token.AccessToken,
+		expires:     time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 10*time.Second),
+	}
+	oauthTokens.Unlock()
+
+	return token.AccessToken, nil
+}
+
+// fetchOAuthToken gets a token from the endpoint, passing the service account
+// email and scope as query parameters, e.g.
+// GET <OAUTH_TOKEN_URL>?serviceAccountEmail=<EMAIL>&scopes=<SCOPE>
+func fetchOAuthToken(ctx context.Context, tokenURL string, serviceAccountEmail string, scope string) (*oauthTokenResponse, error) {
+	endpoint, err := url.Parse(tokenURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OAUTH_TOKEN_URL: %v", err)
+	}
+	query := endpoint.Query()
+	query.Set("serviceAccountEmail", serviceAccountEmail)
+	query.Set("scopes", scope)
+	endpoint.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequest(http.MethodGet, endpoint.String(), nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := outboundClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OAuth token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("failed to fetch OAuth token: HTTP status code %d", resp.StatusCode)
+	}
+
+	token := &oauthTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil || token.AccessToken == "" {
+		return nil, fmt.Errorf("failed to fetch OAuth token: invalid response")
+	}
+
+	return token, nil
+}
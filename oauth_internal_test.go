@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	pduration "github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestOAuthAccessTokenDefaultsToFakeToken(t *testing.T) {
+	token, err := oauthAccessToken(context.Background(), &taskspb.OAuthToken{ServiceAccountEmail: "emulator@service.test"})
+	require.NoError(t, err)
+	assert.Equal(t, defaultOAuthToken, token)
+
+	defer os.Unsetenv("OAUTH_TOKEN")
+	os.Setenv("OAUTH_TOKEN", "my-token")
+
+	token, err = oauthAccessToken(context.Background(), &taskspb.OAuthToken{ServiceAccountEmail: "emulator@service.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "my-token", token)
+}
+
+func TestOAuthAccessTokenFetchedFromEndpoint(t *testing.T) {
+	var mux sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		queries = append(queries, req.URL.RawQuery)
+
+		assert.Equal(t, "Google", req.Header.Get("Metadata-Flavor"))
+		w.Write([]byte(`{"access_token": "token-for-` + req.URL.Query().Get("serviceAccountEmail") + `", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer srv.Close()
+
+	defer os.Unsetenv("OAUTH_TOKEN_URL")
+	os.Setenv("OAUTH_TOKEN_URL", srv.URL+"/token")
+
+	// Fetched again, though cached by an earlier run of the test
+	oauthTokens.Lock()
+	oauthTokens.cache = make(map[string]cachedOAuthToken)
+	oauthTokens.Unlock()
+
+	for i := 0; i < 2; i++ {
+		token, err := oauthAccessToken(context.Background(), &taskspb.OAuthToken{ServiceAccountEmail: "first@service.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "token-for-first@service.test", token)
+	}
+	token, err := oauthAccessToken(context.Background(), &taskspb.OAuthToken{
+		ServiceAccountEmail: "second@service.test",
+		Scope:               "https://www.googleapis.com/auth/pubsub",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "token-for-second@service.test", token)
+
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, []string{
+		"scopes=https%3A%2F%2Fwww.googleapis.com%2Fauth%2Fcloud-platform&serviceAccountEmail=first%40service.test",
+		"scopes=https%3A%2F%2Fwww.googleapis.com%2Fauth%2Fpubsub&serviceAccountEmail=second%40service.test",
+	}, queries, "Cached until it expires")
+}
+
+func TestDispatchSendsOAuthToken(t *testing.T) {
+	authorization := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization <- req.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	defer os.Unsetenv("OAUTH_TOKEN")
+	os.Setenv("OAUTH_TOKEN", "my-token")
+
+	newTaskState := func() *taskspb.Task {
+		return &taskspb.Task{
+			Name:             "projects/bluebook/locations/us-east1/queues/agentq/tasks/my-task",
+			DispatchDeadline: &pduration.Duration{Seconds: 10},
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:        srv.URL,
+					HttpMethod: taskspb.HttpMethod_POST,
+					Headers:    map[string]string{},
+					AuthorizationHeader: &taskspb.HttpRequest_OauthToken{
+						OauthToken: &taskspb.OAuthToken{ServiceAccountEmail: "emulator@service.test"},
+					},
+				},
+			},
+		}
+	}
+
+	statusCode, _, err := dispatch(context.Background(), realClock{}, false, newTaskState(), attemptHistory{}, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "Bearer my-token", <-authorization)
+
+	// Not dispatched without a token
+	os.Unsetenv("OAUTH_TOKEN")
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	defer os.Unsetenv("OAUTH_TOKEN_URL")
+	os.Setenv("OAUTH_TOKEN_URL", failing.URL)
+
+	statusCode, _, err = dispatch(context.Background(), realClock{}, false, newTaskState(), attemptHistory{}, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, -1, statusCode)
+	assert.Len(t, authorization, 0)
+}
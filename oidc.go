@@ -5,13 +5,14 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"math/big"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
 )
 
 const jwksUriPath = "/jwks"
@@ -71,13 +72,24 @@ func init() {
 	OpenIDConfig.KeyID = "cloudtasks-emulator-test"
 }
 
-func createOIDCToken(serviceAccountEmail string, handlerUrl string) string {
+// oidcAudience returns the audience of the token, the handler URL unless the
+// task specifies one
+func oidcAudience(oidcToken *tasks.OidcToken, handlerUrl string) string {
+	if oidcToken.GetAudience() != "" {
+		return oidcToken.GetAudience()
+	}
+
+	return handlerUrl
+}
+
+func createOIDCToken(serviceAccountEmail string, audience string) string {
 	now := time.Now()
 	claims := OpenIDConnectClaims{
 		Email:         serviceAccountEmail,
 		EmailVerified: true,
 		StandardClaims: jwt.StandardClaims{
-			Audience:  handlerUrl,
+			Audience:  audience,
+			Subject:   serviceAccountEmail,
 			Issuer:    OpenIDConfig.IssuerURL,
 			IssuedAt:  now.Unix(),
 			NotBefore: now.Unix(),
@@ -91,7 +103,7 @@ func createOIDCToken(serviceAccountEmail string, handlerUrl string) string {
 	tokenString, err := token.SignedString(OpenIDConfig.PrivateKey)
 
 	if err != nil {
-		log.Fatalf("Failed to create OIDC token: %v", err)
+		logFatal("Failed to create OIDC token", field("error", err))
 	}
 
 	return tokenString
@@ -102,7 +114,7 @@ func openIDConfigHttpHandler(w http.ResponseWriter, r *http.Request) {
 		"issuer":                                OpenIDConfig.IssuerURL,
 		"jwks_uri":                              OpenIDConfig.IssuerURL + jwksUriPath,
 		"id_token_signing_alg_values_supported": []string{"RS256"},
-		"claims_supported":                      []string{"aud", "email", "email_verified", "exp", "iat", "iss", "nbf"},
+		"claims_supported":                      []string{"aud", "email", "email_verified", "exp", "iat", "iss", "nbf", "sub"},
 	}
 
 	respondJSON(w, config, 24*time.Hour)
@@ -130,14 +142,11 @@ func openIDJWKSHttpHandler(w http.ResponseWriter, r *http.Request) {
 	config := map[string]interface{}{
 		"keys": []map[string]string{
 			{
-				// Ideally we would export the exponent from the key too but frankly
-				// it's always AQAB in practice and I lost the will to live trying to
-				// base64url encode a 2-bytes int in go!
-				"e":   "AQAB",
+				"e":   b64Url.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
 				"n":   b64Url.EncodeToString(publicKey.N.Bytes()),
 				"kid": OpenIDConfig.KeyID,
 				"use": "sig",
-				"alg": "RSA256",
+				"alg": "RS256",
 				"kty": "RSA",
 			},
 		},
@@ -182,6 +191,6 @@ func configureOpenIdIssuer(issuerUrl string) (*http.Server, error) {
 	}
 
 	listenAddr := "0.0.0.0"
-	fmt.Printf("Issuing OpenID tokens as %v - running endpoint on %v:%v\n", issuerUrl, listenAddr, port)
+	logInfo("Issuing OpenID tokens", field("issuer", issuerUrl), field("address", listenAddr+":"+port))
 	return serveOpenIDConfigurationEndpoint(listenAddr, port), nil
 }
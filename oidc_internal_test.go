@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -46,6 +50,49 @@ func TestCreateOIDCTokenSignatureIsValidAgainstKey(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCreateOIDCTokenSignatureIsValidAgainstJWKS(t *testing.T) {
+	tokenStr := createOIDCToken("foobar@service.com", "http://any.service/foo")
+
+	// As a handler would, from the published key alone
+	resp := performRequest("GET", "/jwks", openIDJWKSHttpHandler)
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+
+	_, err := new(jwt.Parser).ParseWithClaims(
+		tokenStr,
+		&OpenIDConnectClaims{},
+		func(token *jwt.Token) (interface{}, error) {
+			key := jwks.Keys[0]
+			assert.Equal(t, key.Kid, token.Header["kid"])
+			assert.Equal(t, key.Alg, token.Header["alg"])
+
+			n, err := base64.RawURLEncoding.DecodeString(key.N)
+			require.NoError(t, err)
+			e, err := base64.RawURLEncoding.DecodeString(key.E)
+			require.NoError(t, err)
+
+			return &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}, nil
+		},
+	)
+	require.NoError(t, err)
+}
+
+func TestOIDCAudience(t *testing.T) {
+	assert.Equal(t, "http://my.service/foo", oidcAudience(&taskspb.OidcToken{}, "http://my.service/foo"), "Defaults to the handler URL")
+	assert.Equal(t, "my-audience", oidcAudience(&taskspb.OidcToken{Audience: "my-audience"}, "http://my.service/foo"))
+}
+
 func TestOpenIdConfigHttpHandler(t *testing.T) {
 	OpenIDConfig.IssuerURL = "http://foo.bar:8080"
 
@@ -82,7 +129,7 @@ func TestOpenIdJWKSHttpHandler(t *testing.T) {
           "n": "vhHj4zZSEg7q1-BdSbzSivtmn4EWF_PZIF7gAH-4iqm7v22MN-2wvnmpNLQG_-LeJ5M39kDHWt2ei3HEsxPxbEeeHRzCm23AgXDGTkjuUUXi7GP1nQmWcZnyckD0jr8kZO789pauck61GvnQhtdl4mP3JCCXPI0dJvbkr76ni-hMnjpB7GyChEglIArshTNPwhHm-6M0c4R3uVvzQUpuE7CEcisNH1u8HM0aOnQKXYc42a3P4yllpD70jNt008StXyyIIwN4LFT9-5vM9FrBEpY4k9EAggU2R7FEodnky6e8grPV2b0z2eRLu4jgITPMzyyqYc6LccEPsn99XqkF1w",
           "kid": "any-key-id",
           "use": "sig",
-          "alg": "RSA256",
+          "alg": "RS256",
           "kty": "RSA"
         }
       ]
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+// maxPageSize is the largest page ListTasks returns, also used when the page
+// size isn't set, as in Cloud Tasks
+const maxPageSize = 1000
+
+// taskPageToken holds where the next page of ListTasks starts: after the last
+// task of the previous page, in the order of taskListing. Pages follow on from
+// each other even as tasks are added and removed in between.
+type taskPageToken struct {
+	ScheduleTime time.Time `json:"scheduleTime"`
+
+	Name string `json:"name"`
+}
+
+// taskPageTokenFor returns the position of the task in the listing order
+func taskPageTokenFor(taskState *tasks.Task) taskPageToken {
+	scheduleTime, _ := ptypes.Timestamp(taskState.GetScheduleTime())
+
+	return taskPageToken{ScheduleTime: scheduleTime, Name: taskState.GetName()}
+}
+
+// before tells whether the position comes before the other one
+func (token taskPageToken) before(other taskPageToken) bool {
+	if !token.ScheduleTime.Equal(other.ScheduleTime) {
+		return token.ScheduleTime.Before(other.ScheduleTime)
+	}
+
+	return token.Name < other.Name
+}
+
+// encode returns the opaque form of the token
+func (token taskPageToken) encode() string {
+	data, _ := json.Marshal(token)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeTaskPageToken parses the token, nil for the first page
+func decodeTaskPageToken(pageToken string) (*taskPageToken, error) {
+	if pageToken == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return nil, invalidArgument("page_token", "Invalid page token.")
+	}
+	token := &taskPageToken{}
+	if err := json.Unmarshal(data, token); err != nil || token.Name == "" {
+		return nil, invalidArgument("page_token", "Invalid page token.")
+	}
+
+	return token, nil
+}
+
+// pageSize returns the number of tasks per page, the maximum if unset
+func pageSize(requested int32) (int, error) {
+	if requested < 0 {
+		return 0, invalidArgument("page_size", "page_size must not be negative.")
+	}
+	if requested == 0 || requested > maxPageSize {
+		return maxPageSize, nil
+	}
+
+	return int(requested), nil
+}
+
+// taskListing orders tasks by schedule time, then by name for a stable order
+type taskListing []*tasks.Task
+
+func (l taskListing) Len() int { return len(l) }
+
+func (l taskListing) Less(i, j int) bool {
+	return taskPageTokenFor(l[i]).before(taskPageTokenFor(l[j]))
+}
+
+func (l taskListing) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+// page sorts the tasks and returns those of the page starting after the token,
+// along with the token of the next page if there are more
+func (l taskListing) page(token *taskPageToken, size int) ([]*tasks.Task, string) {
+	sort.Sort(l)
+
+	start := 0
+	if token != nil {
+		start = sort.Search(len(l), func(i int) bool {
+			return token.before(taskPageTokenFor(l[i]))
+		})
+	}
+
+	end := start + size
+	if end >= len(l) {
+		return l[start:], ""
+	}
+
+	return l[start:end], taskPageTokenFor(l[end-1]).encode()
+}
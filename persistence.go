@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+const (
+	snapshotFileName = "snapshot.pb"
+
+	defaultSnapshotInterval = 10 * time.Second
+)
+
+// snapshotStore saves the snapshots of the emulator state, and loads the last
+// one on startup
+type snapshotStore interface {
+	Save(snapshot *Snapshot) error
+
+	// Load returns nil if nothing was saved yet
+	Load() (*Snapshot, error)
+}
+
+// taskStoreFactory is implemented by the snapshot stores that also store the
+// tasks of the queues as they change, rather than only with the snapshots
+type taskStoreFactory interface {
+	newTaskStore(queueName string) taskStore
+}
+
+// queueStore is implemented by the stores that also save the queues as they
+// change, so that their tasks are never stored without them
+type queueStore interface {
+	saveQueue(queueState *tasks.Queue, pull bool)
+
+	// removeQueue removes the queue once it's deleted, or the server reset
+	removeQueue(queueName string)
+}
+
+// queueLeaser is implemented by the stores shared with other instances of the
+// emulator, which dispatch each queue from a single instance, see redis.go
+type queueLeaser interface {
+	// leaseQueue tells whether the instance holds the lease to dispatch the
+	// queue, taking it if no other instance does
+	leaseQueue(queueName string) bool
+}
+
+// snapshotStores create the stores in a data dir by the name of their STORAGE
+var snapshotStores = map[string]func(dataDir string) (snapshotStore, error){
+	"file": newFileSnapshotStore,
+}
+
+// newSnapshotStore creates the store selected with STORAGE, a file by default
+func newSnapshotStore(dataDir string) (snapshotStore, error) {
+	storage := envOrDefault("STORAGE", "file")
+
+	newStore, ok := snapshotStores[storage]
+	if !ok {
+		return nil, fmt.Errorf("Unknown STORAGE %v, the sqlite storage requires building with -tags sqlite", storage)
+	}
+
+	return newStore(dataDir)
+}
+
+// Snapshot holds the queues and pending tasks of the emulator, as persisted to
+// the data dir. It is a protobuf message so that the unrecognized fields of the
+// queues, i.e. the logging config, are kept.
+type Snapshot struct {
+	Queues []*tasks.Queue `protobuf:"bytes,1,rep,name=queues,proto3" json:"queues,omitempty"`
+	Tasks  []*tasks.Task  `protobuf:"bytes,2,rep,name=tasks,proto3" json:"tasks,omitempty"`
+
+	// The names of the queues created as pull queues through the v2beta2 API
+	PullQueues []string `protobuf:"bytes,3,rep,name=pull_queues,json=pullQueues,proto3" json:"pullQueues,omitempty"`
+}
+
+func (m *Snapshot) Reset()         { *m = Snapshot{} }
+func (m *Snapshot) String() string { return proto.CompactTextString(m) }
+func (*Snapshot) ProtoMessage()    {}
+
+// snapshotInterval returns how often the state is saved, set with SNAPSHOT_INTERVAL
+// (e.g. 30s) and every 10 seconds by default
+func snapshotInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("SNAPSHOT_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultSnapshotInterval
+	}
+
+	return interval
+}
+
+// snapshot captures the queues and their pending tasks
+func (s *Server) snapshot() *Snapshot {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	snapshot := &Snapshot{}
+	for _, queue := range s.qs {
+		// Skip deleted queues
+		if queue == nil {
+			continue
+		}
+		snapshot.Queues = append(snapshot.Queues, queue.frozenState())
+		if queue.pull {
+			snapshot.PullQueues = append(snapshot.PullQueues, queue.name)
+		}
+
+		queue.tsMux.Lock()
+		for _, task := range queue.ts.list() {
+			snapshot.Tasks = append(snapshot.Tasks, task.frozenState())
+		}
+		queue.tsMux.Unlock()
+	}
+
+	return snapshot
+}
+
+// restore recreates the queues and tasks of the snapshot. Paused and drained
+// queues are restored as such, and tasks keep their schedule, create time and
+// attempts so far. Expects importMux to be held, for reading at least.
+func (s *Server) restore(snapshot *Snapshot) error {
+	pullQueues := make(map[string]bool)
+	for _, name := range snapshot.PullQueues {
+		pullQueues[name] = true
+	}
+
+	for _, queueState := range snapshot.Queues {
+		_, err := s.startQueue(&tasks.CreateQueueRequest{
+			Parent: queueParent(queueState.GetName()),
+			Queue:  queueState,
+		}, pullQueues[queueState.GetName()])
+		if err != nil {
+			return err
+		}
+
+		queue, _ := s.fetchQueue(queueState.GetName())
+		switch queueState.GetState() {
+		case tasks.Queue_PAUSED:
+			queue.Pause()
+		case tasks.Queue_DISABLED:
+			queue.Drain()
+		}
+	}
+
+	for _, taskState := range snapshot.Tasks {
+		// A task saved without its queue can't be restored, but shouldn't
+		// keep the emulator from starting either
+		queue, err := s.lookupQueue(taskQueueName(taskState.GetName()))
+		if err != nil {
+			logWarn("Skipping the task of a missing queue", field("task", taskState.GetName()))
+			continue
+		}
+
+		task, _, err := queue.NewTask(taskState)
+		if err != nil {
+			return err
+		}
+		s.setTask(taskState.GetName(), task)
+	}
+
+	return nil
+}
+
+// taskQueueName returns the name of the queue the task belongs to
+func taskQueueName(taskName string) string {
+	if i := strings.LastIndex(taskName, "/tasks/"); i >= 0 {
+		return taskName[:i]
+	}
+
+	return ""
+}
+
+// restoreSnapshot restores the state last saved to the store, if any
+func restoreSnapshot(s *Server, store snapshotStore) error {
+	snapshot, err := store.Load()
+	if err != nil || snapshot == nil {
+		return err
+	}
+
+	s.importMux.RLock()
+	defer s.importMux.RUnlock()
+
+	return s.restore(snapshot)
+}
+
+// persistSnapshots saves the state to the store at every interval, see
+// shutdownOnSignal for the last one
+func persistSnapshots(s *Server, store snapshotStore, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := store.Save(s.snapshot()); err != nil {
+			logError("Failed to save snapshot", field("error", err))
+		}
+	}
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then saves the state to the
+// store, if any, closes the files the server writes to and exits
+func shutdownOnSignal(s *Server, store snapshotStore) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if store != nil {
+		if err := store.Save(s.snapshot()); err != nil {
+			logError("Failed to save snapshot", field("error", err))
+		}
+	}
+	if err := s.Close(); err != nil {
+		logError("Failed to close the server", field("error", err))
+	}
+	os.Exit(0)
+}
+
+// fileSnapshotStore keeps the snapshot in a single file of the data dir
+type fileSnapshotStore struct {
+	path string
+}
+
+func newFileSnapshotStore(dataDir string) (snapshotStore, error) {
+	return &fileSnapshotStore{path: filepath.Join(dataDir, snapshotFileName)}, nil
+}
+
+// Save replaces the previous snapshot only once the new one is complete
+func (store *fileSnapshotStore) Save(snapshot *Snapshot) error {
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(store.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(store.path+".tmp", store.path)
+}
+
+func (store *fileSnapshotStore) Load() (*Snapshot, error) {
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{}
+	if err := proto.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	store, err := newSnapshotStore(dataDir)
+	require.NoError(t, err)
+
+	testSnapshotStore(t, store)
+}
+
+func TestUnknownStorage(t *testing.T) {
+	defer os.Unsetenv("STORAGE")
+	os.Setenv("STORAGE", "floppy")
+
+	_, err := newSnapshotStore(os.TempDir())
+	assert.Error(t, err)
+}
+
+// testSnapshotStore checks that the state saved to the store is restored
+func testSnapshotStore(t *testing.T, store snapshotStore) {
+	// Nothing to restore yet
+	restored := NewServer()
+	require.NoError(t, restoreSnapshot(restored, store))
+	assert.Empty(t, restored.snapshot().Queues)
+
+	server := NewServer()
+	defer server.Reset()
+
+	parent := "projects/bluebook/locations/us-east1"
+	runningQueueName := parent + "/queues/running"
+	pausedQueueName := parent + "/queues/paused"
+	for _, queueName := range []string{runningQueueName, pausedQueueName} {
+		_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: parent,
+			Queue: &taskspb.Queue{
+				Name:       queueName,
+				RateLimits: &taskspb.RateLimits{MaxConcurrentDispatches: 7},
+			},
+		})
+		require.NoError(t, err)
+	}
+	_, err := server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: pausedQueueName})
+	require.NoError(t, err)
+
+	scheduleTime, _ := ptypes.TimestampProto(time.Now().Add(time.Hour).Truncate(time.Second))
+	createdTask, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: runningQueueName,
+		Task: &taskspb.Task{
+			Name:         runningQueueName + "/tasks/later",
+			ScheduleTime: scheduleTime,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com", Body: []byte("body")},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	pullQueueName := parent + "/queues/pull"
+	_, err = server.createQueue(&taskspb.CreateQueueRequest{
+		Parent: parent,
+		Queue:  &taskspb.Queue{Name: pullQueueName},
+	}, true)
+	require.NoError(t, err)
+	pullTaskState := &taskspb.Task{Name: pullQueueName + "/tasks/pulled"}
+	setPullMessage(pullTaskState, &PullMessage{Payload: []byte("payload"), Tag: "tag"})
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{Parent: pullQueueName, Task: pullTaskState})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save(server.snapshot()))
+
+	restored = NewServer()
+	defer restored.Reset()
+	require.NoError(t, restoreSnapshot(restored, store))
+
+	runningQueue, err := restored.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: runningQueueName})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, runningQueue.GetState())
+	assert.Equal(t, int32(7), runningQueue.GetRateLimits().GetMaxConcurrentDispatches())
+
+	pausedQueue, err := restored.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: pausedQueueName})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, pausedQueue.GetState())
+
+	restoredTask, err := restored.GetTask(context.Background(), &taskspb.GetTaskRequest{
+		Name:         createdTask.GetName(),
+		ResponseView: taskspb.Task_FULL,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, createdTask.GetScheduleTime(), restoredTask.GetScheduleTime())
+	assert.Equal(t, createdTask.GetCreateTime(), restoredTask.GetCreateTime())
+	assert.Equal(t, []byte("body"), restoredTask.GetHttpRequest().GetBody())
+
+	pullQueue, _ := restored.fetchQueue(pullQueueName)
+	assert.True(t, pullQueue.pull)
+	pullTask, err := restored.GetTask(context.Background(), &taskspb.GetTaskRequest{
+		Name:         pullQueueName + "/tasks/pulled",
+		ResponseView: taskspb.Task_FULL,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &PullMessage{Payload: []byte("payload"), Tag: "tag"}, getPullMessage(pullTask))
+
+	// Scheduled again, so it can still be deleted before it is due
+	_, err = restored.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+}
+
+func TestRestoreSkipsTasksWithoutQueue(t *testing.T) {
+	parent := "projects/bluebook/locations/us-east1"
+	queueName := parent + "/queues/saved"
+	snapshot := &Snapshot{
+		Queues: []*taskspb.Queue{{Name: queueName}},
+		Tasks: []*taskspb.Task{
+			{Name: parent + "/queues/unsaved/tasks/orphan"},
+			{Name: queueName + "/tasks/kept"},
+		},
+	}
+
+	restored := NewServer()
+	defer restored.Reset()
+	require.NoError(t, restored.restore(snapshot))
+
+	_, err := restored.lookupTask(queueName + "/tasks/kept")
+	assert.NoError(t, err)
+	_, err = restored.lookupTask(parent + "/queues/unsaved/tasks/orphan")
+	assert.Error(t, err)
+	_, err = restored.lookupQueue(parent + "/queues/unsaved")
+	assert.Error(t, err)
+}
+
+func TestSnapshotInterval(t *testing.T) {
+	defer os.Unsetenv("SNAPSHOT_INTERVAL")
+
+	for interval, expected := range map[string]time.Duration{
+		"":      10 * time.Second,
+		"30s":   30 * time.Second,
+		"0s":    10 * time.Second,
+		"often": 10 * time.Second,
+	} {
+		os.Setenv("SNAPSHOT_INTERVAL", interval)
+		assert.Equal(t, expected, snapshotInterval(), "SNAPSHOT_INTERVAL=%v", interval)
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
 	rpccode "google.golang.org/genproto/googleapis/rpc/code"
+	codes "google.golang.org/grpc/codes"
 )
 
 func toHTTPMethod(taskMethod tasks.HttpMethod) string {
@@ -66,3 +67,33 @@ func toRPCStatusCode(statusCode int) int32 {
 func toCodeName(rpcCode int32) string {
 	return rpccode.Code_name[rpcCode]
 }
+
+// toHTTPStatusCode maps a gRPC code to the HTTP status the REST API responds with
+func toHTTPStatusCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
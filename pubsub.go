@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// FailedTask is the JSON envelope of a task that ran out of attempts, published
+// to a Pub/Sub topic to archive it
+type FailedTask struct {
+	TaskName string `json:"taskName"`
+
+	QueueName string `json:"queueName"`
+
+	// The target of the task, the host and relative URI for App Engine tasks
+	URL string `json:"url"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Base64 encoded, as the body may be binary
+	Body []byte `json:"body,omitempty"`
+
+	// The status code of the last attempt, -1 if no response was received
+	StatusCode int `json:"statusCode"`
+
+	DispatchCount int32 `json:"dispatchCount"`
+}
+
+// newFailedTask describes the task with its payload and final status
+func newFailedTask(task *Task, queueName string, statusCode int) FailedTask {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	headers := task.state.GetHttpRequest().GetHeaders()
+	if appEngineHTTPRequest := task.state.GetAppEngineHttpRequest(); appEngineHTTPRequest != nil {
+		headers = appEngineHTTPRequest.GetHeaders()
+	}
+
+	return FailedTask{
+		TaskName:      task.state.GetName(),
+		QueueName:     queueName,
+		URL:           targetURL(task.state, nil),
+		Headers:       headers,
+		Body:          getBody(task.state),
+		StatusCode:    statusCode,
+		DispatchCount: task.state.GetDispatchCount(),
+	}
+}
+
+// failedTaskTopic returns the Pub/Sub topic permanently failed tasks are
+// published to, set per queue with FAILED_TASK_TOPIC_<QUEUE_ID> or for all queues
+// with FAILED_TASK_TOPIC. A topic ID refers to a topic in the project of the queue.
+func failedTaskTopic(queueName string) string {
+	topic := queueSetting("FAILED_TASK_TOPIC", queueName)
+	if topic != "" && !strings.Contains(topic, "/") {
+		project := strings.SplitN(queueName, "/", 3)[1]
+		topic = "projects/" + project + "/topics/" + topic
+	}
+
+	return topic
+}
+
+// publishFailedTask publishes the failed task to the topic through the REST API
+// of the Pub/Sub emulator at PUBSUB_EMULATOR_HOST
+func publishFailedTask(topic string, failedTask FailedTask) {
+	host := os.Getenv("PUBSUB_EMULATOR_HOST")
+	if host == "" {
+		logError("Failed to publish failed task, PUBSUB_EMULATOR_HOST is not set", field("task", failedTask.TaskName), field("topic", topic))
+		return
+	}
+
+	data, err := json.Marshal(failedTask)
+	if err != nil {
+		panic(err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"messages": []map[string]interface{}{{
+			// Base64 encoded as a byte slice
+			"data": data,
+			"attributes": map[string]string{
+				"taskName":  failedTask.TaskName,
+				"queueName": failedTask.QueueName,
+			},
+		}},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+host+"/v1/"+topic+":publish", bytes.NewReader(body))
+	if err != nil {
+		logError("Failed to publish failed task", field("task", failedTask.TaskName), field("topic", topic), field("error", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := outboundClient.Do(req.WithContext(ctx))
+	if err != nil {
+		logError("Failed to publish failed task", field("task", failedTask.TaskName), field("topic", topic), field("error", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logError("Failed to publish failed task", field("task", failedTask.TaskName), field("topic", topic), field("statusCode", resp.StatusCode))
+	}
+}
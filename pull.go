@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+	ptimestamp "github.com/golang/protobuf/ptypes/timestamp"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// Cloud Tasks v2 only pushes tasks, but to support code written for the pull
+// queues of the older APIs, a queue can be made a pull queue with
+// PULL_QUEUE_<QUEUE_ID>=true, or by creating it with a pull target through the
+// v2beta2 API. Its tasks aren't dispatched, but leased and acknowledged by the
+// worker. As in those APIs, the schedule time of a leased task is the end of
+// its lease, after which the task can be leased again.
+
+const maxLeaseDuration = 7 * 24 * time.Hour
+
+// leaseFilterRegexp matches the only lease filter supported, tag="<TAG>"
+var leaseFilterRegexp = regexp.MustCompile(`^tag\s*=\s*"([^"]*)"$`)
+
+// PullMessage mirrors the v2beta2 message of the same name, the payload of the
+// tasks of pull queues. The v2 Task message has no such field, so it is kept
+// in XXX_unrecognized under a field number v2 doesn't use, like the logging
+// config of queues (see queuelogging.go).
+type PullMessage struct {
+	Payload []byte `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	Tag     string `protobuf:"bytes,2,opt,name=tag,proto3" json:"tag,omitempty"`
+}
+
+func (m *PullMessage) Reset()         { *m = PullMessage{} }
+func (m *PullMessage) String() string { return proto.CompactTextString(m) }
+func (*PullMessage) ProtoMessage()    {}
+
+// taskUnrecognizedFields decodes the Task fields of the emulator
+type taskUnrecognizedFields struct {
+	PullMessage      *PullMessage `protobuf:"bytes,100,opt,name=pull_message,json=pullMessage,proto3" json:"pullMessage,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (m *taskUnrecognizedFields) Reset()         { *m = taskUnrecognizedFields{} }
+func (m *taskUnrecognizedFields) String() string { return proto.CompactTextString(m) }
+func (*taskUnrecognizedFields) ProtoMessage()    {}
+
+func getPullMessage(taskState *tasks.Task) *PullMessage {
+	fields := &taskUnrecognizedFields{}
+	proto.Unmarshal(taskState.XXX_unrecognized, fields)
+
+	return fields.PullMessage
+}
+
+func setPullMessage(taskState *tasks.Task, message *PullMessage) {
+	fields := &taskUnrecognizedFields{}
+	proto.Unmarshal(taskState.XXX_unrecognized, fields)
+
+	fields.PullMessage = message
+	taskState.XXX_unrecognized, _ = proto.Marshal(fields)
+}
+
+// isPullQueue tells whether the queue was made a pull queue
+func isPullQueue(queueName string) bool {
+	pull, _ := strconv.ParseBool(queueEnv("PULL_QUEUE", queueName))
+	return pull
+}
+
+// leaseFilter parses the filter of the tasks to lease, either empty or tag="<TAG>"
+// to lease only the tasks with a pull message of that tag
+func leaseFilter(filter string) (func(taskState *tasks.Task) bool, error) {
+	if filter == "" {
+		return func(taskState *tasks.Task) bool { return true }, nil
+	}
+
+	match := leaseFilterRegexp.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, invalidArgument("filter", `filter must be formatted: tag="<TAG>"`)
+	}
+	tag := match[1]
+
+	return func(taskState *tasks.Task) bool {
+		return getPullMessage(taskState) != nil && getPullMessage(taskState).Tag == tag
+	}, nil
+}
+
+// LeaseTasks leases up to maxTasks of the due tasks of a pull queue for the
+// duration, those matching the filter if given (see leaseFilter)
+func (s *Server) LeaseTasks(ctx context.Context, queueName string, maxTasks int, leaseDuration time.Duration, filter string) ([]*tasks.Task, error) {
+	queue, err := s.lookupQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+	if !queue.pull {
+		return nil, status.Errorf(codes.FailedPrecondition, "Tasks can only be leased from pull queues.")
+	}
+	if maxTasks < 1 || maxTasks > 1000 {
+		return nil, invalidArgument("max_tasks", "max_tasks must be between 1 and 1000.")
+	}
+	if leaseDuration <= 0 || leaseDuration > maxLeaseDuration {
+		return nil, invalidArgument("lease_duration", "lease_duration must be positive and at most a week.")
+	}
+	match, err := leaseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return queue.lease(maxTasks, leaseDuration, match), nil
+}
+
+// lookupLeasedTask returns the task of a pull queue, as long as it's leased
+func (s *Server) lookupLeasedTask(taskName string) (*Task, error) {
+	task, err := s.lookupTask(taskName)
+	if err != nil {
+		return nil, err
+	}
+	if !task.queue.pull {
+		return nil, status.Errorf(codes.FailedPrecondition, "Only tasks of pull queues can be leased.")
+	}
+
+	return task, nil
+}
+
+// AcknowledgeTask removes a leased task of a pull queue, as it has been
+// processed. The schedule time, if given, must be that of the current lease.
+func (s *Server) AcknowledgeTask(ctx context.Context, taskName string, scheduleTime *ptimestamp.Timestamp) (*empty.Empty, error) {
+	task, err := s.lookupLeasedTask(taskName)
+	if err != nil {
+		return nil, err
+	}
+
+	task.stateMutex.Lock()
+	err = task.checkLease(scheduleTime)
+	task.stateMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The removal of the task from the server struct is handled in the queue callback
+	task.Delete()
+
+	return &empty.Empty{}, nil
+}
+
+// RenewLease extends the lease of a task of a pull queue to the duration from
+// now. The schedule time, if given, must be that of the current lease.
+func (s *Server) RenewLease(ctx context.Context, taskName string, scheduleTime *ptimestamp.Timestamp, leaseDuration time.Duration) (*tasks.Task, error) {
+	task, err := s.lookupLeasedTask(taskName)
+	if err != nil {
+		return nil, err
+	}
+	if leaseDuration <= 0 || leaseDuration > maxLeaseDuration {
+		return nil, invalidArgument("lease_duration", "lease_duration must be positive and at most a week.")
+	}
+
+	return task.moveLease(scheduleTime, s.clock.Now().Add(leaseDuration))
+}
+
+// CancelLease ends the lease of a task of a pull queue, so that it can be leased
+// again straight away. The schedule time, if given, must be that of the current
+// lease.
+func (s *Server) CancelLease(ctx context.Context, taskName string, scheduleTime *ptimestamp.Timestamp) (*tasks.Task, error) {
+	task, err := s.lookupLeasedTask(taskName)
+	if err != nil {
+		return nil, err
+	}
+
+	return task.moveLease(scheduleTime, s.clock.Now())
+}
+
+// lease leases up to maxTasks of the due tasks matching the filter, those
+// scheduled the earliest first
+func (queue *Queue) lease(maxTasks int, leaseDuration time.Duration, match func(taskState *tasks.Task) bool) []*tasks.Task {
+	now := queue.clock.Now()
+
+	// Held throughout so that concurrent leases don't lease the same tasks
+	queue.tsMux.Lock()
+	defer queue.tsMux.Unlock()
+
+	type dueTask struct {
+		task      *Task
+		scheduled time.Time
+	}
+	var due []dueTask
+	for _, task := range queue.ts.list() {
+		task.stateMutex.Lock()
+		scheduled, _ := ptypes.Timestamp(task.state.GetScheduleTime())
+		matched := match(task.state)
+		task.stateMutex.Unlock()
+
+		if matched && !scheduled.After(now) {
+			due = append(due, dueTask{task: task, scheduled: scheduled})
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].scheduled.Equal(due[j].scheduled) {
+			return due[i].scheduled.Before(due[j].scheduled)
+		}
+		return due[i].task.created.Before(due[j].task.created)
+	})
+
+	leased := []*tasks.Task{}
+	for i := 0; i < len(due) && i < maxTasks; i++ {
+		leased = append(leased, due[i].task.lease(now.Add(leaseDuration)))
+	}
+
+	return leased
+}
+
+// hold keeps a task of a pull queue, which is leased instead of dispatched,
+// until it's deleted
+func (task *Task) hold() {
+	task.queue.goRoutine(func() {
+		<-task.cancel
+		task.onDone(task)
+	})
+}
+
+// lease records the lease as an attempt, and moves the schedule time to the end
+// of the lease so that the task isn't leased again before then
+func (task *Task) lease(until time.Time) *tasks.Task {
+	updateStateForDispatch(task)
+
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	task.state.ScheduleTime, _ = ptypes.TimestampProto(until)
+
+	return proto.Clone(task.state).(*tasks.Task)
+}
+
+// moveLease moves the end of the current lease of the task
+func (task *Task) moveLease(scheduleTime *ptimestamp.Timestamp, until time.Time) (*tasks.Task, error) {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	if err := task.checkLease(scheduleTime); err != nil {
+		return nil, err
+	}
+	task.state.ScheduleTime, _ = ptypes.TimestampProto(until)
+
+	return proto.Clone(task.state).(*tasks.Task), nil
+}
+
+// checkLease fails unless the task is leased, until the schedule time if given,
+// expects stateMutex to be held
+func (task *Task) checkLease(scheduleTime *ptimestamp.Timestamp) error {
+	leasedUntil, _ := ptypes.Timestamp(task.state.GetScheduleTime())
+
+	if task.deleted || task.state.GetDispatchCount() == 0 || !leasedUntil.After(task.queue.clock.Now()) {
+		return status.Errorf(codes.FailedPrecondition, "The task is not leased, or its lease has expired.")
+	}
+	if scheduleTime != nil && !proto.Equal(scheduleTime, task.state.GetScheduleTime()) {
+		return status.Errorf(codes.FailedPrecondition, "The schedule time does not match the current lease of the task.")
+	}
+
+	return nil
+}
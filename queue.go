@@ -1,85 +1,472 @@
 package main
 
 import (
-	"log"
+	"container/heap"
+	"encoding/json"
+	"math"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	pduration "github.com/golang/protobuf/ptypes/duration"
 
 	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 )
 
 // Queue holds all internals for a task queue
 type Queue struct {
 	name string
 
+	// The clock of the server, see clock.go
+	clock Clock
+
 	state *tasks.Queue
 
-	fire chan *Task
+	// Tasks waiting for their schedule time, see scheduler.go
+	scheduled taskSchedule
+
+	scheduledSeq uint64
+
+	scheduledMux sync.Mutex
+
+	// Wakes up the scheduler when the scheduled tasks change
+	scheduleSignal chan bool
+
+	cancelScheduler chan bool
+
+	// Tasks that are due, waiting to be dispatched in ETA order
+	due taskHeap
 
-	work chan *Task
+	dueSeq uint64
 
-	ts map[string]*Task
+	dueMux sync.Mutex
+
+	dueSignal chan bool
+
+	work chan *taskHeapEntry
+
+	ts taskStore
 
 	tsMux sync.Mutex
 
+	// The maximum number of tasks in the queue, 0 for unlimited
+	maxTasks int
+
+	// Set by Drain, guarded by tsMux so that no task is added once draining
+	draining bool
+
+	// Closed once a draining queue has no tasks left
+	drainDone chan bool
+
 	tokenBucket chan bool
 
+	// Guarded by lifecycleMux, as it changes when the queue is updated
 	maxDispatchesPerSecond float64
 
+	// Signals the token generator that maxDispatchesPerSecond changed
+	retuneTokenGenerator chan bool
+
+	// Slows the queue down on overloaded responses, nil if disabled, see throttling.go
+	throttle *systemThrottle
+
+	// Dispatches one task at a time in schedule order, without retry jitter
+	serial bool
+
+	// The fraction the retry backoffs are spread by, see applyJitter
+	retryJitter float64
+
 	cancelTokenGenerator chan bool
 
 	cancelDispatcher chan bool
 
-	cancelWorkers chan bool
+	// Sized to the max concurrent dispatches while the queue runs, empty otherwise
+	workers *workerPool
+
+	// Guards the pause, resume and delete transitions, and queue updates
+	lifecycleMux sync.Mutex
+
+	// Set by Run, the goroutines are only stopped if they were started
+	started bool
 
 	cancelled bool
 
 	paused bool
 
+	// Set by Freeze, which stops the dispatches like a pause without changing
+	// the state of the queue
+	frozen bool
+
+	// Set while another instance holds the dispatch lease of the queue, which
+	// stops the dispatches like a freeze, see redis.go
+	unleased bool
+
+	// Set once a draining queue has no tasks left and its goroutines are stopped
+	drained bool
+
+	// Tracks the goroutines of the queue and its tasks, see Wait
+	routines sync.WaitGroup
+
 	onTaskDone func(task *Task)
+
+	httpTarget *HttpTarget
+
+	// Headers added to every task dispatched from the queue
+	defaultHeaders map[string]string
+
+	// Optionally notified when a task runs out of attempts
+	onTaskFailed func(task *Task, statusCode int)
+
+	// Adds the task that ran out of attempts to the dead letter queue, set by the
+	// server, see deadletter.go
+	enqueueDeadLetter func(deadLetterQueue string, task *Task)
+
+	// Optionally notified when the queue is paused, resumed, deleted or purged
+	onEvent func(event QueueEvent)
+
+	// Shared by all queues to bound the concurrent dispatches, nil for no bound
+	dispatchSlots chan bool
+
+	// Whether the tasks are leased instead of dispatched, see pull.go
+	pull bool
+
+	// Shared by all queues to record the dispatch outcomes, nil to not record them
+	dispatchEvents *dispatchEventLog
+
+	// Shared by all queues, nil to not record metrics
+	metrics *metricsRegistry
+
+	// Shared by all queues, nil to not publish task events
+	taskEvents *taskEventStream
+
+	statsMux sync.Mutex
+
+	// Guarded by statsMux
+	routineCounts RoutineCounts
+
+	executions []time.Time
+
+	concurrentDispatches int64
+
+	// The tasks that succeeded or ran out of attempts
+	completedTasks int64
+
+	// When the token generator adds the next token, see TokenBucketStats
+	nextToken time.Time
+}
+
+// QueueStats holds the live statistics of a queue, mirroring the Cloud Tasks
+// QueueStats message. The emulator computes these on request: TasksCount and
+// OldestEstimatedArrivalTime are exact, while ExecutedLastMinuteCount,
+// ConcurrentDispatchesCount and EffectiveExecutionRate are approximations.
+type QueueStats struct {
+	TasksCount int64
+
+	// Zero if the queue has no tasks
+	OldestEstimatedArrivalTime time.Time
+
+	ExecutedLastMinuteCount int64
+
+	ConcurrentDispatchesCount int64
+
+	EffectiveExecutionRate float64
+}
+
+// HttpTarget is the default HTTP target of a queue, used to build buffered
+// tasks. It is set with the HTTP_TARGET_URI_<QUEUE_ID> and
+// HTTP_TARGET_METHOD_<QUEUE_ID> env variables rather than on the queue.
+type HttpTarget struct {
+	Uri string
+
+	HttpMethod tasks.HttpMethod
+
+	Headers map[string]string
+}
+
+// RoutineCounts are the numbers of running goroutines of a queue, to detect leaks
+type RoutineCounts struct {
+	Workers int64
+
+	Dispatchers int64
+
+	TokenGenerators int64
+
+	Schedulers int64
+}
+
+// TokenBucketStats describes the rate limiting token bucket of a queue, to tell
+// why dispatches stall
+type TokenBucketStats struct {
+	// The tokens available for dispatches
+	Tokens int
+
+	MaxBurstSize int
+
+	// The interval at which tokens are added
+	Period time.Duration
+
+	// Zero while the bucket is full, as the next token is then only added once a
+	// dispatch takes one, or if the queue isn't running
+	NextToken time.Time
+}
+
+// queueEnv returns the value of the env variable specific to the queue, the
+// queue ID being uppercased and hyphens replaced, e.g. KEY_MY_QUEUE for my-queue
+func queueEnv(key string, queueName string) string {
+	queueID := queueName[strings.LastIndex(queueName, "/")+1:]
+	suffix := strings.ToUpper(strings.Replace(queueID, "-", "_", -1))
+
+	return os.Getenv(key + "_" + suffix)
+}
+
+// queueSetting returns the value of the env variable specific to the queue if
+// set, see queueEnv, or else that of the env variable for all queues
+func queueSetting(key string, queueName string) string {
+	if queueName != "" {
+		if value := queueEnv(key, queueName); value != "" {
+			return value
+		}
+	}
+
+	return os.Getenv(key)
+}
+
+// maxTasksFromEnv returns the maximum number of tasks a queue can hold, set with
+// MAX_TASKS_PER_QUEUE and unlimited (0) by default
+func maxTasksFromEnv() int {
+	maxTasks, err := strconv.ParseInt(os.Getenv("MAX_TASKS_PER_QUEUE"), 10, 32)
+	if err != nil || maxTasks < 0 {
+		return 0
+	}
+
+	return int(maxTasks)
+}
+
+// serialDispatch returns whether the queue dispatches its tasks strictly one at
+// a time, set for all queues with serial and overridden per queue with
+// SERIAL_DISPATCH_<QUEUE_ID>
+func serialDispatch(queueName string, serial bool) bool {
+	if queueSerial, err := strconv.ParseBool(queueEnv("SERIAL_DISPATCH", queueName)); err == nil {
+		return queueSerial
+	}
+
+	return serial
+}
+
+// initialTokens returns the number of tokens a new queue starts with. Like Cloud
+// Tasks the bucket starts full, unless INITIAL_TOKEN_FILL is set to the fraction
+// (0 to 1) to start with, so that the first dispatches are paced as well.
+func initialTokens(maxBurstSize int32) int {
+	fill, err := strconv.ParseFloat(os.Getenv("INITIAL_TOKEN_FILL"), 64)
+	if err != nil || math.IsNaN(fill) || fill < 0 || fill > 1 {
+		return int(maxBurstSize)
+	}
+
+	return int(fill * float64(maxBurstSize))
+}
+
+// queueParent returns the location of the queue, e.g. projects/my-project/locations/my-location
+func queueParent(queueName string) string {
+	if i := strings.Index(queueName, "/queues/"); i >= 0 {
+		return queueName[:i]
+	}
+
+	return queueName
+}
+
+// queueProject returns the project ID of the queue
+func queueProject(queueName string) string {
+	parts := strings.Split(queueName, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+func httpTargetFromEnv(queueName string) *HttpTarget {
+	uri := queueEnv("HTTP_TARGET_URI", queueName)
+	if uri == "" {
+		return nil
+	}
+
+	httpMethod := tasks.HttpMethod_POST
+	if method, ok := tasks.HttpMethod_value[strings.ToUpper(queueEnv("HTTP_TARGET_METHOD", queueName))]; ok {
+		httpMethod = tasks.HttpMethod(method)
+	}
+
+	return &HttpTarget{
+		Uri:        uri,
+		HttpMethod: httpMethod,
+		Headers:    make(map[string]string),
+	}
+}
+
+// defaultHeadersFromEnv reads the queue's default headers as a JSON object
+// from the DEFAULT_HEADERS_<QUEUE_ID> env variable
+func defaultHeadersFromEnv(queueName string) map[string]string {
+	headers := make(map[string]string)
+
+	if value := queueEnv("DEFAULT_HEADERS", queueName); value != "" {
+		if err := json.Unmarshal([]byte(value), &headers); err != nil {
+			logWarn("Ignoring invalid default headers", field("queue", queueName), field("error", err))
+		}
+	}
+
+	return headers
+}
+
+// NewQueue creates a new task queue, with the settings of the env
+func NewQueue(name string, state *tasks.Queue, clock Clock, onTaskDone func(task *Task)) (*Queue, *tasks.Queue) {
+	return newQueue(name, state, clock, onTaskDone, settingsFromEnv())
 }
 
-// NewQueue creates a new task queue
-func NewQueue(name string, state *tasks.Queue, onTaskDone func(task *Task)) (*Queue, *tasks.Queue) {
+// newQueue creates a new task queue with the settings of its server
+func newQueue(name string, state *tasks.Queue, clock Clock, onTaskDone func(task *Task), settings *settings) (*Queue, *tasks.Queue) {
 	setInitialQueueState(state)
 
 	queue := &Queue{
 		name:                   name,
+		clock:                  clock,
 		state:                  state,
-		fire:                   make(chan *Task),
-		work:                   make(chan *Task),
-		ts:                     make(map[string]*Task),
+		scheduled:              newTaskSchedule(settings.scheduler, clock.Now()),
+		scheduleSignal:         make(chan bool, 1),
+		cancelScheduler:        make(chan bool, 1),
+		dueSignal:              make(chan bool, 1),
+		work:                   make(chan *taskHeapEntry),
+		ts:                     newMemoryTaskStore(),
+		maxTasks:               settings.maxTasksPerQueue,
+		pull:                   isPullQueue(name),
 		onTaskDone:             onTaskDone,
+		httpTarget:             httpTargetFromEnv(name),
+		defaultHeaders:         defaultHeadersFromEnv(name),
+		onTaskFailed:           func(task *Task, statusCode int) {},
+		enqueueDeadLetter:      func(deadLetterQueue string, task *Task) {},
+		onEvent:                func(event QueueEvent) {},
 		tokenBucket:            make(chan bool, state.GetRateLimits().GetMaxBurstSize()),
 		maxDispatchesPerSecond: state.GetRateLimits().GetMaxDispatchesPerSecond(),
+		retuneTokenGenerator:   make(chan bool, 1),
+		throttle:               newSystemThrottle(settings.systemThrottling, clock),
+		serial:                 serialDispatch(name, settings.serialDispatch),
+		retryJitter:            settings.retryJitter,
 		cancelTokenGenerator:   make(chan bool, 1),
 		cancelDispatcher:       make(chan bool, 1),
-		cancelWorkers:          make(chan bool, 1),
+		drainDone:              make(chan bool),
+	}
+	queue.workers = newWorkerPool(func(stop chan bool) {
+		queue.goCountedRoutine(&queue.routineCounts.Workers, func() {
+			queue.runWorker(stop)
+		})
+	})
+	if url := deadLetterURL(name); url != "" {
+		queue.onTaskFailed = func(task *Task, statusCode int) {
+			go sendDeadLetter(url, DeadLetter{
+				TaskName:      task.state.GetName(),
+				QueueName:     name,
+				StatusCode:    statusCode,
+				DispatchCount: task.state.GetDispatchCount(),
+			})
+		}
+	}
+	if topic := failedTaskTopic(name); topic != "" {
+		notify := queue.onTaskFailed
+		queue.onTaskFailed = func(task *Task, statusCode int) {
+			notify(task, statusCode)
+			go publishFailedTask(topic, newFailedTask(task, name, statusCode))
+		}
+	}
+	if deadLetterQueue := deadLetterQueueName(name); deadLetterQueue != "" {
+		notify := queue.onTaskFailed
+		queue.onTaskFailed = func(task *Task, statusCode int) {
+			notify(task, statusCode)
+			queue.enqueueDeadLetter(deadLetterQueue, task)
+		}
+	}
+
+	if url := queueEventsURL(name); url != "" {
+		queue.onEvent = func(event QueueEvent) {
+			go sendQueueEvent(url, event)
+		}
 	}
+
 	// Fill the token bucket
-	for i := 0; i < int(state.GetRateLimits().GetMaxBurstSize()); i++ {
+	for i := 0; i < initialTokens(state.GetRateLimits().GetMaxBurstSize()); i++ {
 		queue.tokenBucket <- true
 	}
 
 	return queue, state
 }
 
-func (queue *Queue) setTask(taskName string, task *Task) {
+// addTask adds the task unless the queue is draining or at its maximum number of tasks
+func (queue *Queue) addTask(taskName string, task *Task) error {
 	queue.tsMux.Lock()
 	defer queue.tsMux.Unlock()
-	queue.ts[taskName] = task
+
+	if queue.draining {
+		return status.Errorf(codes.FailedPrecondition, "The queue is draining and does not accept new tasks.")
+	}
+	if queue.maxTasks > 0 && queue.ts.len() >= queue.maxTasks {
+		return resourceExhausted(queue.name, "The queue has reached its maximum of %d tasks.", queue.maxTasks)
+	}
+	queue.ts.put(taskName, task)
+
+	return nil
 }
 
 func (queue *Queue) removeTask(taskName string) {
-	queue.setTask(taskName, nil)
+	queue.tsMux.Lock()
+	defer queue.tsMux.Unlock()
+
+	if _, ok := queue.ts.get(taskName); !ok {
+		return
+	}
+	queue.ts.remove(taskName)
+
+	if queue.draining && queue.ts.len() == 0 {
+		close(queue.drainDone)
+	}
 }
 
+// backoffFromEnv parses the backoff env variable of the queue as a duration such
+// as 2s or 100ms, or failing that as a number of seconds. Unset, invalid and
+// non-positive values are ignored.
+func backoffFromEnv(key string, queueName string) (*pduration.Duration, bool) {
+	value := queueSetting(key, queueName)
+
+	backoff, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, false
+		}
+		backoff = time.Duration(seconds * float64(time.Second))
+	}
+	if backoff <= 0 {
+		return nil, false
+	}
+
+	return ptypes.DurationProto(backoff), true
+}
+
+// setInitialQueueState resolves the effective queue config, filling in the
+// defaults and applying the env overrides
 func setInitialQueueState(queueState *tasks.Queue) {
+	setAppEngineRoutingOverrideHost(queueState)
+	setRateLimitsDefaults(queueState)
+	setRetryConfigDefaults(queueState)
+
+	queueState.State = tasks.Queue_RUNNING
+}
+
+// setRateLimitsDefaults fills in the unset rate limits and applies the env
+// overrides, those specific to the queue taking precedence
+func setRateLimitsDefaults(queueState *tasks.Queue) {
+	queueName := queueState.GetName()
 	if queueState.GetRateLimits() == nil {
 		queueState.RateLimits = &tasks.RateLimits{}
 	}
@@ -87,7 +474,7 @@ func setInitialQueueState(queueState *tasks.Queue) {
 		queueState.RateLimits.MaxDispatchesPerSecond = 500.0
 	}
 
-	maxDispatchesPerSecond, err := strconv.ParseFloat(os.Getenv("MAX_DISPATCHES_PER_SECOND"), 64)
+	maxDispatchesPerSecond, err := strconv.ParseFloat(queueSetting("MAX_DISPATCHES_PER_SECOND", queueName), 64)
 	if err == nil && maxDispatchesPerSecond != 0 {
 		queueState.RateLimits.MaxDispatchesPerSecond = maxDispatchesPerSecond
 	}
@@ -96,7 +483,7 @@ func setInitialQueueState(queueState *tasks.Queue) {
 		queueState.RateLimits.MaxBurstSize = 100
 	}
 
-	maxBurstSize, err := strconv.ParseInt(os.Getenv("MAX_BURST_SIZE"), 10, 32)
+	maxBurstSize, err := strconv.ParseInt(queueSetting("MAX_BURST_SIZE", queueName), 10, 32)
 	if err == nil && maxBurstSize != 0 {
 		queueState.RateLimits.MaxBurstSize = int32(maxBurstSize)
 	}
@@ -105,18 +492,23 @@ func setInitialQueueState(queueState *tasks.Queue) {
 		queueState.RateLimits.MaxConcurrentDispatches = 1000
 	}
 
-	maxConcurrentDispatches, err := strconv.ParseInt(os.Getenv("MAX_CONCURRENT_DISPATCHES"), 10, 32)
+	maxConcurrentDispatches, err := strconv.ParseInt(queueSetting("MAX_CONCURRENT_DISPATCHES", queueName), 10, 32)
 	if err == nil && maxConcurrentDispatches != 0 {
 		queueState.RateLimits.MaxConcurrentDispatches = int32(maxConcurrentDispatches)
 	}
+}
 
+// setRetryConfigDefaults fills in the unset retry config and applies the env
+// overrides, those specific to the queue taking precedence
+func setRetryConfigDefaults(queueState *tasks.Queue) {
+	queueName := queueState.GetName()
 	if queueState.GetRetryConfig() == nil {
 		queueState.RetryConfig = &tasks.RetryConfig{}
 	}
 	if queueState.GetRetryConfig().GetMaxAttempts() == 0 {
 		queueState.RetryConfig.MaxAttempts = 100
 	}
-	maxAttempts, err := strconv.ParseInt(os.Getenv("MAX_ATTEMPTS"), 10, 32)
+	maxAttempts, err := strconv.ParseInt(queueSetting("MAX_ATTEMPTS", queueName), 10, 32)
 	if err == nil && maxAttempts != 0 {
 		queueState.RetryConfig.MaxAttempts = int32(maxAttempts)
 	}
@@ -124,7 +516,7 @@ func setInitialQueueState(queueState *tasks.Queue) {
 	if queueState.GetRetryConfig().GetMaxDoublings() == 0 {
 		queueState.RetryConfig.MaxDoublings = 16
 	}
-	maxDoublings, err := strconv.ParseInt(os.Getenv("MAX_DOUBLINGS"), 10, 32)
+	maxDoublings, err := strconv.ParseInt(queueSetting("MAX_DOUBLINGS", queueName), 10, 32)
 	if err == nil && maxDoublings != 0 {
 		queueState.RetryConfig.MaxDoublings = int32(maxDoublings)
 	}
@@ -134,11 +526,8 @@ func setInitialQueueState(queueState *tasks.Queue) {
 			Nanos: 100000000,
 		}
 	}
-	minBackoff, err := strconv.ParseInt(os.Getenv("MIN_BACKOFF"), 10, 32)
-	if err == nil && minBackoff != 0 {
-		queueState.RetryConfig.MinBackoff = &pduration.Duration{
-			Nanos: int32(minBackoff),
-		}
+	if minBackoff, ok := backoffFromEnv("MIN_BACKOFF", queueName); ok {
+		queueState.RetryConfig.MinBackoff = minBackoff
 	}
 
 	if queueState.GetRetryConfig().GetMaxBackoff() == nil {
@@ -146,70 +535,364 @@ func setInitialQueueState(queueState *tasks.Queue) {
 			Seconds: 3600,
 		}
 	}
-	maxBackoff, err := strconv.ParseInt(os.Getenv("MAX_BACKOFF"), 10, 32)
-	if err == nil && maxBackoff != 0 {
-		queueState.RetryConfig.MaxBackoff = &pduration.Duration{
-			Nanos: int32(maxBackoff),
-		}
+	if maxBackoff, ok := backoffFromEnv("MAX_BACKOFF", queueName); ok {
+		queueState.RetryConfig.MaxBackoff = maxBackoff
 	}
 
-	queueState.State = tasks.Queue_RUNNING
+	// Unlimited unless set
+	if maxRetryDuration, ok := backoffFromEnv("MAX_RETRY_DURATION", queueName); ok {
+		queueState.RetryConfig.MaxRetryDuration = maxRetryDuration
+	}
 }
 
+// runWorkers sizes the worker pool to the max concurrent dispatches, a single
+// worker in serial dispatch mode, expects lifecycleMux to be held
 func (queue *Queue) runWorkers() {
-	for i := 0; i < int(queue.state.GetRateLimits().GetMaxConcurrentDispatches()); i++ {
-		go queue.runWorker()
+	if queue.serial {
+		queue.workers.resize(1)
+		return
 	}
+	queue.workers.resize(int(queue.state.GetRateLimits().GetMaxConcurrentDispatches()))
+}
+
+// goRoutine runs fn in a goroutine that Wait waits for
+func (queue *Queue) goRoutine(fn func()) {
+	queue.routines.Add(1)
+	go func() {
+		defer queue.routines.Done()
+		fn()
+	}()
+}
+
+// goCountedRoutine runs fn like goRoutine, counting it in the count while it runs
+func (queue *Queue) goCountedRoutine(count *int64, fn func()) {
+	queue.statsMux.Lock()
+	*count++
+	queue.statsMux.Unlock()
+
+	queue.goRoutine(func() {
+		defer func() {
+			queue.statsMux.Lock()
+			*count--
+			queue.statsMux.Unlock()
+		}()
+		fn()
+	})
 }
 
-func (queue *Queue) runWorker() {
+// RoutineCounts returns the numbers of running goroutines of the queue
+func (queue *Queue) RoutineCounts() RoutineCounts {
+	queue.statsMux.Lock()
+	defer queue.statsMux.Unlock()
+
+	return queue.routineCounts
+}
+
+// TokenBucketStats returns the state of the token bucket of the queue. It is
+// cheap enough to poll frequently.
+func (queue *Queue) TokenBucketStats() TokenBucketStats {
+	queue.statsMux.Lock()
+	nextToken := queue.nextToken
+	queue.statsMux.Unlock()
+
+	return TokenBucketStats{
+		Tokens:       len(queue.tokenBucket),
+		MaxBurstSize: cap(queue.tokenBucket),
+		Period:       queue.tokenPeriod(),
+		NextToken:    nextToken,
+	}
+}
+
+// setNextToken records when the token generator adds the next token
+func (queue *Queue) setNextToken(next time.Time) {
+	queue.statsMux.Lock()
+	defer queue.statsMux.Unlock()
+
+	queue.nextToken = next
+}
+
+// runWorker dispatches the due tasks until stopped, see workerPool
+func (queue *Queue) runWorker(stop chan bool) {
 	for {
+		// Stopped before taking on another task, even if one is waiting
+		if isClosed(stop) {
+			return
+		}
+
 		select {
-		case task := <-queue.work:
-			task.Attempt()
-		case <-queue.cancelWorkers:
-			// Forward for next worker
-			queue.cancelWorkers <- true
+		case entry := <-queue.work:
+			queue.acquireDispatchSlot()
+			queue.startExecution()
+			entry.task.attempt(entry.unscheduled)
+			queue.finishExecution()
+			queue.releaseDispatchSlot()
+		case <-stop:
 			return
 		}
 	}
 }
 
+// acquireDispatchSlot waits for one of the dispatch slots shared by all queues
+func (queue *Queue) acquireDispatchSlot() {
+	if queue.dispatchSlots != nil {
+		queue.dispatchSlots <- true
+	}
+}
+
+func (queue *Queue) releaseDispatchSlot() {
+	if queue.dispatchSlots != nil {
+		<-queue.dispatchSlots
+	}
+}
+
+func (queue *Queue) startExecution() {
+	queue.statsMux.Lock()
+	defer queue.statsMux.Unlock()
+	queue.concurrentDispatches++
+}
+
+func (queue *Queue) finishExecution() {
+	queue.statsMux.Lock()
+	defer queue.statsMux.Unlock()
+	queue.concurrentDispatches--
+	queue.executions = append(queue.executions, queue.clock.Now())
+	queue.pruneExecutions()
+}
+
+// completeTask counts a task that succeeded or ran out of attempts
+func (queue *Queue) completeTask() {
+	queue.statsMux.Lock()
+	defer queue.statsMux.Unlock()
+	queue.completedTasks++
+}
+
+// pruneExecutions drops the executions older than a minute, expects statsMux to be held
+func (queue *Queue) pruneExecutions() {
+	cutoff := queue.clock.Now().Add(-time.Minute)
+
+	i := 0
+	for i < len(queue.executions) && queue.executions[i].Before(cutoff) {
+		i++
+	}
+	queue.executions = queue.executions[i:]
+}
+
+// Stats computes the current statistics of the queue
+func (queue *Queue) Stats() QueueStats {
+	var stats QueueStats
+
+	queue.tsMux.Lock()
+	for _, task := range queue.ts.list() {
+		stats.TasksCount++
+
+		task.stateMutex.Lock()
+		scheduled, _ := ptypes.Timestamp(task.state.GetScheduleTime())
+		task.stateMutex.Unlock()
+
+		if stats.OldestEstimatedArrivalTime.IsZero() || scheduled.Before(stats.OldestEstimatedArrivalTime) {
+			stats.OldestEstimatedArrivalTime = scheduled
+		}
+	}
+	queue.tsMux.Unlock()
+
+	queue.statsMux.Lock()
+	queue.pruneExecutions()
+	stats.ExecutedLastMinuteCount = int64(len(queue.executions))
+	stats.ConcurrentDispatchesCount = queue.concurrentDispatches
+	queue.statsMux.Unlock()
+
+	queue.lifecycleMux.Lock()
+	if queue.dispatching() {
+		stats.EffectiveExecutionRate = queue.throttle.enforce(queue.maxDispatchesPerSecond)
+	}
+	queue.lifecycleMux.Unlock()
+
+	return stats
+}
+
+// tokenPeriod is the interval at which the token generator adds tokens
+func (queue *Queue) tokenPeriod() time.Duration {
+	return time.Duration(float64(time.Second) / queue.dispatchRate())
+}
+
+// dispatchRate returns the maximum dispatches per second, which may be
+// fractional, e.g. 0.2 for a dispatch every 5 seconds, lower while the queue
+// is throttled
+func (queue *Queue) dispatchRate() float64 {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	return queue.throttle.enforce(queue.maxDispatchesPerSecond)
+}
+
 func (queue *Queue) runTokenGenerator() {
-	period := time.Second / time.Duration(queue.maxDispatchesPerSecond)
+	defer queue.setNextToken(time.Time{})
+
+	// The tokens are due at whole multiples of the period from the start, so
+	// that fractional rates don't drift
+	rate := queue.dispatchRate()
+	start := queue.clock.Now()
+	var count int64 = 1
+	next := tokenTime(start, count, rate)
 	// Use Timer with Reset() in place of time.Ticker as the latter was causing high CPU usage in Docker
-	t := time.NewTimer(period)
+	t := queue.clock.NewTimer(next.Sub(start))
+	queue.setNextToken(next)
 
 	for {
 		select {
-		case <-t.C:
-			select {
-			case queue.tokenBucket <- true:
-				// Added token
-				t.Reset(period)
-			case <-queue.cancelTokenGenerator:
-				return
+		case <-t.C():
+			// Add a token for every period that elapsed, as a fake clock can
+			// move ahead several periods at once
+			for !next.After(queue.clock.Now()) {
+				select {
+				case queue.tokenBucket <- true:
+					// Added token
+					count++
+					next = tokenTime(start, count, rate)
+				default:
+					// The bucket is full, so wait for room. Tokens don't accrue while full.
+					queue.setNextToken(time.Time{})
+					for added := false; !added; {
+						select {
+						case queue.tokenBucket <- true:
+							added = true
+						case <-queue.retuneTokenGenerator:
+							rate = queue.dispatchRate()
+						case <-queue.cancelTokenGenerator:
+							return
+						}
+					}
+					start = queue.clock.Now()
+					count = 1
+					next = tokenTime(start, count, rate)
+				}
 			}
-		case <-queue.cancelTokenGenerator:
+			t.Reset(next.Sub(queue.clock.Now()))
+			queue.setNextToken(next)
+		case <-queue.retuneTokenGenerator:
+			// The next token comes a new period from now
+			rate = queue.dispatchRate()
 			if !t.Stop() {
-				<-t.C
+				select {
+				case <-t.C():
+				default:
+				}
 			}
+			start = queue.clock.Now()
+			count = 1
+			next = tokenTime(start, count, rate)
+			t.Reset(next.Sub(start))
+			queue.setNextToken(next)
+		case <-queue.cancelTokenGenerator:
+			t.Stop()
 			return
 		}
 	}
 }
 
+// tokenTime returns when the token generator adds the nth token since the start
+func tokenTime(start time.Time, n int64, rate float64) time.Time {
+	return start.Add(time.Duration(float64(n) * float64(time.Second) / rate))
+}
+
+// pushDue adds a task that is due for dispatch, unless it is run on request
+// in the meantime and unscheduled gets closed
+func (queue *Queue) pushDue(task *Task, unscheduled chan bool) {
+	task.stateMutex.Lock()
+	eta, _ := ptypes.Timestamp(task.state.GetScheduleTime())
+	created, _ := ptypes.Timestamp(task.state.GetCreateTime())
+	task.stateMutex.Unlock()
+
+	queue.dueMux.Lock()
+	queue.dueSeq++
+	heap.Push(&queue.due, &taskHeapEntry{
+		task:        task,
+		eta:         eta,
+		created:     created,
+		seq:         queue.dueSeq,
+		unscheduled: unscheduled,
+	})
+	queue.dueMux.Unlock()
+
+	// Wake up the dispatcher if it's waiting
+	select {
+	case queue.dueSignal <- true:
+	default:
+	}
+}
+
+// hasDue tells whether tasks are due
+func (queue *Queue) hasDue() bool {
+	queue.dueMux.Lock()
+	defer queue.dueMux.Unlock()
+
+	return queue.due.Len() > 0
+}
+
+// popDue takes the earliest due task, if any
+func (queue *Queue) popDue() *taskHeapEntry {
+	queue.dueMux.Lock()
+	defer queue.dueMux.Unlock()
+
+	if queue.due.Len() == 0 {
+		return nil
+	}
+
+	return heap.Pop(&queue.due).(*taskHeapEntry)
+}
+
+// nextDue waits for the earliest due task that hasn't been deleted or run on
+// request in the meantime. Returns nil if the dispatcher got cancelled.
+func (queue *Queue) nextDue() *taskHeapEntry {
+	for {
+		entry := queue.popDue()
+		if entry == nil {
+			select {
+			case <-queue.dueSignal:
+				continue
+			case <-queue.cancelDispatcher:
+				return nil
+			}
+		}
+
+		if isClosed(entry.unscheduled) {
+			// Run on request, which took over the task
+			continue
+		}
+
+		select {
+		case <-entry.task.cancel:
+			// Deleted while waiting for dispatch
+			entry.task.onDone(entry.task)
+		default:
+			return entry
+		}
+	}
+}
+
 func (queue *Queue) runDispatcher() {
 	for {
+		// Due tasks are starved while they wait for a token
+		waitStart := queue.clock.Now()
+		starved := len(queue.tokenBucket) == 0 && queue.hasDue()
+
 		select {
 		// Consume a token
 		case <-queue.tokenBucket:
-			select {
+			if starved {
+				queue.metrics.tokenStarved(queue.name, queue.clock.Now().Sub(waitStart))
+			}
 			// Wait for task
-			case task := <-queue.fire:
-				// Pass on to workers
-				queue.work <- task
+			entry := queue.nextDue()
+			if entry == nil {
+				return
+			}
+			select {
+			// Pass on to workers
+			case queue.work <- entry:
 			case <-queue.cancelDispatcher:
+				// Put it back for when the dispatcher resumes
+				queue.pushDue(entry.task, entry.unscheduled)
 				return
 			}
 		case <-queue.cancelDispatcher:
@@ -220,74 +903,379 @@ func (queue *Queue) runDispatcher() {
 
 // Run starts the queue (workers, token generator and dispatcher)
 func (queue *Queue) Run() {
-	go queue.runWorkers()
-	go queue.runTokenGenerator()
-	go queue.runDispatcher()
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	if queue.started || queue.cancelled {
+		return
+	}
+	queue.started = true
+
+	queue.goCountedRoutine(&queue.routineCounts.TokenGenerators, queue.runTokenGenerator)
+	queue.goCountedRoutine(&queue.routineCounts.Schedulers, queue.runScheduler)
+	if queue.dispatching() {
+		queue.runWorkers()
+		queue.goCountedRoutine(&queue.routineCounts.Dispatchers, queue.runDispatcher)
+	}
 }
 
 // NewTask creates a new task on the queue
-func (queue *Queue) NewTask(newTaskState *tasks.Task) (*Task, *tasks.Task) {
+func (queue *Queue) NewTask(newTaskState *tasks.Task) (*Task, *tasks.Task, error) {
+	return queue.newTracedTask(newTaskState, spanContext{})
+}
+
+// newTracedTask creates a new task whose dispatches are traced as part of the
+// trace, or of a new trace of their own if it isn't valid and tracing is enabled
+func (queue *Queue) newTracedTask(newTaskState *tasks.Task, trace spanContext) (*Task, *tasks.Task, error) {
 	task := NewTask(queue, newTaskState, func(task *Task) {
 		queue.removeTask(task.state.GetName())
 		queue.onTaskDone(task)
 	})
+	if !trace.isValid() && tracesEndpoint() != "" {
+		trace = newTraceContext()
+	}
+	task.trace = trace
 
 	taskState := proto.Clone(task.state).(*tasks.Task)
 
-	queue.setTask(taskState.GetName(), task)
+	if err := queue.addTask(taskState.GetName(), task); err != nil {
+		return nil, nil, err
+	}
+	queue.metrics.taskCreated(queue.name)
+	task.publishEvent(TaskCreatedEvent, 0, 0, 0)
+
+	if queue.pull {
+		task.hold()
+	} else {
+		task.Schedule()
+	}
+
+	return task, taskState, nil
+}
 
-	task.Schedule()
+// bufferedTaskState builds the state of a task targeting the queue's default HTTP target
+func (queue *Queue) bufferedTaskState(taskID string, body []byte, contentType string) *tasks.Task {
+	headers := make(map[string]string)
+	for k, v := range queue.httpTarget.Headers {
+		headers[k] = v
+	}
+	if contentType != "" {
+		headers["Content-Type"] = contentType
+	}
+
+	taskState := &tasks.Task{
+		MessageType: &tasks.Task_HttpRequest{
+			HttpRequest: &tasks.HttpRequest{
+				Url:        queue.httpTarget.Uri,
+				HttpMethod: queue.httpTarget.HttpMethod,
+				Headers:    headers,
+				Body:       body,
+			},
+		},
+	}
+	if taskID != "" {
+		taskState.Name = queue.name + "/tasks/" + taskID
+	}
 
-	return task, taskState
+	return taskState
 }
 
 // Delete stops, purges and removes the queue
 func (queue *Queue) Delete() {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
 	if !queue.cancelled {
 		queue.cancelled = true
-		log.Println("Stopping queue")
-		queue.cancelTokenGenerator <- true
-		queue.cancelDispatcher <- true
-		queue.cancelWorkers <- true
+		if queue.started && !queue.drained {
+			logInfo("Stopping queue", field("queue", queue.name))
+			queue.cancelTokenGenerator <- true
+			queue.cancelScheduler <- true
+			if queue.dispatching() {
+				queue.cancelDispatcher <- true
+				queue.workers.resize(0)
+			}
+		}
 
-		queue.Purge()
+		queue.purgeTasks()
+
+		queue.notify(QueueDeletedEvent, QueueDeletedEvent)
 	}
 }
 
 // Purge purges all tasks from the queue
 func (queue *Queue) Purge() {
-	go func() {
+	// Tasks created before the purge time are considered purged, including any
+	// that are created concurrently and so missed below
+	queue.lifecycleMux.Lock()
+	queue.state.PurgeTime = timestampNow(queue.clock)
+	state := queue.state.GetState().String()
+	queue.lifecycleMux.Unlock()
 
-		queue.tsMux.Lock()
-		defer queue.tsMux.Unlock()
+	queue.purgeTasks()
 
-		for _, task := range queue.ts {
-			// Avoid task firing
-			if task != nil {
-				task.Delete()
-			}
+	queue.notify(QueuePurgedEvent, state)
+}
+
+// purgeTasks removes all tasks from the queue
+func (queue *Queue) purgeTasks() {
+
+	// Tasks waiting for dispatch are no longer scheduled, so are done right away
+	queue.dueMux.Lock()
+	due := queue.due
+	queue.due = nil
+	queue.dueMux.Unlock()
+
+	for _, entry := range due {
+		if isClosed(entry.unscheduled) {
+			// Run on request, so among the tasks purged below
+			continue
 		}
-	}()
+		// Avoid a later cancel from being sent
+		entry.task.cancelOnce.Do(func() {})
+		entry.task.onDone(entry.task)
+	}
+
+	// Take a snapshot so the lock isn't held while the tasks are cancelled, as
+	// their removal from the map happens in the task done callback
+	queue.tsMux.Lock()
+	purged := queue.ts.list()
+	queue.tsMux.Unlock()
+
+	for _, task := range purged {
+		// Avoid task firing
+		task.Delete()
+	}
 }
 
 // Pause pauses the queue
 func (queue *Queue) Pause() {
-	if !queue.paused {
-		queue.paused = true
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	if !queue.paused && !queue.cancelled && !queue.drained {
 		queue.state.State = tasks.Queue_PAUSED
+		queue.setHold(&queue.paused, true)
 
-		queue.cancelDispatcher <- true
-		queue.cancelWorkers <- true
+		queue.notify(QueuePausedEvent, tasks.Queue_PAUSED.String())
 	}
 }
 
 // Resume resumes a paused queue
 func (queue *Queue) Resume() {
-	if queue.paused {
-		queue.paused = false
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	if queue.paused && !queue.cancelled && !queue.drained {
 		queue.state.State = tasks.Queue_RUNNING
+		queue.setHold(&queue.paused, false)
+
+		queue.notify(QueueResumedEvent, tasks.Queue_RUNNING.String())
+	}
+}
+
+// Freeze stops the dispatches of the queue, as a pause would, but leaves its
+// state as is, e.g. to hold tasks while a test sets up its assertions
+func (queue *Queue) Freeze() {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	queue.setHold(&queue.frozen, true)
+}
+
+// Unfreeze resumes the dispatches of a frozen queue, unless it is paused
+func (queue *Queue) Unfreeze() {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	queue.setHold(&queue.frozen, false)
+}
+
+// setLeased records whether this instance holds the dispatch lease of the
+// queue, the queue only dispatching while it does
+func (queue *Queue) setLeased(leased bool) {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	queue.setHold(&queue.unleased, !leased)
+}
+
+// leased tells whether this instance holds the dispatch lease of the queue
+func (queue *Queue) leased() bool {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	return !queue.unleased
+}
+
+// setHold sets one of the reasons for the queue not to dispatch, i.e. paused,
+// frozen or unleased, starting or stopping the dispatcher and workers as the
+// queue starts or stops dispatching, expects lifecycleMux to be held
+func (queue *Queue) setHold(hold *bool, value bool) {
+	running := queue.started && !queue.cancelled && !queue.drained
+	wasDispatching := running && queue.dispatching()
+	*hold = value
+
+	switch isDispatching := running && queue.dispatching(); {
+	case wasDispatching && !isDispatching:
+		queue.cancelDispatcher <- true
+		queue.workers.resize(0)
+	case !wasDispatching && isDispatching:
+		queue.goCountedRoutine(&queue.routineCounts.Dispatchers, queue.runDispatcher)
+		queue.runWorkers()
+	}
+}
+
+// dispatching tells whether the dispatcher and workers run while the queue is
+// started, expects lifecycleMux to be held
+func (queue *Queue) dispatching() bool {
+	return !queue.paused && !queue.frozen && !queue.unleased
+}
+
+// Drain stops the queue from accepting new tasks, letting the tasks it holds run
+// as usual. Once they are done, the queue stops and is disabled for good.
+func (queue *Queue) Drain() {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	if queue.cancelled {
+		return
+	}
+
+	queue.tsMux.Lock()
+	if queue.draining {
+		queue.tsMux.Unlock()
+		return
+	}
+	queue.draining = true
+	if queue.ts.len() == 0 {
+		close(queue.drainDone)
+	}
+	queue.tsMux.Unlock()
+
+	queue.goRoutine(queue.awaitDrained)
+
+	queue.notify(QueueDrainingEvent, queue.state.GetState().String())
+}
 
-		go queue.runDispatcher()
-		go queue.runWorkers()
+// awaitDrained disables the draining queue once it has no tasks left
+func (queue *Queue) awaitDrained() {
+	<-queue.drainDone
+
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	// Deleting the queue also leaves it without tasks
+	if queue.cancelled {
+		return
+	}
+
+	queue.drained = true
+	queue.state.State = tasks.Queue_DISABLED
+
+	if queue.started {
+		queue.cancelTokenGenerator <- true
+		queue.cancelScheduler <- true
+		if queue.dispatching() {
+			queue.cancelDispatcher <- true
+			queue.workers.resize(0)
+		}
+	}
+
+	queue.notify(QueueDrainedEvent, tasks.Queue_DISABLED.String())
+}
+
+// purgedBefore tells whether the queue was purged after the given creation time
+func (queue *Queue) purgedBefore(created time.Time) bool {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	if queue.state.GetPurgeTime() == nil {
+		return false
 	}
+	purgeTime, _ := ptypes.Timestamp(queue.state.GetPurgeTime())
+
+	return created.Before(purgeTime)
+}
+
+// frozenState returns a copy of the queue state, with the defaults and env
+// overrides applied, that isn't affected by later changes to the queue
+func (queue *Queue) frozenState() *tasks.Queue {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	return proto.Clone(queue.state).(*tasks.Queue)
+}
+
+func (queue *Queue) notify(event string, state string) {
+	queue.onEvent(QueueEvent{
+		QueueName: queue.name,
+		Event:     event,
+		State:     state,
+		Time:      queue.clock.Now(),
+	})
+}
+
+// routingOverride returns the App Engine routing used for all tasks of the queue, if any
+func (queue *Queue) routingOverride() *tasks.AppEngineRouting {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	return queue.state.GetAppEngineRoutingOverride()
+}
+
+func (queue *Queue) setRoutingOverride(routing *tasks.AppEngineRouting) {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	queue.state.AppEngineRoutingOverride = routing
+	setAppEngineRoutingOverrideHost(queue.state)
+}
+
+// retryConfig returns the retry config of the queue, which changes when the
+// queue is updated
+func (queue *Queue) retryConfig() *tasks.RetryConfig {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	return queue.state.GetRetryConfig()
+}
+
+// reconfigure applies updated rate limits and retry config to the queue as it
+// runs. The token generator is retuned and workers are started or stopped to
+// match, while the pending tasks are kept and retried as per the new config.
+func (queue *Queue) reconfigure(rateLimits *tasks.RateLimits, retryConfig *tasks.RetryConfig) {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	queue.state.RateLimits = rateLimits
+	queue.state.RetryConfig = retryConfig
+
+	if rateLimits.GetMaxDispatchesPerSecond() != queue.maxDispatchesPerSecond {
+		queue.maxDispatchesPerSecond = rateLimits.GetMaxDispatchesPerSecond()
+		select {
+		case queue.retuneTokenGenerator <- true:
+		default:
+		}
+	}
+
+	// Otherwise the workers aren't running, and are started with the new count
+	if !queue.started || queue.cancelled || !queue.dispatching() || queue.drained {
+		return
+	}
+
+	// Busy workers stop once done with their task
+	queue.runWorkers()
+}
+
+func (queue *Queue) setLoggingConfig(config *StackdriverLoggingConfig) {
+	queue.lifecycleMux.Lock()
+	defer queue.lifecycleMux.Unlock()
+
+	setStackdriverLoggingConfig(queue.state, config)
+}
+
+// Wait blocks until the goroutines of a deleted queue and its tasks have stopped
+func (queue *Queue) Wait() {
+	queue.routines.Wait()
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestDeleteUnstartedQueue(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{Name: queueName}, realClock{}, func(task *Task) {})
+
+	scheduleTime, _ := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	_, _, err := queue.NewTask(&taskspb.Task{
+		ScheduleTime: scheduleTime,
+		MessageType: &taskspb.Task_HttpRequest{
+			HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com"},
+		},
+	})
+	require.NoError(t, err)
+
+	queue.Pause()
+	queue.Resume()
+	queue.Delete()
+
+	// No cancels are left behind for goroutines that never started
+	assert.Len(t, queue.cancelTokenGenerator, 0)
+	assert.Len(t, queue.cancelDispatcher, 0)
+	assert.Len(t, queue.cancelScheduler, 0)
+
+	// Nor does a deleted queue start
+	queue.Run()
+	assert.False(t, queue.started)
+
+	waited := make(chan bool)
+	go func() {
+		queue.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		// The task was purged
+		assert.Len(t, queue.ts, 0)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Queue goroutines did not stop")
+	}
+}
+
+func TestQueueRoutineCounts(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{
+		Name:       queueName,
+		RateLimits: &taskspb.RateLimits{MaxConcurrentDispatches: 3},
+	}, realClock{}, func(task *Task) {})
+	assert.Equal(t, RoutineCounts{}, queue.RoutineCounts())
+
+	running := RoutineCounts{Workers: 3, Dispatchers: 1, TokenGenerators: 1, Schedulers: 1}
+	hasCounts := func(expected RoutineCounts) func() bool {
+		return func() bool {
+			return queue.RoutineCounts() == expected
+		}
+	}
+
+	queue.Run()
+	assert.Equal(t, running, queue.RoutineCounts())
+
+	queue.Pause()
+	assert.Eventually(t, hasCounts(RoutineCounts{TokenGenerators: 1, Schedulers: 1}), time.Second, 10*time.Millisecond)
+
+	queue.Resume()
+	assert.Equal(t, running, queue.RoutineCounts())
+
+	queue.Delete()
+	queue.Wait()
+	assert.Equal(t, RoutineCounts{}, queue.RoutineCounts())
+}
+
+func TestFreezeQueue(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{
+		Name:       queueName,
+		RateLimits: &taskspb.RateLimits{MaxConcurrentDispatches: 3},
+	}, realClock{}, func(task *Task) {})
+
+	running := RoutineCounts{Workers: 3, Dispatchers: 1, TokenGenerators: 1, Schedulers: 1}
+	stopped := RoutineCounts{TokenGenerators: 1, Schedulers: 1}
+	hasCounts := func(expected RoutineCounts) func() bool {
+		return func() bool {
+			return queue.RoutineCounts() == expected
+		}
+	}
+
+	// Frozen before it starts, so the dispatcher never does
+	queue.Freeze()
+	queue.Run()
+	assert.Equal(t, stopped, queue.RoutineCounts())
+	assert.Equal(t, taskspb.Queue_RUNNING, queue.frozenState().GetState())
+
+	queue.Unfreeze()
+	assert.Equal(t, running, queue.RoutineCounts())
+
+	queue.Freeze()
+	assert.Eventually(t, hasCounts(stopped), time.Second, 10*time.Millisecond)
+	assert.Equal(t, taskspb.Queue_RUNNING, queue.frozenState().GetState())
+
+	// Paused while frozen, it stays stopped once unfrozen until resumed
+	queue.Pause()
+	queue.Unfreeze()
+	assert.Equal(t, stopped, queue.RoutineCounts())
+	queue.Resume()
+	assert.Equal(t, running, queue.RoutineCounts())
+
+	queue.Freeze()
+	queue.Delete()
+	queue.Wait()
+	assert.Equal(t, RoutineCounts{}, queue.RoutineCounts())
+}
+
+func TestSerialDispatch(t *testing.T) {
+	os.Setenv("SERIAL_DISPATCH_AGENTQ", "true")
+	defer os.Unsetenv("SERIAL_DISPATCH_AGENTQ")
+
+	var mux sync.Mutex
+	var order []string
+	concurrent, maxConcurrent := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		order = append(order, req.URL.Path)
+		concurrent++
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		mux.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mux.Lock()
+		concurrent--
+		mux.Unlock()
+	}))
+	defer srv.Close()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{
+		Name: queueName,
+		RateLimits: &taskspb.RateLimits{
+			MaxDispatchesPerSecond:  500,
+			MaxBurstSize:            100,
+			MaxConcurrentDispatches: 5,
+		},
+	}, realClock{}, func(task *Task) {})
+	assert.True(t, queue.serial)
+
+	// Created in reverse, dispatched in schedule order
+	now := time.Now()
+	for i := 4; i >= 0; i-- {
+		scheduleTime, _ := ptypes.TimestampProto(now.Add(time.Duration(i-10) * time.Second))
+		_, _, err := queue.NewTask(&taskspb.Task{
+			ScheduleTime: scheduleTime,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: srv.URL + "/" + string('a'+rune(i))},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	queue.Run()
+	defer func() {
+		queue.Delete()
+		queue.Wait()
+	}()
+	assert.EqualValues(t, 1, queue.RoutineCounts().Workers)
+
+	assert.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+
+		return len(order) == 5
+	}, 2*time.Second, 10*time.Millisecond)
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, []string{"/a", "/b", "/c", "/d", "/e"}, order)
+	assert.Equal(t, 1, maxConcurrent)
+}
+
+func TestSerialDispatchFromEnv(t *testing.T) {
+	defer os.Unsetenv("SERIAL_DISPATCH")
+	defer os.Unsetenv("SERIAL_DISPATCH_AGENTQ")
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+
+	assert.False(t, serialDispatch(queueName, settingsFromEnv().serialDispatch))
+
+	os.Setenv("SERIAL_DISPATCH", "true")
+	assert.True(t, serialDispatch(queueName, settingsFromEnv().serialDispatch))
+
+	// The queue setting wins
+	os.Setenv("SERIAL_DISPATCH_AGENTQ", "false")
+	assert.False(t, serialDispatch(queueName, settingsFromEnv().serialDispatch))
+	assert.True(t, serialDispatch("projects/bluebook/locations/us-east1/queues/other", settingsFromEnv().serialDispatch))
+}
+
+func TestQueueTokenBucketStats(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{
+		Name: queueName,
+		RateLimits: &taskspb.RateLimits{
+			MaxDispatchesPerSecond: 2,
+			MaxBurstSize:           3,
+		},
+	}, fake, func(task *Task) {})
+	assert.Equal(t, TokenBucketStats{Tokens: 3, MaxBurstSize: 3, Period: 500 * time.Millisecond}, queue.TokenBucketStats())
+
+	// Stands in for a dispatcher, so only the token generator runs
+	queue.goCountedRoutine(&queue.routineCounts.TokenGenerators, queue.runTokenGenerator)
+	defer func() {
+		queue.cancelTokenGenerator <- true
+		queue.Wait()
+		assert.True(t, queue.TokenBucketStats().NextToken.IsZero(), "No next token once stopped")
+	}()
+
+	start := fake.Now()
+	nextTokenIs := func(expected time.Time) func() bool {
+		return func() bool {
+			return queue.TokenBucketStats().NextToken.Equal(expected)
+		}
+	}
+	assert.Eventually(t, nextTokenIs(start.Add(500*time.Millisecond)), time.Second, 10*time.Millisecond)
+
+	// Once full, the next token waits for a dispatch to take one
+	fake.Advance(500 * time.Millisecond)
+	assert.Eventually(t, nextTokenIs(time.Time{}), time.Second, 10*time.Millisecond)
+
+	<-queue.tokenBucket
+	<-queue.tokenBucket
+	assert.Eventually(t, nextTokenIs(start.Add(time.Second)), time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, queue.TokenBucketStats().Tokens)
+}
+
+func TestFractionalDispatchRates(t *testing.T) {
+	fake := newFakeClock(time.Now())
+	os.Setenv("INITIAL_TOKEN_FILL", "0")
+	defer os.Unsetenv("INITIAL_TOKEN_FILL")
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{
+		Name: queueName,
+		RateLimits: &taskspb.RateLimits{
+			MaxDispatchesPerSecond: 0.2,
+			MaxBurstSize:           1000,
+		},
+	}, fake, func(task *Task) {})
+
+	// Stands in for a dispatcher, so only the token generator runs
+	queue.goCountedRoutine(&queue.routineCounts.TokenGenerators, queue.runTokenGenerator)
+	defer func() {
+		queue.cancelTokenGenerator <- true
+		queue.Wait()
+	}()
+	tokensAre := func(expected int) func() bool {
+		return func() bool {
+			return len(queue.tokenBucket) == expected
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// A token every 5 seconds
+	fake.Advance(4900 * time.Millisecond)
+	assert.Eventually(t, tokensAre(0), time.Second, 10*time.Millisecond)
+	fake.Advance(100 * time.Millisecond)
+	assert.Eventually(t, tokensAre(1), time.Second, 10*time.Millisecond)
+	fake.Advance(20 * time.Second)
+	assert.Eventually(t, tokensAre(5), time.Second, 10*time.Millisecond)
+
+	// Changed at runtime, to a token every 400ms from now on
+	queue.reconfigure(&taskspb.RateLimits{MaxDispatchesPerSecond: 2.5, MaxBurstSize: 1000}, queue.retryConfig())
+	assert.Eventually(t, func() bool {
+		return queue.TokenBucketStats().NextToken.Equal(fake.Now().Add(400 * time.Millisecond))
+	}, time.Second, 10*time.Millisecond)
+	fake.Advance(10 * time.Second)
+	assert.Eventually(t, tokensAre(30), time.Second, 10*time.Millisecond)
+
+	// Without drift, a third of a second apart
+	queue.reconfigure(&taskspb.RateLimits{MaxDispatchesPerSecond: 3, MaxBurstSize: 1000}, queue.retryConfig())
+	assert.Eventually(t, func() bool {
+		return !queue.TokenBucketStats().NextToken.IsZero() && queue.TokenBucketStats().NextToken.Sub(fake.Now()) == 333333333*time.Nanosecond
+	}, time.Second, 10*time.Millisecond)
+	fake.Advance(100 * time.Second)
+	assert.Eventually(t, tokensAre(330), time.Second, 10*time.Millisecond)
+}
+
+func TestDrainEmptyQueue(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{Name: queueName}, realClock{}, func(task *Task) {})
+	queue.Run()
+
+	queue.Drain()
+
+	stopped := func() bool {
+		return queue.RoutineCounts() == RoutineCounts{}
+	}
+	assert.Eventually(t, stopped, time.Second, 10*time.Millisecond)
+	assert.Equal(t, taskspb.Queue_DISABLED, queue.frozenState().GetState())
+
+	// Drained for good
+	queue.Resume()
+	assert.Equal(t, taskspb.Queue_DISABLED, queue.frozenState().GetState())
+
+	// The stopped goroutines aren't cancelled again
+	queue.Delete()
+	queue.Wait()
+}
+
+func TestBackoffFromEnv(t *testing.T) {
+	defer os.Unsetenv("MIN_BACKOFF")
+	defer os.Unsetenv("MAX_BACKOFF")
+
+	for value, expected := range map[string]time.Duration{
+		"2s":    2 * time.Second,
+		"100ms": 100 * time.Millisecond,
+		"1m30s": 90 * time.Second,
+		"2":     2 * time.Second,
+		"0.5":   500 * time.Millisecond,
+	} {
+		os.Setenv("MIN_BACKOFF", value)
+		os.Setenv("MAX_BACKOFF", value)
+
+		queueState := &taskspb.Queue{}
+		setInitialQueueState(queueState)
+
+		minBackoff, _ := ptypes.Duration(queueState.GetRetryConfig().GetMinBackoff())
+		maxBackoff, _ := ptypes.Duration(queueState.GetRetryConfig().GetMaxBackoff())
+		assert.Equal(t, expected, minBackoff, "MIN_BACKOFF=%v", value)
+		assert.Equal(t, expected, maxBackoff, "MAX_BACKOFF=%v", value)
+	}
+
+	// Falls back to the defaults
+	for _, value := range []string{"", "0", "-1s", "soon"} {
+		os.Setenv("MIN_BACKOFF", value)
+		os.Setenv("MAX_BACKOFF", value)
+
+		queueState := &taskspb.Queue{}
+		setInitialQueueState(queueState)
+
+		minBackoff, _ := ptypes.Duration(queueState.GetRetryConfig().GetMinBackoff())
+		maxBackoff, _ := ptypes.Duration(queueState.GetRetryConfig().GetMaxBackoff())
+		assert.Equal(t, 100*time.Millisecond, minBackoff, "MIN_BACKOFF=%v", value)
+		assert.Equal(t, time.Hour, maxBackoff, "MAX_BACKOFF=%v", value)
+	}
+}
+
+func TestQueueSpecificEnv(t *testing.T) {
+	for key, value := range map[string]string{
+		"MAX_DISPATCHES_PER_SECOND":       "5",
+		"MAX_DISPATCHES_PER_SECOND_SLOWQ": "0.5",
+		"MAX_CONCURRENT_DISPATCHES_SLOWQ": "1",
+		"MAX_ATTEMPTS_SLOW_Q":             "3",
+		"MIN_BACKOFF_SLOWQ":               "10s",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	slow := &taskspb.Queue{Name: "projects/bluebook/locations/us-east1/queues/slowq"}
+	setInitialQueueState(slow)
+	assert.Equal(t, 0.5, slow.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.Equal(t, int32(1), slow.GetRateLimits().GetMaxConcurrentDispatches())
+	minBackoff, _ := ptypes.Duration(slow.GetRetryConfig().GetMinBackoff())
+	assert.Equal(t, 10*time.Second, minBackoff)
+
+	// Hyphens in the queue ID become underscores
+	slowHyphen := &taskspb.Queue{Name: "projects/bluebook/locations/us-east1/queues/slow-q"}
+	setInitialQueueState(slowHyphen)
+	assert.Equal(t, int32(3), slowHyphen.GetRetryConfig().GetMaxAttempts())
+	assert.Equal(t, 5.0, slowHyphen.GetRateLimits().GetMaxDispatchesPerSecond())
+
+	// The other queues get the settings for all queues, or the defaults
+	fast := &taskspb.Queue{Name: "projects/bluebook/locations/us-east1/queues/fastq"}
+	setInitialQueueState(fast)
+	assert.Equal(t, 5.0, fast.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.Equal(t, int32(1000), fast.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.Equal(t, int32(100), fast.GetRetryConfig().GetMaxAttempts())
+	minBackoff, _ = ptypes.Duration(fast.GetRetryConfig().GetMinBackoff())
+	assert.Equal(t, 100*time.Millisecond, minBackoff)
+}
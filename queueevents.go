@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// The queue events
+const (
+	QueuePausedEvent   = "PAUSED"
+	QueueResumedEvent  = "RESUMED"
+	QueueDeletedEvent  = "DELETED"
+	QueuePurgedEvent   = "PURGED"
+	QueueDrainingEvent = "DRAINING"
+	QueueDrainedEvent  = "DRAINED"
+)
+
+// QueueEvent describes a change to a queue
+type QueueEvent struct {
+	QueueName string `json:"queueName"`
+
+	Event string `json:"event"`
+
+	// The state of the queue after the event, DELETED for a deleted queue
+	State string `json:"state"`
+
+	Time time.Time `json:"time"`
+}
+
+// queueEventsURL returns the endpoint queue events are posted to, set per queue
+// with QUEUE_EVENTS_URL_<QUEUE_ID> or for all queues with QUEUE_EVENTS_URL
+func queueEventsURL(queueName string) string {
+	return queueSetting("QUEUE_EVENTS_URL", queueName)
+}
+
+// sendQueueEvent posts the queue event as JSON to the endpoint
+func sendQueueEvent(url string, event QueueEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		logError("Failed to send queue event", field("queue", event.QueueName), field("event", event.Event), field("error", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := outboundClient.Do(req.WithContext(ctx))
+	if err != nil {
+		logError("Failed to send queue event", field("queue", event.QueueName), field("event", event.Event), field("error", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logError("Failed to send queue event", field("queue", event.QueueName), field("event", event.Event), field("statusCode", resp.StatusCode))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+// queueFilterTermRegexp matches a term of a ListQueues filter, e.g. state: PAUSED
+var queueFilterTermRegexp = regexp.MustCompile(`^([a-z_]+)\s*(:|=|!=)\s*(.+)$`)
+
+// queueFilterAndRegexp separates the terms of a ListQueues filter, which all
+// have to match
+var queueFilterAndRegexp = regexp.MustCompile(`\s+AND\s+`)
+
+// queueFilter parses the filter of the queues to list, either empty or terms
+// joined by AND, each comparing a field with ":" or "=" (equal) or "!=":
+//   - state, e.g. state: PAUSED
+//   - name, either the queue ID or the full name, with a trailing * to match a
+//     prefix, e.g. name = "projects/dev/locations/here/queues/test-*"
+func queueFilter(filter string) (func(queueState *tasks.Queue) bool, error) {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return func(queueState *tasks.Queue) bool { return true }, nil
+	}
+
+	var matchers []func(queueState *tasks.Queue) bool
+	for _, term := range queueFilterAndRegexp.Split(filter, -1) {
+		match := queueFilterTermRegexp.FindStringSubmatch(strings.TrimSpace(term))
+		if match == nil {
+			return nil, invalidArgument("filter", "Invalid filter term %q, expected e.g. state: PAUSED.", term)
+		}
+		field, operator, value := match[1], match[2], strings.TrimSpace(match[3])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		var matcher func(queueState *tasks.Queue) bool
+		switch field {
+		case "state":
+			state, ok := tasks.Queue_State_value[value]
+			if !ok {
+				return nil, invalidArgument("filter", "Invalid queue state %q in filter.", value)
+			}
+			matcher = func(queueState *tasks.Queue) bool {
+				return queueState.GetState() == tasks.Queue_State(state)
+			}
+		case "name":
+			matcher = queueNameMatcher(value)
+		default:
+			return nil, invalidArgument("filter", "Unsupported filter field %q, only state and name are supported.", field)
+		}
+
+		if operator == "!=" {
+			matchers = append(matchers, func(queueState *tasks.Queue) bool { return !matcher(queueState) })
+		} else {
+			matchers = append(matchers, matcher)
+		}
+	}
+
+	return func(queueState *tasks.Queue) bool {
+		for _, matcher := range matchers {
+			if !matcher(queueState) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// queueNameMatcher compares the full name of the queue, or just its ID if the
+// value has no slashes, matching a prefix if the value ends with *
+func queueNameMatcher(value string) func(queueState *tasks.Queue) bool {
+	return func(queueState *tasks.Queue) bool {
+		name := queueState.GetName()
+		if !strings.Contains(value, "/") {
+			name = name[strings.LastIndex(name, "/")+1:]
+		}
+
+		if strings.HasSuffix(value, "*") {
+			return strings.HasPrefix(name, strings.TrimSuffix(value, "*"))
+		}
+		return name == value
+	}
+}
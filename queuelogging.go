@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// The genproto packages the emulator is built with predate some later additions
+// to Cloud Tasks: Queue.stats, Queue.http_target and, in v2,
+// Queue.stackdriver_logging_config, as well as the v2beta3 BufferTask RPC.
+// Clients built against newer protos still send the logging config, and as the
+// Queue message keeps the fields it doesn't know in XXX_unrecognized, it is
+// read from and written to there. The other additions are emulated without
+// their fields, and the messages missing altogether are written out by hand.
+
+// StackdriverLoggingConfig mirrors the Cloud Tasks message of the same name.
+// Logging isn't emulated, the config is only validated and stored.
+type StackdriverLoggingConfig struct {
+	SamplingRatio float64 `protobuf:"fixed64,1,opt,name=sampling_ratio,json=samplingRatio,proto3" json:"samplingRatio,omitempty"`
+}
+
+func (m *StackdriverLoggingConfig) Reset()         { *m = StackdriverLoggingConfig{} }
+func (m *StackdriverLoggingConfig) String() string { return proto.CompactTextString(m) }
+func (*StackdriverLoggingConfig) ProtoMessage()    {}
+
+// GetSamplingRatio returns the sampling ratio, 0 if the config isn't set
+func (m *StackdriverLoggingConfig) GetSamplingRatio() float64 {
+	if m != nil {
+		return m.SamplingRatio
+	}
+	return 0
+}
+
+// queueUnrecognizedFields decodes the Queue fields missing from the v2 protos
+type queueUnrecognizedFields struct {
+	StackdriverLoggingConfig *StackdriverLoggingConfig `protobuf:"bytes,9,opt,name=stackdriver_logging_config,json=stackdriverLoggingConfig,proto3" json:"stackdriverLoggingConfig,omitempty"`
+	XXX_unrecognized         []byte                    `json:"-"`
+}
+
+func (m *queueUnrecognizedFields) Reset()         { *m = queueUnrecognizedFields{} }
+func (m *queueUnrecognizedFields) String() string { return proto.CompactTextString(m) }
+func (*queueUnrecognizedFields) ProtoMessage()    {}
+
+func getStackdriverLoggingConfig(queueState *tasks.Queue) (*StackdriverLoggingConfig, error) {
+	fields := &queueUnrecognizedFields{}
+	if err := proto.Unmarshal(queueState.XXX_unrecognized, fields); err != nil {
+		return nil, err
+	}
+
+	return fields.StackdriverLoggingConfig, nil
+}
+
+func setStackdriverLoggingConfig(queueState *tasks.Queue, config *StackdriverLoggingConfig) {
+	fields := &queueUnrecognizedFields{}
+	proto.Unmarshal(queueState.XXX_unrecognized, fields)
+
+	fields.StackdriverLoggingConfig = config
+	queueState.XXX_unrecognized, _ = proto.Marshal(fields)
+}
+
+func validateStackdriverLoggingConfig(queueState *tasks.Queue) error {
+	config, err := getStackdriverLoggingConfig(queueState)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid queue: %v", err)
+	}
+
+	ratio := config.GetSamplingRatio()
+	if math.IsNaN(ratio) || ratio < 0 || ratio > 1 {
+		return status.Errorf(codes.InvalidArgument, "StackdriverLoggingConfig.sampling_ratio must be between 0.0 and 1.0 inclusive.")
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A rate or age limit of queue.yaml, e.g. 5/s or 2d
+var (
+	queueYAMLRateRegexp     = regexp.MustCompile(`^([0-9]+(?:\.[0-9]*)?)/([smhd])$`)
+	queueYAMLDurationRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]*)?)([smhd])$`)
+)
+
+var queueYAMLUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+}
+
+// queueYAML is the queue.yaml file of App Engine task queues. The settings
+// Cloud Tasks has no equivalent for, e.g. acl or total_storage_limit, are
+// ignored.
+type queueYAML struct {
+	Queues []queueYAMLQueue `yaml:"queue"`
+}
+
+type queueYAMLQueue struct {
+	Name string `yaml:"name"`
+
+	// push by default, or pull
+	Mode string `yaml:"mode"`
+
+	Rate string `yaml:"rate"`
+
+	BucketSize int32 `yaml:"bucket_size"`
+
+	MaxConcurrentRequests int32 `yaml:"max_concurrent_requests"`
+
+	// The [<VERSION>.]<SERVICE> the tasks are routed to
+	Target string `yaml:"target"`
+
+	RetryParameters *queueYAMLRetryParameters `yaml:"retry_parameters"`
+}
+
+type queueYAMLRetryParameters struct {
+	TaskRetryLimit *int32 `yaml:"task_retry_limit"`
+
+	TaskAgeLimit string `yaml:"task_age_limit"`
+
+	MinBackoffSeconds *float64 `yaml:"min_backoff_seconds"`
+
+	MaxBackoffSeconds *float64 `yaml:"max_backoff_seconds"`
+
+	MaxDoublings *int32 `yaml:"max_doublings"`
+}
+
+// loadQueueYAML reads the queue.yaml file
+func loadQueueYAML(path string) (*queueYAML, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &queueYAML{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("Invalid queue.yaml %v: %v", path, err)
+	}
+
+	return file, nil
+}
+
+// toQueue translates the queue as Cloud Tasks does when queue.yaml is deployed
+func (def queueYAMLQueue) toQueue(parent string) (*tasks.Queue, error) {
+	if def.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if def.Mode != "" && def.Mode != "push" && def.Mode != "pull" {
+		return nil, fmt.Errorf("Unknown mode %v, use push or pull", def.Mode)
+	}
+
+	queue := &tasks.Queue{
+		Name: parent + "/queues/" + def.Name,
+		RateLimits: &tasks.RateLimits{
+			MaxBurstSize:            def.BucketSize,
+			MaxConcurrentDispatches: def.MaxConcurrentRequests,
+		},
+		RetryConfig: &tasks.RetryConfig{},
+	}
+	if def.Rate != "" {
+		rate, err := parseQueueYAMLRate(def.Rate)
+		if err != nil {
+			return nil, err
+		}
+		queue.RateLimits.MaxDispatchesPerSecond = rate
+	}
+	if def.Target != "" {
+		if !isAppEngineServiceKey(def.Target) {
+			return nil, fmt.Errorf("target %v must be formatted [<VERSION>.]<SERVICE>", def.Target)
+		}
+		routing := &tasks.AppEngineRouting{Service: def.Target}
+		if labels := strings.Split(def.Target, "."); len(labels) == 2 {
+			routing = &tasks.AppEngineRouting{Version: labels[0], Service: labels[1]}
+		}
+		queue.AppEngineRoutingOverride = routing
+	}
+
+	retry := def.RetryParameters
+	if retry == nil {
+		return queue, nil
+	}
+	// Cloud Tasks takes task_retry_limit as max_attempts as is
+	if retry.TaskRetryLimit != nil {
+		queue.RetryConfig.MaxAttempts = *retry.TaskRetryLimit
+	}
+	if retry.TaskAgeLimit != "" {
+		ageLimit, err := parseQueueYAMLDuration(retry.TaskAgeLimit)
+		if err != nil {
+			return nil, err
+		}
+		queue.RetryConfig.MaxRetryDuration = ptypes.DurationProto(ageLimit)
+	}
+	if retry.MinBackoffSeconds != nil {
+		queue.RetryConfig.MinBackoff = ptypes.DurationProto(time.Duration(*retry.MinBackoffSeconds * float64(time.Second)))
+	}
+	if retry.MaxBackoffSeconds != nil {
+		queue.RetryConfig.MaxBackoff = ptypes.DurationProto(time.Duration(*retry.MaxBackoffSeconds * float64(time.Second)))
+	}
+	if retry.MaxDoublings != nil {
+		queue.RetryConfig.MaxDoublings = *retry.MaxDoublings
+	}
+
+	return queue, nil
+}
+
+// parseQueueYAMLRate parses a rate, e.g. 5/s or 10/m, in dispatches per second
+func parseQueueYAMLRate(rate string) (float64, error) {
+	match := queueYAMLRateRegexp.FindStringSubmatch(strings.TrimSpace(rate))
+	if match == nil {
+		return 0, fmt.Errorf("rate %v must be formatted <NUMBER>/<s|m|h|d>", rate)
+	}
+	count, _ := strconv.ParseFloat(match[1], 64)
+
+	return count / queueYAMLUnits[match[2]].Seconds(), nil
+}
+
+// parseQueueYAMLDuration parses an age limit, e.g. 30m or 2d
+func parseQueueYAMLDuration(duration string) (time.Duration, error) {
+	match := queueYAMLDurationRegexp.FindStringSubmatch(strings.TrimSpace(duration))
+	if match == nil {
+		return 0, fmt.Errorf("task_age_limit %v must be formatted <NUMBER><s|m|h|d>", duration)
+	}
+	count, _ := strconv.ParseFloat(match[1], 64)
+
+	return time.Duration(count * float64(queueYAMLUnits[match[2]])), nil
+}
+
+// importQueueYAML creates the queues of the queue.yaml file in the location,
+// e.g. projects/my-project/locations/my-location. The queues that already
+// exist, e.g. restored from the data dir, are left as they are.
+func importQueueYAML(s *Server, path string, parent string) error {
+	file, err := loadQueueYAML(path)
+	if err != nil {
+		return err
+	}
+
+	for _, def := range file.Queues {
+		queue, err := def.toQueue(parent)
+		if err != nil {
+			return fmt.Errorf("Invalid queue %v in %v: %v", def.Name, path, err)
+		}
+
+		logInfo("Creating queue from queue.yaml", field("queue", queue.GetName()))
+
+		_, err = s.createQueue(&tasks.CreateQueueRequest{Parent: parent, Queue: queue}, def.Mode == "pull")
+		if status.Code(err) == codes.AlreadyExists {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to create queue %v: %v", queue.GetName(), err)
+		}
+	}
+
+	return nil
+}
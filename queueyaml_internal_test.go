@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestImportQueueYAML(t *testing.T) {
+	path := writeConfigFile(t, `
+total_storage_limit: 120M
+queue:
+- name: default
+  rate: 10/m
+  bucket_size: 20
+  max_concurrent_requests: 5
+  target: v2.worker
+  retry_parameters:
+    task_retry_limit: 7
+    task_age_limit: 2d
+    min_backoff_seconds: 0.5
+    max_backoff_seconds: 200
+    max_doublings: 3
+- name: pullq
+  mode: pull
+  acl:
+  - user_email: someone@example.com
+`)
+	defer os.Remove(path)
+
+	server := NewServer()
+	defer server.Reset()
+	parent := "projects/bluebook/locations/us-east1"
+	require.NoError(t, importQueueYAML(server, path, parent))
+
+	queue, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: parent + "/queues/default"})
+	require.NoError(t, err)
+	assert.InDelta(t, 10.0/60, queue.GetRateLimits().GetMaxDispatchesPerSecond(), 1e-9)
+	assert.Equal(t, int32(20), queue.GetRateLimits().GetMaxBurstSize())
+	assert.Equal(t, int32(5), queue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.Equal(t, "worker", queue.GetAppEngineRoutingOverride().GetService())
+	assert.Equal(t, "v2", queue.GetAppEngineRoutingOverride().GetVersion())
+
+	retry := queue.GetRetryConfig()
+	assert.Equal(t, int32(7), retry.GetMaxAttempts())
+	assert.Equal(t, int32(3), retry.GetMaxDoublings())
+	maxRetryDuration, _ := ptypes.Duration(retry.GetMaxRetryDuration())
+	assert.Equal(t, 48*time.Hour, maxRetryDuration)
+	minBackoff, _ := ptypes.Duration(retry.GetMinBackoff())
+	assert.Equal(t, 500*time.Millisecond, minBackoff)
+	maxBackoff, _ := ptypes.Duration(retry.GetMaxBackoff())
+	assert.Equal(t, 200*time.Second, maxBackoff)
+
+	pullQueue, ok := server.fetchQueue(parent + "/queues/pullq")
+	require.True(t, ok)
+	assert.True(t, pullQueue.pull)
+
+	// Importing again leaves the existing queues
+	assert.NoError(t, importQueueYAML(server, path, parent))
+}
+
+func TestQueueYAMLRates(t *testing.T) {
+	for rate, expected := range map[string]float64{
+		"5/s":   5,
+		"30/m":  0.5,
+		"3.6/h": 0.001,
+		"0/s":   0,
+	} {
+		parsed, err := parseQueueYAMLRate(rate)
+		require.NoError(t, err, rate)
+		assert.InDelta(t, expected, parsed, 1e-9, rate)
+	}
+
+	for _, rate := range []string{"", "5", "5/w", "-1/s", "five/s"} {
+		_, err := parseQueueYAMLRate(rate)
+		assert.Error(t, err, rate)
+	}
+}
+
+func TestImportInvalidQueueYAML(t *testing.T) {
+	server := NewServer()
+	defer server.Reset()
+	parent := "projects/bluebook/locations/us-east1"
+
+	for _, content := range []string{
+		"queue:\n- rate: 5/s\n",
+		"queue:\n- name: q\n  rate: fast\n",
+		"queue:\n- name: q\n  mode: batch\n",
+		"queue:\n- name: q\n  target: a.b.c\n",
+		"queue:\n- name: q\n  retry_parameters:\n    task_age_limit: 2w\n",
+		"queue: [",
+	} {
+		path := writeConfigFile(t, content)
+		assert.Error(t, importQueueYAML(server, path, parent), content)
+		os.Remove(path)
+	}
+}
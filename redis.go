@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// Replicas of the emulator share their queues and tasks through Redis with
+// -redis-addr. Each replica keeps working on its state in memory, writing the
+// changes of the queues through to Redis as they happen and those of the tasks
+// at every REDIS_SYNC_INTERVAL, when it also mirrors the changes of the others.
+// A queue only dispatches on the replica holding its lease, which the replica
+// renews at every sync.
+
+const (
+	redisKeyPrefix = "cloud-tasks-emulator:"
+
+	defaultRedisSyncInterval = time.Second
+
+	// How long a lease outlives the last renewal, in sync intervals, so that
+	// another replica takes the queue over once its holder is gone
+	redisLeaseIntervals = 3
+
+	redisTimeout = 5 * time.Second
+)
+
+const (
+	redisQueuesKey     = redisKeyPrefix + "queues"
+	redisPullQueuesKey = redisKeyPrefix + "pull-queues"
+	redisTasksKey      = redisKeyPrefix + "tasks"
+	redisLeaseKey      = redisKeyPrefix + "lease:"
+)
+
+// redisLeaseScript takes the lease of the key for the replica, or renews it if
+// the replica holds it already, returning 1 if the replica holds it
+const redisLeaseScript = `local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if not holder then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0`
+
+// redisReleaseScript gives up the lease of the key if the replica holds it
+const redisReleaseScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// redisSyncInterval returns how often the replicas sync with Redis, set with
+// REDIS_SYNC_INTERVAL (e.g. 500ms) and every second by default
+func redisSyncInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("REDIS_SYNC_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultRedisSyncInterval
+	}
+
+	return interval
+}
+
+// redisClient sends commands to Redis one at a time over a single connection,
+// connecting again after an error
+type redisClient struct {
+	addr string
+
+	mux sync.Mutex
+
+	conn net.Conn
+
+	reader *bufio.Reader
+}
+
+func newRedisClient(addr string) *redisClient {
+	return &redisClient{addr: addr}
+}
+
+// redisError is an error reply of Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// do sends the command and returns its reply: a string, an int64, nil, or a
+// slice of those
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+	}
+
+	reply, err := c.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return reply, err
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads a reply in the Redis protocol
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Invalid Redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, count)
+		for i := range values {
+			if values[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("Invalid Redis reply %q", line)
+	}
+}
+
+// redisStore shares the queues and tasks of the replicas, and the leases to
+// dispatch the queues
+type redisStore struct {
+	client *redisClient
+
+	// Identifies the replica as the holder of the leases
+	replica string
+
+	// How often the replica syncs with Redis, renewing its leases
+	interval time.Duration
+
+	// The tasks saved, or removed if nil, since the last sync, written then
+	// rather than while the queues are locked. Guarded by pendingMux.
+	pendingTasks map[string]*tasks.Task
+
+	pendingMux sync.Mutex
+}
+
+func newRedisStore(addr string, interval time.Duration) (*redisStore, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	store := &redisStore{
+		client:       newRedisClient(addr),
+		replica:      hostname + "-" + hex.EncodeToString(id),
+		interval:     interval,
+		pendingTasks: make(map[string]*tasks.Task),
+	}
+	if _, err := store.client.do("PING"); err != nil {
+		return nil, fmt.Errorf("Failed to connect to Redis at %v: %v", addr, err)
+	}
+
+	return store, nil
+}
+
+// newTaskStore creates the store of the tasks of a queue, writing them to Redis
+// at every sync as they are added and removed
+func (store *redisStore) newTaskStore(queueName string) taskStore {
+	return &redisTaskStore{taskStore: newMemoryTaskStore(), store: store}
+}
+
+func (store *redisStore) saveQueue(queueState *tasks.Queue, pull bool) {
+	data, err := proto.Marshal(queueState)
+	if err == nil {
+		_, err = store.client.do("HSET", redisQueuesKey, queueState.GetName(), string(data))
+	}
+	if err == nil && pull {
+		_, err = store.client.do("SADD", redisPullQueuesKey, queueState.GetName())
+	}
+	if err != nil {
+		logError("Failed to save queue to Redis", field("queue", queueState.GetName()), field("error", err))
+	}
+}
+
+// removeQueue removes the queue and gives up its lease, so that it isn't
+// mirrored back at the next sync
+func (store *redisStore) removeQueue(queueName string) {
+	_, err := store.client.do("HDEL", redisQueuesKey, queueName)
+	if err == nil {
+		_, err = store.client.do("SREM", redisPullQueuesKey, queueName)
+	}
+	if err == nil {
+		_, err = store.client.do("EVAL", redisReleaseScript, "1", redisLeaseKey+queueName, store.replica)
+	}
+	if err != nil {
+		logError("Failed to remove queue from Redis", field("queue", queueName), field("error", err))
+	}
+}
+
+func (store *redisStore) saveTask(taskState *tasks.Task) error {
+	data, err := proto.Marshal(taskState)
+	if err != nil {
+		return err
+	}
+	_, err = store.client.do("HSET", redisTasksKey, taskState.GetName(), string(data))
+
+	return err
+}
+
+// leaseQueue takes or renews the lease to dispatch the queue, telling whether
+// the replica holds it. Failing to reach Redis, the replica gives it up.
+func (store *redisStore) leaseQueue(queueName string) bool {
+	ttl := store.interval * redisLeaseIntervals
+	reply, err := store.client.do("EVAL", redisLeaseScript, "1", redisLeaseKey+queueName, store.replica, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil {
+		logError("Failed to lease queue from Redis", field("queue", queueName), field("error", err))
+		return false
+	}
+
+	return reply == int64(1)
+}
+
+// Load reads the queues and tasks in Redis
+func (store *redisStore) Load() (*Snapshot, error) {
+	snapshot := &Snapshot{}
+
+	queues, err := store.hashValues(redisQueuesKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range queues {
+		queueState := &tasks.Queue{}
+		if err := proto.Unmarshal([]byte(data), queueState); err != nil {
+			return nil, err
+		}
+		snapshot.Queues = append(snapshot.Queues, queueState)
+	}
+
+	ts, err := store.hashValues(redisTasksKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range ts {
+		taskState := &tasks.Task{}
+		if err := proto.Unmarshal([]byte(data), taskState); err != nil {
+			return nil, err
+		}
+		snapshot.Tasks = append(snapshot.Tasks, taskState)
+	}
+
+	reply, err := store.client.do("SMEMBERS", redisPullQueuesKey)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	for _, name := range members {
+		snapshot.PullQueues = append(snapshot.PullQueues, fmt.Sprint(name))
+	}
+
+	return snapshot, nil
+}
+
+// hashValues returns the values of the hash by field
+func (store *redisStore) hashValues(key string) (map[string]string, error) {
+	reply, err := store.client.do("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	pairs, _ := reply.([]interface{})
+
+	values := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		values[fmt.Sprint(pairs[i])] = fmt.Sprint(pairs[i+1])
+	}
+
+	return values, nil
+}
+
+// setPendingTask queues the task to be saved to Redis at the next sync, or
+// removed if nil
+func (store *redisStore) setPendingTask(taskName string, taskState *tasks.Task) {
+	store.pendingMux.Lock()
+	defer store.pendingMux.Unlock()
+
+	store.pendingTasks[taskName] = taskState
+}
+
+// flushTasks writes the pending tasks to Redis. Those that fail to be written
+// are kept for the next sync, unless changed since.
+func (store *redisStore) flushTasks() error {
+	store.pendingMux.Lock()
+	pending := store.pendingTasks
+	store.pendingTasks = make(map[string]*tasks.Task)
+	store.pendingMux.Unlock()
+
+	for name, taskState := range pending {
+		var err error
+		if taskState == nil {
+			_, err = store.client.do("HDEL", redisTasksKey, name)
+		} else {
+			err = store.saveTask(taskState)
+		}
+		if err != nil {
+			store.pendingMux.Lock()
+			for name, taskState := range pending {
+				if _, ok := store.pendingTasks[name]; !ok {
+					store.pendingTasks[name] = taskState
+				}
+			}
+			store.pendingMux.Unlock()
+			return err
+		}
+		delete(pending, name)
+	}
+
+	return nil
+}
+
+// redisTaskStore keeps the tasks of a queue in memory, as they are running, and
+// in Redis for the other replicas, written at every sync
+type redisTaskStore struct {
+	taskStore
+
+	store *redisStore
+}
+
+func (store *redisTaskStore) put(taskName string, task *Task) {
+	store.taskStore.put(taskName, task)
+	store.store.setPendingTask(taskName, task.frozenState())
+}
+
+func (store *redisTaskStore) remove(taskName string) {
+	store.taskStore.remove(taskName)
+	store.store.setPendingTask(taskName, nil)
+}
+
+// syncRedis syncs the server with Redis at every interval
+func syncRedis(s *Server, store *redisStore) {
+	for {
+		time.Sleep(store.interval)
+		if err := s.syncRedis(store); err != nil {
+			logError("Failed to sync with Redis", field("error", err))
+		}
+	}
+}
+
+// syncRedis creates the queues and tasks that other replicas added, and deletes
+// those they removed. The queues take the state in Redis, while the tasks take
+// it only if another replica dispatches them, this one saving the attempts of
+// those it dispatches instead. A draining queue only drains on the others once
+// it is disabled. The leases of the queues are then renewed.
+func (s *Server) syncRedis(store *redisStore) error {
+	// Listed first, as anything added since is written to Redis below
+	s.qsMux.Lock()
+	local := make(map[string]*Queue, len(s.qs))
+	for name, queue := range s.qs {
+		local[name] = queue
+	}
+	s.qsMux.Unlock()
+	localTasks := make(map[string]*Task)
+	for _, queue := range local {
+		if queue == nil {
+			continue
+		}
+		queue.tsMux.Lock()
+		for _, task := range queue.ts.list() {
+			localTasks[task.state.GetName()] = task
+		}
+		queue.tsMux.Unlock()
+	}
+
+	// Written before loading the others' changes, so that the tasks listed
+	// here are in Redis unless done
+	if err := store.flushTasks(); err != nil {
+		return err
+	}
+	shared, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	pullQueues := make(map[string]bool)
+	for _, name := range shared.PullQueues {
+		pullQueues[name] = true
+	}
+	sharedQueues := make(map[string]bool)
+	for _, queueState := range shared.Queues {
+		name := queueState.GetName()
+		sharedQueues[name] = true
+
+		queue, known := local[name]
+		switch {
+		case !known:
+			s.mirrorQueue(queueState, pullQueues[name])
+		case queue == nil:
+			// Deleted here, and about to be removed from Redis
+		case queue.frozenState().GetState() == tasks.Queue_DISABLED:
+			s.saveQueue(queue)
+		default:
+			queue.mirror(queueState)
+		}
+	}
+	for name, queue := range local {
+		if queue != nil && !sharedQueues[name] {
+			queue.Delete()
+			s.removeQueue(name)
+		}
+	}
+
+	sharedTasks := make(map[string]bool)
+	for _, taskState := range shared.Tasks {
+		name := taskState.GetName()
+		sharedTasks[name] = true
+
+		task, known := localTasks[name]
+		switch {
+		case !known:
+			s.mirrorTask(taskState)
+		case task.queue.leased():
+			if state := task.frozenState(); !proto.Equal(state, taskState) {
+				if err := store.saveTask(state); err != nil {
+					return err
+				}
+			}
+		default:
+			task.mirror(taskState)
+		}
+	}
+	for name, task := range localTasks {
+		// Unless done since listed
+		if current, _ := s.lookupTask(name); current == task && !sharedTasks[name] {
+			task.Delete()
+			// Dropped right away, as it is only dropped on its dispatch otherwise
+			task.queue.removeTask(name)
+			s.removeTask(name)
+		}
+	}
+
+	for name := range sharedQueues {
+		if queue, _ := s.fetchQueue(name); queue != nil {
+			queue.setLeased(store.leaseQueue(name))
+		}
+	}
+
+	return nil
+}
+
+// mirrorQueue creates the queue that another replica added, in its state
+func (s *Server) mirrorQueue(queueState *tasks.Queue, pull bool) {
+	snapshot := &Snapshot{Queues: []*tasks.Queue{queueState}}
+	if pull {
+		snapshot.PullQueues = []string{queueState.GetName()}
+	}
+
+	// Created here since listed otherwise
+	s.importMux.RLock()
+	defer s.importMux.RUnlock()
+	if err := s.restore(snapshot); err != nil && status.Code(err) != codes.AlreadyExists {
+		logError("Failed to create queue from Redis", field("queue", queueState.GetName()), field("error", err))
+	}
+}
+
+// mirrorTask creates the task that another replica added, unless it is done here
+func (s *Server) mirrorTask(taskState *tasks.Task) {
+	s.tsMux.Lock()
+	_, exists := s.ts.get(taskState.GetName())
+	removed := s.isRecentlyRemoved(taskState.GetName())
+	s.tsMux.Unlock()
+	if exists || removed {
+		return
+	}
+
+	queue, err := s.lookupQueue(taskQueueName(taskState.GetName()))
+	if err != nil {
+		return
+	}
+	task, _, err := queue.NewTask(taskState)
+	if err != nil {
+		logError("Failed to create task from Redis", field("task", taskState.GetName()), field("error", err))
+		return
+	}
+	s.setTask(taskState.GetName(), task)
+}
+
+// mirror applies the state of the queue in Redis, as another replica changed it
+func (queue *Queue) mirror(queueState *tasks.Queue) {
+	current := queue.frozenState()
+
+	switch queueState.GetState() {
+	case tasks.Queue_PAUSED:
+		queue.Pause()
+	case tasks.Queue_RUNNING:
+		queue.Resume()
+	case tasks.Queue_DISABLED:
+		queue.Drain()
+	}
+
+	if !proto.Equal(current.GetRateLimits(), queueState.GetRateLimits()) || !proto.Equal(current.GetRetryConfig(), queueState.GetRetryConfig()) {
+		queue.reconfigure(queueState.GetRateLimits(), queueState.GetRetryConfig())
+	}
+}
+
+// mirror takes the state of the task in Redis, as dispatched by the replica
+// holding the lease of its queue, waiting for its new schedule time if it
+// hasn't come up yet
+func (task *Task) mirror(taskState *tasks.Task) {
+	task.stateMutex.Lock()
+	if task.deleted || proto.Equal(task.state, taskState) {
+		task.stateMutex.Unlock()
+		return
+	}
+	rescheduled := !proto.Equal(task.state.GetScheduleTime(), taskState.GetScheduleTime())
+	task.state = taskState
+	task.attempts = newAttemptHistory(taskState.GetDispatchCount(), taskState.GetResponseCount())
+	task.stateMutex.Unlock()
+
+	if rescheduled && task.queue.unschedule(task) {
+		task.queue.schedule(task)
+	}
+}
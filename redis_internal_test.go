@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+// fakeRedis serves the commands the emulator sends to Redis, keeping the
+// leases until deleted rather than letting them expire
+type fakeRedis struct {
+	listener net.Listener
+
+	mux sync.Mutex
+
+	hashes map[string]map[string]string
+
+	sets map[string]map[string]bool
+
+	values map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	redis := &fakeRedis{
+		listener: listener,
+		hashes:   make(map[string]map[string]string),
+		sets:     make(map[string]map[string]bool),
+		values:   make(map[string]string),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go redis.serve(conn)
+		}
+	}()
+
+	return redis
+}
+
+func (redis *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		command, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range command.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		fmt.Fprint(conn, redis.reply(args))
+	}
+}
+
+func (redis *fakeRedis) reply(args []string) string {
+	redis.mux.Lock()
+	defer redis.mux.Unlock()
+
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "HSET":
+		if redis.hashes[args[1]] == nil {
+			redis.hashes[args[1]] = make(map[string]string)
+		}
+		redis.hashes[args[1]][args[2]] = args[3]
+		return ":1\r\n"
+	case "HDEL":
+		delete(redis.hashes[args[1]], args[2])
+		return ":1\r\n"
+	case "HGETALL":
+		var items []string
+		for key, value := range redis.hashes[args[1]] {
+			items = append(items, key, value)
+		}
+		return fakeRedisArray(items)
+	case "SADD":
+		if redis.sets[args[1]] == nil {
+			redis.sets[args[1]] = make(map[string]bool)
+		}
+		redis.sets[args[1]][args[2]] = true
+		return ":1\r\n"
+	case "SREM":
+		delete(redis.sets[args[1]], args[2])
+		return ":1\r\n"
+	case "SMEMBERS":
+		var members []string
+		for member := range redis.sets[args[1]] {
+			members = append(members, member)
+		}
+		return fakeRedisArray(members)
+	case "EVAL":
+		key, replica := args[3], args[4]
+		holder, ok := redis.values[key]
+		switch args[1] {
+		case redisLeaseScript:
+			if ok && holder != replica {
+				return ":0\r\n"
+			}
+			redis.values[key] = replica
+			return ":1\r\n"
+		case redisReleaseScript:
+			if !ok || holder != replica {
+				return ":0\r\n"
+			}
+			delete(redis.values, key)
+			return ":1\r\n"
+		default:
+			return "-ERR unknown script\r\n"
+		}
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// expireLease drops the lease of the queue, as if its holder stopped renewing it
+func (redis *fakeRedis) expireLease(queueName string) {
+	redis.mux.Lock()
+	defer redis.mux.Unlock()
+
+	delete(redis.values, redisLeaseKey+queueName)
+}
+
+func fakeRedisArray(items []string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(item), item)
+	}
+
+	return reply
+}
+
+// newRedisServer creates a server sharing its queues and tasks through Redis
+func newRedisServer(t *testing.T, addr string) (*Server, *redisStore) {
+	store, err := newRedisStore(addr, time.Hour)
+	require.NoError(t, err)
+
+	server := NewServer()
+	server.newTaskStore = store.newTaskStore
+	server.queueStore = store
+
+	return server, store
+}
+
+func TestRedisSharesQueuesAndTasks(t *testing.T) {
+	redis := newFakeRedis(t)
+	defer redis.listener.Close()
+
+	dispatched := make(chan string, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dispatched <- r.URL.Path
+	}))
+	defer target.Close()
+
+	serverA, storeA := newRedisServer(t, redis.listener.Addr().String())
+	defer serverA.Reset()
+	serverB, storeB := newRedisServer(t, redis.listener.Addr().String())
+	defer serverB.Reset()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/shared"
+	_, err := serverA.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, serverB.syncRedis(storeB))
+	queueA, _ := serverA.fetchQueue(queueName)
+	queueB, _ := serverB.fetchQueue(queueName)
+	require.NotNil(t, queueB)
+	assert.True(t, queueA.leased())
+	assert.False(t, queueB.leased())
+
+	// Created on B, but dispatched by A once synced
+	taskName := queueName + "/tasks/shared"
+	_, err = serverB.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			Name: taskName,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: target.URL + "/shared"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	select {
+	case path := <-dispatched:
+		t.Fatalf("Dispatched %v without the lease", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Only written to Redis as B syncs
+	require.NoError(t, serverA.syncRedis(storeA))
+	_, err = serverA.lookupTask(taskName)
+	assert.Error(t, err)
+	require.NoError(t, serverB.syncRedis(storeB))
+	require.NoError(t, serverA.syncRedis(storeA))
+	select {
+	case path := <-dispatched:
+		assert.Equal(t, "/shared", path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Task not dispatched")
+	}
+
+	// Done on A, so gone from B
+	assert.Eventually(t, func() bool {
+		_, err := serverA.lookupTask(taskName)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, serverA.syncRedis(storeA))
+	require.NoError(t, serverB.syncRedis(storeB))
+	_, err = serverB.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: taskName})
+	assert.Error(t, err)
+
+	_, err = serverA.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	require.NoError(t, serverB.syncRedis(storeB))
+	assert.Equal(t, taskspb.Queue_PAUSED, queueB.frozenState().GetState())
+
+	// B takes over once the lease of A expires
+	redis.expireLease(queueName)
+	require.NoError(t, serverB.syncRedis(storeB))
+	assert.True(t, queueB.leased())
+	require.NoError(t, serverA.syncRedis(storeA))
+	assert.False(t, queueA.leased())
+
+	_, err = serverB.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	require.NoError(t, serverA.syncRedis(storeA))
+	_, err = serverA.lookupQueue(queueName)
+	assert.Error(t, err)
+}
+
+func TestRedisResetRemovesQueues(t *testing.T) {
+	redis := newFakeRedis(t)
+	defer redis.listener.Close()
+
+	server, store := newRedisServer(t, redis.listener.Addr().String())
+	defer server.Reset()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/reset"
+	_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+
+	server.Reset()
+	require.NoError(t, server.syncRedis(store))
+	queues, err := server.ListQueues(context.Background(), &taskspb.ListQueuesRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+	})
+	require.NoError(t, err)
+	assert.Empty(t, queues.GetQueues())
+
+	// The lease is given up with the queue
+	other, _ := newRedisServer(t, redis.listener.Addr().String())
+	defer other.Reset()
+	_, err = other.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+	queue, _ := other.fetchQueue(queueName)
+	assert.True(t, queue.leased())
+}
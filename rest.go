@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/genproto/protobuf/field_mask"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// restHandlerFunc maps a REST request onto the gRPC handler. The resource is
+// the name or parent matched in the path.
+type restHandlerFunc func(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error)
+
+type restRoute struct {
+	method  string
+	path    *regexp.Regexp
+	handler restHandlerFunc
+}
+
+const (
+	restLocationPattern = `projects/[^/]+/locations/[^/]+`
+	restQueuePattern    = restLocationPattern + `/queues/[^/:]+`
+	restTaskPattern     = restQueuePattern + `/tasks/[^/:]+`
+)
+
+// Routes as per https://cloud.google.com/tasks/docs/reference/rest
+var restRoutes = []restRoute{
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restLocationPattern + `)/queues$`), restCreateQueue},
+	{http.MethodGet, regexp.MustCompile(`^/v2/(` + restLocationPattern + `)/queues$`), restListQueues},
+	{http.MethodGet, regexp.MustCompile(`^/v2/(` + restQueuePattern + `)$`), restGetQueue},
+	{http.MethodPatch, regexp.MustCompile(`^/v2/(` + restQueuePattern + `)$`), restUpdateQueue},
+	{http.MethodDelete, regexp.MustCompile(`^/v2/(` + restQueuePattern + `)$`), restDeleteQueue},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restQueuePattern + `):purge$`), restPurgeQueue},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restQueuePattern + `):pause$`), restPauseQueue},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restQueuePattern + `):resume$`), restResumeQueue},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restQueuePattern + `):drain$`), restDrainQueue},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restQueuePattern + `)/tasks$`), restCreateTask},
+	{http.MethodGet, regexp.MustCompile(`^/v2/(` + restQueuePattern + `)/tasks$`), restListTasks},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restQueuePattern + `)/tasks/([^/:]*):buffer$`), restBufferTask},
+	{http.MethodGet, regexp.MustCompile(`^/v2/(` + restTaskPattern + `)$`), restGetTask},
+	{http.MethodDelete, regexp.MustCompile(`^/v2/(` + restTaskPattern + `)$`), restDeleteTask},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restTaskPattern + `):run$`), restRunTask},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restQueuePattern + `)/tasks:lease$`), restLeaseTasks},
+	{http.MethodPost, regexp.MustCompile(`^/v2/(` + restTaskPattern + `):acknowledge$`), restAcknowledgeTask},
+	{http.MethodPost, regexp.MustCompile(`^/reset$`), restReset},
+	{http.MethodPost, regexp.MustCompile(`^/advance$`), restAdvance},
+	{http.MethodPost, regexp.MustCompile(`^/flush$`), restFlush},
+	{http.MethodPost, regexp.MustCompile(`^/freeze$`), restFreeze},
+	{http.MethodPost, regexp.MustCompile(`^/unfreeze$`), restUnfreeze},
+	{http.MethodGet, regexp.MustCompile(`^/debug/queues$`), restDebugQueues},
+	{http.MethodGet, regexp.MustCompile(`^/dispatches$`), restDispatchEvents},
+	{http.MethodGet, regexp.MustCompile(`^/admin/queues$`), restAdminQueues},
+	{http.MethodGet, regexp.MustCompile(`^/admin/(` + restQueuePattern + `)/tasks$`), restAdminTasks},
+	{http.MethodGet, regexp.MustCompile(`^/admin/export$`), restExport},
+	{http.MethodPost, regexp.MustCompile(`^/admin/import$`), restImport},
+}
+
+func restCreateQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	queue := &tasks.Queue{}
+	if err := unmarshalRestQueue(body, queue); err != nil {
+		return nil, err
+	}
+
+	return s.CreateQueue(ctx, &tasks.CreateQueueRequest{Parent: resource[0], Queue: queue})
+}
+
+// restListQueues lists the queues of the location, optionally with e.g.
+// ?filter=state:PAUSED
+func restListQueues(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.ListQueues(ctx, &tasks.ListQueuesRequest{
+		Parent: resource[0],
+		Filter: req.URL.Query().Get("filter"),
+	})
+}
+
+func restGetQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.GetQueue(ctx, &tasks.GetQueueRequest{Name: resource[0]})
+}
+
+func restUpdateQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	queue := &tasks.Queue{}
+	if err := unmarshalRestQueue(body, queue); err != nil {
+		return nil, err
+	}
+	queue.Name = resource[0]
+
+	updateMask := &field_mask.FieldMask{}
+	if paths := req.URL.Query().Get("updateMask"); paths != "" {
+		for _, path := range strings.Split(paths, ",") {
+			updateMask.Paths = append(updateMask.Paths, toSnakeCase(path))
+		}
+	}
+
+	return s.UpdateQueue(ctx, &tasks.UpdateQueueRequest{Queue: queue, UpdateMask: updateMask})
+}
+
+func restDeleteQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.DeleteQueue(ctx, &tasks.DeleteQueueRequest{Name: resource[0]})
+}
+
+func restPurgeQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.PurgeQueue(ctx, &tasks.PurgeQueueRequest{Name: resource[0]})
+}
+
+func restPauseQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.PauseQueue(ctx, &tasks.PauseQueueRequest{Name: resource[0]})
+}
+
+func restResumeQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.ResumeQueue(ctx, &tasks.ResumeQueueRequest{Name: resource[0]})
+}
+
+func restDrainQueue(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.DrainQueue(ctx, resource[0])
+}
+
+func restCreateTask(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	in := &tasks.CreateTaskRequest{}
+	if err := unmarshalRestBody(body, in); err != nil {
+		return nil, err
+	}
+	in.Parent = resource[0]
+	if in.Task == nil {
+		in.Task = &tasks.Task{}
+	}
+
+	return s.CreateTask(ctx, in)
+}
+
+// restListTasks lists the tasks of the queue, optionally with ?responseView=FULL
+// and paged with ?pageSize=100&pageToken=<NEXT_PAGE_TOKEN>
+func restListTasks(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	query := req.URL.Query()
+
+	var size int64
+	if query.Get("pageSize") != "" {
+		var err error
+		if size, err = strconv.ParseInt(query.Get("pageSize"), 10, 32); err != nil {
+			return nil, invalidArgument("page_size", "page_size must be a number.")
+		}
+	}
+
+	return s.ListTasks(ctx, &tasks.ListTasksRequest{
+		Parent:       resource[0],
+		ResponseView: tasks.Task_View(tasks.Task_View_value[query.Get("responseView")]),
+		PageSize:     int32(size),
+		PageToken:    query.Get("pageToken"),
+	})
+}
+
+func restBufferTask(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	task, err := s.BufferTask(ctx, resource[0], resource[1], body, req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Mirrors BufferTaskResponse, see v2beta3.go
+	return &tasks.CreateTaskRequest{Task: task}, nil
+}
+
+// restGetTask gets the task, optionally with ?responseView=FULL
+func restGetTask(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.GetTask(ctx, &tasks.GetTaskRequest{
+		Name:         resource[0],
+		ResponseView: tasks.Task_View(tasks.Task_View_value[req.URL.Query().Get("responseView")]),
+	})
+}
+
+func restDeleteTask(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.DeleteTask(ctx, &tasks.DeleteTaskRequest{Name: resource[0]})
+}
+
+// restRunTask runs the task, with an optional body like {"responseView": "FULL"}
+func restRunTask(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	in := &tasks.RunTaskRequest{}
+	if err := unmarshalRestBody(body, in); err != nil {
+		return nil, err
+	}
+	in.Name = resource[0]
+
+	return s.RunTask(ctx, in)
+}
+
+// restLeaseTasks leases tasks of a pull queue, with a body like
+// {"maxTasks": 10, "leaseDuration": "60s"}, and optionally a "filter" as in
+// v2beta2
+func restLeaseTasks(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	var in struct {
+		MaxTasks      int    `json:"maxTasks"`
+		LeaseDuration string `json:"leaseDuration"`
+		Filter        string `json:"filter"`
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid JSON payload received. %v", err)
+	}
+	leaseDuration, err := time.ParseDuration(in.LeaseDuration)
+	if err != nil {
+		return nil, invalidArgument("lease_duration", "lease_duration must be a duration, e.g. 60s.")
+	}
+
+	leased, err := s.LeaseTasks(ctx, resource[0], in.MaxTasks, leaseDuration, in.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mirrors LeaseTasksResponse, which isn't defined in the v2 protos
+	return &tasks.ListTasksResponse{Tasks: leased}, nil
+}
+
+func restAcknowledgeTask(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.AcknowledgeTask(ctx, resource[0], nil)
+}
+
+// restReset clears the emulator state, if enabled with ENABLE_RESET=true
+func restReset(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("ENABLE_RESET")); !enabled {
+		return nil, status.Errorf(codes.NotFound, "The requested URL %s was not found.", req.URL.Path)
+	}
+
+	s.Reset()
+
+	return &empty.Empty{}, nil
+}
+
+// restFlush runs the tasks of all queues straight away, or those of a queue only
+// with ?queue=<queue name>, responding with the number of tasks run, e.g.
+// {"flushedTasks": 3}
+func restFlush(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	flushed, err := s.Flush(req.URL.Query().Get("queue"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"flushedTasks": numberValue(int64(flushed)),
+	}}, nil
+}
+
+// restFreeze stops the dispatches of all queues until unfrozen
+func restFreeze(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	s.Freeze()
+
+	return &empty.Empty{}, nil
+}
+
+func restUnfreeze(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	s.Unfreeze()
+
+	return &empty.Empty{}, nil
+}
+
+// restAdvance moves the fake clock forward by the duration, e.g. ?duration=30s
+func restAdvance(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	duration, err := time.ParseDuration(req.URL.Query().Get("duration"))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "The duration must be zero or more, e.g. 30s.")
+	}
+
+	if _, err := s.AdvanceTime(duration); err != nil {
+		return nil, err
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// restDebugQueues returns the numbers of running goroutines and the token bucket
+// of each queue, e.g.
+// {"projects/dev/locations/here/queues/firstq": {"workers": 1000, "dispatchers": 1, "tokenGenerators": 1, "schedulers": 1,
+// "tokenBucket": {"tokens": 99, "maxBurstSize": 100, "period": "0.002s", "nextTokenTime": "2020-01-01T00:00:00.002Z"}}}
+func restDebugQueues(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	buckets := s.QueueTokenBuckets()
+
+	queues := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+	for name, counts := range s.QueueRoutineCounts() {
+		fields := map[string]*structpb.Value{
+			"workers":         numberValue(counts.Workers),
+			"dispatchers":     numberValue(counts.Dispatchers),
+			"tokenGenerators": numberValue(counts.TokenGenerators),
+			"schedulers":      numberValue(counts.Schedulers),
+		}
+		if bucket, ok := buckets[name]; ok {
+			fields["tokenBucket"] = tokenBucketValue(bucket)
+		}
+		queues.Fields[name] = &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: fields}}}
+	}
+
+	return queues, nil
+}
+
+// tokenBucketValue formats the token bucket stats, the period as a JSON duration
+// and the next token time, left out if unknown, as an RFC 3339 time
+func tokenBucketValue(bucket TokenBucketStats) *structpb.Value {
+	fields := map[string]*structpb.Value{
+		"tokens":       numberValue(int64(bucket.Tokens)),
+		"maxBurstSize": numberValue(int64(bucket.MaxBurstSize)),
+		"period":       stringValue(strconv.FormatFloat(bucket.Period.Seconds(), 'f', -1, 64) + "s"),
+	}
+	if !bucket.NextToken.IsZero() {
+		fields["nextTokenTime"] = stringValue(bucket.NextToken.UTC().Format(time.RFC3339Nano))
+	}
+
+	return &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: fields}}}
+}
+
+// restDispatchEvents returns the recorded dispatch outcomes, optionally filtered
+// with ?queue=<queue name>&since=<RFC 3339 time>&until=<RFC 3339 time>
+func restDispatchEvents(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	query := req.URL.Query()
+
+	var since, until time.Time
+	for param, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, invalidArgument(param, "%v must be an RFC 3339 time, e.g. 2020-01-01T00:00:00Z.", param)
+			}
+			*t = parsed
+		}
+	}
+
+	var events []*structpb.Value
+	for _, event := range s.DispatchEvents(query.Get("queue"), since, until) {
+		events = append(events, structValue(map[string]*structpb.Value{
+			"time":       timeValue(event.Time),
+			"queueName":  stringValue(event.QueueName),
+			"taskName":   stringValue(event.TaskName),
+			"attempt":    numberValue(int64(event.Attempt)),
+			"url":        stringValue(event.URL),
+			"statusCode": numberValue(int64(event.StatusCode)),
+			"duration":   numberValue(int64(event.Duration)),
+		}))
+	}
+
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"events": listValue(events),
+	}}, nil
+}
+
+// restAdminQueues summarizes all queues, e.g.
+// {"queues": [{"name": "projects/dev/locations/here/queues/firstq", "state": "RUNNING", "pendingTasks": 2, ...}]}
+func restAdminQueues(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	var queues []*structpb.Value
+	for _, queue := range s.AdminQueues() {
+		fields := map[string]*structpb.Value{
+			"name":               stringValue(queue.Name),
+			"state":              stringValue(queue.State),
+			"pendingTasks":       numberValue(queue.PendingTasks),
+			"inFlightDispatches": numberValue(queue.InFlightDispatches),
+			"completedTasks":     numberValue(queue.CompletedTasks),
+		}
+		if queue.OldestScheduleTime != nil {
+			fields["oldestScheduleTime"] = timeValue(*queue.OldestScheduleTime)
+		}
+		queues = append(queues, structValue(fields))
+	}
+
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"queues": listValue(queues),
+	}}, nil
+}
+
+// restAdminTasks describes the pending tasks of the queue, with their schedule
+// times, attempt counts and last response codes
+func restAdminTasks(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	ts, err := s.AdminTasks(resource[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptions []*structpb.Value
+	for _, task := range ts {
+		fields := map[string]*structpb.Value{
+			"name":          stringValue(task.Name),
+			"scheduleTime":  timeValue(task.ScheduleTime),
+			"createTime":    timeValue(task.CreateTime),
+			"dispatchCount": numberValue(int64(task.DispatchCount)),
+			"responseCount": numberValue(int64(task.ResponseCount)),
+			"dispatching":   {Kind: &structpb.Value_BoolValue{BoolValue: task.Dispatching}},
+		}
+		if task.LastStatusCode != 0 {
+			fields["lastStatusCode"] = numberValue(int64(task.LastStatusCode))
+		}
+		descriptions = append(descriptions, structValue(fields))
+	}
+
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"tasks": listValue(descriptions),
+	}}, nil
+}
+
+// restExport dumps the queues and pending tasks, e.g.
+// {"queues": [...], "tasks": [...], "pullQueues": [...]}, as loaded by /admin/import
+func restExport(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	return s.Export(), nil
+}
+
+// restImport replaces the queues and tasks with those of an export, which
+// resets the emulator, so it's enabled with ENABLE_RESET=true as well
+func restImport(s *Server, ctx context.Context, resource []string, req *http.Request, body []byte) (proto.Message, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("ENABLE_RESET")); !enabled {
+		return nil, status.Errorf(codes.NotFound, "The requested URL %s was not found.", req.URL.Path)
+	}
+
+	snapshot := &Snapshot{}
+	if err := unmarshalRestBody(body, snapshot); err != nil {
+		return nil, err
+	}
+	if err := s.Import(snapshot); err != nil {
+		return nil, err
+	}
+
+	return &empty.Empty{}, nil
+}
+
+func numberValue(n int64) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: float64(n)}}
+}
+
+func stringValue(str string) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: str}}
+}
+
+// timeValue formats the time as an RFC 3339 time
+func timeValue(t time.Time) *structpb.Value {
+	return stringValue(t.Format(time.RFC3339Nano))
+}
+
+func structValue(fields map[string]*structpb.Value) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: fields}}}
+}
+
+// listValue is the list of the values, empty rather than null if there are none
+func listValue(values []*structpb.Value) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_ListValue{ListValue: &structpb.ListValue{Values: values}}}
+}
+
+// unmarshalRestQueue unmarshals a queue, including its logging config, kept in
+// the unrecognized fields
+func unmarshalRestQueue(body []byte, queue *tasks.Queue) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid JSON payload received. %v", err)
+	}
+
+	var config *StackdriverLoggingConfig
+	if rawConfig, ok := fields["stackdriverLoggingConfig"]; ok {
+		config = &StackdriverLoggingConfig{}
+		if err := json.Unmarshal(rawConfig, config); err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid JSON payload received. %v", err)
+		}
+		delete(fields, "stackdriverLoggingConfig")
+		body, _ = json.Marshal(fields)
+	}
+
+	if err := unmarshalRestBody(body, queue); err != nil {
+		return err
+	}
+	if config != nil {
+		setStackdriverLoggingConfig(queue, config)
+	}
+
+	return nil
+}
+
+// marshalRestResponse marshals the response, adding the logging config of the
+// queues from their unrecognized fields
+func marshalRestResponse(resp proto.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	marshaler := jsonpb.Marshaler{}
+	if err := marshaler.Marshal(&buf, resp); err != nil {
+		return nil, err
+	}
+
+	queue, ok := resp.(*tasks.Queue)
+	if !ok {
+		return buf.Bytes(), nil
+	}
+	config, _ := getStackdriverLoggingConfig(queue)
+	if config == nil {
+		return buf.Bytes(), nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		return nil, err
+	}
+	fields["stackdriverLoggingConfig"] = config
+
+	return json.Marshal(fields)
+}
+
+// toSnakeCase converts a JSON field mask path to its proto field names
+func toSnakeCase(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if unicode.IsUpper(r) {
+			b.WriteRune('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func unmarshalRestBody(body []byte, pb proto.Message) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	unmarshaler := jsonpb.Unmarshaler{}
+	if err := unmarshaler.Unmarshal(bytes.NewReader(body), pb); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid JSON payload received. %v", err)
+	}
+
+	return nil
+}
+
+// NewRestHandler creates an HTTP handler serving the Cloud Tasks REST API,
+// transcoding the requests to the emulator server
+func NewRestHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Served as is rather than as JSON
+		if req.Method == http.MethodGet {
+			switch req.URL.Path {
+			case "/ui", "/ui/":
+				serveDashboard(w)
+				return
+			case "/admin/events":
+				serveTaskEvents(s, w, req)
+				return
+			case "/metrics":
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				s.WriteMetrics(w)
+				return
+			case "/healthz":
+				respondPlainText(w, http.StatusOK, "ok")
+				return
+			case "/readyz":
+				if !s.Ready() {
+					respondPlainText(w, http.StatusServiceUnavailable, "not ready")
+					return
+				}
+				respondPlainText(w, http.StatusOK, "ok")
+				return
+			}
+		}
+
+		for _, route := range restRoutes {
+			matches := route.path.FindStringSubmatch(req.URL.Path)
+			if matches == nil {
+				continue
+			}
+			if req.Method != route.method {
+				continue
+			}
+
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			resp, err := route.handler(s, req.Context(), matches[1:], req, body)
+			if err != nil {
+				respondRestError(w, err)
+				return
+			}
+
+			respBody, err := marshalRestResponse(resp)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(respBody)
+			return
+		}
+
+		respondRestError(w, status.Errorf(codes.NotFound, "The requested URL %s was not found.", req.URL.Path))
+	})
+}
+
+func respondPlainText(w http.ResponseWriter, statusCode int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(body + "\n"))
+}
+
+func respondRestError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	httpStatus := toHTTPStatusCode(st.Code())
+
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    httpStatus,
+			"message": st.Message(),
+			"status":  toCodeName(int32(st.Code())),
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(body)
+}
+
+func serveRest(s *Server, listenAddr string, listenPort string) *http.Server {
+	server := &http.Server{Addr: listenAddr + ":" + listenPort, Handler: NewRestHandler(s)}
+	go server.ListenAndServe()
+
+	return server
+}
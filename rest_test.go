@@ -0,0 +1,766 @@
+package main_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/aertje/cloud-tasks-emulator"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRestQueueAndTaskLifecycle(t *testing.T) {
+	srv := httptest.NewServer(NewRestHandler(NewServer()))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+
+	resp, body := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, queueName, body["name"])
+	assert.Equal(t, "RUNNING", body["state"])
+
+	resp, body = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+":pause", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "PAUSED", body["state"])
+
+	scheduleTime := time.Now().Add(24 * time.Hour).UTC().Format("2006-01-02T15:04:05Z")
+	resp, body = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{
+		"task": {
+			"name": "`+queueName+`/tasks/my-task",
+			"scheduleTime": "`+scheduleTime+`",
+			"httpRequest": {"url": "http://localhost:5000/success", "httpMethod": "PUT"}
+		}
+	}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, queueName+"/tasks/my-task", body["name"])
+	assert.Equal(t, scheduleTime, body["scheduleTime"])
+	assert.Equal(t, "PUT", body["httpRequest"].(map[string]interface{})["httpMethod"])
+
+	resp, body = restRequest(t, srv, http.MethodGet, "/v2/"+queueName+"/tasks/my-task", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, queueName+"/tasks/my-task", body["name"])
+	assert.Equal(t, "BASIC", body["view"])
+
+	resp, body = restRequest(t, srv, http.MethodGet, "/v2/"+queueName+"/tasks/my-task?responseView=FULL", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "FULL", body["view"])
+	assert.Equal(t, "Google-Cloud-Tasks", body["httpRequest"].(map[string]interface{})["headers"].(map[string]interface{})["User-Agent"])
+
+	resp, body = restRequest(t, srv, http.MethodGet, "/v2/"+queueName+"/tasks", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, body["tasks"], 1)
+
+	resp, _ = restRequest(t, srv, http.MethodDelete, "/v2/"+queueName+"/tasks/my-task", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+":resume", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "RUNNING", body["state"])
+}
+
+func TestRestDrainQueue(t *testing.T) {
+	var mux sync.Mutex
+	dispatched := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		dispatched++
+	}))
+	defer target.Close()
+
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	createTask := func(taskID string) (*http.Response, map[string]interface{}) {
+		scheduleTime := time.Now().Add(time.Second).UTC().Format("2006-01-02T15:04:05Z")
+		return restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{
+			"task": {"name": "`+queueName+`/tasks/`+taskID+`", "scheduleTime": "`+scheduleTime+`", "httpRequest": {"url": "`+target.URL+`"}}
+		}`)
+	}
+	for _, taskID := range []string{"pending-1", "pending-2"} {
+		resp, _ = createTask(taskID)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Keeps running until the pending tasks are done
+	resp, body := restRequest(t, srv, http.MethodPost, "/v2/"+queueName+":drain", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "RUNNING", body["state"])
+
+	resp, body = createTask("rejected")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "FAILED_PRECONDITION", body["error"].(map[string]interface{})["status"])
+
+	drained := func() bool {
+		_, body := restRequest(t, srv, http.MethodGet, "/v2/"+queueName, "")
+		return body["state"] == "DISABLED"
+	}
+	assert.Eventually(t, drained, 3*time.Second, 50*time.Millisecond)
+
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, 2, dispatched, "The pending tasks completed")
+}
+
+func TestRestQueueAndTaskManagement(t *testing.T) {
+	dispatched := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dispatched <- req.Header.Get("X-CloudTasks-TaskName")
+	}))
+	defer target.Close()
+
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	otherParent := "projects/TestProject/locations/OtherLocation"
+	for _, name := range []string{queueName, formatQueueName(otherParent, "other")} {
+		resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+name[:strings.Index(name, "/queues/")]+"/queues", `{"name": "`+name+`"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Only lists the queues of the location
+	resp, body := restRequest(t, srv, http.MethodGet, "/v2/"+formattedParent+"/queues", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, body["queues"], 1)
+	assert.Equal(t, queueName, body["queues"].([]interface{})[0].(map[string]interface{})["name"])
+
+	scheduleTime := time.Now().Add(time.Hour).UTC().Format("2006-01-02T15:04:05Z")
+	for _, taskID := range []string{"run-now", "purged"} {
+		resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{
+			"task": {"name": "`+queueName+`/tasks/`+taskID+`", "scheduleTime": "`+scheduleTime+`", "httpRequest": {"url": "`+target.URL+`", "body": "Ym9keQ=="}}
+		}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, body = restRequest(t, srv, http.MethodGet, "/v2/"+queueName+"/tasks", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, body["tasks"], 2)
+	basicHTTPRequest := body["tasks"].([]interface{})[0].(map[string]interface{})["httpRequest"].(map[string]interface{})
+	assert.Equal(t, target.URL, basicHTTPRequest["url"])
+	assert.Nil(t, basicHTTPRequest["body"], "Basic view by default")
+
+	resp, body = restRequest(t, srv, http.MethodGet, "/v2/"+queueName+"/tasks?responseView=FULL", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, body["tasks"], 2)
+	assert.Equal(t, "Ym9keQ==", body["tasks"].([]interface{})[0].(map[string]interface{})["httpRequest"].(map[string]interface{})["body"])
+
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks/run-now:run", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	select {
+	case taskID := <-dispatched:
+		assert.Equal(t, "run-now", taskID)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Task was not run")
+	}
+
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+":purge", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = restRequest(t, srv, http.MethodGet, "/v2/"+queueName+"/tasks/purged", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = restRequest(t, srv, http.MethodDelete, "/v2/"+queueName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = restRequest(t, srv, http.MethodGet, "/v2/"+queueName, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRestQueueStackdriverLoggingConfig(t *testing.T) {
+	srv := httptest.NewServer(NewRestHandler(NewServer()))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`", "stackdriverLoggingConfig": {"samplingRatio": 2}}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`", "stackdriverLoggingConfig": {"samplingRatio": 0.3}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"samplingRatio": 0.3}, body["stackdriverLoggingConfig"])
+
+	resp, body = restRequest(t, srv, http.MethodPatch, "/v2/"+queueName+"?updateMask=stackdriverLoggingConfig.samplingRatio", `{"stackdriverLoggingConfig": {"samplingRatio": 0.7}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"samplingRatio": 0.7}, body["stackdriverLoggingConfig"])
+
+	resp, body = restRequest(t, srv, http.MethodGet, "/v2/"+queueName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"samplingRatio": 0.7}, body["stackdriverLoggingConfig"])
+	assert.Equal(t, "RUNNING", body["state"])
+}
+
+func TestRestErrors(t *testing.T) {
+	srv := httptest.NewServer(NewRestHandler(NewServer()))
+	defer srv.Close()
+
+	resp, body := restRequest(t, srv, http.MethodGet, "/v2/"+formatQueueName(formattedParent, "missing"), "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "NOT_FOUND", body["error"].(map[string]interface{})["status"])
+
+	resp, body = restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": 12}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "INVALID_ARGUMENT", body["error"].(map[string]interface{})["status"])
+
+	resp, _ = restRequest(t, srv, http.MethodGet, "/v1/unknown", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRestReset(t *testing.T) {
+	defer os.Unsetenv("ENABLE_RESET")
+	os.Setenv("ENABLE_RESET", "true")
+
+	server := NewServer()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	for _, queueID := range []string{"first", "second"} {
+		queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  &taskspb.Queue{Name: formatQueueName(formattedParent, queueID)},
+		})
+		require.NoError(t, err)
+
+		_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				Name:         queue.GetName() + "/tasks/pending",
+				ScheduleTime: &timestamp.Timestamp{Seconds: time.Now().Add(time.Hour).Unix()},
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:5000/success"},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	resp, _ := restRequest(t, srv, http.MethodPost, "/reset", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	queues, err := server.ListQueues(context.Background(), &taskspb.ListQueuesRequest{Parent: formattedParent})
+	require.NoError(t, err)
+	assert.Empty(t, queues.GetQueues())
+
+	// The names are free to use again
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  &taskspb.Queue{Name: formatQueueName(formattedParent, "first")},
+	})
+	require.NoError(t, err)
+	_, err = server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: queue.GetName() + "/tasks/pending"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestRestResetDisabled(t *testing.T) {
+	srv := httptest.NewServer(NewRestHandler(NewServer()))
+	defer srv.Close()
+
+	resp, _ := restRequest(t, srv, http.MethodPost, "/reset", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRestPullQueueLeases(t *testing.T) {
+	defer os.Unsetenv("PULL_QUEUE_PULLED")
+	os.Setenv("PULL_QUEUE_PULLED", "true")
+
+	dispatched := make(chan bool, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dispatched <- true
+	}))
+	defer target.Close()
+
+	srv := httptest.NewServer(NewRestHandler(NewServer()))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "pulled")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{
+		"task": {"name": "`+queueName+`/tasks/pulled-task", "httpRequest": {"url": "`+target.URL+`"}}
+	}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lease := func() []interface{} {
+		resp, body := restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks:lease", `{"maxTasks": 10, "leaseDuration": "0.2s"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		leased, _ := body["tasks"].([]interface{})
+		return leased
+	}
+
+	leased := lease()
+	require.Len(t, leased, 1)
+	assert.Equal(t, queueName+"/tasks/pulled-task", leased[0].(map[string]interface{})["name"])
+	assert.EqualValues(t, 1, leased[0].(map[string]interface{})["dispatchCount"])
+
+	// Not available again while leased
+	assert.Len(t, lease(), 0)
+
+	// The lease expires without an acknowledgement
+	time.Sleep(300 * time.Millisecond)
+	leased = lease()
+	require.Len(t, leased, 1)
+	assert.EqualValues(t, 2, leased[0].(map[string]interface{})["dispatchCount"])
+
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks/pulled-task:acknowledge", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Len(t, lease(), 0)
+	resp, _ = restRequest(t, srv, http.MethodGet, "/v2/"+queueName+"/tasks/pulled-task", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Tasks of pull queues are never dispatched
+	assert.Len(t, dispatched, 0)
+
+	// Push queues are unaffected
+	pushQueueName := formatQueueName(formattedParent, "pushed")
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+pushQueueName+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body := restRequest(t, srv, http.MethodPost, "/v2/"+pushQueueName+"/tasks:lease", `{"maxTasks": 10, "leaseDuration": "1s"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "FAILED_PRECONDITION", body["error"].(map[string]interface{})["status"])
+}
+
+func TestRestDebugQueues(t *testing.T) {
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`", "rateLimits": {"maxConcurrentDispatches": 5}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := restRequest(t, srv, http.MethodGet, "/debug/queues", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Whether the dispatcher holds a token waiting for a task, and whether the
+	// next token time is known, depends on how far the goroutines got
+	tokenBucket := body[queueName].(map[string]interface{})["tokenBucket"].(map[string]interface{})
+	assert.Contains(t, []interface{}{99.0, 100.0}, tokenBucket["tokens"])
+	delete(tokenBucket, "tokens")
+	delete(tokenBucket, "nextTokenTime")
+
+	assert.Equal(t, map[string]interface{}{
+		queueName: map[string]interface{}{
+			"workers":         5.0,
+			"dispatchers":     1.0,
+			"tokenGenerators": 1.0,
+			"schedulers":      1.0,
+			"tokenBucket": map[string]interface{}{
+				"maxBurstSize": 100.0,
+				"period":       "0.002s",
+			},
+		},
+	}, body)
+}
+
+func TestRestDispatchEvents(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`", "retryConfig": {"maxAttempts": 1}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	start := time.Now()
+	for _, path := range []string{"/succeed", "/fail"} {
+		resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{
+			"task": {"name": "`+queueName+`/tasks/task`+strings.Replace(path, "/", "-", 1)+`", "httpRequest": {"url": "`+target.URL+path+`"}}
+		}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	resp, body := restRequest(t, srv, http.MethodGet, "/dispatches?queue="+queueName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	events := body["events"].([]interface{})
+	require.Len(t, events, 2)
+	for i, expected := range []struct {
+		path       string
+		statusCode float64
+	}{{"/succeed", 200}, {"/fail", 500}} {
+		event := events[i].(map[string]interface{})
+		assert.Equal(t, queueName, event["queueName"])
+		assert.Equal(t, queueName+"/tasks/task"+strings.Replace(expected.path, "/", "-", 1), event["taskName"])
+		assert.Equal(t, 1.0, event["attempt"])
+		assert.Equal(t, target.URL+expected.path, event["url"])
+		assert.Equal(t, expected.statusCode, event["statusCode"])
+	}
+
+	// Filtered on the queue and time range
+	resp, body = restRequest(t, srv, http.MethodGet, "/dispatches?queue="+formatQueueName(formattedParent, "other"), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, body["events"], 0)
+	resp, body = restRequest(t, srv, http.MethodGet, "/dispatches?until="+start.UTC().Format(time.RFC3339Nano), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, body["events"], 0)
+
+	resp, _ = restRequest(t, srv, http.MethodGet, "/dispatches?since=yesterday", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestRestAdmin(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`", "retryConfig": {"minBackoff": "60s"}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	later := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	for _, task := range []string{
+		`{"name": "` + queueName + `/tasks/failing", "httpRequest": {"url": "` + target.URL + `"}}`,
+		`{"name": "` + queueName + `/tasks/later", "scheduleTime": "` + later.Format(time.RFC3339) + `", "httpRequest": {"url": "` + target.URL + `"}}`,
+	} {
+		resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{"task": `+task+`}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resp, body := restRequest(t, srv, http.MethodGet, "/admin/queues", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	queues := body["queues"].([]interface{})
+	require.Len(t, queues, 1)
+	queue := queues[0].(map[string]interface{})
+	assert.Equal(t, queueName, queue["name"])
+	assert.Equal(t, "RUNNING", queue["state"])
+	assert.Equal(t, 2.0, queue["pendingTasks"])
+	assert.Equal(t, 0.0, queue["completedTasks"])
+	assert.Contains(t, queue, "oldestScheduleTime")
+
+	resp, body = restRequest(t, srv, http.MethodGet, "/admin/"+queueName+"/tasks", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	ts := body["tasks"].([]interface{})
+	require.Len(t, ts, 2)
+
+	// Retried in a minute, so before the task scheduled in an hour
+	failing := ts[0].(map[string]interface{})
+	assert.Equal(t, queueName+"/tasks/failing", failing["name"])
+	assert.Equal(t, 1.0, failing["dispatchCount"])
+	assert.Equal(t, 1.0, failing["responseCount"])
+	assert.Equal(t, 500.0, failing["lastStatusCode"])
+	assert.Equal(t, false, failing["dispatching"])
+
+	pending := ts[1].(map[string]interface{})
+	assert.Equal(t, queueName+"/tasks/later", pending["name"])
+	assert.Equal(t, later.Format(time.RFC3339), pending["scheduleTime"])
+	assert.Equal(t, 0.0, pending["dispatchCount"])
+	assert.NotContains(t, pending, "lastStatusCode")
+
+	resp, _ = restRequest(t, srv, http.MethodGet, "/admin/"+formatQueueName(formattedParent, "missing")+"/tasks", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRestExportImport(t *testing.T) {
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`", "rateLimits": {"maxDispatchesPerSecond": 2}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+":pause", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{"task": {"name": "`+queueName+`/tasks/held", "httpRequest": {"url": "http://localhost:1/held", "body": "aGVsZA=="}}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, exported := restRequest(t, srv, http.MethodGet, "/admin/export", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, exported["queues"], 1)
+	require.Len(t, exported["tasks"], 1)
+	assert.Equal(t, "PAUSED", exported["queues"].([]interface{})[0].(map[string]interface{})["state"])
+	dump, err := json.Marshal(exported)
+	require.NoError(t, err)
+
+	// Loaded into another emulator, e.g. locally
+	replayed := NewServer()
+	defer replayed.Reset()
+	replaySrv := httptest.NewServer(NewRestHandler(replayed))
+	defer replaySrv.Close()
+	resp, _ = restRequest(t, replaySrv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+formatQueueName(formattedParent, "replaced")+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Replacing the state requires enabling resets
+	resp, _ = restRequest(t, replaySrv, http.MethodPost, "/admin/import", string(dump))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = restRequest(t, replaySrv, http.MethodGet, "/v2/"+formatQueueName(formattedParent, "replaced"), "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Only the imported queue is paused, the one the dump is checked with first
+	// posts no events
+	events := make(chan QueueEvent, 10)
+	eventsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event QueueEvent
+		json.NewDecoder(req.Body).Decode(&event)
+		events <- event
+	}))
+	defer eventsSrv.Close()
+	defer os.Unsetenv("QUEUE_EVENTS_URL_TEST")
+	os.Setenv("QUEUE_EVENTS_URL_TEST", eventsSrv.URL)
+
+	defer os.Unsetenv("ENABLE_RESET")
+	os.Setenv("ENABLE_RESET", "true")
+	resp, _ = restRequest(t, replaySrv, http.MethodPost, "/admin/import", string(dump))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	select {
+	case event := <-events:
+		assert.Equal(t, QueuePausedEvent, event.Event)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Queue event was not received")
+	}
+	select {
+	case event := <-events:
+		assert.Fail(t, "Unexpected queue event", event.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+	os.Unsetenv("QUEUE_EVENTS_URL_TEST")
+
+	resp, body := restRequest(t, replaySrv, http.MethodGet, "/v2/"+queueName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "PAUSED", body["state"])
+	assert.Equal(t, 2.0, body["rateLimits"].(map[string]interface{})["maxDispatchesPerSecond"])
+	resp, body = restRequest(t, replaySrv, http.MethodGet, "/v2/"+queueName+"/tasks/held?responseView=FULL", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "aGVsZA==", body["httpRequest"].(map[string]interface{})["body"])
+	resp, _ = restRequest(t, replaySrv, http.MethodGet, "/v2/"+formatQueueName(formattedParent, "replaced"), "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Rejected without touching the state
+	resp, _ = restRequest(t, replaySrv, http.MethodPost, "/admin/import", `{"tasks": [{"name": "`+formatQueueName(formattedParent, "missing")+`/tasks/orphan"}]}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = restRequest(t, replaySrv, http.MethodPost, "/admin/import", `{"queues": "nope"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = restRequest(t, replaySrv, http.MethodPost, "/admin/import", `{"queues": [{"name": "`+formatQueueName(formattedParent, "valid")+`"}, {"name": "invalid"}]}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = restRequest(t, replaySrv, http.MethodGet, "/v2/"+formatQueueName(formattedParent, "valid"), "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = restRequest(t, replaySrv, http.MethodGet, "/v2/"+queueName, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRestDashboard(t *testing.T) {
+	srv := httptest.NewServer(NewRestHandler(NewServer()))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/ui")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "/admin/queues")
+}
+
+func TestRestTaskEvents(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer target.Close()
+
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stream, err := srv.Client().Get(srv.URL + "/admin/events?queue=" + queueName)
+	require.NoError(t, err)
+	defer stream.Body.Close()
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{
+		"task": {"name": "`+queueName+`/tasks/streamed", "httpRequest": {"url": "`+target.URL+`"}}
+	}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lines := bufio.NewScanner(stream.Body)
+	var events []map[string]interface{}
+	for len(events) < 4 && lines.Scan() {
+		line := lines.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		events = append(events, event)
+	}
+	require.Len(t, events, 4)
+
+	for i, expected := range []struct {
+		eventType  string
+		attempt    interface{}
+		statusCode interface{}
+	}{
+		{"TASK_CREATED", nil, nil},
+		{"DISPATCH_STARTED", 1.0, nil},
+		{"ATTEMPT_FINISHED", 1.0, 200.0},
+		{"TASK_COMPLETED", 1.0, 200.0},
+	} {
+		assert.Equal(t, expected.eventType, events[i]["type"])
+		assert.Equal(t, queueName, events[i]["queueName"])
+		assert.Equal(t, queueName+"/tasks/streamed", events[i]["taskName"])
+		assert.Equal(t, expected.attempt, events[i]["attempt"])
+		assert.Equal(t, expected.statusCode, events[i]["statusCode"])
+	}
+}
+
+func TestRestFreezeAndFlush(t *testing.T) {
+	dispatched := make(chan bool, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dispatched <- true
+	}))
+	defer target.Close()
+
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	resp, _ := restRequest(t, srv, http.MethodPost, "/freeze", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	for i := 0; i < 2; i++ {
+		resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{"task": {"httpRequest": {"url": "`+target.URL+`"}}}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, dispatched, 0)
+
+	resp, body := restRequest(t, srv, http.MethodPost, "/flush?queue="+queueName, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"flushedTasks": 2.0}, body)
+	assert.Eventually(t, func() bool { return len(dispatched) == 2 }, time.Second, 10*time.Millisecond)
+
+	resp, _ = restRequest(t, srv, http.MethodPost, "/unfreeze", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRestMetrics(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+
+	server := NewServer()
+	defer server.Reset()
+	srv := httptest.NewServer(NewRestHandler(server))
+	defer srv.Close()
+
+	queueName := formatQueueName(formattedParent, "test")
+	resp, _ := restRequest(t, srv, http.MethodPost, "/v2/"+formattedParent+"/queues", `{"name": "`+queueName+`", "retryConfig": {"maxAttempts": 2, "minBackoff": "0.1s"}}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, path := range []string{"/succeed", "/fail"} {
+		resp, _ = restRequest(t, srv, http.MethodPost, "/v2/"+queueName+"/tasks", `{
+			"task": {"httpRequest": {"url": "`+target.URL+path+`"}}
+		}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	queueLabel := `{queue="` + queueName + `"}`
+	for _, sample := range []string{
+		"# TYPE cloud_tasks_emulator_tasks_created_total counter",
+		"cloud_tasks_emulator_tasks_created_total" + queueLabel + " 2",
+		"cloud_tasks_emulator_dispatches_total" + queueLabel + " 3",
+		"cloud_tasks_emulator_retries_total" + queueLabel + " 1",
+		"cloud_tasks_emulator_tasks_succeeded_total" + queueLabel + " 1",
+		`cloud_tasks_emulator_dispatch_failures_total{queue="` + queueName + `",status_code="503"} 2`,
+		"cloud_tasks_emulator_tasks_failed_total" + queueLabel + " 1",
+		"# TYPE cloud_tasks_emulator_dispatch_duration_seconds histogram",
+		`cloud_tasks_emulator_dispatch_duration_seconds_bucket{queue="` + queueName + `",le="+Inf"} 3`,
+		"cloud_tasks_emulator_dispatch_duration_seconds_count" + queueLabel + " 3",
+		"cloud_tasks_emulator_queue_depth" + queueLabel + " 0",
+	} {
+		assert.Contains(t, string(body), sample+"\n")
+	}
+}
+
+func TestRestHealthEndpoints(t *testing.T) {
+	srv := httptest.NewServer(NewRestHandler(NewServer()))
+	defer srv.Close()
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := srv.Client().Get(srv.URL + path)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "ok\n", string(body))
+	}
+}
+
+func restRequest(t *testing.T, srv *httptest.Server, method string, path string, body string) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var parsed map[string]interface{}
+	require.NoError(t, json.Unmarshal(respBody, &parsed), string(respBody))
+
+	return resp, parsed
+}
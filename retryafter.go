@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryAfter returns when the response asks for the task to be retried, from
+// its Retry-After header, either a number of seconds or an HTTP date. Like Cloud
+// Tasks, it is only honored on 429 Too Many Requests and 503 Service Unavailable,
+// zero otherwise or when the header is missing or invalid.
+func retryAfter(resp *http.Response, now time.Time) time.Time {
+	if !isOverloaded(resp.StatusCode) {
+		return time.Time{}
+	}
+
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return time.Time{}
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return time.Time{}
+		}
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		statusCode int
+		retryAfter string
+		expected   time.Time
+	}{
+		{http.StatusServiceUnavailable, "120", now.Add(2 * time.Minute)},
+		{http.StatusTooManyRequests, " 5 ", now.Add(5 * time.Second)},
+		{http.StatusTooManyRequests, "Wed, 01 Jan 2020 01:00:00 GMT", now.Add(time.Hour)},
+		{http.StatusServiceUnavailable, "", time.Time{}},
+		{http.StatusServiceUnavailable, "-5", time.Time{}},
+		{http.StatusServiceUnavailable, "soon", time.Time{}},
+		{http.StatusInternalServerError, "120", time.Time{}},
+		{http.StatusOK, "120", time.Time{}},
+	} {
+		resp := &http.Response{StatusCode: test.statusCode, Header: http.Header{}}
+		if test.retryAfter != "" {
+			resp.Header.Set("Retry-After", test.retryAfter)
+		}
+		assert.Equal(t, test.expected, retryAfter(resp, now), "%v %q", test.statusCode, test.retryAfter)
+	}
+}
+
+func TestRetryAfterDelaysNextAttempt(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "300")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	server := newServer(fake)
+	defer server.Reset()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+
+	taskName := queueName + "/tasks/retry-after"
+	dispatched := fake.Now()
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			Name: taskName,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Rather than after the minimum backoff of 0.1s
+	var scheduled time.Time
+	assert.Eventually(t, func() bool {
+		task, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: taskName})
+		if err != nil {
+			return false
+		}
+		scheduled, _ = ptypes.Timestamp(task.GetScheduleTime())
+		return scheduled.After(dispatched.Add(time.Minute))
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, dispatched.Add(300*time.Second).Unix(), scheduled.Unix())
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+// taskSchedule holds the tasks waiting for their schedule time, not safe for
+// concurrent use
+type taskSchedule interface {
+	push(entry *taskHeapEntry)
+
+	// remove tells whether the entry was still waiting
+	remove(entry *taskHeapEntry) bool
+
+	// next returns when the scheduler should next look for due tasks, false if
+	// there are no tasks
+	next() (time.Time, bool)
+
+	// popDue takes the tasks due by now
+	popDue(now time.Time) []*taskHeapEntry
+
+	Len() int
+}
+
+// taskSchedules create the task schedules by the name of their SCHEDULER
+var taskSchedules = map[string]func(now time.Time) taskSchedule{
+	"heap":  newHeapSchedule,
+	"wheel": newTimingWheel,
+}
+
+// newTaskSchedule creates the schedule by the name of the scheduler, a heap
+// unless known, which suits all but the largest numbers of tasks (see
+// timingwheel.go)
+func newTaskSchedule(scheduler string, now time.Time) taskSchedule {
+	newSchedule, ok := taskSchedules[scheduler]
+	if !ok {
+		return newHeapSchedule(now)
+	}
+
+	return newSchedule(now)
+}
+
+// heapSchedule keeps the tasks in schedule time order in a heap
+type heapSchedule struct {
+	taskHeap
+}
+
+// newHeapSchedule creates a heap schedule, which doesn't depend on the time it
+// starts at
+func newHeapSchedule(now time.Time) taskSchedule {
+	return &heapSchedule{}
+}
+
+func (s *heapSchedule) push(entry *taskHeapEntry) {
+	heap.Push(&s.taskHeap, entry)
+}
+
+func (s *heapSchedule) remove(entry *taskHeapEntry) bool {
+	if entry.index < 0 {
+		return false
+	}
+	heap.Remove(&s.taskHeap, entry.index)
+
+	return true
+}
+
+func (s *heapSchedule) next() (time.Time, bool) {
+	if s.taskHeap.Len() == 0 {
+		return time.Time{}, false
+	}
+
+	return s.taskHeap[0].eta, true
+}
+
+func (s *heapSchedule) popDue(now time.Time) []*taskHeapEntry {
+	var due []*taskHeapEntry
+	for s.taskHeap.Len() > 0 && !s.taskHeap[0].eta.After(now) {
+		due = append(due, heap.Pop(&s.taskHeap).(*taskHeapEntry))
+	}
+
+	return due
+}
+
+// schedule adds the task to the tasks waiting for their schedule time. A single
+// scheduler per queue moves them on to the due tasks, rather than a goroutine
+// and timer per task, which adds up for large backlogs of future tasks.
+func (queue *Queue) schedule(task *Task) {
+	task.stateMutex.Lock()
+	eta, _ := ptypes.Timestamp(task.state.GetScheduleTime())
+	created, _ := ptypes.Timestamp(task.state.GetCreateTime())
+	unscheduled := task.unscheduled
+	task.stateMutex.Unlock()
+
+	queue.scheduledMux.Lock()
+	queue.scheduledSeq++
+	entry := &taskHeapEntry{
+		task:        task,
+		eta:         eta,
+		created:     created,
+		seq:         queue.scheduledSeq,
+		unscheduled: unscheduled,
+	}
+	queue.scheduled.push(entry)
+	task.scheduledEntry = entry
+	queue.scheduledMux.Unlock()
+
+	queue.signalScheduler()
+}
+
+// unschedule removes the task from the tasks waiting for their schedule time,
+// telling whether it was waiting
+func (queue *Queue) unschedule(task *Task) bool {
+	queue.scheduledMux.Lock()
+	defer queue.scheduledMux.Unlock()
+
+	entry := task.scheduledEntry
+	task.scheduledEntry = nil
+	if entry == nil {
+		return false
+	}
+
+	return queue.scheduled.remove(entry)
+}
+
+// signalScheduler wakes up the scheduler if it's waiting
+func (queue *Queue) signalScheduler() {
+	select {
+	case queue.scheduleSignal <- true:
+	default:
+	}
+}
+
+// nextScheduled returns when the scheduler should next look for due tasks,
+// false if there are none
+func (queue *Queue) nextScheduled() (time.Time, bool) {
+	queue.scheduledMux.Lock()
+	defer queue.scheduledMux.Unlock()
+
+	return queue.scheduled.next()
+}
+
+// popScheduled takes the scheduled tasks that are due by now, leaving out those
+// run on request in the meantime
+func (queue *Queue) popScheduled(now time.Time) []*taskHeapEntry {
+	queue.scheduledMux.Lock()
+	defer queue.scheduledMux.Unlock()
+
+	var due []*taskHeapEntry
+	for _, entry := range queue.scheduled.popDue(now) {
+		if entry.task.scheduledEntry == entry {
+			entry.task.scheduledEntry = nil
+		}
+		if !isClosed(entry.unscheduled) {
+			due = append(due, entry)
+		}
+	}
+
+	return due
+}
+
+// runScheduler moves the scheduled tasks on to the due tasks at their schedule
+// time, with a single timer for the earliest one
+func (queue *Queue) runScheduler() {
+	for {
+		for _, entry := range queue.popScheduled(queue.clock.Now()) {
+			queue.pushDue(entry.task, entry.unscheduled)
+		}
+
+		var timer Timer
+		var timerC <-chan time.Time
+		if next, ok := queue.nextScheduled(); ok {
+			timer = queue.clock.NewTimer(next.Sub(queue.clock.Now()))
+			timerC = timer.C()
+		}
+
+		select {
+		case <-timerC:
+		case <-queue.scheduleSignal:
+			// An earlier task may have been scheduled
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-queue.cancelScheduler:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+	}
+}
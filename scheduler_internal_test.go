@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestSchedulerHoldsFutureTasksWithoutGoroutines(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{Name: queueName}, realClock{}, func(task *Task) {})
+	queue.Run()
+	defer func() {
+		queue.Delete()
+		queue.Wait()
+	}()
+
+	scheduledCount := func() int {
+		queue.scheduledMux.Lock()
+		defer queue.scheduledMux.Unlock()
+		return queue.scheduled.Len()
+	}
+	before := runtime.NumGoroutine()
+
+	scheduleTime, _ := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	var created []*Task
+	for i := 0; i < 1000; i++ {
+		task, _, err := queue.NewTask(&taskspb.Task{
+			ScheduleTime: scheduleTime,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com"},
+			},
+		})
+		require.NoError(t, err)
+		created = append(created, task)
+	}
+
+	assert.InDelta(t, before, runtime.NumGoroutine(), 10)
+	assert.Equal(t, 1000, scheduledCount())
+
+	// Deleted right away, rather than once due
+	created[500].Delete()
+	assert.Equal(t, 999, scheduledCount())
+	queue.tsMux.Lock()
+	assert.NotContains(t, queue.ts, created[500].state.GetName())
+	queue.tsMux.Unlock()
+}
+
+func TestSchedulerMovesDueTasksInScheduleOrder(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	var mux sync.Mutex
+	var dispatched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		dispatched = append(dispatched, req.Header.Get("X-CloudTasks-TaskName"))
+	}))
+	defer srv.Close()
+	dispatchedTasks := func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]string(nil), dispatched...)
+	}
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{
+		Name:       queueName,
+		RateLimits: &taskspb.RateLimits{MaxConcurrentDispatches: 1},
+	}, fake, func(task *Task) {})
+	queue.Run()
+	defer func() {
+		queue.Delete()
+		queue.Wait()
+	}()
+
+	for _, delay := range []time.Duration{30 * time.Second, 10 * time.Second, 20 * time.Second} {
+		scheduleTime, _ := ptypes.TimestampProto(fake.Now().Add(delay))
+		_, _, err := queue.NewTask(&taskspb.Task{
+			Name:         queueName + "/tasks/after-" + delay.String(),
+			ScheduleTime: scheduleTime,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	fake.Advance(15 * time.Second)
+	assert.Eventually(t, func() bool { return len(dispatchedTasks()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"after-10s"}, dispatchedTasks())
+
+	fake.Advance(20 * time.Second)
+	assert.Eventually(t, func() bool { return len(dispatchedTasks()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"after-10s", "after-20s", "after-30s"}, dispatchedTasks())
+}
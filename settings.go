@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// settings holds the settings of the server and its queues given with the
+// command line flags, see main. A server created without them, e.g. in the
+// tests, reads them from the env variables of the same names as it creates its
+// queues.
+type settings struct {
+	// How the tasks wait for their schedule time, see newTaskSchedule
+	scheduler string
+
+	// The maximum number of tasks of a queue, 0 for unlimited
+	maxTasksPerQueue int
+
+	systemThrottling bool
+
+	// Overridden per queue with SERIAL_DISPATCH_<QUEUE_ID>, see serialDispatch
+	serialDispatch bool
+
+	// Create the missing queues of the tasks rather than failing with NOT_FOUND
+	autoCreateQueues bool
+
+	// The fraction the retry backoffs are spread by, see applyJitter
+	retryJitter float64
+
+	// The file the gRPC calls are recorded to, if any, see audit.go
+	auditLogFile string
+}
+
+// settingsFromEnv reads the settings from SCHEDULER, MAX_TASKS_PER_QUEUE,
+// SYSTEM_THROTTLING, SERIAL_DISPATCH, AUTO_CREATE_QUEUES, RETRY_JITTER and
+// AUDIT_LOG_FILE
+func settingsFromEnv() *settings {
+	systemThrottling, _ := strconv.ParseBool(os.Getenv("SYSTEM_THROTTLING"))
+	serial, _ := strconv.ParseBool(os.Getenv("SERIAL_DISPATCH"))
+	autoCreateQueues, _ := strconv.ParseBool(os.Getenv("AUTO_CREATE_QUEUES"))
+
+	return &settings{
+		scheduler:        envOrDefault("SCHEDULER", "heap"),
+		maxTasksPerQueue: maxTasksFromEnv(),
+		systemThrottling: systemThrottling,
+		serialDispatch:   serial,
+		autoCreateQueues: autoCreateQueues,
+		retryJitter:      retryJitter(),
+		auditLogFile:     os.Getenv("AUDIT_LOG_FILE"),
+	}
+}
+
+// currentSettings returns the settings given to the server, or else those of
+// the env
+func (s *Server) currentSettings() *settings {
+	if s.settings != nil {
+		return s.settings
+	}
+
+	return settingsFromEnv()
+}
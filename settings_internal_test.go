@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestServerSettings(t *testing.T) {
+	defer os.Unsetenv("MAX_TASKS_PER_QUEUE")
+	os.Setenv("MAX_TASKS_PER_QUEUE", "5")
+
+	server := NewServer()
+	defer server.Reset()
+	server.settings = &settings{
+		scheduler:        "wheel",
+		maxTasksPerQueue: 1,
+		serialDispatch:   true,
+		autoCreateQueues: true,
+		retryJitter:      0.5,
+	}
+
+	// Created on the fly, with the settings given rather than those of the env
+	queueName := "projects/bluebook/locations/us-east1/queues/configured"
+	_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/configured"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	queue, err := server.lookupQueue(queueName)
+	require.NoError(t, err)
+	assert.Equal(t, 1, queue.maxTasks)
+	assert.IsType(t, &timingWheel{}, queue.scheduled)
+	assert.True(t, queue.serial)
+	assert.Equal(t, 0.5, queue.retryJitter)
+	assert.Nil(t, queue.throttle)
+}
@@ -0,0 +1,246 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	_ "github.com/mattn/go-sqlite3"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+const sqliteFileName = "emulator.db"
+
+// The state columns are there to query the database outside the emulator, the
+// snapshot is restored from the serialized queues and tasks
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS queues (
+	name TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	queue BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tasks (
+	name TEXT PRIMARY KEY,
+	queue_name TEXT NOT NULL,
+	schedule_time TEXT NOT NULL,
+	dispatch_count INTEGER NOT NULL,
+	task BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS pull_queues (
+	name TEXT PRIMARY KEY
+);
+`
+
+func init() {
+	snapshotStores["sqlite"] = newSqliteSnapshotStore
+}
+
+// sqliteSnapshotStore keeps the snapshot in a SQLite database in the data dir
+type sqliteSnapshotStore struct {
+	db *sql.DB
+}
+
+func newSqliteSnapshotStore(dataDir string) (snapshotStore, error) {
+	db, err := sql.Open("sqlite3", filepath.Join(dataDir, sqliteFileName))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteSnapshotStore{db: db}, nil
+}
+
+// Save replaces the previous snapshot in a single transaction
+func (store *sqliteSnapshotStore) Save(snapshot *Snapshot) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM tasks"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM queues"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM pull_queues"); err != nil {
+		return err
+	}
+
+	for _, queueState := range snapshot.Queues {
+		data, err := proto.Marshal(queueState)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO queues (name, state, queue) VALUES (?, ?, ?)",
+			queueState.GetName(), queueState.GetState().String(), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range snapshot.PullQueues {
+		if _, err := tx.Exec("INSERT INTO pull_queues (name) VALUES (?)", name); err != nil {
+			return err
+		}
+	}
+
+	for _, taskState := range snapshot.Tasks {
+		if err := saveSqliteTask(tx, taskState); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// sqliteExecer is a database or a transaction
+type sqliteExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// saveSqliteTask inserts the task, or replaces it
+func saveSqliteTask(db sqliteExecer, taskState *tasks.Task) error {
+	data, err := proto.Marshal(taskState)
+	if err != nil {
+		return err
+	}
+	scheduleTime, _ := ptypes.Timestamp(taskState.GetScheduleTime())
+	_, err = db.Exec("INSERT OR REPLACE INTO tasks (name, queue_name, schedule_time, dispatch_count, task) VALUES (?, ?, ?, ?, ?)",
+		taskState.GetName(), taskQueueName(taskState.GetName()), scheduleTime.UTC().Format(time.RFC3339Nano), taskState.GetDispatchCount(), data)
+
+	return err
+}
+
+// newTaskStore creates the store of the tasks of a queue, writing them through
+// to the database as they are added and removed
+func (store *sqliteSnapshotStore) newTaskStore(queueName string) taskStore {
+	return &sqliteTaskStore{taskStore: newMemoryTaskStore(), db: store.db}
+}
+
+// sqliteTaskStore keeps the tasks in memory, as they are running, and in the
+// database, so that they can be queried outside the emulator between snapshots,
+// along with their queues, see saveQueue.
+// The attempts of the tasks are only saved with the snapshots.
+type sqliteTaskStore struct {
+	taskStore
+
+	db *sql.DB
+}
+
+func (store *sqliteTaskStore) put(taskName string, task *Task) {
+	store.taskStore.put(taskName, task)
+
+	if err := saveSqliteTask(store.db, task.frozenState()); err != nil {
+		logError("Failed to save task", field("task", taskName), field("error", err))
+	}
+}
+
+func (store *sqliteTaskStore) remove(taskName string) {
+	store.taskStore.remove(taskName)
+
+	if _, err := store.db.Exec("DELETE FROM tasks WHERE name = ?", taskName); err != nil {
+		logError("Failed to delete task", field("task", taskName), field("error", err))
+	}
+}
+
+// saveQueue inserts the queue, or replaces it, so that the tasks written
+// through are restored with their queue should the emulator stop before the
+// next snapshot
+func (store *sqliteSnapshotStore) saveQueue(queueState *tasks.Queue, pull bool) {
+	data, err := proto.Marshal(queueState)
+	if err == nil {
+		_, err = store.db.Exec("INSERT OR REPLACE INTO queues (name, state, queue) VALUES (?, ?, ?)",
+			queueState.GetName(), queueState.GetState().String(), data)
+	}
+	if err == nil && pull {
+		_, err = store.db.Exec("INSERT OR IGNORE INTO pull_queues (name) VALUES (?)", queueState.GetName())
+	}
+	if err != nil {
+		logError("Failed to save queue", field("queue", queueState.GetName()), field("error", err))
+	}
+}
+
+func (store *sqliteSnapshotStore) removeQueue(queueName string) {
+	for _, query := range []string{
+		"DELETE FROM tasks WHERE queue_name = ?",
+		"DELETE FROM pull_queues WHERE name = ?",
+		"DELETE FROM queues WHERE name = ?",
+	} {
+		if _, err := store.db.Exec(query, queueName); err != nil {
+			logError("Failed to delete queue", field("queue", queueName), field("error", err))
+			return
+		}
+	}
+}
+
+func (store *sqliteSnapshotStore) Load() (*Snapshot, error) {
+	snapshot := &Snapshot{}
+
+	queueRows, err := store.db.Query("SELECT queue FROM queues")
+	if err != nil {
+		return nil, err
+	}
+	defer queueRows.Close()
+	for queueRows.Next() {
+		var data []byte
+		if err := queueRows.Scan(&data); err != nil {
+			return nil, err
+		}
+		queueState := &tasks.Queue{}
+		if err := proto.Unmarshal(data, queueState); err != nil {
+			return nil, err
+		}
+		snapshot.Queues = append(snapshot.Queues, queueState)
+	}
+	if err := queueRows.Err(); err != nil {
+		return nil, err
+	}
+
+	taskRows, err := store.db.Query("SELECT task FROM tasks")
+	if err != nil {
+		return nil, err
+	}
+	defer taskRows.Close()
+	for taskRows.Next() {
+		var data []byte
+		if err := taskRows.Scan(&data); err != nil {
+			return nil, err
+		}
+		taskState := &tasks.Task{}
+		if err := proto.Unmarshal(data, taskState); err != nil {
+			return nil, err
+		}
+		snapshot.Tasks = append(snapshot.Tasks, taskState)
+	}
+	if err := taskRows.Err(); err != nil {
+		return nil, err
+	}
+
+	pullQueueRows, err := store.db.Query("SELECT name FROM pull_queues")
+	if err != nil {
+		return nil, err
+	}
+	defer pullQueueRows.Close()
+	for pullQueueRows.Next() {
+		var name string
+		if err := pullQueueRows.Scan(&name); err != nil {
+			return nil, err
+		}
+		snapshot.PullQueues = append(snapshot.PullQueues, name)
+	}
+	if err := pullQueueRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
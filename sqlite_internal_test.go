@@ -0,0 +1,125 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestSqliteSnapshotStore(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	defer os.Unsetenv("STORAGE")
+	os.Setenv("STORAGE", "sqlite")
+
+	store, err := newSnapshotStore(dataDir)
+	require.NoError(t, err)
+
+	testSnapshotStore(t, store)
+}
+
+func TestSqliteTaskStore(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	store, err := newSqliteSnapshotStore(dataDir)
+	require.NoError(t, err)
+
+	server := NewServer()
+	defer server.Reset()
+	server.newTaskStore = store.(taskStoreFactory).newTaskStore
+	server.queueStore = store.(queueStore)
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	_, err = server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+	server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queueName})
+
+	taskName := queueName + "/tasks/stored"
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			Name: taskName,
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/stored"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Stored as created, before any snapshot
+	db := store.(*sqliteSnapshotStore).db
+	var storedState string
+	require.NoError(t, db.QueryRow("SELECT state FROM queues WHERE name = ?", queueName).Scan(&storedState))
+	assert.Equal(t, "PAUSED", storedState)
+	var storedQueue string
+	require.NoError(t, db.QueryRow("SELECT queue_name FROM tasks WHERE name = ?", taskName).Scan(&storedQueue))
+	assert.Equal(t, queueName, storedQueue)
+
+	_, err = server.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: taskName})
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM tasks").Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestSqliteQueueStore(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	store, err := newSqliteSnapshotStore(dataDir)
+	require.NoError(t, err)
+
+	server := NewServer()
+	defer server.Reset()
+	server.newTaskStore = store.(taskStoreFactory).newTaskStore
+	server.queueStore = store.(queueStore)
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	_, err = server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+	server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queueName})
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/stored"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Restored with its queue though no snapshot was saved
+	restored := NewServer()
+	defer restored.Reset()
+	require.NoError(t, restoreSnapshot(restored, store))
+	queue, err := restored.lookupQueue(queueName)
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, queue.frozenState().GetState())
+	assert.Len(t, restored.snapshot().Tasks, 1)
+
+	_, err = server.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	snapshot, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, snapshot.Queues)
+	assert.Empty(t, snapshot.Tasks)
+}
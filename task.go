@@ -2,14 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,14 +21,36 @@ import (
 	pduration "github.com/golang/protobuf/ptypes/duration"
 	ptimestamp "github.com/golang/protobuf/ptypes/timestamp"
 	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
 	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 )
 
+// Size limits as per https://cloud.google.com/tasks/docs/quotas
+const (
+	defaultMaxTaskBodySize = 100 * 1024
+	defaultMaxTaskSize     = 1024 * 1024
+)
+
+// Tasks can't be scheduled further ahead than this
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+// The range of dispatch deadlines of HTTP tasks, App Engine tasks can take up
+// to a day as per https://cloud.google.com/tasks/docs/reference/rpc/google.cloud.tasks.v2#task
+const (
+	minDispatchDeadline          = 15 * time.Second
+	maxDispatchDeadline          = 30 * time.Minute
+	maxAppEngineDispatchDeadline = 24 * time.Hour
+)
+
+// errDispatchDeadlineExceeded is returned by dispatch when the handler didn't
+// respond within the dispatch deadline of the task
+var errDispatchDeadlineExceeded = errors.New("dispatch deadline exceeded")
+
 var r *regexp.Regexp
 
 func init() {
 	// Format requirements as per https://cloud.google.com/tasks/docs/reference/rest/v2/projects.locations.queues.tasks#Task.FIELDS.name
-	r = regexp.MustCompile("projects/([a-zA-Z0-9:.-]+)/locations/([a-zA-Z0-9-]+)/queues/([a-zA-Z0-9-]+)/tasks/([a-zA-Z0-9_-]+)")
+	r = regexp.MustCompile("^projects/([a-zA-Z0-9:.-]+)/locations/([a-zA-Z0-9-]+)/queues/([a-zA-Z0-9-]+)/tasks/([a-zA-Z0-9_-]{1,500})$")
 }
 
 func parseTaskName(task *tasks.Task) TaskNameParts {
@@ -42,6 +67,36 @@ func isValidTaskName(name string) bool {
 	return r.MatchString(name)
 }
 
+func getBody(taskState *tasks.Task) []byte {
+	if httpRequest := taskState.GetHttpRequest(); httpRequest != nil {
+		return httpRequest.GetBody()
+	}
+
+	return taskState.GetAppEngineHttpRequest().GetBody()
+}
+
+// maxTaskBodySize returns the maximum size of the request body, which can be
+// overridden with the MAX_TASK_BODY_SIZE env variable
+func maxTaskBodySize() int {
+	maxSize, err := strconv.ParseInt(os.Getenv("MAX_TASK_BODY_SIZE"), 10, 32)
+	if err == nil && maxSize != 0 {
+		return int(maxSize)
+	}
+
+	return defaultMaxTaskBodySize
+}
+
+// maxTaskSize returns the maximum size of the serialized task, which can be
+// overridden with the MAX_TASK_SIZE env variable
+func maxTaskSize() int {
+	maxSize, err := strconv.ParseInt(os.Getenv("MAX_TASK_SIZE"), 10, 32)
+	if err == nil && maxSize != 0 {
+		return int(maxSize)
+	}
+
+	return defaultMaxTaskSize
+}
+
 type TaskNameParts struct {
 	project  string
 	location string
@@ -62,34 +117,66 @@ type Task struct {
 	stateMutex sync.Mutex
 
 	cancelOnce sync.Once
+
+	// Set by Delete, guarded by stateMutex
+	deleted bool
+
+	// Aborts the attempt in flight, guarded by stateMutex
+	cancelAttempt context.CancelFunc
+
+	// Closed when the task is run on request, which drops the schedule that was
+	// pending, then replaced for the next schedule. Guarded by stateMutex.
+	unscheduled chan bool
+
+	// The entry of the task in the scheduled heap of the queue, while waiting
+	// for its schedule time. Guarded by the scheduledMux of the queue.
+	scheduledEntry *taskHeapEntry
+
+	// When the task was created, unlike the create time in the state not
+	// truncated to seconds, to tell whether it predates a purge
+	created time.Time
+
+	// The counts behind the dispatch and response counts of the state and the
+	// retry and execution count headers. Guarded by stateMutex.
+	attempts attemptHistory
+
+	// The trace the dispatches belong to, that of the RPC that created the task
+	// if traced, see tracing.go
+	trace spanContext
 }
 
 // NewTask creates a new task for the specified queue
 func NewTask(queue *Queue, taskState *tasks.Task, onDone func(task *Task)) *Task {
-	setInitialTaskState(taskState, queue.name)
+	created := queue.clock.Now()
+	setInitialTaskState(taskState, queue.name, queue.clock)
 
 	task := &Task{
-		queue:  queue,
-		state:  taskState,
-		onDone: onDone,
-		cancel: make(chan bool, 1), // Buffered in case cancel comes when task is not scheduled
+		queue:       queue,
+		state:       taskState,
+		onDone:      onDone,
+		cancel:      make(chan bool, 1), // Buffered in case cancel comes when task is not scheduled
+		created:     created,
+		unscheduled: make(chan bool),
+		attempts:    newAttemptHistory(taskState.GetDispatchCount(), taskState.GetResponseCount()),
 	}
 
 	return task
 }
 
-func setInitialTaskState(taskState *tasks.Task, queueName string) {
+func setInitialTaskState(taskState *tasks.Task, queueName string, clock Clock) {
 	if taskState.GetName() == "" {
-		taskID := strconv.FormatUint(uint64(rand.Uint64()), 10)
-		taskState.Name = queueName + "/tasks/" + taskID
+		taskState.Name = queueName + "/tasks/" + newTaskID()
 	}
 
-	taskState.CreateTime = ptypes.TimestampNow()
-	// For some reason the cloud does not set nanos
-	taskState.CreateTime.Nanos = 0
+	// Only set already for a task restored from a snapshot
+	if taskState.GetCreateTime() == nil {
+		taskState.CreateTime = timestampNow(clock)
+		// For some reason the cloud does not set nanos
+		taskState.CreateTime.Nanos = 0
+	}
 
 	if taskState.GetScheduleTime() == nil {
-		taskState.ScheduleTime = ptypes.TimestampNow()
+		taskState.ScheduleTime = timestampNow(clock)
 	}
 	if taskState.GetDispatchDeadline() == nil {
 		taskState.DispatchDeadline = &pduration.Duration{Seconds: 600}
@@ -134,53 +221,87 @@ func setInitialTaskState(taskState *tasks.Task, queueName string) {
 		}
 
 		if appEngineHTTPRequest.GetAppEngineRouting().Host == "" {
-			var host, domainSeparator string
+			appEngineHTTPRequest.GetAppEngineRouting().Host = appEngineRoutingHost(parseTaskName(taskState).project, appEngineHTTPRequest.GetAppEngineRouting())
+		}
 
-			emulatorHost := os.Getenv("APP_ENGINE_EMULATOR_HOST")
+		if appEngineHTTPRequest.GetRelativeUri() == "" {
+			appEngineHTTPRequest.RelativeUri = "/"
+		}
+	}
+}
 
-			if emulatorHost == "" {
-				// TODO: the new route format for appengine is <PROJECT_ID>.<REGION_ID>.r.appspot.com
-				// TODO: support custom domains
-				// https://cloud.google.com/appengine/docs/standard/python/how-requests-are-routed
-				host = "https://" + parseTaskName(taskState).project + ".appspot.com"
-				domainSeparator = "-dot-"
-			} else {
-				host = emulatorHost
-				domainSeparator = "."
-			}
+// frozenState returns a copy of the task state that is safe to pass on
+func (task *Task) frozenState() *tasks.Task {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
 
-			hostURL, err := url.Parse(host)
+	return proto.Clone(task.state).(*tasks.Task)
+}
 
-			if err != nil {
-				panic(err)
-			}
+// basicState returns the BASIC view of the task, copying the target without
+// its potentially large body and headers.
+func (task *Task) basicState() *tasks.Task {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
 
-			if appEngineHTTPRequest.GetAppEngineRouting().GetService() != "" {
-				hostURL.Host = appEngineHTTPRequest.GetAppEngineRouting().GetService() + domainSeparator + hostURL.Host
-			}
-			if appEngineHTTPRequest.GetAppEngineRouting().GetVersion() != "" {
-				hostURL.Host = appEngineHTTPRequest.GetAppEngineRouting().GetVersion() + domainSeparator + hostURL.Host
-			}
-			if appEngineHTTPRequest.GetAppEngineRouting().GetInstance() != "" {
-				hostURL.Host = appEngineHTTPRequest.GetAppEngineRouting().GetInstance() + domainSeparator + hostURL.Host
-			}
+	basic := *task.state
+	stripTaskPayload(&basic)
 
-			appEngineHTTPRequest.GetAppEngineRouting().Host = hostURL.String()
-		}
+	return proto.Clone(&basic).(*tasks.Task)
+}
 
-		if appEngineHTTPRequest.GetRelativeUri() == "" {
-			appEngineHTTPRequest.RelativeUri = "/"
-		}
+// taskView returns the task state in the requested view. BASIC, the default,
+// leaves out the body and headers of the target, as does Cloud Tasks. The
+// state must be a copy, it is changed in place.
+func taskView(taskState *tasks.Task, view tasks.Task_View) *tasks.Task {
+	if view == tasks.Task_FULL {
+		taskState.View = tasks.Task_FULL
+	} else {
+		stripTaskPayload(taskState)
+	}
+
+	return taskState
+}
+
+// stripTaskPayload replaces the target by a shallow copy without the body and
+// headers, so the original target is left alone
+func stripTaskPayload(taskState *tasks.Task) {
+	switch target := taskState.GetMessageType().(type) {
+	case *tasks.Task_HttpRequest:
+		httpRequest := *target.HttpRequest
+		httpRequest.Body = nil
+		httpRequest.Headers = nil
+		taskState.MessageType = &tasks.Task_HttpRequest{HttpRequest: &httpRequest}
+	case *tasks.Task_AppEngineHttpRequest:
+		appEngineHTTPRequest := *target.AppEngineHttpRequest
+		appEngineHTTPRequest.Body = nil
+		appEngineHTTPRequest.Headers = nil
+		taskState.MessageType = &tasks.Task_AppEngineHttpRequest{AppEngineHttpRequest: &appEngineHTTPRequest}
+	}
+
+	if pullMessage := getPullMessage(taskState); pullMessage != nil {
+		setPullMessage(taskState, &PullMessage{Tag: pullMessage.Tag})
 	}
+
+	taskState.View = tasks.Task_BASIC
 }
 
-func updateStateForReschedule(task *Task) *tasks.Task {
+func copyTimestamp(ts *ptimestamp.Timestamp) *ptimestamp.Timestamp {
+	if ts == nil {
+		return nil
+	}
+
+	return &ptimestamp.Timestamp{Seconds: ts.GetSeconds(), Nanos: ts.GetNanos()}
+}
+
+// updateStateForReschedule sets the schedule time of the next attempt, backing
+// off exponentially unless the target asked to retry later than that
+func updateStateForReschedule(task *Task, retryAfter time.Time) *tasks.Task {
+	retryConfig := task.queue.retryConfig()
+
 	// The lock is to ensure a consistent state when updating
 	task.stateMutex.Lock()
 	taskState := task.state
-	queueState := task.queue.state
-
-	retryConfig := queueState.GetRetryConfig()
 
 	minBackoff, _ := ptypes.Duration(retryConfig.GetMinBackoff())
 	maxBackoff, _ := ptypes.Duration(retryConfig.GetMaxBackoff())
@@ -193,6 +314,9 @@ func updateStateForReschedule(task *Task) *tasks.Task {
 	if backoff > maxBackoff {
 		backoff = maxBackoff
 	}
+	if !task.queue.serial {
+		backoff = applyJitter(backoff, task.queue.retryJitter)
+	}
 	protoBackoff := ptypes.DurationProto(backoff)
 	prevScheduleTime := taskState.GetScheduleTime()
 
@@ -208,6 +332,9 @@ func updateStateForReschedule(task *Task) *tasks.Task {
 		Nanos:   int32(scheduleNanos),
 		Seconds: scheduleSeconds,
 	}
+	if scheduled, _ := ptypes.Timestamp(taskState.ScheduleTime); retryAfter.After(scheduled) {
+		taskState.ScheduleTime, _ = ptypes.TimestampProto(retryAfter)
+	}
 
 	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
 	task.stateMutex.Unlock()
@@ -215,11 +342,36 @@ func updateStateForReschedule(task *Task) *tasks.Task {
 	return frozenTaskState
 }
 
+// retryJitter returns the jitter factor applied to retry backoffs, set with
+// the RETRY_JITTER env variable (e.g. 0.2 for +/-20%). Defaults to no jitter,
+// and is capped at 1 so a backoff never turns negative.
+func retryJitter() float64 {
+	jitter, err := strconv.ParseFloat(os.Getenv("RETRY_JITTER"), 64)
+	if err != nil || jitter < 0 {
+		return 0
+	}
+	if jitter > 1 {
+		return 1
+	}
+
+	return jitter
+}
+
+// applyJitter randomly spreads the backoff within +/- factor of its value
+func applyJitter(backoff time.Duration, factor float64) time.Duration {
+	if factor == 0 {
+		return backoff
+	}
+
+	spread := (rand.Float64()*2 - 1) * factor
+	return backoff + time.Duration(float64(backoff)*spread)
+}
+
 func updateStateForDispatch(task *Task) *tasks.Task {
 	task.stateMutex.Lock()
 	taskState := task.state
 
-	dispatchTime := ptypes.TimestampNow()
+	dispatchTime := timestampNow(task.queue.clock)
 
 	taskState.LastAttempt = &tasks.Attempt{
 		ScheduleTime: &ptimestamp.Timestamp{
@@ -229,7 +381,8 @@ func updateStateForDispatch(task *Task) *tasks.Task {
 		DispatchTime: dispatchTime,
 	}
 
-	taskState.DispatchCount++
+	task.attempts.dispatched()
+	taskState.DispatchCount = task.attempts.dispatches
 
 	if taskState.GetFirstAttempt() == nil {
 		taskState.FirstAttempt = &tasks.Attempt{
@@ -243,23 +396,29 @@ func updateStateForDispatch(task *Task) *tasks.Task {
 	return frozenTaskState
 }
 
-func updateStateAfterDispatch(task *Task, statusCode int) *tasks.Task {
+func updateStateAfterDispatch(task *Task, statusCode int, dispatchErr error) *tasks.Task {
 	task.stateMutex.Lock()
 
 	taskState := task.state
 
 	rpcCode := toRPCStatusCode(statusCode)
-	rpcCodeName := toCodeName(rpcCode)
+	message := fmt.Sprintf("%s(%d): HTTP status code %d", toCodeName(rpcCode), rpcCode, statusCode)
+	if dispatchErr == errDispatchDeadlineExceeded {
+		rpcCode = int32(rpccode.Code_DEADLINE_EXCEEDED)
+		deadline, _ := ptypes.Duration(taskState.GetDispatchDeadline())
+		message = fmt.Sprintf("%s(%d): The dispatch deadline of %v was exceeded", toCodeName(rpcCode), rpcCode, deadline)
+	}
 
 	lastAttempt := taskState.GetLastAttempt()
 
-	lastAttempt.ResponseTime = ptypes.TimestampNow()
+	lastAttempt.ResponseTime = timestampNow(task.queue.clock)
 	lastAttempt.ResponseStatus = &rpcstatus.Status{
 		Code:    rpcCode,
-		Message: fmt.Sprintf("%s(%d): HTTP status code %d", rpcCodeName, rpcCode, statusCode),
+		Message: message,
 	}
 
-	taskState.ResponseCount++
+	task.attempts.responded(statusCode, dispatchErr)
+	taskState.ResponseCount = task.attempts.responses
 
 	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
 	task.stateMutex.Unlock()
@@ -267,29 +426,76 @@ func updateStateAfterDispatch(task *Task, statusCode int) *tasks.Task {
 	return frozenTaskState
 }
 
-func (task *Task) reschedule(retry bool, statusCode int) {
+// reschedule completes the task or schedules its next attempt, no earlier than
+// the Retry-After of the response if set
+func (task *Task) reschedule(retry bool, statusCode int, retryAfter time.Time) {
 	if statusCode >= 200 && statusCode <= 299 {
-		log.Println("Task done")
+		logInfo("Task done", task.logFields(field("statusCode", statusCode))...)
+		task.queue.completeTask()
+		task.publishEvent(TaskCompletedEvent, task.dispatchCount(), statusCode, 0)
 		task.onDone(task)
 	} else {
-		log.Println("Task exec error with status " + strconv.Itoa(statusCode))
+		logWarn("Task exec error", task.logFields(field("statusCode", statusCode))...)
 		if retry {
-			retryConfig := task.queue.state.GetRetryConfig()
-
-			if task.state.DispatchCount >= retryConfig.GetMaxAttempts() {
-				log.Println("Ran out of attempts")
-			} else {
-				updateStateForReschedule(task)
+			if task.hasAttemptsLeft() {
+				updateStateForReschedule(task, retryAfter)
 				task.Schedule()
+			} else {
+				logError("Ran out of attempts", task.logFields(field("statusCode", statusCode))...)
+				task.queue.metrics.taskFailed(task.queue.name)
+				task.queue.onTaskFailed(task, statusCode)
+				task.queue.completeTask()
+				task.publishEvent(TaskFailedEvent, task.dispatchCount(), statusCode, 0)
+				task.onDone(task)
 			}
 		}
 	}
 }
 
-func dispatch(retry bool, taskState *tasks.Task) int {
-	client := &http.Client{}
-	client.Timeout, _ = ptypes.Duration(taskState.GetDispatchDeadline())
+// hasAttemptsLeft checks the dispatches so far against the queue retry config.
+// As in Cloud Tasks the first dispatch is attempt 1, and -1 means unlimited. With
+// a max retry duration too, the task is only given up once both the attempts and
+// the time since the first attempt are used up.
+func (task *Task) hasAttemptsLeft() bool {
+	retryConfig := task.queue.retryConfig()
+	maxAttempts := retryConfig.GetMaxAttempts()
+	maxRetryDuration, _ := ptypes.Duration(retryConfig.GetMaxRetryDuration())
+
+	task.stateMutex.Lock()
+	attemptsLeft := maxAttempts <= 0 || task.state.GetDispatchCount() < maxAttempts
+	firstAttempt, _ := ptypes.Timestamp(task.state.GetFirstAttempt().GetDispatchTime())
+	task.stateMutex.Unlock()
+
+	if maxRetryDuration <= 0 {
+		return attemptsLeft
+	}
+	durationLeft := task.queue.clock.Now().Sub(firstAttempt) < maxRetryDuration
+	if maxAttempts <= 0 {
+		return durationLeft
+	}
 
+	return attemptsLeft || durationLeft
+}
+
+// targetURL returns the URL the task is dispatched to
+func targetURL(taskState *tasks.Task, routingOverride *tasks.AppEngineRouting) string {
+	if httpRequest := taskState.GetHttpRequest(); httpRequest != nil {
+		return httpRequest.GetUrl()
+	}
+
+	appEngineHTTPRequest := taskState.GetAppEngineHttpRequest()
+	host := appEngineHTTPRequest.GetAppEngineRouting().GetHost()
+	// The queue override takes precedence over the task routing
+	if routingOverride != nil {
+		host = routingOverride.GetHost()
+	}
+
+	return host + appEngineHTTPRequest.GetRelativeUri()
+}
+
+// dispatch sends the task request, returning the response status code and when
+// it asks for a retry, if it does, or -1 with the error if no response was received
+func dispatch(ctx context.Context, clock Clock, retry bool, taskState *tasks.Task, attempts attemptHistory, defaultHeaders map[string]string, routingOverride *tasks.AppEngineRouting) (int, time.Time, error) {
 	var req *http.Request
 	var headers map[string]string
 
@@ -301,24 +507,32 @@ func dispatch(retry bool, taskState *tasks.Task) int {
 
 	headerQueueName := nameParts.queueId
 	headerTaskName := nameParts.taskId
-	headerTaskRetryCount := fmt.Sprintf("%v", taskState.GetDispatchCount()-1)
-	headerTaskExecutionCount := fmt.Sprintf("%v", taskState.GetResponseCount())
+	headerTaskRetryCount := fmt.Sprintf("%v", attempts.retryCount())
+	headerTaskExecutionCount := fmt.Sprintf("%v", attempts.executions)
 	headerTaskETA := fmt.Sprintf("%f", float64(scheduled.UnixNano())/1e9)
 
 	if httpRequest != nil {
 		method := toHTTPMethod(httpRequest.GetHttpMethod())
 
-		req, _ = http.NewRequest(method, httpRequest.GetUrl(), bytes.NewBuffer(httpRequest.GetBody()))
+		headers = dispatchHeaders(httpRequest.GetHeaders(), "X-Cloudtasks-")
 
-		headers = httpRequest.GetHeaders()
+		req = newDispatchRequest(method, httpRequest.GetUrl(), dispatchBody(httpRequest.GetBody(), headers, taskState, attempts))
 
 		if auth := httpRequest.GetOidcToken(); auth != nil {
-			tokenStr := createOIDCToken(auth.ServiceAccountEmail, httpRequest.GetUrl())
+			tokenStr := createOIDCToken(auth.ServiceAccountEmail, oidcAudience(auth, httpRequest.GetUrl()))
+			headers["Authorization"] = "Bearer " + tokenStr
+		}
+		if auth := httpRequest.GetOauthToken(); auth != nil {
+			tokenStr, err := oauthAccessToken(ctx, auth)
+			if err != nil {
+				logWarn("Failed to get an OAuth token", field("task", taskState.GetName()), field("error", err))
+				return -1, time.Time{}, err
+			}
 			headers["Authorization"] = "Bearer " + tokenStr
 		}
 
 		// Headers as per https://cloud.google.com/tasks/docs/creating-http-target-tasks#handler
-		// TODO: optional headers
+		// TODO: optional headers (X-CloudTasks-TaskPreviousResponse, X-CloudTasks-TaskRetryReason)
 		headers["X-CloudTasks-QueueName"] = headerQueueName
 		headers["X-CloudTasks-TaskName"] = headerTaskName
 		headers["X-CloudTasks-TaskExecutionCount"] = headerTaskExecutionCount
@@ -327,13 +541,11 @@ func dispatch(retry bool, taskState *tasks.Task) int {
 	} else if appEngineHTTPRequest != nil {
 		method := toHTTPMethod(appEngineHTTPRequest.GetHttpMethod())
 
-		host := appEngineHTTPRequest.GetAppEngineRouting().GetHost()
-
-		url := host + appEngineHTTPRequest.GetRelativeUri()
+		url := targetURL(taskState, routingOverride)
 
-		req, _ = http.NewRequest(method, url, bytes.NewBuffer(appEngineHTTPRequest.GetBody()))
+		headers = dispatchHeaders(appEngineHTTPRequest.GetHeaders(), "X-Appengine-", "X-Google-")
 
-		headers = appEngineHTTPRequest.GetHeaders()
+		req = newDispatchRequest(method, url, dispatchBody(appEngineHTTPRequest.GetBody(), headers, taskState, attempts))
 
 		// These headers are only set on dispatch, see https://cloud.google.com/tasks/docs/reference/rpc/google.cloud.tasks.v2#google.cloud.tasks.v2.AppEngineHttpRequest
 		// TODO: optional headers
@@ -344,69 +556,316 @@ func dispatch(retry bool, taskState *tasks.Task) int {
 		headers["X-AppEngine-TaskETA"] = headerTaskETA
 	}
 
+	// Queue defaults apply unless the task sets the same header
+	for k, v := range defaultHeaders {
+		if !hasHeader(headers, k) {
+			req.Header[k] = []string{v}
+		}
+	}
+
 	for k, v := range headers {
+		if http.CanonicalHeaderKey(k) == bodyTemplateHeader {
+			continue
+		}
 		// Uses a direct set to maintain capitalization
 		// TODO: figure out a way to test these, as the Go net/http client lib overrides the incoming header capitalization
 		req.Header[k] = []string{v}
 	}
 
-	resp, err := client.Do(req)
+	// Continues the trace of the task in the handler
+	if sc := spanContextFrom(ctx); sc.isValid() {
+		req.Header.Set("traceparent", sc.traceparent())
+	}
+
+	if req.ContentLength > 0 && !hasHeader(headers, "Content-Type") && !hasHeader(defaultHeaders, "Content-Type") {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	// The body length is known, so like Cloud Tasks the request has a Content-Length,
+	// unless the body is sent chunked for testing with OUTBOUND_CHUNKED=true
+	if chunked, _ := strconv.ParseBool(os.Getenv("OUTBOUND_CHUNKED")); chunked && req.ContentLength > 0 {
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+	}
+
+	logDispatches := dispatchLoggingEnabled()
+	if logDispatches {
+		logDispatchRequest(taskState.GetName(), req)
+	}
+
+	deadline, _ := ptypes.Duration(taskState.GetDispatchDeadline())
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	resp, err := outboundClient.Do(req.WithContext(ctx))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		return -1
+		logWarn("Dispatch failed", field("task", taskState.GetName()), field("error", err))
+		if ctx.Err() == context.DeadlineExceeded {
+			return -1, time.Time{}, errDispatchDeadlineExceeded
+		}
+		return -1, time.Time{}, err
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode
+	if logDispatches {
+		// Only read what is logged, the rest is drained below
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(logMaxBodySize())+1))
+		logDispatchResponse(taskState.GetName(), resp, body)
+	}
+	// Drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return resp.StatusCode, retryAfter(resp, clock.Now()), nil
+}
+
+// newDispatchRequest creates the outbound request for a task. As with Cloud
+// Tasks, the body is only sent for methods that carry one.
+func newDispatchRequest(method string, url string, body []byte) *http.Request {
+	if !methodAllowsBody(method) {
+		body = nil
+	}
+
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+
+	return req
+}
+
+func methodAllowsBody(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// dispatchHeaders copies the headers of the task to send them on, leaving out
+// those with the reserved prefixes, which only Cloud Tasks sets. App Engine
+// handlers rely on this to trust the X-AppEngine-* headers.
+func dispatchHeaders(taskHeaders map[string]string, reservedPrefixes ...string) map[string]string {
+	headers := make(map[string]string, len(taskHeaders))
+	for k, v := range taskHeaders {
+		if !hasReservedPrefix(http.CanonicalHeaderKey(k), reservedPrefixes) {
+			headers[k] = v
+		}
+	}
+
+	return headers
+}
+
+func hasReservedPrefix(header string, reservedPrefixes []string) bool {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(header, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasHeader checks for the header in a case-insensitive way
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if http.CanonicalHeaderKey(k) == http.CanonicalHeaderKey(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (task *Task) doDispatch(retry bool, unscheduled chan bool) {
+	if task.queue.purgedBefore(task.created) {
+		// Created before the queue was purged, but missed by the purge itself
+		logInfo("Task purged before dispatch", task.logFields()...)
+		task.onDone(task)
+		return
+	}
+
+	ctx, cancel := task.startAttempt()
+	defer cancel()
+
+	routingOverride := task.queue.routingOverride()
+	start := time.Now()
+	task.stateMutex.Lock()
+	attempts := task.attempts
+	dispatchSpan := startSpan("dispatch", spanKindClient, task.trace)
+	dispatchSpan.setAttribute("cloudtasks.task_name", task.state.GetName())
+	dispatchSpan.setAttribute("cloudtasks.attempt", int(attempts.dispatches))
+	dispatchSpan.setAttribute("http.url", targetURL(task.state, routingOverride))
+	task.stateMutex.Unlock()
+	task.publishEvent(DispatchStartedEvent, attempts.dispatches, 0, 0)
+
+	respCode, retryAfter, dispatchErr := dispatch(contextWithSpan(ctx, dispatchSpan), task.queue.clock, retry, task.state, attempts, task.queue.defaultHeaders, routingOverride)
+	dispatchSpan.setAttribute("http.status_code", respCode)
+	if dispatchErr != nil {
+		dispatchSpan.setError(dispatchErr.Error())
+	} else if respCode < 200 || respCode > 299 {
+		dispatchSpan.setError("HTTP status code " + strconv.Itoa(respCode))
+	}
+	dispatchSpan.end()
+	duration := time.Since(start)
+	task.recordDispatch(routingOverride, respCode, duration)
+	task.queue.metrics.dispatched(task.queue.name, attempts.dispatches, respCode, duration)
+	task.publishEvent(AttemptFinishedEvent, attempts.dispatches, respCode, duration)
+	task.queue.observeResponse(respCode)
+
+	if isClosed(unscheduled) {
+		// Run on request in the meantime, which decides what happens next
+		logInfo("Task run during dispatch", task.logFields()...)
+		return
+	}
+
+	if task.isDeleted() {
+		// Deleted while in flight, so the outcome no longer matters
+		logInfo("Task deleted during dispatch", task.logFields()...)
+		task.onDone(task)
+		return
+	}
+
+	updateStateAfterDispatch(task, respCode, dispatchErr)
+	task.reschedule(retry, respCode, retryAfter)
+}
+
+// startAttempt creates the context for a dispatch attempt, which is cancelled
+// when the task gets deleted
+func (task *Task) startAttempt() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	if task.deleted {
+		cancel()
+	}
+	task.cancelAttempt = cancel
+
+	return ctx, cancel
+}
+
+// dispatchCount returns the attempts so far
+func (task *Task) dispatchCount() int32 {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	return task.attempts.dispatches
+}
+
+func (task *Task) isDeleted() bool {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	return task.deleted
 }
 
-func (task *Task) doDispatch(retry bool) {
-	respCode := dispatch(retry, task.state)
+// recordDispatch adds the outcome of the dispatch to the event log of the server
+func (task *Task) recordDispatch(routingOverride *tasks.AppEngineRouting, statusCode int, duration time.Duration) {
+	if task.queue.dispatchEvents == nil {
+		return
+	}
 
-	updateStateAfterDispatch(task, respCode)
-	task.reschedule(retry, respCode)
+	task.stateMutex.Lock()
+	event := DispatchEvent{
+		Time:       task.queue.clock.Now(),
+		QueueName:  task.queue.name,
+		TaskName:   task.state.GetName(),
+		Attempt:    task.state.GetDispatchCount(),
+		URL:        targetURL(task.state, routingOverride),
+		StatusCode: statusCode,
+		Duration:   duration,
+	}
+	task.stateMutex.Unlock()
+
+	task.queue.dispatchEvents.record(event)
 }
 
 // Attempt tries to execute a task
 func (task *Task) Attempt() {
+	task.stateMutex.Lock()
+	unscheduled := task.unscheduled
+	task.stateMutex.Unlock()
+
+	task.attempt(unscheduled)
+}
+
+// attempt dispatches the task as scheduled, unless it got run on request since
+func (task *Task) attempt(unscheduled chan bool) {
+	if isClosed(unscheduled) {
+		return
+	}
+
 	updateStateForDispatch(task)
 
-	task.doDispatch(true)
+	task.doDispatch(true, unscheduled)
 }
 
-// Run runs the task outside of the normal queueing mechanism.
+// Run runs the task outside of the normal queueing mechanism, whatever its
+// schedule time and even if the queue is paused. As in Cloud Tasks, the
+// pending schedule is dropped and the task is due now, so that retries back
+// off from now should the dispatch fail.
 // This method is called directly by request.
 func (task *Task) Run() *tasks.Task {
+	task.stateMutex.Lock()
+	close(task.unscheduled)
+	task.unscheduled = make(chan bool)
+	unscheduled := task.unscheduled
+	task.state.ScheduleTime = timestampNow(task.queue.clock)
+	task.stateMutex.Unlock()
+
+	task.queue.unschedule(task)
+
 	taskState := updateStateForDispatch(task)
 
-	go task.doDispatch(false)
+	task.queue.goRoutine(func() {
+		task.doDispatch(true, unscheduled)
+	})
 
 	return taskState
 }
 
-// Delete cancels the task if it is queued for execution.
+// runIfIdle runs the task unless it is being dispatched or got deleted, telling
+// whether it did
+func (task *Task) runIfIdle() bool {
+	task.stateMutex.Lock()
+	idle := !task.attempts.inFlight && !task.deleted
+	task.stateMutex.Unlock()
+
+	if !idle {
+		return false
+	}
+	task.Run()
+
+	return true
+}
+
+// Delete cancels the task if it is queued for execution, or aborts its
+// request if it is being dispatched.
 // This method is called directly by request.
 func (task *Task) Delete() {
+	task.stateMutex.Lock()
+	task.deleted = true
+	if task.cancelAttempt != nil {
+		task.cancelAttempt()
+	}
+	task.stateMutex.Unlock()
+
 	task.cancelOnce.Do(func() {
+		if task.queue.unschedule(task) {
+			// Waiting for its schedule time, so nothing else holds on to it
+			task.onDone(task)
+			return
+		}
 		task.cancel <- true
 	})
 }
 
-// Schedule schedules the task for execution.
+// Schedule schedules the task for execution, with the scheduler of the queue.
 // It is initially called by the queue, later by the task reschedule.
 func (task *Task) Schedule() {
-	scheduled, _ := ptypes.Timestamp(task.state.GetScheduleTime())
-
-	fromNow := scheduled.Sub(time.Now())
+	task.queue.schedule(task)
+}
 
-	go func() {
-		select {
-		case <-time.After(fromNow):
-			task.queue.fire <- task
-			return
-		case <-task.cancel:
-			task.onDone(task)
-			return
-		}
-	}()
+// isClosed tells whether the channel got closed, for channels only ever closed
+func isClosed(c chan bool) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
 }
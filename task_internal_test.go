@@ -1,11 +1,19 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/ptypes"
+	pduration "github.com/golang/protobuf/ptypes/duration"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
 )
 
 func TestSetInitialTaskStateAppEngineNoEmulatorDefaults(t *testing.T) {
@@ -14,7 +22,7 @@ func TestSetInitialTaskStateAppEngineNoEmulatorDefaults(t *testing.T) {
 			AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{},
 		},
 	}
-	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq")
+	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq", realClock{})
 
 	assert.Equal(t, "https://bluebook.appspot.com", taskState.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost())
 }
@@ -31,7 +39,7 @@ func TestInitialTaskStateAppEngineNoEmulatorTargeted(t *testing.T) {
 			},
 		},
 	}
-	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq")
+	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq", realClock{})
 
 	assert.Equal(t, "https://2-dot-v1-dot-worker-dot-bluebook.appspot.com", taskState.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost())
 }
@@ -45,7 +53,7 @@ func TestSetInitialTaskStateAppEngineEmulatorDefaults(t *testing.T) {
 			AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{},
 		},
 	}
-	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq")
+	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq", realClock{})
 
 	assert.Equal(t, "http://localhost:1234", taskState.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost())
 }
@@ -65,7 +73,293 @@ func TestSetInitialTaskStateAppEngineEmulatorTargeted(t *testing.T) {
 			},
 		},
 	}
-	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq")
+	setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq", realClock{})
 
 	assert.Equal(t, "http://2.v1.worker.nginx", taskState.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost())
 }
+
+func TestSetInitialTaskStateAppEngineServiceHosts(t *testing.T) {
+	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
+	os.Setenv("APP_ENGINE_EMULATOR_HOST", "http://nginx")
+	defer os.Unsetenv("APP_ENGINE_SERVICE_HOSTS")
+	os.Setenv("APP_ENGINE_SERVICE_HOSTS", "default=http://localhost:8080, worker=http://localhost:8081/,v2.worker=http://localhost:8082,v2.default=http://localhost:8090")
+
+	for _, tc := range []struct {
+		service  string
+		version  string
+		expected string
+	}{
+		{"", "", "http://localhost:8080"},
+		{"", "v2", "http://localhost:8090"},
+		{"default", "", "http://localhost:8080"},
+		{"worker", "", "http://localhost:8081"},
+		{"worker", "v1", "http://localhost:8081"},
+		{"worker", "v2", "http://localhost:8082"},
+		{"other", "", "http://other.nginx"},
+		{"other", "v2", "http://v2.other.nginx"},
+	} {
+		taskState := &taskspb.Task{
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					AppEngineRouting: &taskspb.AppEngineRouting{Service: tc.service, Version: tc.version},
+					RelativeUri:      "/work",
+				},
+			},
+		}
+		setInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq", realClock{})
+
+		assert.Equal(t, tc.expected, taskState.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost(), "Service %q version %q", tc.service, tc.version)
+		assert.Equal(t, tc.expected+"/work", targetURL(taskState, nil), "Service %q version %q", tc.service, tc.version)
+	}
+}
+
+func TestParseAppEngineServiceHost(t *testing.T) {
+	service, host, err := parseAppEngineServiceHost("worker=http://localhost:8081/")
+	require.NoError(t, err)
+	assert.Equal(t, "worker", service)
+	assert.Equal(t, "http://localhost:8081", host)
+
+	service, host, err = parseAppEngineServiceHost("v2.worker=http://localhost:8082")
+	require.NoError(t, err)
+	assert.Equal(t, "v2.worker", service)
+	assert.Equal(t, "http://localhost:8082", host)
+
+	for _, mapping := range []string{"worker", "1.v2.worker=http://localhost:8082", ".worker=http://localhost:8082", "=http://localhost:8081", "worker=localhost:8081", "worker=/path", "Worker_1=http://localhost:8081"} {
+		_, _, err := parseAppEngineServiceHost(mapping)
+		assert.Error(t, err, mapping)
+	}
+}
+
+func TestApplyJitterNoFactor(t *testing.T) {
+	assert.Equal(t, 400*time.Millisecond, applyJitter(400*time.Millisecond, 0))
+}
+
+func TestApplyJitterWithinWindow(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		backoff := applyJitter(time.Second, 0.2)
+
+		assert.True(t, backoff >= 800*time.Millisecond, "backoff %v should not be below window", backoff)
+		assert.True(t, backoff <= 1200*time.Millisecond, "backoff %v should not be above window", backoff)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	assert.Equal(t, 0.0, retryJitter())
+
+	defer os.Unsetenv("RETRY_JITTER")
+	os.Setenv("RETRY_JITTER", "0.2")
+
+	assert.Equal(t, 0.2, retryJitter())
+
+	os.Setenv("RETRY_JITTER", "1.5")
+
+	assert.Equal(t, 1.0, retryJitter())
+}
+
+func TestGenerateTaskNameSkipsRecentlyUsedNames(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	s := NewServer()
+	defer resetTaskIDs()
+
+	seedTaskIDs(1)
+	recentName := queueName + "/tasks/" + newTaskID()
+	s.removeTask(recentName)
+
+	// Replays the same IDs, so the first one is taken
+	seedTaskIDs(1)
+	generatedName := s.generateTaskName(queueName)
+
+	assert.NotEqual(t, recentName, generatedName)
+	assert.Regexp(t, "^"+queueName+"/tasks/[0-9]+$", generatedName)
+}
+
+func TestTaskIDSeed(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	s := NewServer()
+	defer resetTaskIDs()
+
+	defer os.Unsetenv("TASK_ID_SEED")
+	os.Setenv("TASK_ID_SEED", "42")
+
+	s.Reset()
+	first := []string{s.generateTaskName(queueName), s.generateTaskName(queueName)}
+	s.Reset()
+	second := []string{s.generateTaskName(queueName), s.generateTaskName(queueName)}
+
+	assert.Equal(t, first, second, "Generated names are reproducible after a reset")
+	assert.NotEqual(t, first[0], first[1])
+
+	os.Unsetenv("TASK_ID_SEED")
+	s.Reset()
+	third := []string{s.generateTaskName(queueName), s.generateTaskName(queueName)}
+
+	assert.NotEqual(t, first, third, "Generated names are random without a seed")
+	assert.Regexp(t, "^"+queueName+"/tasks/[0-9]+$", third[0])
+}
+
+func TestTaskCreatedBeforePurgeIsNotDispatched(t *testing.T) {
+	dispatched := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dispatched <- true
+	}))
+	defer srv.Close()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{Name: queueName}, realClock{}, func(task *Task) {})
+
+	// Stands in for a task created concurrently with the purge, which the purge
+	// itself didn't see
+	done := make(chan bool, 1)
+	task := NewTask(queue, &taskspb.Task{
+		MessageType: &taskspb.Task_HttpRequest{
+			HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+		},
+	}, func(task *Task) {
+		done <- true
+	})
+
+	queue.Purge()
+	assert.NotNil(t, queue.frozenState().GetPurgeTime())
+
+	task.Attempt()
+
+	assert.Len(t, done, 1)
+	assert.Len(t, dispatched, 0)
+}
+
+func TestRunDropsPendingSchedule(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	dispatched := make(chan bool, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dispatched <- true
+	}))
+	defer srv.Close()
+
+	done := make(chan bool, 2)
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{Name: queueName}, fake, func(task *Task) {
+		done <- true
+	})
+	queue.Run()
+	defer queue.Delete()
+
+	scheduleTime, _ := ptypes.TimestampProto(fake.Now().Add(10 * time.Second))
+	task, _, err := queue.NewTask(&taskspb.Task{
+		ScheduleTime: scheduleTime,
+		MessageType: &taskspb.Task_HttpRequest{
+			HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+		},
+	})
+	require.NoError(t, err)
+
+	task.Run()
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, dispatched, 1)
+	assert.Len(t, done, 1)
+
+	// The timer of the original schedule is gone, so nothing fires
+	fake.Advance(15 * time.Second)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, dispatched, 1)
+	assert.Len(t, done, 1)
+}
+
+func TestMaxRetryDuration(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	var mux sync.Mutex
+	dispatchCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		dispatchCount++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	// Retried every second, the last retry after 2.5s is at 3s
+	for maxAttempts, expectedDispatches := range map[int32]int{
+		-1: 4,
+		2:  4,
+		6:  6,
+	} {
+		mux.Lock()
+		dispatchCount = 0
+		mux.Unlock()
+
+		failed := make(chan bool, 1)
+		queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+		queue, _ := NewQueue(queueName, &taskspb.Queue{
+			Name: queueName,
+			RetryConfig: &taskspb.RetryConfig{
+				MaxAttempts:      maxAttempts,
+				MaxRetryDuration: &pduration.Duration{Seconds: 2, Nanos: 5e8},
+				MinBackoff:       &pduration.Duration{Seconds: 1},
+				MaxBackoff:       &pduration.Duration{Seconds: 1},
+			},
+		}, fake, func(task *Task) {})
+		queue.onTaskFailed = func(task *Task, statusCode int) {
+			failed <- true
+		}
+		queue.Run()
+
+		_, _, err := queue.NewTask(&taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+			},
+		})
+		require.NoError(t, err)
+
+		for i := 0; i < 10 && len(failed) == 0; i++ {
+			time.Sleep(50 * time.Millisecond)
+			fake.Advance(time.Second)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		mux.Lock()
+		assert.Equal(t, expectedDispatches, dispatchCount, "max attempts %v", maxAttempts)
+		mux.Unlock()
+		assert.Len(t, failed, 1, "max attempts %v", maxAttempts)
+
+		queue.Delete()
+		queue.Wait()
+	}
+}
+
+func TestDispatchDeadlineExceeded(t *testing.T) {
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{Name: queueName}, realClock{}, func(task *Task) {})
+	defer queue.Delete()
+
+	// Shorter than CreateTask allows, to keep the test quick
+	task, _, err := queue.NewTask(&taskspb.Task{
+		DispatchDeadline: &pduration.Duration{Nanos: 1e8},
+		MessageType: &taskspb.Task_HttpRequest{
+			HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+		},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	task.Attempt()
+	assert.True(t, time.Since(start) < time.Second, "Gave up on the handler after the deadline")
+
+	taskState := task.frozenState()
+	assert.Equal(t, int32(rpccode.Code_DEADLINE_EXCEEDED), taskState.GetLastAttempt().GetResponseStatus().GetCode())
+	assert.Contains(t, taskState.GetLastAttempt().GetResponseStatus().GetMessage(), "dispatch deadline of 100ms")
+	assert.EqualValues(t, 1, taskState.GetDispatchCount())
+	assert.EqualValues(t, 0, taskState.GetResponseCount(), "No response was received")
+
+	// Retried
+	queue.tsMux.Lock()
+	assert.Contains(t, queue.ts, taskState.GetName())
+	queue.tsMux.Unlock()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The task events
+const (
+	TaskCreatedEvent     = "TASK_CREATED"
+	DispatchStartedEvent = "DISPATCH_STARTED"
+	AttemptFinishedEvent = "ATTEMPT_FINISHED"
+	TaskCompletedEvent   = "TASK_COMPLETED"
+	TaskFailedEvent      = "TASK_FAILED"
+)
+
+const (
+	// The events a subscriber can fall behind by before its stream is ended
+	taskEventBufferSize = 256
+
+	// How often an idle stream sends a comment to keep the connection open
+	taskEventKeepAlivePeriod = 15 * time.Second
+)
+
+// Why the stream of a subscriber that fell too far behind ends
+var taskEventOverflowMessage = fmt.Sprintf("The stream fell more than %d events behind, missing the events since.", taskEventBufferSize)
+
+// TaskEvent describes a step in the life of a task, streamed on /admin/events
+type TaskEvent struct {
+	Time time.Time `json:"time"`
+
+	Type string `json:"type"`
+
+	QueueName string `json:"queueName"`
+
+	TaskName string `json:"taskName"`
+
+	// Starts at 1 for the first dispatch, left out for TASK_CREATED
+	Attempt int32 `json:"attempt,omitempty"`
+
+	// The HTTP status code of the attempt, -1 if no response was received. Set
+	// for ATTEMPT_FINISHED, TASK_COMPLETED and TASK_FAILED.
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// In nanoseconds in JSON, set for ATTEMPT_FINISHED
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// taskEventStream broadcasts the task events of all queues to the subscribers.
+// Rather than slowing the queues down, a subscriber that falls too far behind
+// is dropped, its channel closed once the events it holds are received, so
+// that its stream ends instead of silently missing events.
+type taskEventStream struct {
+	mux sync.Mutex
+
+	subscribers map[chan TaskEvent]bool
+}
+
+func newTaskEventStream() *taskEventStream {
+	return &taskEventStream{subscribers: make(map[chan TaskEvent]bool)}
+}
+
+func (s *taskEventStream) publish(event TaskEvent) {
+	if s == nil {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// subscribe returns the channel the events are sent to until unsubscribed, or
+// closed if the subscriber falls too far behind
+func (s *taskEventStream) subscribe() (chan TaskEvent, func()) {
+	events := make(chan TaskEvent, taskEventBufferSize)
+
+	s.mux.Lock()
+	s.subscribers[events] = true
+	s.mux.Unlock()
+
+	return events, func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		delete(s.subscribers, events)
+	}
+}
+
+// publishEvent publishes an event about the task
+func (task *Task) publishEvent(eventType string, attempt int32, statusCode int, duration time.Duration) {
+	if task.queue.taskEvents == nil {
+		return
+	}
+
+	task.stateMutex.Lock()
+	taskName := task.state.GetName()
+	task.stateMutex.Unlock()
+
+	task.queue.taskEvents.publish(TaskEvent{
+		Time:       task.queue.clock.Now(),
+		Type:       eventType,
+		QueueName:  task.queue.name,
+		TaskName:   taskName,
+		Attempt:    attempt,
+		StatusCode: statusCode,
+		Duration:   duration,
+	})
+}
+
+// serveTaskEvents streams the task events as server-sent events, those of the
+// queue only with ?queue=<queue name>, until the client disconnects
+func serveTaskEvents(s *Server, w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+	queueName := req.URL.Query().Get("queue")
+
+	events, unsubscribe := s.taskEvents.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(taskEventKeepAlivePeriod)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				fmt.Fprintf(w, "event: overflow\ndata: %s\n\n", taskEventOverflowMessage)
+				flusher.Flush()
+				return
+			}
+			if queueName != "" && event.QueueName != queueName {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
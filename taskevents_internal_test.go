@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskEventSubscriberOverflow(t *testing.T) {
+	stream := newTaskEventStream()
+	events, unsubscribe := stream.subscribe()
+	defer unsubscribe()
+	kept, keptUnsubscribe := stream.subscribe()
+	defer keptUnsubscribe()
+
+	for i := 0; i < taskEventBufferSize; i++ {
+		stream.publish(TaskEvent{Type: TaskCreatedEvent})
+		<-kept
+	}
+	stream.publish(TaskEvent{Type: TaskCompletedEvent})
+
+	// The events held are still received before the channel is closed
+	for i := 0; i < taskEventBufferSize; i++ {
+		event, ok := <-events
+		assert.True(t, ok)
+		assert.Equal(t, TaskCreatedEvent, event.Type)
+	}
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// Others keep up
+	event := <-kept
+	assert.Equal(t, TaskCompletedEvent, event.Type)
+}
+
+func TestServeTaskEventsEndsOnOverflow(t *testing.T) {
+	server := NewServer()
+	done := make(chan bool)
+	recorder := httptest.NewRecorder()
+	go func() {
+		serveTaskEvents(server, recorder, httptest.NewRequest("GET", "/admin/events", nil))
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		server.taskEvents.mux.Lock()
+		defer server.taskEvents.mux.Unlock()
+		return len(server.taskEvents.subscribers) == 1
+	}, time.Second, time.Millisecond)
+	// The recorder doesn't block, so the stream is overflowed by hand
+	server.taskEvents.mux.Lock()
+	for events := range server.taskEvents.subscribers {
+		delete(server.taskEvents.subscribers, events)
+		close(events)
+	}
+	server.taskEvents.mux.Unlock()
+
+	<-done
+	assert.Contains(t, recorder.Body.String(), "event: overflow\ndata: "+taskEventOverflowMessage)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+)
+
+type taskHeapEntry struct {
+	task *Task
+
+	eta time.Time
+
+	created time.Time
+
+	// Insertion order, to keep the ordering stable for identical times
+	seq uint64
+
+	// The unscheduled channel of the task when it was scheduled, the entry is
+	// dropped once closed (see Task.Run)
+	unscheduled chan bool
+
+	// The position in the heap, -1 once popped, so that it can be removed
+	index int
+
+	// The timing wheel slot holding the entry, index being its position in it
+	slot *wheelSlot
+}
+
+// taskHeap is a priority queue of tasks ordered by ETA, with ties broken by
+// creation time. It implements heap.Interface and is not safe for concurrent use.
+type taskHeap []*taskHeapEntry
+
+func (h taskHeap) Len() int {
+	return len(h)
+}
+
+func (h taskHeap) Less(i, j int) bool {
+	if !h[i].eta.Equal(h[j].eta) {
+		return h[i].eta.Before(h[j].eta)
+	}
+	if !h[i].created.Equal(h[j].created) {
+		return h[i].created.Before(h[j].created)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x interface{}) {
+	entry := x.(*taskHeapEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var (
+	taskIDRand = newTaskIDRand()
+
+	taskIDMux sync.Mutex
+)
+
+// newTaskIDRand draws task IDs from crypto/rand, unless TASK_ID_SEED is set to
+// make the generated IDs reproducible
+func newTaskIDRand() *rand.Rand {
+	if seed, err := strconv.ParseInt(os.Getenv("TASK_ID_SEED"), 10, 64); err == nil {
+		return rand.New(rand.NewSource(seed))
+	}
+
+	return rand.New(cryptoSource{})
+}
+
+// resetTaskIDs starts over the sequence of IDs of TASK_ID_SEED, if set
+func resetTaskIDs() {
+	taskIDMux.Lock()
+	defer taskIDMux.Unlock()
+
+	taskIDRand = newTaskIDRand()
+}
+
+// seedTaskIDs makes the generated task IDs reproducible, for tests
+func seedTaskIDs(seed int64) {
+	taskIDMux.Lock()
+	defer taskIDMux.Unlock()
+
+	taskIDRand = rand.New(rand.NewSource(seed))
+}
+
+// newTaskID generates a random numeric task ID, in the style of the IDs
+// Cloud Tasks generates
+func newTaskID() string {
+	taskIDMux.Lock()
+	defer taskIDMux.Unlock()
+
+	return strconv.FormatUint(taskIDRand.Uint64(), 10)
+}
+
+// cryptoSource is a rand.Source reading from crypto/rand, it can't be seeded
+type cryptoSource struct{}
+
+func (cryptoSource) Seed(int64) {}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() &^ (1 << 63))
+}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	return binary.BigEndian.Uint64(b[:])
+}
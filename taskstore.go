@@ -0,0 +1,52 @@
+package main
+
+// taskStore holds tasks by name, those of a queue or, for the lookups of the
+// server, those of all queues. It isn't safe for concurrent use, its owner
+// guarding it with its own mutex.
+type taskStore interface {
+	// get returns the task, and whether the name is in the store at all, as the
+	// server stores nil for the names reserved for tasks being created
+	get(taskName string) (*Task, bool)
+
+	put(taskName string, task *Task)
+
+	remove(taskName string)
+
+	len() int
+
+	// list returns the tasks, in no particular order
+	list() []*Task
+}
+
+// memoryTaskStore keeps the tasks in a map, the default
+type memoryTaskStore map[string]*Task
+
+func newMemoryTaskStore() taskStore {
+	return memoryTaskStore(make(map[string]*Task))
+}
+
+func (store memoryTaskStore) get(taskName string) (*Task, bool) {
+	task, ok := store[taskName]
+	return task, ok
+}
+
+func (store memoryTaskStore) put(taskName string, task *Task) {
+	store[taskName] = task
+}
+
+func (store memoryTaskStore) remove(taskName string) {
+	delete(store, taskName)
+}
+
+func (store memoryTaskStore) len() int {
+	return len(store)
+}
+
+func (store memoryTaskStore) list() []*Task {
+	ts := make([]*Task, 0, len(store))
+	for _, task := range store {
+		ts = append(ts, task)
+	}
+
+	return ts
+}
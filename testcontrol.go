@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	pduration "github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/empty"
+	ptimestamp "github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// Freeze stops the dispatches of all queues, including those created until
+// Unfreeze, without changing their state, so that tests can create tasks and
+// inspect them before they run
+func (s *Server) Freeze() {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	s.frozen = true
+	for _, queue := range s.qs {
+		if queue != nil {
+			queue.Freeze()
+		}
+	}
+}
+
+// Unfreeze resumes the dispatches of all queues, apart from the paused ones
+func (s *Server) Unfreeze() {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+
+	s.frozen = false
+	for _, queue := range s.qs {
+		if queue != nil {
+			queue.Unfreeze()
+		}
+	}
+}
+
+// Flush runs all the tasks of the queue, or of all queues if the name is empty,
+// straight away, whatever their schedule time and the rate limits, as RunTask
+// would. The tasks of pull queues and those being dispatched are left alone.
+// Returns the number of tasks run.
+func (s *Server) Flush(queueName string) (int, error) {
+	var queues []*Queue
+	if queueName != "" {
+		queue, err := s.lookupQueue(queueName)
+		if err != nil {
+			return 0, err
+		}
+		queues = append(queues, queue)
+	} else {
+		s.qsMux.Lock()
+		for _, queue := range s.qs {
+			if queue != nil {
+				queues = append(queues, queue)
+			}
+		}
+		s.qsMux.Unlock()
+	}
+
+	flushed := 0
+	for _, queue := range queues {
+		if queue.pull {
+			continue
+		}
+
+		queue.tsMux.Lock()
+		ts := queue.ts.list()
+		queue.tsMux.Unlock()
+
+		for _, task := range ts {
+			if task.runIfIdle() {
+				flushed++
+			}
+		}
+	}
+
+	return flushed, nil
+}
+
+// AdvanceTime moves the fake clock forward, firing the task schedules and
+// releasing the rate limiting tokens that become due in order, and returns the
+// new time. Fails unless the emulator uses the fake clock.
+func (s *Server) AdvanceTime(duration time.Duration) (time.Time, error) {
+	fake, ok := s.clock.(*fakeClock)
+	if !ok {
+		return time.Time{}, status.Errorf(codes.FailedPrecondition, "The clock can only be advanced when the emulator uses the fake clock.")
+	}
+	if duration < 0 {
+		return time.Time{}, status.Errorf(codes.InvalidArgument, "The duration must be zero or more, e.g. 30s.")
+	}
+
+	fake.Advance(duration)
+
+	return fake.Now(), nil
+}
+
+// FlushRequest mirrors the message of the same name in emulator.proto
+type FlushRequest struct {
+	// Only the tasks of the queue if set
+	Queue string `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+}
+
+func (m *FlushRequest) Reset()         { *m = FlushRequest{} }
+func (m *FlushRequest) String() string { return proto.CompactTextString(m) }
+func (*FlushRequest) ProtoMessage()    {}
+
+// FlushResponse mirrors the message of the same name in emulator.proto
+type FlushResponse struct {
+	FlushedTasks int32 `protobuf:"varint,1,opt,name=flushed_tasks,json=flushedTasks,proto3" json:"flushed_tasks,omitempty"`
+}
+
+func (m *FlushResponse) Reset()         { *m = FlushResponse{} }
+func (m *FlushResponse) String() string { return proto.CompactTextString(m) }
+func (*FlushResponse) ProtoMessage()    {}
+
+// AdvanceTimeRequest mirrors the message of the same name in emulator.proto
+type AdvanceTimeRequest struct {
+	Duration *pduration.Duration `protobuf:"bytes,1,opt,name=duration,proto3" json:"duration,omitempty"`
+}
+
+func (m *AdvanceTimeRequest) Reset()         { *m = AdvanceTimeRequest{} }
+func (m *AdvanceTimeRequest) String() string { return proto.CompactTextString(m) }
+func (*AdvanceTimeRequest) ProtoMessage()    {}
+
+// AdvanceTimeResponse mirrors the message of the same name in emulator.proto
+type AdvanceTimeResponse struct {
+	// The time of the fake clock once advanced
+	Now *ptimestamp.Timestamp `protobuf:"bytes,1,opt,name=now,proto3" json:"now,omitempty"`
+}
+
+func (m *AdvanceTimeResponse) Reset()         { *m = AdvanceTimeResponse{} }
+func (m *AdvanceTimeResponse) String() string { return proto.CompactTextString(m) }
+func (*AdvanceTimeResponse) ProtoMessage()    {}
+
+// testControlMethods are the unary RPCs of the emulator service
+var testControlMethods = []grpc.MethodDesc{
+	{MethodName: "Reset", Handler: emptyMethodHandler("Reset", func(s *Server) error {
+		if enabled, _ := strconv.ParseBool(os.Getenv("ENABLE_RESET")); !enabled {
+			return status.Errorf(codes.FailedPrecondition, "Resetting the emulator requires ENABLE_RESET=true.")
+		}
+		s.Reset()
+		return nil
+	})},
+	{MethodName: "Freeze", Handler: emptyMethodHandler("Freeze", func(s *Server) error {
+		s.Freeze()
+		return nil
+	})},
+	{MethodName: "Unfreeze", Handler: emptyMethodHandler("Unfreeze", func(s *Server) error {
+		s.Unfreeze()
+		return nil
+	})},
+	{MethodName: "Flush", Handler: flushHandler},
+	{MethodName: "AdvanceTime", Handler: advanceTimeHandler},
+}
+
+// emptyMethodHandler handles an RPC taking and returning google.protobuf.Empty
+func emptyMethodHandler(name string, call func(s *Server) error) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := &empty.Empty{}
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &empty.Empty{}, call(srv.(*Server))
+		}
+		if interceptor == nil {
+			return handler(ctx, in)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + emulatorServiceName + "/" + name}
+
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
+func flushHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := &FlushRequest{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		flushed, err := srv.(*Server).Flush(req.(*FlushRequest).Queue)
+		if err != nil {
+			return nil, err
+		}
+		return &FlushResponse{FlushedTasks: int32(flushed)}, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + emulatorServiceName + "/Flush"}
+
+	return interceptor(ctx, in, info, handler)
+}
+
+func advanceTimeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := &AdvanceTimeRequest{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		duration, err := ptypes.Duration(req.(*AdvanceTimeRequest).Duration)
+		if err != nil {
+			return nil, invalidArgument("duration", "The duration must be zero or more, e.g. 30s.")
+		}
+		now, err := srv.(*Server).AdvanceTime(duration)
+		if err != nil {
+			return nil, err
+		}
+		nowProto, _ := ptypes.TimestampProto(now)
+		return &AdvanceTimeResponse{Now: nowProto}, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + emulatorServiceName + "/AdvanceTime"}
+
+	return interceptor(ctx, in, info, handler)
+}
+
+// Reset deletes all queues and tasks of the emulator, which requires ENABLE_RESET=true
+func (c *EmulatorClient) Reset(ctx context.Context) error {
+	return c.cc.Invoke(ctx, "/"+emulatorServiceName+"/Reset", &empty.Empty{}, &empty.Empty{})
+}
+
+// Freeze stops the dispatches of all queues until unfrozen
+func (c *EmulatorClient) Freeze(ctx context.Context) error {
+	return c.cc.Invoke(ctx, "/"+emulatorServiceName+"/Freeze", &empty.Empty{}, &empty.Empty{})
+}
+
+// Unfreeze resumes the dispatches of all queues, apart from the paused ones
+func (c *EmulatorClient) Unfreeze(ctx context.Context) error {
+	return c.cc.Invoke(ctx, "/"+emulatorServiceName+"/Unfreeze", &empty.Empty{}, &empty.Empty{})
+}
+
+// Flush runs the tasks of the queue, or of all queues if empty, straight away,
+// returning the number of tasks run
+func (c *EmulatorClient) Flush(ctx context.Context, queueName string) (int, error) {
+	resp := &FlushResponse{}
+	if err := c.cc.Invoke(ctx, "/"+emulatorServiceName+"/Flush", &FlushRequest{Queue: queueName}, resp); err != nil {
+		return 0, err
+	}
+
+	return int(resp.FlushedTasks), nil
+}
+
+// AdvanceTime moves the fake clock of the emulator forward, returning the new
+// time. The emulator must run with the fake clock.
+func (c *EmulatorClient) AdvanceTime(ctx context.Context, duration time.Duration) (time.Time, error) {
+	resp := &AdvanceTimeResponse{}
+	if err := c.cc.Invoke(ctx, "/"+emulatorServiceName+"/AdvanceTime", &AdvanceTimeRequest{Duration: ptypes.DurationProto(duration)}, resp); err != nil {
+		return time.Time{}, err
+	}
+
+	return ptypes.Timestamp(resp.Now)
+}
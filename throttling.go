@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// The least time between two changes of the enforced rate, so that the
+	// responses to a burst of dispatches only slow the queue down once
+	throttleInterval = time.Second
+
+	// The enforced rate backs off to no less than a dispatch every 10 seconds
+	minEnforcedRate = 0.1
+
+	// The enforced rate is halved on overload, and grows by half again on success
+	throttleBackoff  = 0.5
+	throttleRecovery = 1.5
+)
+
+// systemThrottle emulates how Cloud Tasks slows down a whole queue when its
+// target returns 429 Too Many Requests or 503 Service Unavailable: the queue
+// dispatches at an enforced rate below its max dispatches per second, which
+// backs off on every overloaded response and recovers gradually as the target
+// succeeds again. Enabled with SYSTEM_THROTTLING.
+type systemThrottle struct {
+	clock Clock
+
+	mux sync.Mutex
+
+	// The enforced dispatches per second, 0 while the queue isn't throttled
+	rate float64
+
+	// When the enforced rate last changed
+	changed time.Time
+}
+
+// newSystemThrottle returns the throttle of a queue, nil unless enabled
+func newSystemThrottle(enabled bool, clock Clock) *systemThrottle {
+	if !enabled {
+		return nil
+	}
+
+	return &systemThrottle{clock: clock}
+}
+
+// isOverloaded tells whether the response asks the queue to slow down
+func isOverloaded(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// enforce returns the rate at which the queue dispatches, the max rate unless throttled
+func (t *systemThrottle) enforce(maxRate float64) float64 {
+	if t == nil {
+		return maxRate
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.rate == 0 || t.rate >= maxRate {
+		return maxRate
+	}
+
+	return t.rate
+}
+
+// observe adjusts the enforced rate to the response of a dispatch, telling
+// whether it changed
+func (t *systemThrottle) observe(statusCode int, maxRate float64) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	now := t.clock.Now()
+	if !t.changed.IsZero() && now.Sub(t.changed) < throttleInterval {
+		return false
+	}
+
+	rate := t.rate
+	if rate == 0 || rate > maxRate {
+		rate = maxRate
+	}
+
+	switch {
+	case isOverloaded(statusCode):
+		if rate <= minEnforcedRate {
+			return false
+		}
+		t.rate = rate * throttleBackoff
+		if t.rate < minEnforcedRate {
+			t.rate = minEnforcedRate
+		}
+	case t.rate != 0 && statusCode >= 200 && statusCode < 300:
+		t.rate = rate * throttleRecovery
+		if t.rate >= maxRate {
+			// Recovered
+			t.rate = 0
+		}
+	default:
+		return false
+	}
+	t.changed = now
+
+	return true
+}
+
+// observeResponse adjusts the dispatch rate of the queue to the response of a
+// dispatch, retuning the token generator if it changed
+func (queue *Queue) observeResponse(statusCode int) {
+	queue.lifecycleMux.Lock()
+	maxRate := queue.maxDispatchesPerSecond
+	queue.lifecycleMux.Unlock()
+
+	if queue.throttle.observe(statusCode, maxRate) {
+		select {
+		case queue.retuneTokenGenerator <- true:
+		default:
+		}
+	}
+}
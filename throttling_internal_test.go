@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestSystemThrottleBacksOffAndRecovers(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	throttle := &systemThrottle{clock: fake}
+	assert.Equal(t, 10.0, throttle.enforce(10))
+
+	assert.True(t, throttle.observe(http.StatusServiceUnavailable, 10))
+	assert.Equal(t, 5.0, throttle.enforce(10))
+
+	// The responses to the same burst only back off once
+	assert.False(t, throttle.observe(http.StatusTooManyRequests, 10))
+	assert.Equal(t, 5.0, throttle.enforce(10))
+
+	fake.Advance(throttleInterval)
+	assert.True(t, throttle.observe(http.StatusTooManyRequests, 10))
+	assert.Equal(t, 2.5, throttle.enforce(10))
+
+	// Other failures leave the rate as is
+	fake.Advance(throttleInterval)
+	assert.False(t, throttle.observe(http.StatusInternalServerError, 10))
+	assert.False(t, throttle.observe(-1, 10))
+	assert.Equal(t, 2.5, throttle.enforce(10))
+
+	for _, expected := range []float64{3.75, 5.625, 8.4375, 10} {
+		assert.True(t, throttle.observe(http.StatusOK, 10))
+		assert.Equal(t, expected, throttle.enforce(10))
+		fake.Advance(throttleInterval)
+	}
+
+	// Recovered
+	assert.False(t, throttle.observe(http.StatusOK, 10))
+	assert.Equal(t, 10.0, throttle.enforce(10))
+}
+
+func TestSystemThrottleMinRate(t *testing.T) {
+	fake := newFakeClock(time.Now())
+
+	throttle := &systemThrottle{clock: fake}
+	for i := 0; i < 10; i++ {
+		throttle.observe(http.StatusServiceUnavailable, 1)
+		fake.Advance(throttleInterval)
+	}
+	assert.Equal(t, minEnforcedRate, throttle.enforce(1))
+
+	// A lower max rate applies right away
+	assert.Equal(t, 0.05, throttle.enforce(0.05))
+}
+
+func TestSystemThrottleDisabled(t *testing.T) {
+	os.Unsetenv("SYSTEM_THROTTLING")
+	throttle := newSystemThrottle(settingsFromEnv().systemThrottling, realClock{})
+	assert.Nil(t, throttle)
+	assert.False(t, throttle.observe(http.StatusServiceUnavailable, 10))
+	assert.Equal(t, 10.0, throttle.enforce(10))
+
+	os.Setenv("SYSTEM_THROTTLING", "true")
+	defer os.Unsetenv("SYSTEM_THROTTLING")
+	assert.NotNil(t, newSystemThrottle(settingsFromEnv().systemThrottling, realClock{}))
+}
+
+func TestThrottledQueueSlowsDown(t *testing.T) {
+	os.Setenv("SYSTEM_THROTTLING", "true")
+	defer os.Unsetenv("SYSTEM_THROTTLING")
+
+	queueName := "projects/p/locations/l/queues/throttled"
+	queue, _ := NewQueue(queueName, &taskspb.Queue{
+		Name:       queueName,
+		RateLimits: &taskspb.RateLimits{MaxDispatchesPerSecond: 8},
+	}, realClock{}, func(task *Task) {})
+	assert.Equal(t, 8.0, queue.dispatchRate())
+
+	queue.observeResponse(http.StatusServiceUnavailable)
+	assert.Equal(t, 4.0, queue.dispatchRate())
+	assert.Equal(t, 4.0, queue.Stats().EffectiveExecutionRate)
+	assert.Len(t, queue.retuneTokenGenerator, 1)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/heap"
+	"math/bits"
+	"time"
+)
+
+const (
+	// The time span of the slots of the lowest level
+	wheelTick = time.Millisecond
+
+	// The slots per level, as many as the bits of the occupancy bitmaps
+	wheelSlots = 64
+
+	// With 64 slots of 1ms, the 6 levels span over two years, far beyond the 30
+	// days tasks can be scheduled ahead
+	wheelLevels = 6
+)
+
+// timingWheel is a hierarchical timing wheel: each level has 64 slots, each
+// spanning 64 times the slots of the level below. A task goes in the lowest
+// level that spans its schedule time, and moves down a level whenever the wheel
+// reaches its slot. Adding and removing a task take constant time, unlike the
+// heap, which suits millions of pending tasks. Selected with SCHEDULER=wheel.
+type timingWheel struct {
+	// The tick up to which the wheel went, in ticks since the Unix epoch
+	current int64
+
+	levels [wheelLevels]wheelLevel
+
+	// The tasks beyond the span of the top level, normally none
+	overflow taskHeap
+
+	count int
+}
+
+type wheelLevel struct {
+	slots [wheelSlots]*wheelSlot
+
+	// The slots holding tasks
+	occupied uint64
+}
+
+// wheelSlot holds the tasks of a slot, unordered. The index of the entries is
+// their position in it.
+type wheelSlot struct {
+	level int
+
+	// The slot number, the start of the slot in slot spans since the Unix epoch
+	number int64
+
+	entries []*taskHeapEntry
+}
+
+func newTimingWheel(now time.Time) taskSchedule {
+	return &timingWheel{current: wheelTicks(now)}
+}
+
+// wheelTicks returns the tick of the time
+func wheelTicks(t time.Time) int64 {
+	return t.UnixNano() / int64(wheelTick)
+}
+
+// wheelSpan returns the ticks spanned by a slot of the level
+func wheelSpan(level int) int64 {
+	return int64(1) << (6 * uint(level))
+}
+
+func (w *timingWheel) Len() int {
+	return w.count
+}
+
+func (w *timingWheel) push(entry *taskHeapEntry) {
+	w.count++
+	w.place(entry)
+}
+
+// place puts the entry in the lowest level that spans it, in the overflow if none
+func (w *timingWheel) place(entry *taskHeapEntry) {
+	tick := wheelTicks(entry.eta)
+	if tick < w.current {
+		// Already due
+		tick = w.current
+	}
+
+	for level := 0; level < wheelLevels; level++ {
+		number := tick / wheelSpan(level)
+		if number-w.current/wheelSpan(level) < wheelSlots {
+			w.slot(level, number).add(entry)
+			w.levels[level].occupied |= 1 << uint(number%wheelSlots)
+			return
+		}
+	}
+
+	entry.slot = nil
+	heap.Push(&w.overflow, entry)
+}
+
+// slot returns the slot of the level by its number, set up if empty
+func (w *timingWheel) slot(level int, number int64) *wheelSlot {
+	slots := &w.levels[level].slots
+	i := number % wheelSlots
+	if slots[i] == nil {
+		slots[i] = &wheelSlot{level: level}
+	}
+	slots[i].number = number
+
+	return slots[i]
+}
+
+func (s *wheelSlot) add(entry *taskHeapEntry) {
+	entry.slot = s
+	entry.index = len(s.entries)
+	s.entries = append(s.entries, entry)
+}
+
+func (w *timingWheel) remove(entry *taskHeapEntry) bool {
+	if entry.index < 0 {
+		return false
+	}
+
+	slot := entry.slot
+	if slot == nil {
+		heap.Remove(&w.overflow, entry.index)
+	} else {
+		last := len(slot.entries) - 1
+		slot.entries[entry.index] = slot.entries[last]
+		slot.entries[entry.index].index = entry.index
+		slot.entries[last] = nil
+		slot.entries = slot.entries[:last]
+		if len(slot.entries) == 0 {
+			w.levels[slot.level].occupied &^= 1 << uint(slot.number%wheelSlots)
+		}
+		entry.slot = nil
+		entry.index = -1
+	}
+	w.count--
+
+	return true
+}
+
+// earliest returns the occupied slot that the wheel reaches first, preferring
+// higher levels, whose tasks move down first, when slots start at the same tick
+func (w *timingWheel) earliest() (*wheelSlot, int64, bool) {
+	var earliest *wheelSlot
+	var earliestStart int64
+	for level := wheelLevels - 1; level >= 0; level-- {
+		occupied := w.levels[level].occupied
+		if occupied == 0 {
+			continue
+		}
+
+		// Look from the slot of the current tick onwards
+		currentNumber := w.current / wheelSpan(level)
+		offset := bits.TrailingZeros64(bits.RotateLeft64(occupied, -int(currentNumber%wheelSlots)))
+		number := currentNumber + int64(offset)
+		start := number * wheelSpan(level)
+		if earliest == nil || start < earliestStart {
+			earliest = w.levels[level].slots[number%wheelSlots]
+			earliestStart = start
+		}
+	}
+
+	return earliest, earliestStart, earliest != nil
+}
+
+func (w *timingWheel) next() (time.Time, bool) {
+	slot, start, ok := w.earliest()
+	if !ok {
+		if w.overflow.Len() == 0 {
+			return time.Time{}, false
+		}
+		// Moved into the wheel when the scheduler wakes up
+		return w.overflow[0].eta, true
+	}
+
+	if slot.level > 0 {
+		// When its tasks move down a level
+		return time.Unix(0, start*int64(wheelTick)), true
+	}
+
+	// The tasks of the lowest level are due at their own time
+	next := slot.entries[0].eta
+	for _, entry := range slot.entries[1:] {
+		if entry.eta.Before(next) {
+			next = entry.eta
+		}
+	}
+
+	return next, true
+}
+
+func (w *timingWheel) popDue(now time.Time) []*taskHeapEntry {
+	nowTick := wheelTicks(now)
+
+	var due []*taskHeapEntry
+	for {
+		w.refill()
+
+		slot, start, ok := w.earliest()
+		if !ok || start > nowTick {
+			break
+		}
+		if start > w.current {
+			w.current = start
+		}
+
+		entries := slot.entries
+		slot.entries = nil
+		w.levels[slot.level].occupied &^= 1 << uint(slot.number%wheelSlots)
+
+		if slot.level > 0 {
+			// Move the tasks down a level
+			for _, entry := range entries {
+				w.place(entry)
+			}
+			continue
+		}
+
+		// Due unless later in the current tick
+		for _, entry := range entries {
+			if entry.eta.After(now) {
+				slot.add(entry)
+				w.levels[0].occupied |= 1 << uint(slot.number%wheelSlots)
+				continue
+			}
+			entry.slot = nil
+			entry.index = -1
+			w.count--
+			due = append(due, entry)
+		}
+		if len(slot.entries) > 0 {
+			break
+		}
+	}
+
+	if nowTick > w.current {
+		w.current = nowTick
+		w.refill()
+	}
+
+	return due
+}
+
+// refill moves the tasks of the overflow that the top level now spans into it
+func (w *timingWheel) refill() {
+	top := wheelLevels - 1
+	for w.overflow.Len() > 0 {
+		number := wheelTicks(w.overflow[0].eta) / wheelSpan(top)
+		if number-w.current/wheelSpan(top) >= wheelSlots {
+			return
+		}
+		w.place(heap.Pop(&w.overflow).(*taskHeapEntry))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimingWheelMatchesHeap(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	wheel := newTimingWheel(start)
+	heapSchedule := newHeapSchedule(start)
+
+	random := rand.New(rand.NewSource(1))
+	spreads := []time.Duration{time.Millisecond, time.Second, time.Hour, 30 * 24 * time.Hour, 3 * 365 * 24 * time.Hour}
+
+	var wheelEntries, heapEntries []*taskHeapEntry
+	for i := 0; i < 5000; i++ {
+		spread := spreads[random.Intn(len(spreads))]
+		eta := start.Add(time.Duration(random.Int63n(int64(spread))) - time.Millisecond)
+		wheelEntries = append(wheelEntries, &taskHeapEntry{eta: eta, seq: uint64(i)})
+		heapEntries = append(heapEntries, &taskHeapEntry{eta: eta, seq: uint64(i)})
+		wheel.push(wheelEntries[i])
+		heapSchedule.push(heapEntries[i])
+	}
+
+	for i := 0; i < 500; i++ {
+		n := random.Intn(len(wheelEntries))
+		assert.Equal(t, heapSchedule.remove(heapEntries[n]), wheel.remove(wheelEntries[n]))
+	}
+	require.Equal(t, heapSchedule.Len(), wheel.Len())
+
+	now := start
+	for wheel.Len() > 0 {
+		next, ok := wheel.next()
+		require.True(t, ok)
+		heapNext, _ := heapSchedule.next()
+		assert.False(t, next.After(heapNext), "Wakes up by the earliest task")
+
+		// Either to the next wake up or a random step
+		if random.Intn(2) == 0 && next.After(now) {
+			now = next
+		} else {
+			now = now.Add(time.Duration(random.Int63n(int64(spreads[random.Intn(len(spreads)-1)]))))
+		}
+
+		assert.Equal(t, seqs(heapSchedule.popDue(now)), seqs(wheel.popDue(now)), "Due by %v", now)
+		require.Equal(t, heapSchedule.Len(), wheel.Len())
+	}
+
+	_, ok := wheel.next()
+	assert.False(t, ok)
+}
+
+func TestTimingWheelKeepsTasksLaterInTheTick(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	wheel := newTimingWheel(start)
+	early := &taskHeapEntry{eta: start.Add(100 * time.Microsecond)}
+	late := &taskHeapEntry{eta: start.Add(900 * time.Microsecond)}
+	wheel.push(late)
+	wheel.push(early)
+
+	next, _ := wheel.next()
+	assert.Equal(t, early.eta, next)
+	assert.Equal(t, []*taskHeapEntry{early}, wheel.popDue(start.Add(500*time.Microsecond)))
+
+	next, _ = wheel.next()
+	assert.Equal(t, late.eta, next)
+	assert.True(t, wheel.remove(late))
+	assert.False(t, wheel.remove(late))
+	assert.Equal(t, 0, wheel.Len())
+}
+
+func seqs(entries []*taskHeapEntry) []uint64 {
+	var seqs []uint64
+	for _, entry := range entries {
+		seqs = append(seqs, entry.seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs
+}
+
+func BenchmarkSchedule(b *testing.B) {
+	for name, newSchedule := range taskSchedules {
+		b.Run(name, func(b *testing.B) {
+			benchmarkSchedule(b, newSchedule)
+		})
+	}
+}
+
+// benchmarkSchedule schedules tasks on top of a million pending ones spread
+// over 30 days, deleting as many, and takes those that become due over time
+func benchmarkSchedule(b *testing.B, newSchedule func(now time.Time) taskSchedule) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	random := rand.New(rand.NewSource(1))
+	spread := int64(30 * 24 * time.Hour)
+	schedule := newSchedule(start)
+	pending := make([]*taskHeapEntry, 1000000)
+	for i := range pending {
+		pending[i] = &taskHeapEntry{eta: start.Add(time.Duration(random.Int63n(spread)))}
+		schedule.push(pending[i])
+	}
+
+	b.ResetTimer()
+	now := start
+	for i := 0; i < b.N; i++ {
+		entry := &taskHeapEntry{eta: now.Add(time.Duration(random.Int63n(spread)))}
+		schedule.push(entry)
+
+		n := random.Intn(len(pending))
+		schedule.remove(pending[n])
+		pending[n] = entry
+
+		if i%1000 == 0 {
+			now = now.Add(time.Second)
+			schedule.popDue(now)
+		}
+	}
+}
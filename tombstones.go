@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultTaskDedupLimit bounds the names of removed tasks remembered for the
+// dedup window, so that memory stays bounded under sustained load
+const defaultTaskDedupLimit = 100000
+
+// taskTombstones remembers when tasks got removed, so that their names aren't
+// reused within the dedup window. The tombstones are kept in removal order, so
+// the expired ones are dropped as new ones come in, along with the oldest ones
+// beyond the limit. Not safe for concurrent use.
+type taskTombstones struct {
+	removed map[string]time.Time
+
+	order []taskTombstone
+
+	// The start of the order, the tombstones before it are dropped
+	head int
+}
+
+type taskTombstone struct {
+	name string
+
+	removed time.Time
+}
+
+func newTaskTombstones() *taskTombstones {
+	return &taskTombstones{removed: make(map[string]time.Time)}
+}
+
+// add records the removal of the task, dropping the expired tombstones
+func (t *taskTombstones) add(taskName string, now time.Time) {
+	t.removed[taskName] = now
+	t.order = append(t.order, taskTombstone{name: taskName, removed: now})
+
+	window := taskDedupWindow()
+	limit := taskDedupLimit()
+	for t.head < len(t.order) {
+		oldest := t.order[t.head]
+		if now.Sub(oldest.removed) < window && (limit <= 0 || len(t.order)-t.head <= limit) {
+			break
+		}
+		// Unless the name got removed again since
+		if t.removed[oldest.name].Equal(oldest.removed) {
+			delete(t.removed, oldest.name)
+		}
+		t.order[t.head] = taskTombstone{}
+		t.head++
+	}
+
+	// Reclaim the dropped part of the order once it makes up most of it
+	if t.head > 1024 && t.head > len(t.order)/2 {
+		t.order = append([]taskTombstone(nil), t.order[t.head:]...)
+		t.head = 0
+	}
+}
+
+// isRecent tells whether the task got removed within the dedup window
+func (t *taskTombstones) isRecent(taskName string, now time.Time) bool {
+	removed, ok := t.removed[taskName]
+
+	return ok && now.Sub(removed) < taskDedupWindow()
+}
+
+// has tells whether a tombstone of the task is kept, expired or not
+func (t *taskTombstones) has(taskName string) bool {
+	_, ok := t.removed[taskName]
+
+	return ok
+}
+
+// Len returns the number of tombstones kept
+func (t *taskTombstones) Len() int {
+	return len(t.removed)
+}
+
+// taskDedupLimit returns how many names of removed tasks are remembered at
+// most, 100000 unless set with the TASK_DEDUP_LIMIT env variable (0 for no
+// limit). Names dropped for the limit can be reused within the dedup window.
+func taskDedupLimit() int {
+	limit, err := strconv.Atoi(os.Getenv("TASK_DEDUP_LIMIT"))
+	if err != nil || limit < 0 {
+		return defaultTaskDedupLimit
+	}
+
+	return limit
+}
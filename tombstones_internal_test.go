@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func TestTaskTombstonesExpire(t *testing.T) {
+	os.Setenv("TASK_DEDUP_WINDOW", "1m")
+	defer os.Unsetenv("TASK_DEDUP_WINDOW")
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tombstones := newTaskTombstones()
+
+	tombstones.add("first", start)
+	tombstones.add("second", start.Add(30*time.Second))
+	assert.True(t, tombstones.isRecent("first", start.Add(59*time.Second)))
+	assert.False(t, tombstones.isRecent("first", start.Add(time.Minute)))
+
+	// Removed again, so its first tombstone expiring doesn't drop it
+	tombstones.add("second", start.Add(50*time.Second))
+	tombstones.add("third", start.Add(100*time.Second))
+	assert.Equal(t, 2, tombstones.Len())
+	assert.False(t, tombstones.has("first"))
+	assert.True(t, tombstones.isRecent("second", start.Add(100*time.Second)))
+	assert.True(t, tombstones.isRecent("third", start.Add(100*time.Second)))
+}
+
+func TestTaskTombstonesLimit(t *testing.T) {
+	os.Setenv("TASK_DEDUP_LIMIT", "1000")
+	defer os.Unsetenv("TASK_DEDUP_LIMIT")
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tombstones := newTaskTombstones()
+	for i := 0; i < 10000; i++ {
+		tombstones.add(fmt.Sprintf("task-%d", i), start.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	assert.Equal(t, 1000, tombstones.Len())
+	assert.True(t, len(tombstones.order) <= 3000, "The dropped tombstones are reclaimed")
+	assert.False(t, tombstones.has("task-8999"))
+	assert.True(t, tombstones.has("task-9000"))
+}
+
+func TestCompletedTasksAreForgotten(t *testing.T) {
+	os.Setenv("TASK_DEDUP_WINDOW", "0")
+	defer os.Unsetenv("TASK_DEDUP_WINDOW")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	server := NewServer()
+	defer server.Reset()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+	_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: "projects/bluebook/locations/us-east1",
+		Queue:  &taskspb.Queue{Name: queueName},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: srv.URL},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	forgotten := func() bool {
+		server.tsMux.Lock()
+		defer server.tsMux.Unlock()
+		return server.ts.len() == 0 && server.tombstones.Len() <= 1
+	}
+	assert.Eventually(t, forgotten, 5*time.Second, 10*time.Millisecond)
+}
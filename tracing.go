@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The span kinds and status codes of OTLP
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+// spanContext identifies a span across processes, as in the W3C traceparent
+// header. A trace ID without a span ID stands for a trace without a root span.
+type spanContext struct {
+	traceID [16]byte
+
+	spanID [8]byte
+
+	sampled bool
+}
+
+func (sc spanContext) isValid() bool {
+	return sc.traceID != [16]byte{}
+}
+
+// traceparent formats the span context as a W3C traceparent header
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header, false if invalid
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	sc.sampled = flags[0]&1 == 1
+	if !sc.isValid() || sc.spanID == [8]byte{} {
+		return spanContext{}, false
+	}
+
+	return sc, true
+}
+
+// newTraceContext starts a new trace, without a root span
+func newTraceContext() spanContext {
+	var sc spanContext
+	rand.Read(sc.traceID[:])
+	sc.sampled = true
+
+	return sc
+}
+
+// span is an OpenTelemetry span, exported to the collector when it ends
+type span struct {
+	name string
+
+	kind int
+
+	context spanContext
+
+	parentSpanID [8]byte
+
+	start time.Time
+
+	attributes map[string]interface{}
+
+	// Set if the operation failed
+	errorMessage string
+
+	failed bool
+}
+
+// tracesEndpoint returns where spans are exported to with OTLP over HTTP, set
+// with OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT for
+// its /v1/traces. Tracing is disabled if neither is set.
+func tracesEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+
+	return ""
+}
+
+// startSpan starts a span as a child of the parent if valid, nil if tracing is
+// disabled. The methods of a nil span do nothing.
+func startSpan(name string, kind int, parent spanContext) *span {
+	if tracesEndpoint() == "" {
+		return nil
+	}
+
+	s := &span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if parent.isValid() {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.parentSpanID = parent.spanID
+	} else {
+		s.context = newTraceContext()
+	}
+	rand.Read(s.context.spanID[:])
+
+	return s
+}
+
+// setAttribute sets a string or int attribute
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.attributes[key] = value
+}
+
+func (s *span) setError(message string) {
+	if s == nil {
+		return
+	}
+
+	s.failed = true
+	s.errorMessage = message
+}
+
+// end exports the span unless its trace isn't sampled
+func (s *span) end() {
+	if s == nil || !s.context.sampled {
+		return
+	}
+
+	go exportSpan(tracesEndpoint(), s.otlp(time.Now()))
+}
+
+// otlp formats the span in the OTLP JSON encoding
+func (s *span) otlp(end time.Time) map[string]interface{} {
+	attributes := make([]map[string]interface{}, 0, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes = append(attributes, otlpAttribute(key, value))
+	}
+
+	otlpSpan := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.context.traceID[:]),
+		"spanId":            hex.EncodeToString(s.context.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        attributes,
+	}
+	if s.parentSpanID != [8]byte{} {
+		otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentSpanID[:])
+	}
+	if s.failed {
+		otlpSpan["status"] = map[string]interface{}{"code": spanStatusError, "message": s.errorMessage}
+	}
+
+	return otlpSpan
+}
+
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var otlpValue map[string]interface{}
+	switch v := value.(type) {
+	case int:
+		// 64 bit integers are strings in JSON
+		otlpValue = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	default:
+		otlpValue = map[string]interface{}{"stringValue": v}
+	}
+
+	return map[string]interface{}{"key": key, "value": otlpValue}
+}
+
+// serviceName returns the service name of the spans, set with OTEL_SERVICE_NAME
+func serviceName() string {
+	return envOrDefault("OTEL_SERVICE_NAME", "cloud-tasks-emulator")
+}
+
+// exportSpan posts the span to the collector
+func exportSpan(endpoint string, otlpSpan map[string]interface{}) {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpAttribute("service.name", serviceName())},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "cloud-tasks-emulator"},
+				"spans": []interface{}{otlpSpan},
+			}},
+		}},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		logError("Failed to export span", field("span", otlpSpan["name"]), field("error", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := outboundClient.Do(req.WithContext(ctx))
+	if err != nil {
+		logError("Failed to export span", field("span", otlpSpan["name"]), field("error", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logError("Failed to export span", field("span", otlpSpan["name"]), field("statusCode", resp.StatusCode))
+	}
+}
+
+type spanContextKey struct{}
+
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, s.context)
+}
+
+// spanContextFrom returns the context of the span in progress, the zero one if none
+func spanContextFrom(ctx context.Context) spanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(spanContext)
+
+	return sc
+}
+
+// traceUnaryRPC traces the RPCs, continuing the trace of the traceparent in
+// the request metadata if any
+func traceUnaryRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var parent spanContext
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("traceparent"); len(values) > 0 {
+			parent, _ = parseTraceparent(values[0])
+		}
+	}
+
+	s := startSpan(strings.TrimPrefix(info.FullMethod, "/"), spanKindServer, parent)
+	defer s.end()
+	s.setAttribute("rpc.system", "grpc")
+
+	resp, err := handler(contextWithSpan(ctx, s), req)
+	code := status.Code(err)
+	s.setAttribute("rpc.grpc.status_code", int(code))
+	if err != nil {
+		s.setError(status.Convert(err).Message())
+	}
+
+	return resp, err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.True(t, sc.sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.traceparent())
+
+	sc, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	require.True(t, ok)
+	assert.False(t, sc.sampled)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	os.Unsetenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+
+	s := startSpan("disabled", spanKindServer, spanContext{})
+	assert.Nil(t, s)
+	s.setAttribute("key", "value")
+	s.setError("failed")
+	s.end()
+	assert.False(t, spanContextFrom(contextWithSpan(context.Background(), s)).isValid())
+}
+
+func TestTracesFromRPCToHandler(t *testing.T) {
+	type otlpSpan struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Kind         int    `json:"kind"`
+	}
+	spans := make(chan otlpSpan, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var export struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(req.Body).Decode(&export)
+		for _, resourceSpans := range export.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, s := range scopeSpans.Spans {
+					spans <- s
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	traceparents := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparents <- req.Header.Get("traceparent")
+	}))
+	defer target.Close()
+
+	ctx := context.Background()
+	emulator, err := StartInProcess(ctx)
+	require.NoError(t, err)
+	defer emulator.Close()
+
+	queueName := "projects/bluebook/locations/us-east1/queues/traced"
+	_, err = emulator.CreateQueue(ctx, queueName)
+	require.NoError(t, err)
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, err = emulator.Client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: target.URL},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	var traceparent string
+	select {
+	case traceparent = <-traceparents:
+	case <-time.After(time.Second):
+		require.Fail(t, "Task was not dispatched")
+	}
+	handlerParent, ok := parseTraceparent(traceparent)
+	require.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", handlerParent.traceparent()[3:35])
+
+	byName := make(map[string]otlpSpan)
+	for len(byName) < 2 {
+		select {
+		case s := <-spans:
+			byName[s.Name] = s
+		case <-time.After(time.Second):
+			require.Fail(t, "Spans were not exported", "%v", byName)
+		}
+	}
+
+	rpc := byName["google.cloud.tasks.v2.CloudTasks/CreateTask"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rpc.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", rpc.ParentSpanID)
+	assert.Equal(t, spanKindServer, rpc.Kind)
+
+	dispatch := byName["dispatch"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", dispatch.TraceID)
+	assert.Equal(t, rpc.SpanID, dispatch.ParentSpanID)
+	assert.Equal(t, spanKindClient, dispatch.Kind)
+	// The handler continues from the dispatch
+	assert.Equal(t, dispatch.SpanID, handlerParent.traceparent()[36:52])
+}
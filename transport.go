@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// outboundClient is shared by all queues and dispatches so that every task
+// request is routed the same way and connections are reused. Timeouts are
+// applied per request.
+var outboundClient = &http.Client{
+	Transport:     newOutboundRoundTripper(),
+	CheckRedirect: noRedirects,
+}
+
+// noRedirects makes the client return redirects as the response, as Cloud Tasks
+// doesn't follow them but treats them as a failed attempt
+func noRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// newOutboundRoundTripper creates the round tripper for dispatched requests.
+// HTTP/2 is negotiated over TLS, and with OUTBOUND_H2C=true plain http
+// requests use HTTP/2 with prior knowledge (h2c) too.
+func newOutboundRoundTripper() http.RoundTripper {
+	transport := newOutboundTransport()
+
+	if h2c, _ := strconv.ParseBool(os.Getenv("OUTBOUND_H2C")); h2c {
+		return &h2cRoundTripper{
+			h2c:      newH2CTransport(),
+			fallback: transport,
+		}
+	}
+
+	return transport
+}
+
+// newOutboundTransport creates the transport for dispatched requests, with the
+// connection pool configurable with the OUTBOUND_MAX_IDLE_CONNS,
+// OUTBOUND_MAX_IDLE_CONNS_PER_HOST and OUTBOUND_IDLE_CONN_TIMEOUT (in seconds) env variables
+func newOutboundTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: outboundProxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          envInt("OUTBOUND_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:   envInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", 100),
+		IdleConnTimeout:       time.Duration(envInt("OUTBOUND_IDLE_CONN_TIMEOUT", 90)) * time.Second,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// newH2CTransport creates a transport speaking HTTP/2 over plain TCP. Note that
+// proxies are not supported for these requests.
+func newH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, 30*time.Second)
+		},
+	}
+}
+
+// h2cRoundTripper sends plain http requests with h2c, and others (https) with
+// the fallback, which negotiates the protocol
+type h2cRoundTripper struct {
+	h2c http.RoundTripper
+
+	fallback http.RoundTripper
+}
+
+func (rt *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return rt.h2c.RoundTrip(req)
+	}
+
+	return rt.fallback.RoundTrip(req)
+}
+
+// outboundProxy resolves the proxy to use for a dispatched request. An explicit
+// OUTBOUND_PROXY_URL takes precedence over HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	if proxyURL := os.Getenv("OUTBOUND_PROXY_URL"); proxyURL != "" {
+		return url.Parse(proxyURL)
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.ParseInt(os.Getenv(name), 10, 32)
+	if err == nil && value != 0 {
+		return int(value)
+	}
+
+	return defaultValue
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	pduration "github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+func protoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+}
+
+func assertRoundTripProto(t *testing.T, rt http.RoundTripper, url string, expectedProto string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedProto, resp.Proto, "Protocol used by client")
+	assert.Equal(t, expectedProto, string(body), "Protocol seen by server")
+}
+
+func TestOutboundTransportNegotiatesHTTP2OverTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(protoHandler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	transport := newOutboundTransport()
+	transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	assertRoundTripProto(t, transport, srv.URL, "HTTP/2.0")
+}
+
+func TestOutboundTransportFallsBackToHTTP1OverTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(protoHandler())
+	defer srv.Close()
+
+	transport := newOutboundTransport()
+	transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	assertRoundTripProto(t, transport, srv.URL, "HTTP/1.1")
+}
+
+func TestOutboundRoundTripperH2C(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(protoHandler(), &http2.Server{}))
+	defer srv.Close()
+
+	defer os.Unsetenv("OUTBOUND_H2C")
+
+	assertRoundTripProto(t, newOutboundRoundTripper(), srv.URL, "HTTP/1.1")
+
+	os.Setenv("OUTBOUND_H2C", "true")
+
+	assertRoundTripProto(t, newOutboundRoundTripper(), srv.URL, "HTTP/2.0")
+}
+
+func BenchmarkDispatchReusesConnections(b *testing.B) {
+	var connections int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	taskState := &taskspb.Task{
+		Name:             "projects/bluebook/locations/us-east1/queues/agentq/tasks/my-task",
+		DispatchDeadline: &pduration.Duration{Seconds: 10},
+		MessageType: &taskspb.Task_HttpRequest{
+			HttpRequest: &taskspb.HttpRequest{
+				Url:        srv.URL,
+				HttpMethod: taskspb.HttpMethod_POST,
+				Headers:    make(map[string]string),
+			},
+		},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if statusCode, _, _ := dispatch(context.Background(), realClock{}, false, taskState, attemptHistory{}, nil, nil); statusCode != http.StatusOK {
+			b.Fatalf("Unexpected status code %d", statusCode)
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&connections)), "connections")
+	if connections > 1 {
+		b.Errorf("Expected a single reused connection, got %d", connections)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+)
+
+// serveDashboard serves the web UI, a single page that follows the admin API and
+// acts on the queues and tasks through the REST API
+func serveDashboard(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Cloud Tasks Emulator</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #202124; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #dadce0; font-size: 0.9em; }
+th { background: #f1f3f4; }
+tr.selected { background: #e8f0fe; }
+a { color: #1a73e8; cursor: pointer; }
+button { margin-right: 0.3em; }
+.failed { color: #d93025; }
+.dispatching { color: #188038; }
+#error { color: #d93025; }
+</style>
+</head>
+<body>
+<h1>Cloud Tasks Emulator</h1>
+<p id="error"></p>
+<table>
+<thead><tr>
+<th>Queue</th><th>State</th><th>Max dispatches/s</th><th>Max concurrent</th><th>Max burst</th>
+<th>Pending</th><th>Dispatching</th><th>Completed</th><th></th>
+</tr></thead>
+<tbody id="queues"></tbody>
+</table>
+<div id="tasks-section" hidden>
+<h2 id="tasks-title"></h2>
+<table>
+<thead><tr>
+<th>Task</th><th>Schedule time</th><th>Status</th><th>Dispatches</th><th>Responses</th><th></th>
+</tr></thead>
+<tbody id="tasks"></tbody>
+</table>
+</div>
+<script>
+var selectedQueue = null;
+
+function escapeHTML(value) {
+  return String(value).replace(/[&<>"']/g, function (c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+  });
+}
+
+function shortName(name) {
+  return name.substring(name.lastIndexOf("/") + 1);
+}
+
+function request(method, path) {
+  return fetch(path, {method: method}).then(function (resp) {
+    return resp.json().then(function (body) {
+      if (!resp.ok) {
+        throw new Error(body.error ? body.error.message : resp.statusText);
+      }
+      return body;
+    });
+  });
+}
+
+function act(method, path) {
+  request(method, path).then(refresh, showError);
+}
+
+function showError(err) {
+  document.getElementById("error").textContent = err.message;
+}
+
+function taskStatus(task) {
+  if (task.dispatching) {
+    return '<span class="dispatching">dispatching</span>';
+  }
+  if (task.lastStatusCode === -1) {
+    return '<span class="failed">retrying, no response</span>';
+  }
+  if (task.lastStatusCode) {
+    return '<span class="failed">retrying, last ' + task.lastStatusCode + '</span>';
+  }
+  return "pending";
+}
+
+function renderQueues(queues, rateLimits) {
+  document.getElementById("queues").innerHTML = queues.map(function (queue, i) {
+    var limits = rateLimits[i] || {};
+    var name = escapeHTML(queue.name);
+    var toggle = queue.state === "PAUSED"
+      ? '<button data-method="POST" data-path="/v2/' + name + ':resume">Resume</button>'
+      : '<button data-method="POST" data-path="/v2/' + name + ':pause">Pause</button>';
+    return '<tr' + (queue.name === selectedQueue ? ' class="selected"' : '') + '>' +
+      '<td><a data-queue="' + name + '">' + name + '</a></td>' +
+      '<td>' + escapeHTML(queue.state) + '</td>' +
+      '<td>' + escapeHTML(limits.maxDispatchesPerSecond || "") + '</td>' +
+      '<td>' + escapeHTML(limits.maxConcurrentDispatches || "") + '</td>' +
+      '<td>' + escapeHTML(limits.maxBurstSize || "") + '</td>' +
+      '<td>' + queue.pendingTasks + '</td>' +
+      '<td>' + queue.inFlightDispatches + '</td>' +
+      '<td>' + queue.completedTasks + '</td>' +
+      '<td>' + toggle + '<button data-method="POST" data-path="/v2/' + name + ':purge" data-confirm="Purge all tasks of ' + name + '?">Purge</button></td>' +
+      '</tr>';
+  }).join("");
+}
+
+function renderTasks(tasks) {
+  document.getElementById("tasks-section").hidden = false;
+  document.getElementById("tasks-title").textContent = "Tasks of " + shortName(selectedQueue);
+  document.getElementById("tasks").innerHTML = tasks.map(function (task) {
+    var name = escapeHTML(task.name);
+    return '<tr>' +
+      '<td title="' + name + '">' + escapeHTML(shortName(task.name)) + '</td>' +
+      '<td>' + escapeHTML(new Date(task.scheduleTime).toLocaleString()) + '</td>' +
+      '<td>' + taskStatus(task) + '</td>' +
+      '<td>' + task.dispatchCount + '</td>' +
+      '<td>' + task.responseCount + '</td>' +
+      '<td><button data-method="POST" data-path="/v2/' + name + ':run">Run</button>' +
+      '<button data-method="DELETE" data-path="/v2/' + name + '">Delete</button></td>' +
+      '</tr>';
+  }).join("");
+}
+
+function refresh() {
+  request("GET", "/admin/queues").then(function (body) {
+    var queues = body.queues;
+    if (selectedQueue && !queues.some(function (queue) { return queue.name === selectedQueue; })) {
+      selectedQueue = null;
+      document.getElementById("tasks-section").hidden = true;
+    }
+    return Promise.all(queues.map(function (queue) {
+      return request("GET", "/v2/" + queue.name).then(function (state) {
+        return state.rateLimits;
+      }, function () {
+        return {};
+      });
+    })).then(function (rateLimits) {
+      renderQueues(queues, rateLimits);
+      if (selectedQueue) {
+        return request("GET", "/admin/" + selectedQueue + "/tasks").then(function (body) {
+          renderTasks(body.tasks);
+        });
+      }
+    });
+  }).then(function () {
+    document.getElementById("error").textContent = "";
+  }, showError);
+}
+
+document.addEventListener("click", function (event) {
+  var target = event.target;
+  if (target.dataset.queue) {
+    selectedQueue = target.dataset.queue;
+    refresh();
+  } else if (target.dataset.path) {
+    if (!target.dataset.confirm || confirm(target.dataset.confirm)) {
+      act(target.dataset.method, target.dataset.path);
+    }
+  }
+});
+
+// Refreshes once the events of a burst settle, polling as well in case the
+// stream drops events
+var pendingRefresh = null;
+new EventSource("/admin/events").onmessage = function () {
+  if (!pendingRefresh) {
+    pendingRefresh = setTimeout(function () {
+      pendingRefresh = null;
+      refresh();
+    }, 200);
+  }
+};
+
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
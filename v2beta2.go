@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	beta2 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta2"
+	v1 "google.golang.org/genproto/googleapis/iam/v1"
+	"google.golang.org/genproto/protobuf/field_mask"
+)
+
+// V2beta2Server serves the v2beta2 API on top of the v2 one, sharing its queues
+// and tasks. Unlike v2beta3, its messages are laid out differently from v2, so
+// they are converted field by field. Queues created with a pull target are pull
+// queues, whose tasks carry a pull message and are leased (see pull.go).
+type V2beta2Server struct {
+	s *Server
+}
+
+// NewV2beta2Server creates the v2beta2 API for the emulator server
+func NewV2beta2Server(s *Server) *V2beta2Server {
+	return &V2beta2Server{s: s}
+}
+
+func appEngineRoutingFromBeta2(routing *beta2.AppEngineRouting) *tasks.AppEngineRouting {
+	if routing == nil {
+		return nil
+	}
+
+	return &tasks.AppEngineRouting{
+		Service:  routing.GetService(),
+		Version:  routing.GetVersion(),
+		Instance: routing.GetInstance(),
+		Host:     routing.GetHost(),
+	}
+}
+
+func appEngineRoutingToBeta2(routing *tasks.AppEngineRouting) *beta2.AppEngineRouting {
+	if routing == nil {
+		return nil
+	}
+
+	return &beta2.AppEngineRouting{
+		Service:  routing.GetService(),
+		Version:  routing.GetVersion(),
+		Instance: routing.GetInstance(),
+		Host:     routing.GetHost(),
+	}
+}
+
+// queueFromBeta2 converts a v2beta2 queue, telling whether it has a pull target
+func queueFromBeta2(queue *beta2.Queue) (*tasks.Queue, bool) {
+	if queue == nil {
+		return nil, false
+	}
+
+	converted := &tasks.Queue{
+		Name:                     queue.GetName(),
+		AppEngineRoutingOverride: appEngineRoutingFromBeta2(queue.GetAppEngineHttpTarget().GetAppEngineRoutingOverride()),
+		State:                    tasks.Queue_State(queue.GetState()),
+		PurgeTime:                queue.GetPurgeTime(),
+	}
+	if rateLimits := queue.GetRateLimits(); rateLimits != nil {
+		converted.RateLimits = &tasks.RateLimits{
+			MaxDispatchesPerSecond:  rateLimits.GetMaxTasksDispatchedPerSecond(),
+			MaxBurstSize:            rateLimits.GetMaxBurstSize(),
+			MaxConcurrentDispatches: rateLimits.GetMaxConcurrentTasks(),
+		}
+	}
+	if retryConfig := queue.GetRetryConfig(); retryConfig != nil {
+		converted.RetryConfig = &tasks.RetryConfig{
+			MaxAttempts:      retryConfig.GetMaxAttempts(),
+			MaxRetryDuration: retryConfig.GetMaxRetryDuration(),
+			MinBackoff:       retryConfig.GetMinBackoff(),
+			MaxBackoff:       retryConfig.GetMaxBackoff(),
+			MaxDoublings:     retryConfig.GetMaxDoublings(),
+		}
+		if retryConfig.GetUnlimitedAttempts() {
+			converted.RetryConfig.MaxAttempts = -1
+		}
+	}
+
+	return converted, queue.GetPullTarget() != nil
+}
+
+// queueToBeta2 converts a v2 queue to v2beta2, see queueFromBeta2
+func queueToBeta2(queue *tasks.Queue, pull bool) *beta2.Queue {
+	converted := &beta2.Queue{
+		Name:      queue.GetName(),
+		State:     beta2.Queue_State(queue.GetState()),
+		PurgeTime: queue.GetPurgeTime(),
+		RateLimits: &beta2.RateLimits{
+			MaxTasksDispatchedPerSecond: queue.GetRateLimits().GetMaxDispatchesPerSecond(),
+			MaxBurstSize:                queue.GetRateLimits().GetMaxBurstSize(),
+			MaxConcurrentTasks:          queue.GetRateLimits().GetMaxConcurrentDispatches(),
+		},
+		RetryConfig: &beta2.RetryConfig{
+			MaxRetryDuration: queue.GetRetryConfig().GetMaxRetryDuration(),
+			MinBackoff:       queue.GetRetryConfig().GetMinBackoff(),
+			MaxBackoff:       queue.GetRetryConfig().GetMaxBackoff(),
+			MaxDoublings:     queue.GetRetryConfig().GetMaxDoublings(),
+		},
+	}
+	if maxAttempts := queue.GetRetryConfig().GetMaxAttempts(); maxAttempts < 0 {
+		converted.RetryConfig.NumAttempts = &beta2.RetryConfig_UnlimitedAttempts{UnlimitedAttempts: true}
+	} else {
+		converted.RetryConfig.NumAttempts = &beta2.RetryConfig_MaxAttempts{MaxAttempts: maxAttempts}
+	}
+	if pull {
+		converted.TargetType = &beta2.Queue_PullTarget{PullTarget: &beta2.PullTarget{}}
+	} else {
+		converted.TargetType = &beta2.Queue_AppEngineHttpTarget{
+			AppEngineHttpTarget: &beta2.AppEngineHttpTarget{
+				AppEngineRoutingOverride: appEngineRoutingToBeta2(queue.GetAppEngineRoutingOverride()),
+			},
+		}
+	}
+
+	return converted
+}
+
+func taskFromBeta2(task *beta2.Task) *tasks.Task {
+	if task == nil {
+		return nil
+	}
+
+	converted := &tasks.Task{
+		Name:         task.GetName(),
+		ScheduleTime: task.GetScheduleTime(),
+	}
+	if request := task.GetAppEngineHttpRequest(); request != nil {
+		converted.MessageType = &tasks.Task_AppEngineHttpRequest{
+			AppEngineHttpRequest: &tasks.AppEngineHttpRequest{
+				HttpMethod:       tasks.HttpMethod(request.GetHttpMethod()),
+				AppEngineRouting: appEngineRoutingFromBeta2(request.GetAppEngineRouting()),
+				RelativeUri:      request.GetRelativeUrl(),
+				Headers:          request.GetHeaders(),
+				Body:             request.GetPayload(),
+			},
+		}
+	}
+	if message := task.GetPullMessage(); message != nil {
+		setPullMessage(converted, &PullMessage{Payload: message.GetPayload(), Tag: message.GetTag()})
+	}
+
+	return converted
+}
+
+func taskToBeta2(task *tasks.Task) *beta2.Task {
+	converted := &beta2.Task{
+		Name:         task.GetName(),
+		ScheduleTime: task.GetScheduleTime(),
+		CreateTime:   task.GetCreateTime(),
+		View:         beta2.Task_View(task.GetView()),
+		Status: &beta2.TaskStatus{
+			AttemptDispatchCount: task.GetDispatchCount(),
+			AttemptResponseCount: task.GetResponseCount(),
+			FirstAttemptStatus:   attemptToBeta2(task.GetFirstAttempt()),
+			LastAttemptStatus:    attemptToBeta2(task.GetLastAttempt()),
+		},
+	}
+	if request := task.GetAppEngineHttpRequest(); request != nil {
+		converted.PayloadType = &beta2.Task_AppEngineHttpRequest{
+			AppEngineHttpRequest: &beta2.AppEngineHttpRequest{
+				HttpMethod:       beta2.HttpMethod(request.GetHttpMethod()),
+				AppEngineRouting: appEngineRoutingToBeta2(request.GetAppEngineRouting()),
+				RelativeUrl:      request.GetRelativeUri(),
+				Headers:          request.GetHeaders(),
+				Payload:          request.GetBody(),
+			},
+		}
+	}
+	if message := getPullMessage(task); message != nil {
+		converted.PayloadType = &beta2.Task_PullMessage{
+			PullMessage: &beta2.PullMessage{Payload: message.Payload, Tag: message.Tag},
+		}
+	}
+
+	return converted
+}
+
+func attemptToBeta2(attempt *tasks.Attempt) *beta2.AttemptStatus {
+	if attempt == nil {
+		return nil
+	}
+
+	return &beta2.AttemptStatus{
+		ScheduleTime:   attempt.GetScheduleTime(),
+		DispatchTime:   attempt.GetDispatchTime(),
+		ResponseTime:   attempt.GetResponseTime(),
+		ResponseStatus: attempt.GetResponseStatus(),
+	}
+}
+
+// updateMaskPathsFromBeta2 maps the v2beta2 paths of the queue fields that were
+// renamed in v2
+var updateMaskPathsFromBeta2 = map[string]string{
+	"rate_limits.max_tasks_dispatched_per_second": "rate_limits.max_dispatches_per_second",
+	"rate_limits.max_concurrent_tasks":            "rate_limits.max_concurrent_dispatches",
+	"retry_config.unlimited_attempts":             "retry_config.max_attempts",
+}
+
+// updateMaskFromBeta2 maps the v2beta2 paths of the queue fields onto the v2 ones
+func updateMaskFromBeta2(updateMask *field_mask.FieldMask) *field_mask.FieldMask {
+	if updateMask == nil {
+		return nil
+	}
+
+	converted := &field_mask.FieldMask{}
+	for _, path := range updateMask.GetPaths() {
+		path = strings.TrimPrefix(path, "app_engine_http_target.")
+		if renamed, ok := updateMaskPathsFromBeta2[path]; ok {
+			path = renamed
+		}
+		converted.Paths = append(converted.Paths, path)
+	}
+
+	return converted
+}
+
+// ListQueues lists the existing queues
+func (b *V2beta2Server) ListQueues(ctx context.Context, in *beta2.ListQueuesRequest) (*beta2.ListQueuesResponse, error) {
+	resp, err := b.s.ListQueues(ctx, &tasks.ListQueuesRequest{
+		Parent: in.GetParent(),
+		Filter: in.GetFilter(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	converted := &beta2.ListQueuesResponse{}
+	for _, queue := range resp.GetQueues() {
+		converted.Queues = append(converted.Queues, b.convertQueue(queue))
+	}
+
+	return converted, nil
+}
+
+// GetQueue returns the requested queue
+func (b *V2beta2Server) GetQueue(ctx context.Context, in *beta2.GetQueueRequest) (*beta2.Queue, error) {
+	return b.queueToBeta2(b.s.GetQueue(ctx, &tasks.GetQueueRequest{Name: in.GetName()}))
+}
+
+// CreateQueue creates a new queue, a pull queue if it has a pull target
+func (b *V2beta2Server) CreateQueue(ctx context.Context, in *beta2.CreateQueueRequest) (*beta2.Queue, error) {
+	queue, pull := queueFromBeta2(in.GetQueue())
+
+	return b.queueToBeta2(b.s.createQueue(&tasks.CreateQueueRequest{Parent: in.GetParent(), Queue: queue}, pull))
+}
+
+// UpdateQueue updates an existing queue, see Server.UpdateQueue
+func (b *V2beta2Server) UpdateQueue(ctx context.Context, in *beta2.UpdateQueueRequest) (*beta2.Queue, error) {
+	queue, _ := queueFromBeta2(in.GetQueue())
+
+	return b.queueToBeta2(b.s.UpdateQueue(ctx, &tasks.UpdateQueueRequest{Queue: queue, UpdateMask: updateMaskFromBeta2(in.GetUpdateMask())}))
+}
+
+// DeleteQueue removes an existing queue
+func (b *V2beta2Server) DeleteQueue(ctx context.Context, in *beta2.DeleteQueueRequest) (*empty.Empty, error) {
+	return b.s.DeleteQueue(ctx, &tasks.DeleteQueueRequest{Name: in.GetName()})
+}
+
+// PurgeQueue purges the specified queue
+func (b *V2beta2Server) PurgeQueue(ctx context.Context, in *beta2.PurgeQueueRequest) (*beta2.Queue, error) {
+	return b.queueToBeta2(b.s.PurgeQueue(ctx, &tasks.PurgeQueueRequest{Name: in.GetName()}))
+}
+
+// PauseQueue pauses queue execution
+func (b *V2beta2Server) PauseQueue(ctx context.Context, in *beta2.PauseQueueRequest) (*beta2.Queue, error) {
+	return b.queueToBeta2(b.s.PauseQueue(ctx, &tasks.PauseQueueRequest{Name: in.GetName()}))
+}
+
+// ResumeQueue resumes a paused queue
+func (b *V2beta2Server) ResumeQueue(ctx context.Context, in *beta2.ResumeQueueRequest) (*beta2.Queue, error) {
+	return b.queueToBeta2(b.s.ResumeQueue(ctx, &tasks.ResumeQueueRequest{Name: in.GetName()}))
+}
+
+// GetIamPolicy doesn't do anything
+func (b *V2beta2Server) GetIamPolicy(ctx context.Context, in *v1.GetIamPolicyRequest) (*v1.Policy, error) {
+	return b.s.GetIamPolicy(ctx, in)
+}
+
+// SetIamPolicy doesn't do anything
+func (b *V2beta2Server) SetIamPolicy(ctx context.Context, in *v1.SetIamPolicyRequest) (*v1.Policy, error) {
+	return b.s.SetIamPolicy(ctx, in)
+}
+
+// TestIamPermissions doesn't do anything
+func (b *V2beta2Server) TestIamPermissions(ctx context.Context, in *v1.TestIamPermissionsRequest) (*v1.TestIamPermissionsResponse, error) {
+	return b.s.TestIamPermissions(ctx, in)
+}
+
+// ListTasks lists the tasks in the specified queue
+func (b *V2beta2Server) ListTasks(ctx context.Context, in *beta2.ListTasksRequest) (*beta2.ListTasksResponse, error) {
+	resp, err := b.s.ListTasks(ctx, &tasks.ListTasksRequest{
+		Parent:       in.GetParent(),
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+		PageSize:     in.GetPageSize(),
+		PageToken:    in.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &beta2.ListTasksResponse{Tasks: tasksToBeta2(resp.GetTasks()), NextPageToken: resp.GetNextPageToken()}, nil
+}
+
+// GetTask returns the specified task
+func (b *V2beta2Server) GetTask(ctx context.Context, in *beta2.GetTaskRequest) (*beta2.Task, error) {
+	return b.taskToBeta2(b.s.GetTask(ctx, &tasks.GetTaskRequest{
+		Name:         in.GetName(),
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+	}))
+}
+
+// CreateTask creates a new task, with a pull message in pull queues
+func (b *V2beta2Server) CreateTask(ctx context.Context, in *beta2.CreateTaskRequest) (*beta2.Task, error) {
+	return b.taskToBeta2(b.s.CreateTask(ctx, &tasks.CreateTaskRequest{
+		Parent:       in.GetParent(),
+		Task:         taskFromBeta2(in.GetTask()),
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+	}))
+}
+
+// DeleteTask removes an existing task
+func (b *V2beta2Server) DeleteTask(ctx context.Context, in *beta2.DeleteTaskRequest) (*empty.Empty, error) {
+	return b.s.DeleteTask(ctx, &tasks.DeleteTaskRequest{Name: in.GetName()})
+}
+
+// LeaseTasks leases tasks of a pull queue, see Server.LeaseTasks
+func (b *V2beta2Server) LeaseTasks(ctx context.Context, in *beta2.LeaseTasksRequest) (*beta2.LeaseTasksResponse, error) {
+	leaseDuration, err := ptypes.Duration(in.GetLeaseDuration())
+	if err != nil {
+		return nil, invalidArgument("lease_duration", "lease_duration is required.")
+	}
+
+	leased, err := b.s.LeaseTasks(ctx, in.GetParent(), int(in.GetMaxTasks()), leaseDuration, in.GetFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	return &beta2.LeaseTasksResponse{Tasks: tasksToBeta2(leased)}, nil
+}
+
+// AcknowledgeTask removes a leased task of a pull queue
+func (b *V2beta2Server) AcknowledgeTask(ctx context.Context, in *beta2.AcknowledgeTaskRequest) (*empty.Empty, error) {
+	if in.GetScheduleTime() == nil {
+		return nil, invalidArgument("schedule_time", "schedule_time is required.")
+	}
+
+	return b.s.AcknowledgeTask(ctx, in.GetName(), in.GetScheduleTime())
+}
+
+// RenewLease extends the lease of a task of a pull queue
+func (b *V2beta2Server) RenewLease(ctx context.Context, in *beta2.RenewLeaseRequest) (*beta2.Task, error) {
+	if in.GetScheduleTime() == nil {
+		return nil, invalidArgument("schedule_time", "schedule_time is required.")
+	}
+	leaseDuration, err := ptypes.Duration(in.GetLeaseDuration())
+	if err != nil {
+		return nil, invalidArgument("lease_duration", "lease_duration is required.")
+	}
+
+	return b.taskToBeta2(b.s.RenewLease(ctx, in.GetName(), in.GetScheduleTime(), leaseDuration))
+}
+
+// CancelLease ends the lease of a task of a pull queue
+func (b *V2beta2Server) CancelLease(ctx context.Context, in *beta2.CancelLeaseRequest) (*beta2.Task, error) {
+	if in.GetScheduleTime() == nil {
+		return nil, invalidArgument("schedule_time", "schedule_time is required.")
+	}
+
+	return b.taskToBeta2(b.s.CancelLease(ctx, in.GetName(), in.GetScheduleTime()))
+}
+
+// RunTask executes the task immediately
+func (b *V2beta2Server) RunTask(ctx context.Context, in *beta2.RunTaskRequest) (*beta2.Task, error) {
+	return b.taskToBeta2(b.s.RunTask(ctx, &tasks.RunTaskRequest{
+		Name:         in.GetName(),
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+	}))
+}
+
+func tasksToBeta2(taskStates []*tasks.Task) []*beta2.Task {
+	converted := []*beta2.Task{}
+	for _, task := range taskStates {
+		converted = append(converted, taskToBeta2(task))
+	}
+
+	return converted
+}
+
+// convertQueue converts a v2 queue, with a pull target if it's a pull queue
+func (b *V2beta2Server) convertQueue(queue *tasks.Queue) *beta2.Queue {
+	pullQueue, ok := b.s.fetchQueue(queue.GetName())
+
+	return queueToBeta2(queue, ok && pullQueue != nil && pullQueue.pull)
+}
+
+// queueToBeta2 converts the response of a v2 method returning a queue
+func (b *V2beta2Server) queueToBeta2(queue *tasks.Queue, err error) (*beta2.Queue, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return b.convertQueue(queue), nil
+}
+
+// taskToBeta2 converts the response of a v2 method returning a task
+func (b *V2beta2Server) taskToBeta2(task *tasks.Task, err error) (*beta2.Task, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return taskToBeta2(task), nil
+}
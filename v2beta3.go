@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/genproto/googleapis/api/httpbody"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	beta3 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	v1 "google.golang.org/genproto/googleapis/iam/v1"
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// V2beta3Server serves the v2beta3 API on top of the v2 one, sharing its queues
+// and tasks. The messages of both versions mostly differ in their field numbers
+// only, so they are converted through their JSON form.
+type V2beta3Server struct {
+	s *Server
+}
+
+// BufferTask is served as an unknown method of the service, see
+// V2beta3Server.HandleUnknownMethod
+const v2beta3BufferTaskMethod = "/google.cloud.tasks.v2beta3.CloudTasks/BufferTask"
+
+// BufferTaskRequest mirrors the v2beta3 message of the same name
+type BufferTaskRequest struct {
+	Queue  string             `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	TaskId string             `protobuf:"bytes,2,opt,name=task_id,json=taskId,proto3" json:"task_id,omitempty"`
+	Body   *httpbody.HttpBody `protobuf:"bytes,3,opt,name=body,proto3" json:"body,omitempty"`
+}
+
+// GetQueue returns the queue name, empty if the request isn't set
+func (m *BufferTaskRequest) GetQueue() string {
+	if m != nil {
+		return m.Queue
+	}
+	return ""
+}
+
+// GetTaskId returns the task ID, empty if the request isn't set
+func (m *BufferTaskRequest) GetTaskId() string {
+	if m != nil {
+		return m.TaskId
+	}
+	return ""
+}
+
+// GetBody returns the body, nil if the request isn't set
+func (m *BufferTaskRequest) GetBody() *httpbody.HttpBody {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+func (m *BufferTaskRequest) Reset()         { *m = BufferTaskRequest{} }
+func (m *BufferTaskRequest) String() string { return proto.CompactTextString(m) }
+func (*BufferTaskRequest) ProtoMessage()    {}
+
+// BufferTaskResponse mirrors the v2beta3 message of the same name
+type BufferTaskResponse struct {
+	Task *beta3.Task `protobuf:"bytes,1,opt,name=task,proto3" json:"task,omitempty"`
+}
+
+func (m *BufferTaskResponse) Reset()         { *m = BufferTaskResponse{} }
+func (m *BufferTaskResponse) String() string { return proto.CompactTextString(m) }
+func (*BufferTaskResponse) ProtoMessage()    {}
+
+// NewV2beta3Server creates the v2beta3 API for the emulator server
+func NewV2beta3Server(s *Server) *V2beta3Server {
+	return &V2beta3Server{s: s}
+}
+
+// convertMessage copies the message into another one with the same JSON form
+func convertMessage(from proto.Message, to proto.Message) error {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, from); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid message: %v", err)
+	}
+	if err := jsonpb.Unmarshal(&buf, to); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid message: %v", err)
+	}
+
+	return nil
+}
+
+// queueToV2 converts a v2beta3 queue. Unlike v2, v2beta3 holds the routing
+// override in the App Engine queue type, and its logging config goes to the
+// unrecognized fields of the v2 queue.
+func queueToV2(queue *beta3.Queue) (*tasks.Queue, error) {
+	if queue == nil {
+		return nil, nil
+	}
+
+	stripped := proto.Clone(queue).(*beta3.Queue)
+	stripped.QueueType = nil
+	stripped.StackdriverLoggingConfig = nil
+
+	converted := &tasks.Queue{}
+	if err := convertMessage(stripped, converted); err != nil {
+		return nil, err
+	}
+
+	if routing := queue.GetAppEngineHttpQueue().GetAppEngineRoutingOverride(); routing != nil {
+		converted.AppEngineRoutingOverride = &tasks.AppEngineRouting{}
+		if err := convertMessage(routing, converted.AppEngineRoutingOverride); err != nil {
+			return nil, err
+		}
+	}
+	if config := queue.GetStackdriverLoggingConfig(); config != nil {
+		setStackdriverLoggingConfig(converted, &StackdriverLoggingConfig{SamplingRatio: config.GetSamplingRatio()})
+	}
+
+	return converted, nil
+}
+
+// queueFromV2 converts a v2 queue to v2beta3, see queueToV2
+func queueFromV2(queue *tasks.Queue) (*beta3.Queue, error) {
+	stripped := proto.Clone(queue).(*tasks.Queue)
+	stripped.AppEngineRoutingOverride = nil
+
+	converted := &beta3.Queue{}
+	if err := convertMessage(stripped, converted); err != nil {
+		return nil, err
+	}
+
+	if routing := queue.GetAppEngineRoutingOverride(); routing != nil {
+		override := &beta3.AppEngineRouting{}
+		if err := convertMessage(routing, override); err != nil {
+			return nil, err
+		}
+		converted.QueueType = &beta3.Queue_AppEngineHttpQueue{
+			AppEngineHttpQueue: &beta3.AppEngineHttpQueue{AppEngineRoutingOverride: override},
+		}
+	}
+	if config, _ := getStackdriverLoggingConfig(queue); config != nil {
+		converted.StackdriverLoggingConfig = &beta3.StackdriverLoggingConfig{SamplingRatio: config.GetSamplingRatio()}
+	}
+
+	return converted, nil
+}
+
+func taskToV2(task *beta3.Task) (*tasks.Task, error) {
+	if task == nil {
+		return nil, nil
+	}
+
+	converted := &tasks.Task{}
+	if err := convertMessage(task, converted); err != nil {
+		return nil, err
+	}
+
+	return converted, nil
+}
+
+func taskFromV2(task *tasks.Task) (*beta3.Task, error) {
+	converted := &beta3.Task{}
+	if err := convertMessage(task, converted); err != nil {
+		return nil, err
+	}
+
+	return converted, nil
+}
+
+// updateMaskToV2 maps the v2beta3 path of the routing override onto the v2 one
+func updateMaskToV2(updateMask *field_mask.FieldMask) *field_mask.FieldMask {
+	if updateMask == nil {
+		return nil
+	}
+
+	converted := &field_mask.FieldMask{}
+	for _, path := range updateMask.GetPaths() {
+		converted.Paths = append(converted.Paths, strings.TrimPrefix(path, "app_engine_http_queue."))
+	}
+
+	return converted
+}
+
+// ListQueues lists the existing queues
+func (b *V2beta3Server) ListQueues(ctx context.Context, in *beta3.ListQueuesRequest) (*beta3.ListQueuesResponse, error) {
+	resp, err := b.s.ListQueues(ctx, &tasks.ListQueuesRequest{
+		Parent: in.GetParent(),
+		Filter: in.GetFilter(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	converted := &beta3.ListQueuesResponse{}
+	for _, queue := range resp.GetQueues() {
+		convertedQueue, err := queueFromV2(queue)
+		if err != nil {
+			return nil, err
+		}
+		converted.Queues = append(converted.Queues, convertedQueue)
+	}
+
+	return converted, nil
+}
+
+// GetQueue returns the requested queue
+func (b *V2beta3Server) GetQueue(ctx context.Context, in *beta3.GetQueueRequest) (*beta3.Queue, error) {
+	return b.queueFromV2(b.s.GetQueue(ctx, &tasks.GetQueueRequest{Name: in.GetName()}))
+}
+
+// CreateQueue creates a new queue
+func (b *V2beta3Server) CreateQueue(ctx context.Context, in *beta3.CreateQueueRequest) (*beta3.Queue, error) {
+	queue, err := queueToV2(in.GetQueue())
+	if err != nil {
+		return nil, err
+	}
+
+	return b.queueFromV2(b.s.CreateQueue(ctx, &tasks.CreateQueueRequest{Parent: in.GetParent(), Queue: queue}))
+}
+
+// UpdateQueue updates an existing queue, see Server.UpdateQueue
+func (b *V2beta3Server) UpdateQueue(ctx context.Context, in *beta3.UpdateQueueRequest) (*beta3.Queue, error) {
+	queue, err := queueToV2(in.GetQueue())
+	if err != nil {
+		return nil, err
+	}
+
+	return b.queueFromV2(b.s.UpdateQueue(ctx, &tasks.UpdateQueueRequest{Queue: queue, UpdateMask: updateMaskToV2(in.GetUpdateMask())}))
+}
+
+// DeleteQueue removes an existing queue
+func (b *V2beta3Server) DeleteQueue(ctx context.Context, in *beta3.DeleteQueueRequest) (*empty.Empty, error) {
+	return b.s.DeleteQueue(ctx, &tasks.DeleteQueueRequest{Name: in.GetName()})
+}
+
+// PurgeQueue purges the specified queue
+func (b *V2beta3Server) PurgeQueue(ctx context.Context, in *beta3.PurgeQueueRequest) (*beta3.Queue, error) {
+	return b.queueFromV2(b.s.PurgeQueue(ctx, &tasks.PurgeQueueRequest{Name: in.GetName()}))
+}
+
+// PauseQueue pauses queue execution
+func (b *V2beta3Server) PauseQueue(ctx context.Context, in *beta3.PauseQueueRequest) (*beta3.Queue, error) {
+	return b.queueFromV2(b.s.PauseQueue(ctx, &tasks.PauseQueueRequest{Name: in.GetName()}))
+}
+
+// ResumeQueue resumes a paused queue
+func (b *V2beta3Server) ResumeQueue(ctx context.Context, in *beta3.ResumeQueueRequest) (*beta3.Queue, error) {
+	return b.queueFromV2(b.s.ResumeQueue(ctx, &tasks.ResumeQueueRequest{Name: in.GetName()}))
+}
+
+// GetIamPolicy doesn't do anything
+func (b *V2beta3Server) GetIamPolicy(ctx context.Context, in *v1.GetIamPolicyRequest) (*v1.Policy, error) {
+	return b.s.GetIamPolicy(ctx, in)
+}
+
+// SetIamPolicy doesn't do anything
+func (b *V2beta3Server) SetIamPolicy(ctx context.Context, in *v1.SetIamPolicyRequest) (*v1.Policy, error) {
+	return b.s.SetIamPolicy(ctx, in)
+}
+
+// TestIamPermissions doesn't do anything
+func (b *V2beta3Server) TestIamPermissions(ctx context.Context, in *v1.TestIamPermissionsRequest) (*v1.TestIamPermissionsResponse, error) {
+	return b.s.TestIamPermissions(ctx, in)
+}
+
+// ListTasks lists the tasks in the specified queue
+func (b *V2beta3Server) ListTasks(ctx context.Context, in *beta3.ListTasksRequest) (*beta3.ListTasksResponse, error) {
+	resp, err := b.s.ListTasks(ctx, &tasks.ListTasksRequest{
+		Parent:       in.GetParent(),
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+		PageSize:     in.GetPageSize(),
+		PageToken:    in.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	converted := &beta3.ListTasksResponse{NextPageToken: resp.GetNextPageToken()}
+	for _, task := range resp.GetTasks() {
+		convertedTask, err := taskFromV2(task)
+		if err != nil {
+			return nil, err
+		}
+		converted.Tasks = append(converted.Tasks, convertedTask)
+	}
+
+	return converted, nil
+}
+
+// GetTask returns the specified task
+func (b *V2beta3Server) GetTask(ctx context.Context, in *beta3.GetTaskRequest) (*beta3.Task, error) {
+	return b.taskFromV2(b.s.GetTask(ctx, &tasks.GetTaskRequest{
+		Name:         in.GetName(),
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+	}))
+}
+
+// CreateTask creates a new task
+func (b *V2beta3Server) CreateTask(ctx context.Context, in *beta3.CreateTaskRequest) (*beta3.Task, error) {
+	task, err := taskToV2(in.GetTask())
+	if err != nil {
+		return nil, err
+	}
+
+	return b.taskFromV2(b.s.CreateTask(ctx, &tasks.CreateTaskRequest{
+		Parent:       in.GetParent(),
+		Task:         task,
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+	}))
+}
+
+// DeleteTask removes an existing task
+func (b *V2beta3Server) DeleteTask(ctx context.Context, in *beta3.DeleteTaskRequest) (*empty.Empty, error) {
+	return b.s.DeleteTask(ctx, &tasks.DeleteTaskRequest{Name: in.GetName()})
+}
+
+// RunTask executes the task immediately
+func (b *V2beta3Server) RunTask(ctx context.Context, in *beta3.RunTaskRequest) (*beta3.Task, error) {
+	return b.taskFromV2(b.s.RunTask(ctx, &tasks.RunTaskRequest{
+		Name:         in.GetName(),
+		ResponseView: tasks.Task_View(in.GetResponseView()),
+	}))
+}
+
+// BufferTask creates a task from just a body, dispatched to the HTTP target of
+// the queue, see Server.BufferTask
+func (b *V2beta3Server) BufferTask(ctx context.Context, in *BufferTaskRequest) (*BufferTaskResponse, error) {
+	task, err := b.taskFromV2(b.s.BufferTask(ctx, in.GetQueue(), in.GetTaskId(), in.GetBody().GetData(), in.GetBody().GetContentType()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BufferTaskResponse{Task: task}, nil
+}
+
+// HandleUnknownMethod serves the RPCs the protos in use don't define, to be set
+// as the unknown service handler of the gRPC server
+func (b *V2beta3Server) HandleUnknownMethod(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	if method != v2beta3BufferTaskMethod {
+		return status.Errorf(codes.Unimplemented, "unknown method %v", method)
+	}
+
+	in := &BufferTaskRequest{}
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	resp, err := b.BufferTask(stream.Context(), in)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendMsg(resp)
+}
+
+// queueFromV2 converts the response of a v2 method returning a queue
+func (b *V2beta3Server) queueFromV2(queue *tasks.Queue, err error) (*beta3.Queue, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return queueFromV2(queue)
+}
+
+// taskFromV2 converts the response of a v2 method returning a task
+func (b *V2beta3Server) taskFromV2(task *tasks.Task, err error) (*beta3.Task, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return taskFromV2(task)
+}
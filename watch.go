@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	pduration "github.com/golang/protobuf/ptypes/duration"
+	ptimestamp "github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
+)
+
+// The emulator-specific gRPC service, defined in emulator.proto. Its messages
+// are written out by hand, as the build doesn't generate code.
+const emulatorServiceName = "cloudtasks.emulator.v1.Emulator"
+
+// Sent in the response headers of WatchTasks once subscribed, to tell them from
+// those of a call that failed before, which come with the trailers
+const watchSubscribedHeader = "x-watch-subscribed"
+
+// WatchTasksRequest mirrors the message of the same name in emulator.proto
+type WatchTasksRequest struct {
+	// Only the events of the queue if set
+	Queue string `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+
+	// Only the events of the task if set
+	Task string `protobuf:"bytes,2,opt,name=task,proto3" json:"task,omitempty"`
+
+	// Only the events of these types if set, e.g. TASK_COMPLETED
+	Types []string `protobuf:"bytes,3,rep,name=types,proto3" json:"types,omitempty"`
+}
+
+func (m *WatchTasksRequest) Reset()         { *m = WatchTasksRequest{} }
+func (m *WatchTasksRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchTasksRequest) ProtoMessage()    {}
+
+// WatchTasksResponse mirrors the message of the same name in emulator.proto, a
+// task event
+type WatchTasksResponse struct {
+	Time *ptimestamp.Timestamp `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+
+	QueueName string `protobuf:"bytes,3,opt,name=queue_name,json=queueName,proto3" json:"queue_name,omitempty"`
+
+	TaskName string `protobuf:"bytes,4,opt,name=task_name,json=taskName,proto3" json:"task_name,omitempty"`
+
+	Attempt int32 `protobuf:"varint,5,opt,name=attempt,proto3" json:"attempt,omitempty"`
+
+	StatusCode int32 `protobuf:"varint,6,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+
+	Duration *pduration.Duration `protobuf:"bytes,7,opt,name=duration,proto3" json:"duration,omitempty"`
+}
+
+func (m *WatchTasksResponse) Reset()         { *m = WatchTasksResponse{} }
+func (m *WatchTasksResponse) String() string { return proto.CompactTextString(m) }
+func (*WatchTasksResponse) ProtoMessage()    {}
+
+var taskEventTypes = map[string]bool{
+	TaskCreatedEvent:     true,
+	DispatchStartedEvent: true,
+	AttemptFinishedEvent: true,
+	TaskCompletedEvent:   true,
+	TaskFailedEvent:      true,
+}
+
+var emulatorServiceDesc = grpc.ServiceDesc{
+	ServiceName: emulatorServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods:     testControlMethods,
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchTasks",
+			Handler:       watchTasksHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "emulator.proto",
+}
+
+// registerEmulatorService serves the emulator-specific RPCs
+func registerEmulatorService(grpcServer *grpc.Server, s *Server) {
+	grpcServer.RegisterService(&emulatorServiceDesc, s)
+}
+
+func watchTasksHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := &WatchTasksRequest{}
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+
+	return srv.(*Server).WatchTasks(in, stream)
+}
+
+// WatchTasks streams the task events matching the request until the client
+// cancels, or fails with DATA_LOSS once it falls too far behind. The response
+// headers are sent once subscribed, so that the events of the tasks created
+// from then on aren't missed.
+func (s *Server) WatchTasks(in *WatchTasksRequest, stream grpc.ServerStream) error {
+	types := make(map[string]bool)
+	for _, eventType := range in.Types {
+		if !taskEventTypes[eventType] {
+			return invalidArgument("types", "Unknown task event type %v.", eventType)
+		}
+		types[eventType] = true
+	}
+
+	events, unsubscribe := s.taskEvents.subscribe()
+	defer unsubscribe()
+
+	if err := stream.SendHeader(metadata.Pairs(watchSubscribedHeader, "true")); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.DataLoss, taskEventOverflowMessage)
+			}
+			if in.Queue != "" && event.QueueName != in.Queue {
+				continue
+			}
+			if in.Task != "" && event.TaskName != in.Task {
+				continue
+			}
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			if err := stream.SendMsg(watchTasksResponse(event)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+func watchTasksResponse(event TaskEvent) *WatchTasksResponse {
+	eventTime, _ := ptypes.TimestampProto(event.Time)
+	resp := &WatchTasksResponse{
+		Time:       eventTime,
+		Type:       event.Type,
+		QueueName:  event.QueueName,
+		TaskName:   event.TaskName,
+		Attempt:    event.Attempt,
+		StatusCode: int32(event.StatusCode),
+	}
+	if event.Duration != 0 {
+		resp.Duration = ptypes.DurationProto(event.Duration)
+	}
+
+	return resp
+}
+
+// EmulatorClient calls the emulator-specific RPCs, e.g. from Go tests
+type EmulatorClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewEmulatorClient creates a client on the connection to the emulator
+func NewEmulatorClient(cc *grpc.ClientConn) *EmulatorClient {
+	return &EmulatorClient{cc: cc}
+}
+
+// TaskWatch receives the events of WatchTasks
+type TaskWatch struct {
+	stream grpc.ClientStream
+}
+
+// WatchTasks starts watching the task events, returning once subscribed. Cancel
+// the context to stop.
+func (c *EmulatorClient) WatchTasks(ctx context.Context, in *WatchTasksRequest) (*TaskWatch, error) {
+	stream, err := c.cc.NewStream(ctx, &emulatorServiceDesc.Streams[0], "/"+emulatorServiceName+"/WatchTasks")
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Get(watchSubscribedHeader)) == 0 {
+		// Failed before subscribing, the status being that of the stream
+		if err := stream.RecvMsg(&WatchTasksResponse{}); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Unavailable, "The watch ended before subscribing.")
+	}
+
+	return &TaskWatch{stream: stream}, nil
+}
+
+// Recv blocks until the next event
+func (w *TaskWatch) Recv() (*WatchTasksResponse, error) {
+	resp := &WatchTasksResponse{}
+	if err := w.stream.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Await receives events until one of the task of the type, e.g. TASK_COMPLETED
+func (w *TaskWatch) Await(taskName string, eventType string) (*WatchTasksResponse, error) {
+	for {
+		resp, err := w.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if resp.TaskName == taskName && resp.Type == eventType {
+			return resp, nil
+		}
+	}
+}
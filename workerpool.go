@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// workerPool runs the workers of a queue, which take the due tasks off its work
+// channel. The size of the pool is set explicitly: missing workers are started,
+// while surplus workers stop once done with the task at hand.
+type workerPool struct {
+	mux sync.Mutex
+
+	// Closed to stop the running workers, one each, the last ones stopped first
+	stops []chan bool
+
+	// Starts a worker that runs until its stop channel is closed
+	start func(stop chan bool)
+}
+
+func newWorkerPool(start func(stop chan bool)) *workerPool {
+	return &workerPool{start: start}
+}
+
+// resize starts or stops workers so that the size of the pool is as given, 0
+// stopping them all
+func (pool *workerPool) resize(size int) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+
+	for len(pool.stops) < size {
+		stop := make(chan bool)
+		pool.stops = append(pool.stops, stop)
+		pool.start(stop)
+	}
+	for len(pool.stops) > size {
+		last := len(pool.stops) - 1
+		close(pool.stops[last])
+		pool.stops[last] = nil
+		pool.stops = pool.stops[:last]
+	}
+}
+
+// size returns the number of workers that aren't stopped, including those still
+// busy with a task
+func (pool *workerPool) size() int {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+
+	return len(pool.stops)
+}
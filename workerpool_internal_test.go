@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolResize(t *testing.T) {
+	var running int64
+	var wg sync.WaitGroup
+	pool := newWorkerPool(func(stop chan bool) {
+		atomic.AddInt64(&running, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-stop
+			atomic.AddInt64(&running, -1)
+		}()
+	})
+	runningAre := func(expected int64) func() bool {
+		return func() bool {
+			return atomic.LoadInt64(&running) == expected
+		}
+	}
+
+	pool.resize(5)
+	assert.Equal(t, 5, pool.size())
+	assert.Equal(t, int64(5), atomic.LoadInt64(&running))
+
+	pool.resize(2)
+	assert.Equal(t, 2, pool.size())
+	assert.Eventually(t, runningAre(2), time.Second, 10*time.Millisecond)
+
+	pool.resize(8)
+	assert.Equal(t, 8, pool.size())
+	assert.Eventually(t, runningAre(8), time.Second, 10*time.Millisecond)
+
+	pool.resize(0)
+	wg.Wait()
+	assert.Equal(t, 0, pool.size())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&running))
+}
+
+func TestStoppedWorkerTakesNoMoreTasks(t *testing.T) {
+	queue := &Queue{work: make(chan *taskHeapEntry, 1)}
+	queue.work <- &taskHeapEntry{}
+
+	stop := make(chan bool)
+	close(stop)
+	done := make(chan bool)
+	go func() {
+		queue.runWorker(stop)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "The worker did not stop")
+	}
+	assert.Len(t, queue.work, 1, "The waiting task is left for other workers")
+}